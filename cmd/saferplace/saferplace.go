@@ -20,6 +20,10 @@ func run() error {
 	configFile := flag.String("config", "", "Config file")
 	flag.Parse()
 
+	if flag.Arg(0) == "vapid" {
+		return vapid(*configFile, flag.Args()[1:])
+	}
+
 	components := saferplace.AllComponents()
 	if len(flag.Args()) > 0 {
 		if flag.Arg(0) != "all" {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"safer.place/internal/config"
+	"safer.place/internal/webpush"
+)
+
+const vapidUsage = `usage: saferplace [-config file] vapid <command>
+
+commands:
+  generate [-out file]  generate new VAPID keys, writing the private key to the file
+  public [-key file]    print the public key, which the PWA uses to subscribe`
+
+// vapid manages the VAPID keys used to send the push notifications.
+func vapid(configFile string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(vapidUsage)
+	}
+
+	switch args[0] {
+	case "generate":
+		return vapidGenerate(args[1:])
+	case "public":
+		return vapidPublic(configFile, args[1:])
+	default:
+		return errors.New(vapidUsage)
+	}
+}
+
+func vapidGenerate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	out := fs.String("out", "", "File the private key is written to, printed if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	keys, err := webpush.GenerateKeys()
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		fmt.Println("private key:", keys.PrivateKey())
+	} else {
+		// Never overwrite existing keys, as all the subscriptions are bound to them.
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return fmt.Errorf("unable to create key file: %w", err)
+		}
+		if _, err := fmt.Fprintln(f, keys.PrivateKey()); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to write key file: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("unable to write key file: %w", err)
+		}
+	}
+	fmt.Println("public key:", keys.PublicKey())
+
+	return nil
+}
+
+func vapidPublic(configFile string, args []string) error {
+	fs := flag.NewFlagSet("public", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "Private key file, defaults to push.key_file from the config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *keyFile == "" {
+		cfg, err := config.Parse(configFile)
+		if err != nil {
+			return err
+		}
+		*keyFile = cfg.Push.KeyFile
+	}
+	if *keyFile == "" {
+		return errors.New("missing key file")
+	}
+
+	keys, err := webpush.LoadKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+	fmt.Println(keys.PublicKey())
+
+	return nil
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"connectrpc.com/connect"
+	"github.com/saferplace/webserver-go/middleware"
 	"safer.place/internal/database"
 )
 
@@ -33,6 +35,27 @@ func NewAuthInterceptor(db database.Database) connect.UnaryInterceptorFunc {
 	})
 }
 
+// NewSessionMiddleware rejects the requests without a valid session, for the handlers which are
+// not connect services.
+func NewSessionMiddleware(db database.Database) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			session := extractSession(req.Header.Values("Cookie"))
+			if session == "" {
+				http.Error(w, "no valid token", http.StatusUnauthorized)
+				return
+			}
+
+			if err := db.IsValidSession(req.Context(), session); err != nil {
+				http.Error(w, "invalid session", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
 func extractSession(cookies []string) string {
 	for _, cookie := range cookies {
 		if strings.HasPrefix(cookie, `Authorization="Bearer `) {
@@ -27,12 +27,13 @@ func NewUserAuthInterceptor() connect.UnaryInterceptorFunc {
 				return nil, connect.NewError(connect.CodeUnauthenticated, ErrUserUnauthenticated)
 			}
 
-			return next(ctx, req)
+			return next(WithUser(ctx, emailHeader), req)
 		})
 	})
 }
 
-// NewUserAuthMiddleware
+// NewUserAuthMiddleware rejects the requests without the user email, and attaches the email to
+// the request context.
 func NewUserAuthMiddleware() middleware.Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -41,7 +42,21 @@ func NewUserAuthMiddleware() middleware.Middleware {
 				http.Error(w, ErrUserUnauthenticated.Error(), http.StatusUnauthorized)
 				return
 			}
-			next.ServeHTTP(w, req)
+			next.ServeHTTP(w, req.WithContext(WithUser(req.Context(), emailHeader)))
 		})
 	}
 }
+
+type userKey struct{}
+
+// WithUser attaches the authenticated user email to the context.
+func WithUser(ctx context.Context, email string) context.Context {
+	return context.WithValue(ctx, userKey{}, email)
+}
+
+// UserFromContext returns the authenticated user email, or an empty string if the request was
+// not authenticated.
+func UserFromContext(ctx context.Context) string {
+	email, _ := ctx.Value(userKey{}).(string)
+	return email
+}
@@ -2,19 +2,32 @@ package saferplace
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
+	"net/http"
 	"slices"
 
+	"connectrpc.com/connect"
 	"go.uber.org/zap"
 	"golang.org/x/exp/maps"
 	"golang.org/x/sync/errgroup"
+	"safer.place/internal/auth"
 	"safer.place/internal/config"
+	"safer.place/internal/escalation"
+	"safer.place/internal/imagegc"
 	"safer.place/internal/review"
+	"safer.place/internal/scanner/clamd"
 	"safer.place/internal/service"
+	"safer.place/internal/triage"
 
 	// Registered services
+	"safer.place/internal/service/discord"
+	"safer.place/internal/service/images"
 	"safer.place/internal/service/imageupload"
+	"safer.place/internal/service/push"
 	reportv1 "safer.place/internal/service/report/v1"
+	"safer.place/internal/service/reporter"
 	reviewv1 "safer.place/internal/service/review/v1"
 	viewerv1 "safer.place/internal/service/viewer/v1"
 )
@@ -23,35 +36,57 @@ import (
 type Component string
 
 const (
-	ConsumerComponent Component = "consumer"
-	ReviewComponent   Component = "review"
-	ReportComponent   Component = "report"
-	UploaderComponent Component = "uploader"
-	ViewerComponent   Component = "viewer"
+	ConsumerComponent   Component = "consumer"
+	DiscordComponent    Component = "discord"
+	EscalationComponent Component = "escalation"
+	GCComponent         Component = "gc"
+	ImagesComponent     Component = "images"
+	PushComponent       Component = "push"
+	ReviewComponent     Component = "review"
+	ReportComponent     Component = "report"
+	ReporterComponent   Component = "reporter"
+	ResumableComponent  Component = "resumable"
+	UploaderComponent   Component = "uploader"
+	ViewerComponent     Component = "viewer"
 )
 
 var componentDependencies = map[Component][]Dependency{
-	ConsumerComponent: {QueueDependency, DatabaseDependency, NotifierDependency},
-	ReviewComponent:   {DatabaseDependency},
-	ReportComponent:   {QueueDependency},
-	UploaderComponent: {StorageDependency},
-	ViewerComponent:   {DatabaseDependency},
+	ConsumerComponent:   {QueueDependency, DatabaseDependency, NotifierDependency, PushDependency, ReporterDependency},
+	DiscordComponent:    {DatabaseDependency, PushDependency, ReporterDependency},
+	EscalationComponent: {DatabaseDependency, NotifierDependency},
+	GCComponent:         {StorageDependency, DatabaseDependency},
+	ImagesComponent:     {StorageDependency, DatabaseDependency},
+	PushComponent:       {DatabaseDependency, PushDependency},
+	ReviewComponent:     {DatabaseDependency, PushDependency, ReporterDependency},
+	ReportComponent:     {QueueDependency, DatabaseDependency, StorageDependency},
+	ReporterComponent:   {DatabaseDependency},
+	ResumableComponent:  {StorageDependency, DatabaseDependency},
+	UploaderComponent:   {StorageDependency, DatabaseDependency},
+	ViewerComponent:     {DatabaseDependency},
 }
 
 var headlessComponents = map[Component]registerHeadlessComponentFn{
-	ConsumerComponent: registerConsumer,
+	ConsumerComponent:   registerConsumer,
+	EscalationComponent: registerEscalation,
+	GCComponent:         registerGC,
 }
 
 type ComponentRegisterMap = map[Component]registerComponentFn
 
 var reviewerComponents = ComponentRegisterMap{
-	ReviewComponent: registerReview,
+	DiscordComponent: registerDiscord,
+	ImagesComponent:  registerReviewerImages,
+	ReviewComponent:  registerReview,
 }
 
 var userComponents = ComponentRegisterMap{
-	ReportComponent:   registerReport,
-	UploaderComponent: registerUploader,
-	ViewerComponent:   registerViewer,
+	ImagesComponent:    registerImages,
+	PushComponent:      registerPushSubscriptions,
+	ReportComponent:    registerReport,
+	ReporterComponent:  registerReporter,
+	ResumableComponent: registerResumableUploader,
+	UploaderComponent:  registerUploader,
+	ViewerComponent:    registerViewer,
 }
 
 // StringsToComponents convert string slice to component slice or panic
@@ -62,10 +97,24 @@ func StringsToComponents(ss []string) []Component {
 		switch s {
 		case string(ConsumerComponent):
 			res = append(res, ConsumerComponent)
+		case string(DiscordComponent):
+			res = append(res, DiscordComponent)
+		case string(EscalationComponent):
+			res = append(res, EscalationComponent)
+		case string(GCComponent):
+			res = append(res, GCComponent)
+		case string(ImagesComponent):
+			res = append(res, ImagesComponent)
+		case string(PushComponent):
+			res = append(res, PushComponent)
 		case string(ReviewComponent):
 			res = append(res, ReportComponent)
 		case string(ReportComponent):
 			res = append(res, ReportComponent)
+		case string(ReporterComponent):
+			res = append(res, ReporterComponent)
+		case string(ResumableComponent):
+			res = append(res, ResumableComponent)
 		case string(UploaderComponent):
 			res = append(res, UploaderComponent)
 		case string(ViewerComponent):
@@ -105,7 +154,9 @@ type registerHeadlessComponentFn func(context.Context, *config.Config, *dependen
 func createHeadlessComponents(ctx context.Context, cfg *config.Config, wantedComponents []Component, deps *dependencies, eg *errgroup.Group) error {
 	for component, fn := range headlessComponents {
 		if slices.Contains(wantedComponents, component) {
-			return fn(ctx, cfg, deps, eg)
+			if err := fn(ctx, cfg, deps, eg); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -122,6 +173,10 @@ func createServices(ctx context.Context, cfg *config.Config, wantedComponents []
 			if err != nil {
 				return nil, err
 			}
+			// Services which are not configured are skipped.
+			if service == nil {
+				continue
+			}
 			services = append(services, service)
 		}
 	}
@@ -129,13 +184,33 @@ func createServices(ctx context.Context, cfg *config.Config, wantedComponents []
 }
 
 func registerConsumer(ctx context.Context, cfg *config.Config, deps *dependencies, eg *errgroup.Group) error {
+	rules, err := triage.New(cfg.Triage, deps.logger.With(zap.String("component", "triage")))
+	if err != nil {
+		return fmt.Errorf("unable to load triage rules: %w", err)
+	}
+
+	opts := []review.Option{
+		review.Triage(rules),
+		review.Notifiers(deps.notifiers),
+		review.Priority(deps.priority),
+	}
+	if deps.alerts != nil {
+		opts = append(opts, review.Alerts(deps.alerts))
+	}
+	if deps.reporters != nil {
+		opts = append(opts, review.Reporters(deps.reporters))
+	}
 	consumer := review.New(
 		deps.logger.With(zap.String("component", "review")),
 		deps.queue,
 		deps.database,
 		deps.notifer,
+		opts...,
 	)
 
+	eg.Go(func() error {
+		return rules.Run(ctx)
+	})
 	eg.Go(func() error {
 		return consumer.Run(ctx)
 	})
@@ -143,10 +218,149 @@ func registerConsumer(ctx context.Context, cfg *config.Config, deps *dependencie
 	return nil
 }
 
-func registerReview(_ context.Context, _ *config.Config, deps *dependencies) (service.Service, error) {
+func registerEscalation(ctx context.Context, cfg *config.Config, deps *dependencies, eg *errgroup.Group) error {
+	escalator, err := escalation.New(
+		cfg.Escalation,
+		deps.logger.With(zap.String("component", "escalation")),
+		deps.database,
+		deps.notifer,
+		deps.metrics,
+		escalation.Notifiers(deps.notifiers),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create escalation: %w", err)
+	}
+
+	eg.Go(func() error {
+		return escalator.Run(ctx)
+	})
+
+	return nil
+}
+
+func registerGC(ctx context.Context, cfg *config.Config, deps *dependencies, eg *errgroup.Group) error {
+	opts := []imagegc.Option{imagegc.Resumable(deps.resumable)}
+	if deps.originals != nil {
+		opts = append(opts, imagegc.Originals(deps.originals))
+	}
+	if deps.quarantine != nil {
+		opts = append(opts, imagegc.Quarantine(deps.quarantine))
+	}
+
+	collector, err := imagegc.New(
+		cfg.GC,
+		deps.logger.With(zap.String("component", "gc")),
+		deps.database,
+		deps.storage,
+		deps.metrics,
+		opts...,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create gc: %w", err)
+	}
+
+	eg.Go(func() error {
+		return collector.Run(ctx)
+	})
+
+	return nil
+}
+
+func registerDiscord(_ context.Context, cfg *config.Config, deps *dependencies) (service.Service, error) {
+	log := deps.logger.With(zap.String("service", "discord"))
+	if cfg.Discord.PublicKey == "" {
+		log.Info("discord interactions disabled, missing public key")
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(cfg.Discord.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode discord public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("discord public key must be %d bytes", ed25519.PublicKeySize)
+	}
+
+	return discord.Register(
+		discord.Logger(log),
+		discord.PublicKey(key),
+		discord.WithReviewer(reviewv1.New(
+			deps.database,
+			deps.logger.With(zap.String("service", "reviewv1")),
+			deps.metrics,
+			deps.priority,
+			reviewOptions(deps)...,
+		)),
+	), nil
+}
+
+func registerReview(_ context.Context, cfg *config.Config, deps *dependencies) (service.Service, error) {
+	opts := reviewOptions(deps)
+	if cfg.Review.SimilarImages.Enabled {
+		similar := cfg.Review.SimilarImages
+		opts = append(opts, reviewv1.SimilarImages(similar.MaxDistance, similar.Window, similar.MaxResults))
+	}
 	return reviewv1.Register(
 		deps.database,
 		deps.logger.With(zap.String("service", "reviewv1")),
+		deps.metrics,
+		deps.priority,
+		opts...,
+	), nil
+}
+
+// reviewOptions are shared by all the ways an incident can be reviewed.
+func reviewOptions(deps *dependencies) []reviewv1.Option {
+	opts := []reviewv1.Option{reviewv1.Background(deps.background)}
+	if deps.alerts != nil {
+		opts = append(opts, reviewv1.Alerts(deps.alerts))
+	}
+	if deps.reporters != nil {
+		opts = append(opts, reviewv1.Reporters(deps.reporters))
+	}
+	return opts
+}
+
+// registerImages serves the images of the accepted incidents to the public.
+func registerImages(_ context.Context, cfg *config.Config, deps *dependencies) (service.Service, error) {
+	return images.Register(
+		images.Logger(deps.logger.With(zap.String("service", "images"))),
+		images.Storage(deps.storage),
+		images.IncidentLookup(deps.database),
+		images.Presign(cfg.Storage.PresignExpiry),
+		images.Variants(deps.variants),
+	), nil
+}
+
+// registerReviewerImages serves all images to the reviewers with a valid session.
+func registerReviewerImages(_ context.Context, cfg *config.Config, deps *dependencies) (service.Service, error) {
+	opts := []images.Option{
+		images.Logger(deps.logger.With(zap.String("service", "images"))),
+		images.Storage(deps.storage),
+		images.Reviewer(),
+		images.Presign(cfg.Storage.PresignExpiry),
+		images.Variants(deps.variants),
+	}
+	if deps.originals != nil {
+		opts = append(opts, images.Originals(deps.originals))
+	}
+	svc := images.Register(opts...)
+	sessions := auth.NewSessionMiddleware(deps.database)
+	return func(interceptors ...connect.Interceptor) (string, http.Handler) {
+		path, handler := svc(interceptors...)
+		return path, sessions(handler)
+	}, nil
+}
+
+func registerPushSubscriptions(_ context.Context, _ *config.Config, deps *dependencies) (service.Service, error) {
+	if deps.vapid == nil {
+		return nil, nil
+	}
+
+	return push.Register(
+		push.Logger(deps.logger.With(zap.String("service", "push"))),
+		push.Keys(deps.vapid),
+		push.Subscriptions(deps.database),
 	), nil
 }
 
@@ -154,15 +368,80 @@ func registerReport(_ context.Context, _ *config.Config, deps *dependencies) (se
 	return reportv1.Register(
 		deps.queue,
 		deps.logger.With(zap.String("service", "reportv1")),
+		reportv1.Reporters(deps.database),
+		reportv1.Images(deps.storage, deps.database),
 	), nil
 }
 
-func registerUploader(_ context.Context, _ *config.Config, deps *dependencies) (service.Service, error) {
-	return imageupload.Register(
+func registerReporter(_ context.Context, _ *config.Config, deps *dependencies) (service.Service, error) {
+	return reporter.Register(
+		reporter.Logger(deps.logger.With(zap.String("service", "reporter"))),
+		reporter.PreferencesStore(deps.database),
+	), nil
+}
+
+func registerUploader(_ context.Context, cfg *config.Config, deps *dependencies) (service.Service, error) {
+	opts, err := uploaderOptions(cfg, deps)
+	if err != nil {
+		return nil, err
+	}
+	return rateLimited(imageupload.Register(opts...), deps), nil
+}
+
+func registerResumableUploader(_ context.Context, cfg *config.Config, deps *dependencies) (service.Service, error) {
+	opts, err := uploaderOptions(cfg, deps)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, imageupload.Resumable(deps.resumable, deps.database))
+	return rateLimited(imageupload.RegisterResumable(opts...), deps), nil
+}
+
+// rateLimited applies the rate limits to the HTTP service. The Connect services are limited by the
+// interceptor instead, so their errors use the Connect codes.
+func rateLimited(svc service.Service, deps *dependencies) service.Service {
+	if deps.limiter == nil {
+		return svc
+	}
+	return func(interceptors ...connect.Interceptor) (string, http.Handler) {
+		path, handler := svc(interceptors...)
+		return path, deps.limiter.Middleware(handler)
+	}
+}
+
+// uploaderOptions are shared by all the ways an image can be uploaded.
+func uploaderOptions(cfg *config.Config, deps *dependencies) ([]imageupload.Option, error) {
+	opts := []imageupload.Option{
 		imageupload.Logger(deps.logger.With(zap.String("service", "imageupload"))),
 		imageupload.Tracer(deps.tracing.Tracer("imageupload")),
 		imageupload.Storage(deps.storage),
-	), nil
+		imageupload.Uploads(deps.database),
+		imageupload.Hashes(deps.database),
+		imageupload.Limits(&cfg.Upload),
+		imageupload.Metrics(deps.metrics),
+		imageupload.Variants(deps.variants),
+	}
+	if deps.originals != nil {
+		opts = append(opts, imageupload.Originals(deps.originals))
+	}
+
+	switch cfg.Scanner.Provider {
+	case "":
+	case "clamd":
+		if cfg.Upload.MaxSize > cfg.Scanner.Clamd.StreamMaxLength {
+			return nil, fmt.Errorf("upload max_size %d is larger than the clamd stream_max_length %d, "+
+				"the larger uploads could not be scanned", cfg.Upload.MaxSize, cfg.Scanner.Clamd.StreamMaxLength)
+		}
+		sc, err := clamd.New(&cfg.Scanner.Clamd)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create clamd scanner: %w", err)
+		}
+		opts = append(opts, imageupload.Scanner(sc, deps.quarantine))
+	default:
+		return nil, fmt.Errorf("unable to create %q scanner: %w", cfg.Scanner.Provider, errProviderNotFound)
+	}
+
+	return opts, nil
 }
 
 func registerViewer(_ context.Context, _ *config.Config, deps *dependencies) (service.Service, error) {
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"slices"
 	"time"
 
@@ -23,12 +24,26 @@ import (
 	"safer.place/internal/database"
 	"safer.place/internal/database/sqldatabase"
 	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/content"
+	"safer.place/internal/notifier/digestnotifier"
+	"safer.place/internal/notifier/discordnotifier"
+	"safer.place/internal/notifier/emailnotifier"
+	"safer.place/internal/notifier/fanoutnotifier"
 	"safer.place/internal/notifier/lognotifier"
+	"safer.place/internal/notifier/pushnotifier"
+	"safer.place/internal/notifier/reporternotifier"
+	"safer.place/internal/notifier/webhooknotifier"
+	"safer.place/internal/priority"
 	"safer.place/internal/queue"
 	"safer.place/internal/queue/memory"
+	"safer.place/internal/ratelimit"
 	"safer.place/internal/storage"
+	"safer.place/internal/storage/encrypted"
+	"safer.place/internal/storage/filesystem"
 	"safer.place/internal/storage/minio"
 	"safer.place/internal/tracing"
+	"safer.place/internal/variants"
+	"safer.place/internal/webpush"
 )
 
 var errProviderNotFound = errors.New("provider not found")
@@ -40,6 +55,8 @@ const (
 	QueueDependency    Dependency = "queue"
 	StorageDependency  Dependency = "storage"
 	NotifierDependency Dependency = "notifier"
+	PushDependency     Dependency = "push"
+	ReporterDependency Dependency = "reporter"
 )
 
 func dependenciesToStrings(dependencies []Dependency) []string {
@@ -63,6 +80,10 @@ func StringsToDependencies(ss []string) []Dependency {
 			res = append(res, StorageDependency)
 		case string(NotifierDependency):
 			res = append(res, NotifierDependency)
+		case string(PushDependency):
+			res = append(res, PushDependency)
+		case string(ReporterDependency):
+			res = append(res, ReporterDependency)
 		default:
 			panic(fmt.Sprintf("unrecognised dependency %q", s))
 		}
@@ -72,15 +93,39 @@ func StringsToDependencies(ss []string) []Dependency {
 
 type dependencies struct {
 	// always created dependencies
-	tracing trace.TracerProvider
-	metrics *prometheus.Registry
-	logger  *zap.Logger
+	tracing  trace.TracerProvider
+	metrics  *prometheus.Registry
+	logger   *zap.Logger
+	priority *priority.Scorer
+	content  *content.Renderer
+	// limiter applies the rate limits to the user services, nil if disabled.
+	limiter *ratelimit.Limiter
 
 	// dynamically created dependencies
 	database database.Database
 	queue    queue.Queue[*incident.Incident]
 	storage  storage.Storage
-	notifer  notifier.Notifier
+	// originals are the uploaded images before their metadata is stripped, nil when not kept.
+	originals storage.Storage
+	// resumable keeps the resumable uploads until they are complete.
+	resumable storage.Storage
+	// quarantine keeps the uploads rejected by the malware scanner, nil when they are not scanned.
+	quarantine storage.Storage
+	notifer    notifier.Notifier
+	// notifiers contains all configured notifiers by name, so they can be selected at runtime.
+	notifiers map[string]notifier.Notifier
+	// digests are flushed on shutdown, so the collected incidents are not lost.
+	digests []*digestnotifier.Notifier
+	// vapid keys and the alerts sent using web push, nil if push notifications are disabled.
+	vapid  *webpush.Keys
+	push   *pushnotifier.Notifier
+	alerts notifier.Notifier
+	// reporters are notified about the outcome of their reports, nil if disabled.
+	reporters notifier.Notifier
+	// background notifications are sent after the response, and waited for on shutdown.
+	background *notifier.Background
+	// variants generates the resized variants of the images in the storage.
+	variants *variants.Generator
 }
 
 type registerDependencyFn func(context.Context, *config.Config, *dependencies) error
@@ -92,6 +137,7 @@ func createDependencies(ctx context.Context, cfg *config.Config, components []Co
 		logger:  newLogger(cfg),
 		metrics: prometheus.NewRegistry(),
 	}
+	deps.background = notifier.NewBackground(deps.logger.With(zap.String("component", "notifications")))
 
 	mc := multiCloser{closer(func() error { return deps.logger.Sync() })}
 
@@ -102,6 +148,25 @@ func createDependencies(ctx context.Context, cfg *config.Config, components []Co
 	mc = append(mc, tracingCloser)
 	deps.tracing = tracing
 
+	deps.priority, err = priority.New(cfg.Priority)
+	if err != nil {
+		return nil, mc, fmt.Errorf("unable to create priority scorer: %w", err)
+	}
+
+	deps.content, err = content.New(&cfg.Notifier.Content)
+	if err != nil {
+		return nil, mc, fmt.Errorf("unable to load notification templates: %w", err)
+	}
+
+	if cfg.RateLimit.Enabled {
+		deps.limiter, err = ratelimit.New(&cfg.RateLimit, deps.metrics,
+			ratelimit.Logger(deps.logger.With(zap.String("component", "ratelimit"))),
+		)
+		if err != nil {
+			return nil, mc, fmt.Errorf("unable to create rate limiter: %w", err)
+		}
+	}
+
 	deps.logger.Debug("initializing dependencies",
 		zap.Strings("components", ComponentsToStrings(components)),
 		zap.Strings("dependencies", dependenciesToStrings(wantedDependencies)),
@@ -113,19 +178,41 @@ func createDependencies(ctx context.Context, cfg *config.Config, components []Co
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
-	for dep, fn := range map[Dependency]registerDependencyFn{
-		DatabaseDependency: registerDatabase,
-		QueueDependency:    registerQueue,
-		StorageDependency:  registerStorage,
-		NotifierDependency: registerNotifier,
+	// Dependencies are registered in order, as some depend on the others.
+	for _, dep := range []struct {
+		dep Dependency
+		fn  registerDependencyFn
+	}{
+		{DatabaseDependency, registerDatabase},
+		{QueueDependency, registerQueue},
+		{StorageDependency, registerStorage},
+		{NotifierDependency, registerNotifier},
+		{PushDependency, registerPush},
+		{ReporterDependency, registerReporters},
 	} {
-		if slices.Contains(wantedDependencies, dep) {
-			if err := fn(ctx, cfg, deps); err != nil {
+		if slices.Contains(wantedDependencies, dep.dep) {
+			if err := dep.fn(ctx, cfg, deps); err != nil {
 				return deps, mc, err
 			}
 		}
 	}
 
+	if deps.variants != nil {
+		mc = append(mc, deps.variants)
+	}
+	// The notifications in progress are sent before the digests are flushed, as they can be
+	// collected by the digests.
+	mc = append(mc, closer(func() error {
+		deps.background.Wait()
+		return nil
+	}))
+	for _, d := range deps.digests {
+		d := d
+		mc = append(mc, closer(func() error {
+			return d.Flush(context.Background())
+		}))
+	}
+
 	return deps, mc, nil
 }
 
@@ -171,7 +258,7 @@ func registerQueue(_ context.Context, cfg *config.Config, deps *dependencies) (e
 	var v queue.Queue[*incident.Incident]
 	switch cfg.Queue.Provider {
 	case "memory":
-		v = memory.New[*incident.Incident]()
+		v = memory.New(memory.Priority(deps.priority.Base))
 	default:
 		err = errProviderNotFound
 	}
@@ -185,11 +272,81 @@ func registerQueue(_ context.Context, cfg *config.Config, deps *dependencies) (e
 }
 
 func registerStorage(ctx context.Context, cfg *config.Config, deps *dependencies) (err error) {
-	var v storage.Storage
-	switch cfg.Storage.Provider {
+	deps.storage, err = newStorage(ctx, cfg.Storage.Provider, cfg.Storage.Minio, cfg.Storage.Filesystem, deps)
+	if err != nil {
+		return fmt.Errorf("unable to open %q storage: %w", cfg.Storage.Provider, err)
+	}
+
+	// The originals, the quarantine and the resumable uploads use the same provider, in a separate
+	// bucket or directory.
+	if originals := cfg.Storage.Originals; originals.Enabled {
+		deps.originals, err = newSeparateStorage(ctx, cfg, originals.Bucket, originals.Dir, deps)
+		if err != nil {
+			return fmt.Errorf("unable to open %q storage for the originals: %w", cfg.Storage.Provider, err)
+		}
+	}
+	if cfg.Scanner.Provider != "" {
+		quarantine := cfg.Storage.Quarantine
+		deps.quarantine, err = newSeparateStorage(ctx, cfg, quarantine.Bucket, quarantine.Dir, deps)
+		if err != nil {
+			return fmt.Errorf("unable to open %q storage for the quarantine: %w", cfg.Storage.Provider, err)
+		}
+	}
+	resumable := cfg.Storage.Resumable
+	deps.resumable, err = newSeparateStorage(ctx, cfg, resumable.Bucket, resumable.Dir, deps)
+	if err != nil {
+		return fmt.Errorf("unable to open %q storage for the resumable uploads: %w", cfg.Storage.Provider, err)
+	}
+
+	if cfg.Storage.Encryption.Enabled {
+		for _, store := range []*storage.Storage{&deps.storage, &deps.originals, &deps.quarantine, &deps.resumable} {
+			if *store == nil {
+				continue
+			}
+			*store, err = encrypted.New(*store, &cfg.Storage.Encryption,
+				encrypted.Logger(deps.logger.With(zap.String("component", "encryption"))),
+				encrypted.Metrics(deps.metrics),
+			)
+			if err != nil {
+				return fmt.Errorf("unable to set up the storage encryption: %w", err)
+			}
+		}
+	}
+
+	deps.variants = variants.New(
+		variants.Config{
+			Workers: cfg.Upload.VariantWorkers,
+			Queue:   cfg.Upload.VariantQueue,
+			Quality: cfg.Upload.Quality,
+		},
+		deps.storage,
+		deps.logger.With(zap.String("component", "variants")),
+		deps.tracing.Tracer("variants"),
+	)
+
+	return nil
+}
+
+// newSeparateStorage uses the storage provider with another bucket or directory.
+func newSeparateStorage(
+	ctx context.Context, cfg *config.Config, bucket, dir string, deps *dependencies,
+) (storage.Storage, error) {
+	minioCfg := *cfg.Storage.Minio
+	minioCfg.Bucket = bucket
+	return newStorage(ctx, cfg.Storage.Provider, &minioCfg, &filesystem.Config{Dir: dir}, deps)
+}
+
+func newStorage(
+	ctx context.Context,
+	provider string,
+	minioCfg *minio.Config,
+	filesystemCfg *filesystem.Config,
+	deps *dependencies,
+) (storage.Storage, error) {
+	switch provider {
 	case "minio":
-		v, err = minio.New(ctx,
-			cfg.Storage.Minio,
+		return minio.New(ctx,
+			minioCfg,
 			minio.Tracer(
 				deps.tracing.Tracer("storage",
 					trace.WithInstrumentationAttributes(
@@ -198,33 +355,168 @@ func registerStorage(ctx context.Context, cfg *config.Config, deps *dependencies
 				),
 			),
 		)
+	case "filesystem":
+		return filesystem.New(
+			filesystemCfg,
+			filesystem.Tracer(
+				deps.tracing.Tracer("storage",
+					trace.WithInstrumentationAttributes(
+						attribute.String("provider", "filesystem"),
+					),
+				),
+			),
+		)
 	default:
-		err = errProviderNotFound
+		return nil, errProviderNotFound
 	}
+}
+
+func registerNotifier(_ context.Context, cfg *config.Config, deps *dependencies) error {
+	log := deps.logger.With(zap.String("notifier", cfg.Notifier.Provider))
+	deps.notifiers = map[string]notifier.Notifier{}
 
+	var (
+		v   notifier.Notifier
+		err error
+		r   = deps.content
+	)
+	if cfg.Notifier.Provider == "fanout" {
+		v, err = newFanoutNotifier(cfg.Notifier.Targets, r, deps)
+	} else {
+		v, err = newNotifier(cfg.Notifier.Provider, &cfg.Notifier.NotifierSettings, r, log)
+		if err == nil {
+			v, err = deps.withDigest(cfg.Notifier.Digest, v, log)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("unable to open %q storage: %w", cfg.Storage.Provider, err)
+		return fmt.Errorf("unable to open %q notifier: %w", cfg.Notifier.Provider, err)
 	}
 
-	deps.storage = v
+	deps.notifer = v
+	deps.notifiers[cfg.Notifier.Provider] = v
 	return nil
 }
 
-func registerNotifier(_ context.Context, cfg *config.Config, deps *dependencies) (err error) {
-	var v notifier.Notifier
-	log := deps.logger.With(zap.String("notifier", cfg.Notifier.Provider))
-	switch cfg.Notifier.Provider {
+// newFanoutNotifier creates the notifiers of all targets. The targets are also added to the
+// named notifiers, so they can be selected individually.
+func newFanoutNotifier(
+	targets []config.NotifierTarget, r *content.Renderer, deps *dependencies,
+) (notifier.Notifier, error) {
+	fanout := make([]fanoutnotifier.Target, 0, len(targets))
+	for _, t := range targets {
+		log := deps.logger.With(zap.String("notifier", t.Name))
+		n, err := newNotifier(t.Provider, &t.NotifierSettings, r, log)
+		if err == nil {
+			n, err = deps.withDigest(t.Digest, n, log)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %q target: %w", t.Name, err)
+		}
+
+		fanout = append(fanout, fanoutnotifier.Target{
+			Name:     t.Name,
+			Notifier: n,
+			Route:    t.Route,
+		})
+		deps.notifiers[t.Name] = n
+	}
+
+	var opts []fanoutnotifier.Option
+	if deps.database != nil {
+		opts = append(opts, fanoutnotifier.Deliveries(deps.database))
+	}
+	return fanoutnotifier.New(fanout, opts...)
+}
+
+func newNotifier(
+	provider string, settings *config.NotifierSettings, r *content.Renderer, log *zap.Logger,
+) (notifier.Notifier, error) {
+	switch provider {
 	case "log":
-		v = lognotifier.New(log)
+		return lognotifier.New(log, r), nil
+	case "discord":
+		return discordnotifier.New(settings.Discord, http.DefaultClient, r)
+	case "webhook":
+		return webhooknotifier.New(settings.Webhook, http.DefaultClient, r)
+	case "email":
+		return emailnotifier.New(settings.Email, r)
 	default:
-		err = errProviderNotFound
+		return nil, errProviderNotFound
+	}
+}
+
+// withDigest wraps the notifier in a digest if it is enabled.
+func (deps *dependencies) withDigest(
+	cfg *digestnotifier.Config, n notifier.Notifier, log *zap.Logger,
+) (notifier.Notifier, error) {
+	if !cfg.Enabled() {
+		return n, nil
 	}
 
+	d, err := digestnotifier.New(cfg, n, log.With(zap.Bool("digest", true)))
 	if err != nil {
-		return fmt.Errorf("unable to open %q database: %w", cfg.Notifier.Provider, err)
+		return nil, err
 	}
+	deps.digests = append(deps.digests, d)
+	return d, nil
+}
 
-	deps.notifer = v
+// registerPush loads the VAPID keys and creates the alerts sent to the push subscribers. Push
+// notifications are disabled when the key file is not configured.
+func registerPush(_ context.Context, cfg *config.Config, deps *dependencies) error {
+	if cfg.Push.KeyFile == "" {
+		deps.logger.Info("push notifications disabled, missing key file")
+		return nil
+	}
+	if deps.database == nil {
+		return errors.New("push notifications require the database")
+	}
+
+	keys, err := webpush.LoadKeys(cfg.Push.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load vapid keys: %w", err)
+	}
+
+	deps.vapid = keys
+	deps.push = pushnotifier.New(
+		&cfg.Push,
+		webpush.NewClient(http.DefaultClient, keys, cfg.Push.Subject),
+		deps.database,
+		deps.content,
+		deps.logger.With(zap.String("notifier", "push")),
+	)
+	deps.alerts = deps.push
+	return nil
+}
+
+// registerReporters creates the notifications sent to the reporters, using email when the relay
+// is configured and push when push notifications are enabled.
+func registerReporters(_ context.Context, cfg *config.Config, deps *dependencies) error {
+	log := deps.logger.With(zap.String("notifier", "reporter"))
+	if deps.database == nil {
+		return errors.New("reporter notifications require the database")
+	}
+
+	var (
+		mailer reporternotifier.Mailer
+		pusher reporternotifier.Pusher
+	)
+	if cfg.Reporters.Email != nil && cfg.Reporters.Email.Host != "" {
+		m, err := emailnotifier.NewSender(cfg.Reporters.Email, deps.content)
+		if err != nil {
+			return fmt.Errorf("unable to create reporter email: %w", err)
+		}
+		mailer = m
+	}
+	if deps.push != nil {
+		pusher = deps.push
+	}
+	if mailer == nil && pusher == nil {
+		log.Info("reporter notifications disabled, neither email nor push is configured")
+		return nil
+	}
+
+	deps.reporters = reporternotifier.New(deps.database, mailer, pusher, log)
 	return nil
 }
 
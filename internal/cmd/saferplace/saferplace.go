@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"slices"
 
 	"connectrpc.com/connect"
 	"connectrpc.com/otelconnect"
@@ -16,6 +17,7 @@ import (
 	"golang.org/x/sync/errgroup"
 	"safer.place/internal/auth"
 	"safer.place/internal/config"
+	"safer.place/internal/cors"
 	"safer.place/internal/service"
 )
 
@@ -31,7 +33,7 @@ func Run(ctx context.Context, components []Component, cfg *config.Config) (err e
 
 	// shared middleware
 	middlewares := []middleware.Middleware{
-		middleware.Cors(cfg.Webserver.CORSDomains),
+		cors.Middleware(cfg.Webserver.CORSDomains),
 	}
 
 	// shared interceptors
@@ -70,10 +72,15 @@ func Run(ctx context.Context, components []Component, cfg *config.Config) (err e
 			reviewerServices,
 		)...,
 	)
+	// The users are rate limited, the uploads are limited by the middleware of their services.
+	userInterceptors := interceptors
+	if deps.limiter != nil {
+		userInterceptors = append(slices.Clip(interceptors), deps.limiter.Interceptor())
+	}
 	services = append(services,
 		FinalizeServices(
 			[]middleware.Middleware{userAuthMiddleware},
-			interceptors,
+			userInterceptors,
 			userServices,
 		)...,
 	)
@@ -9,8 +9,26 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"gopkg.in/yaml.v3"
 	"safer.place/internal/database/sqldatabase"
+	"safer.place/internal/escalation"
+	"safer.place/internal/imagegc"
+	"safer.place/internal/notifier/content"
+	"safer.place/internal/notifier/digestnotifier"
+	"safer.place/internal/notifier/discordnotifier"
+	"safer.place/internal/notifier/emailnotifier"
+	"safer.place/internal/notifier/fanoutnotifier"
+	"safer.place/internal/notifier/pushnotifier"
+	"safer.place/internal/notifier/reporternotifier"
+	"safer.place/internal/notifier/webhooknotifier"
+	"safer.place/internal/priority"
+	"safer.place/internal/ratelimit"
+	"safer.place/internal/scanner/clamd"
+	"safer.place/internal/service/discord"
+	"safer.place/internal/service/imageupload"
+	"safer.place/internal/storage/encrypted"
+	"safer.place/internal/storage/filesystem"
 	"safer.place/internal/storage/minio"
 	"safer.place/internal/tracing"
+	"safer.place/internal/triage"
 )
 
 // Config containing all configuration for saferplace.
@@ -24,7 +42,25 @@ type Config struct {
 	Queue     QueueConfig     `yaml:"queue"`
 	Database  DatabaseConfig  `yaml:"database"`
 	Storage   StorageConfig   `yaml:"storage"`
-	Notifier  NotifierConfig  `yaml:"notifier"`
+	// Upload validates the images uploaded by the users.
+	Upload     imageupload.Config `yaml:"upload"`
+	Notifier   NotifierConfig     `yaml:"notifier"`
+	Triage     triage.Config      `yaml:"triage"`
+	Escalation escalation.Config  `yaml:"escalation"`
+	Priority   priority.Config    `yaml:"priority"`
+	Review     ReviewConfig       `yaml:"review"`
+	// GC removes the uploaded images which were never attached to an incident.
+	GC imagegc.Config `yaml:"gc"`
+	// Scanner checks the uploaded images for malware.
+	Scanner ScannerConfig `yaml:"scanner"`
+	// RateLimit limits how often the users can report incidents and upload images.
+	RateLimit ratelimit.Config `yaml:"rate_limit" split_words:"true"`
+	// Discord interactions used to review incidents directly from discord.
+	Discord discord.Config `yaml:"discord"`
+	// Push notifications sent to the PWA users about alerting incidents.
+	Push pushnotifier.Config `yaml:"push"`
+	// Reporters are notified about the outcome of their reports.
+	Reporters reporternotifier.Config `yaml:"reporters"`
 }
 
 // WebserverConfig contains all configuration used to setup the webserver and middleware
@@ -54,12 +90,130 @@ type DatabaseConfig struct {
 type StorageConfig struct {
 	Provider string `yaml:"provider" default:"minio"`
 
-	Minio *minio.Config `yaml:"minio"`
+	Minio      *minio.Config      `yaml:"minio"`
+	Filesystem *filesystem.Config `yaml:"filesystem"`
+
+	// Originals keeps the uploaded images before their metadata is stripped.
+	Originals OriginalsConfig `yaml:"originals"`
+
+	// Quarantine keeps the uploads rejected by the malware scanner.
+	Quarantine QuarantineConfig `yaml:"quarantine"`
+
+	// Resumable keeps the resumable uploads until they are complete.
+	Resumable ResumableConfig `yaml:"resumable"`
+
+	// Encryption encrypts the images, including the originals, before they are stored.
+	Encryption encrypted.Config `yaml:"encryption"`
+
+	// PresignExpiry redirects image downloads to temporary URLs when the provider supports them.
+	// Images are served directly when it is zero, or when they are encrypted.
+	PresignExpiry time.Duration `yaml:"presign_expiry" default:"0"`
+}
+
+// OriginalsConfig configures where the original uploaded images are kept, using the same provider
+// as the other images. They can contain the location of the reporter, so they are only served to
+// the reviewers with a valid session.
+type OriginalsConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Bucket used by the minio provider.
+	Bucket string `yaml:"bucket" default:"originals"`
+	// Dir used by the filesystem provider.
+	Dir string `yaml:"dir" default:"originals"`
+}
+
+// QuarantineConfig configures where the uploads rejected by the malware scanner are kept, using
+// the same provider as the other images. They are never served, and they are removed by the gc
+// component after its grace period.
+type QuarantineConfig struct {
+	// Bucket used by the minio provider.
+	Bucket string `yaml:"bucket" default:"quarantine"`
+	// Dir used by the filesystem provider.
+	Dir string `yaml:"dir" default:"quarantine"`
+}
+
+// ResumableConfig configures where the parts of the resumable uploads are kept until the upload is
+// complete, using the same provider as the other images. They are never served.
+type ResumableConfig struct {
+	// Bucket used by the minio provider.
+	Bucket string `yaml:"bucket" default:"resumable"`
+	// Dir used by the filesystem provider.
+	Dir string `yaml:"dir" default:"resumable"`
+}
+
+// ScannerConfig configures the malware scanning of the uploads, which is disabled when the
+// provider is empty.
+type ScannerConfig struct {
+	Provider string `yaml:"provider" default:""`
+
+	Clamd clamd.Config `yaml:"clamd"`
+}
+
+// ReviewConfig configures what the reviewers are shown about the incidents.
+type ReviewConfig struct {
+	// SimilarImages shows the other incidents with near-identical images.
+	SimilarImages SimilarImagesConfig `yaml:"similar_images" split_words:"true"`
+}
+
+// SimilarImagesConfig configures how the images of the incidents are compared using their
+// perceptual hashes. The hashes are saved when the images are uploaded, except for the HEIC
+// images which cannot be decoded.
+type SimilarImagesConfig struct {
+	Enabled bool `yaml:"enabled" default:"true"`
+	// MaxDistance is the number of different bits of the hashes of the similar images, from 0 for
+	// the identical images to 64.
+	MaxDistance int `yaml:"max_distance" split_words:"true" default:"10"`
+	// Window around the viewed incident within which the other incidents are compared.
+	Window time.Duration `yaml:"window" default:"720h"`
+	// MaxResults is the number of the most similar incidents shown.
+	MaxResults int `yaml:"max_results" split_words:"true" default:"10"`
 }
 
 // Notifier can be configured to notify a third party of a incident.
 type NotifierConfig struct {
 	Provider string `yaml:"provider" default:"log"`
+
+	// Content of the notifications sent by all notifiers.
+	Content content.Config `yaml:"content"`
+
+	NotifierSettings `yaml:",inline"`
+
+	// Targets are the notifiers used by the fanout provider.
+	Targets []NotifierTarget `yaml:"targets" ignored:"true"`
+}
+
+// NotifierSettings contains the settings of each notifier provider.
+type NotifierSettings struct {
+	Discord *discordnotifier.Config `yaml:"discord"`
+	Webhook *webhooknotifier.Config `yaml:"webhook"`
+	Email   *emailnotifier.Config   `yaml:"email"`
+	// Digest collects the notifications into a single summary, disabled by default.
+	Digest *digestnotifier.Config `yaml:"digest"`
+}
+
+// NotifierTarget is a notifier which receives only the incidents matching its route.
+type NotifierTarget struct {
+	Name     string `yaml:"name"`
+	Provider string `yaml:"provider"`
+
+	NotifierSettings `yaml:",inline"`
+
+	Route fanoutnotifier.Route `yaml:"route"`
+}
+
+// UnmarshalYAML applies the defaults before decoding the target, as the targets can't be read
+// from the environment.
+func (t *NotifierTarget) UnmarshalYAML(value *yaml.Node) error {
+	type plain NotifierTarget
+	target := plain{}
+	if err := envconfig.Process("saferplace_notifier_target", &target); err != nil {
+		return fmt.Errorf("unable to apply defaults: %w", err)
+	}
+	if err := value.Decode(&target); err != nil {
+		return err
+	}
+
+	*t = NotifierTarget(target)
+	return nil
 }
 
 // CertConfig specifies how the certificates should be created
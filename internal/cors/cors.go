@@ -0,0 +1,61 @@
+// Copyright 2023 SaferPlace
+
+// Package cors allows the web apps on the other domains, such as the PWA and the review UI, to
+// call the API. Besides the Connect RPCs, it allows the methods used by the HTTP services and
+// exposes their response headers, so the browsers let the apps read them.
+package cors
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/rs/cors"
+	"github.com/saferplace/webserver-go/middleware"
+)
+
+// Methods allowed by the browsers.
+var Methods = []string{
+	// CORS preflight
+	http.MethodOptions,
+	http.MethodGet,
+	// connect RPCs
+	http.MethodPost,
+	// reporter preferences
+	http.MethodPut,
+	// resumable uploads
+	http.MethodHead,
+	http.MethodPatch,
+	// push subscriptions and resumable uploads
+	http.MethodDelete,
+}
+
+// ExposedHeaders which the apps can read from the responses. The wildcard cannot be used, as it
+// is treated as the literal header name in requests with credentials.
+var ExposedHeaders = []string{
+	// connect and grpc-web errors
+	"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin",
+	// resumable uploads
+	"Location", "Upload-Offset", "Upload-Length", "Upload-Expires",
+	"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+	"Image-Reference",
+	// duplicate reports, see review.SimilarIncidentsHeader
+	"Similar-Incidents",
+}
+
+// Middleware allows the requests from the domains, or from all domains when there are none.
+func Middleware(domains []string) middleware.Middleware {
+	return cors.New(cors.Options{
+		AllowedMethods: Methods,
+		AllowOriginFunc: func(origin string) bool {
+			// Disable CORS when the domain list is not specified.
+			if len(domains) == 0 {
+				return true
+			}
+			return slices.Contains(domains, origin)
+		},
+		// rs/cors mirrors the headers listed in the Access-Control-Request-Headers preflight
+		// request header.
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: ExposedHeaders,
+	}).Handler
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 SaferPlace
+
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	const origin = "https://app.safer.place"
+	handler := Middleware([]string{origin})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upload-Offset", "5")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func(method, origin string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/uploads/abc", nil)
+		r.Header.Set("Origin", origin)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete, http.MethodPut} {
+		rec := request(http.MethodOptions, origin, http.Header{
+			"Access-Control-Request-Method":  {method},
+			"Access-Control-Request-Headers": {"Tus-Resumable,Upload-Offset,Content-Type"},
+		})
+		if got := rec.Header().Get("Access-Control-Allow-Methods"); got != method {
+			t.Errorf("preflight %s: allowed methods = %q", method, got)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Upload-Offset") {
+			t.Errorf("preflight %s: allowed headers = %q", method, got)
+		}
+	}
+
+	rec := request(http.MethodPatch, origin, nil)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != origin {
+		t.Errorf("allowed origin = %q, want %q", got, origin)
+	}
+	exposed := rec.Header().Get("Access-Control-Expose-Headers")
+	for _, h := range []string{"Location", "Upload-Offset", "Upload-Expires", "Tus-Resumable", "Image-Reference", "Similar-Incidents"} {
+		if !strings.Contains(exposed, h) {
+			t.Errorf("exposed headers %q do not include %s", exposed, h)
+		}
+	}
+
+	rec = request(http.MethodPatch, "https://example.com", nil)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("allowed origin = %q for an unknown origin", got)
+	}
+}
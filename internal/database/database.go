@@ -57,11 +57,86 @@ var (
 type Database interface {
 	SaveIncident(context.Context, *incident.Incident) error
 	SaveReview(context.Context, string, incident.Resolution, *incident.Comment) error
+	SavePriority(context.Context, string, int) error
+	Priorities(context.Context) (map[string]int, error)
+	SaveEscalation(context.Context, string, int) error
+	EscalationLevel(context.Context, string) (int, error)
+	NotificationDeliveries(context.Context, string, string) ([]string, error)
+	SaveNotificationDelivery(context.Context, string, string, string) error
 	ViewIncident(context.Context, string) (*incident.Incident, error)
+	IncidentByImage(context.Context, string) (*incident.Incident, error)
 	IncidentsWithoutReview(context.Context) ([]*incident.Incident, error)
 	IncidentsInRadius(context.Context, *incident.Coordinates, float64) ([]*incident.Incident, error)
 	IncidentsInRegion(context.Context, time.Time, *viewer.Region) ([]*incident.Incident, error)
 	SaveSession(context.Context, string) error
 	IsValidSession(context.Context, string) error
 	AlertingIncidents(context.Context, time.Time, *viewer.Region) ([]*incident.Incident, error)
+	SavePushSubscription(context.Context, *PushSubscription) error
+	DeletePushSubscription(context.Context, string) error
+	PushSubscriptionOwner(context.Context, string) (string, error)
+	PushSubscriptionsAt(context.Context, *incident.Coordinates) ([]*PushSubscription, error)
+	SaveReporter(context.Context, string, string) error
+	Reporter(context.Context, string) (string, error)
+	SaveReporterPreferences(context.Context, *ReporterPreferences) error
+	ReporterPreferences(context.Context, string) (*ReporterPreferences, error)
+	SaveUpload(context.Context, *Upload) error
+	Upload(context.Context, string) (*Upload, error)
+	AttachUpload(context.Context, string, string) error
+	DetachUpload(context.Context, string, string) error
+	TryLock(context.Context, string, string, time.Time) (bool, error)
+	Unlock(context.Context, string, string) error
+	SaveImageHash(context.Context, string, uint64) error
+	SimilarIncidents(context.Context, string, int, time.Duration, int) ([]*SimilarIncident, error)
+}
+
+// PushSubscription is a web push subscription to the alerts in the region tiles.
+type PushSubscription struct {
+	Endpoint string
+	// Owner is the email of the user who subscribed, only they can change or delete the
+	// subscription. Subscriptions saved without an owner are claimed by the next user saving them.
+	Owner string
+	// P256dh and Auth are the base64url encoded keys of the subscription.
+	P256dh string
+	Auth   string
+	// Tiles are the "z/x/y" names of the subscribed region tiles.
+	Tiles []string
+}
+
+// ReporterChannel is how the reporter wants to hear about the outcome of their reports.
+type ReporterChannel string
+
+const (
+	ReporterChannelEmail ReporterChannel = "email"
+	ReporterChannelPush  ReporterChannel = "push"
+	// ReporterChannelNone opts the reporter out of the notifications.
+	ReporterChannelNone ReporterChannel = "none"
+)
+
+// ReporterPreferences of the notifications sent to the reporter.
+type ReporterPreferences struct {
+	Email   string
+	Channel ReporterChannel
+	// Push is the subscription used by the push channel, nil if the reporter did not provide one
+	// or it has since expired. It shares the endpoint with the alert subscriptions, but the tiles
+	// are never set.
+	Push *PushSubscription
+}
+
+// Upload is the token issued for an uploaded image. It lets the user who uploaded the image attach
+// it to one of their reports until it expires.
+type Upload struct {
+	// Reference of the image in the storage.
+	Reference string
+	// Uploader is the email of the user who uploaded the image.
+	Uploader string
+	Expires  time.Time
+	// Incident the image is attached to, empty until it is used in a report.
+	Incident string
+}
+
+// SimilarIncident has an image similar to the image of another incident.
+type SimilarIncident struct {
+	ID string
+	// Distance between the perceptual hashes of the images, 0 for identical images.
+	Distance int
 }
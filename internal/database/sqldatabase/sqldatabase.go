@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"api.safer.place/incident/v1"
@@ -15,6 +16,8 @@ import (
 	"golang.org/x/exp/slices"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"safer.place/internal/database"
+	"safer.place/internal/geo"
+	"safer.place/internal/imaging"
 )
 
 // Config of the SQLDatabase
@@ -31,14 +34,42 @@ type Database struct {
 	saveIncidentStmt           *sql.Stmt
 	updateResolutionStmt       *sql.Stmt
 	saveCommentStmt            *sql.Stmt
+	savePriorityStmt           *sql.Stmt
+	prioritiesStmt             *sql.Stmt
+	saveEscalationStmt         *sql.Stmt
+	escalationLevelStmt        *sql.Stmt
+	deliveriesStmt             *sql.Stmt
+	saveDeliveryStmt           *sql.Stmt
 	viewIncidentStmt           *sql.Stmt
 	viewCommentsStmt           *sql.Stmt
+	incidentByImageStmt        *sql.Stmt
 	incidentsWithoutReviewStmt *sql.Stmt
 	incidentsInRadiusStmt      *sql.Stmt
 	incidentsInRegionStmt      *sql.Stmt
 	saveSessionStmt            *sql.Stmt
 	isValidSessionStmt         *sql.Stmt
 	alertingIncidentsStmt      *sql.Stmt
+	savePushSubscriptionStmt   *sql.Stmt
+	savePushTileStmt           *sql.Stmt
+	deletePushTilesStmt        *sql.Stmt
+	deletePushSubscriptionStmt *sql.Stmt
+	pushOwnerStmt              *sql.Stmt
+	savePushOwnerStmt          *sql.Stmt
+	deletePushOwnerStmt        *sql.Stmt
+	pushSubscriptionsAtStmt    *sql.Stmt
+	saveReporterStmt           *sql.Stmt
+	reporterStmt               *sql.Stmt
+	saveReporterPrefsStmt      *sql.Stmt
+	reporterPrefsStmt          *sql.Stmt
+	saveUploadStmt             *sql.Stmt
+	uploadStmt                 *sql.Stmt
+	attachUploadStmt           *sql.Stmt
+	detachUploadStmt           *sql.Stmt
+	tryLockStmt                *sql.Stmt
+	unlockStmt                 *sql.Stmt
+	saveImageHashStmt          *sql.Stmt
+	imageHashStmt              *sql.Stmt
+	imageHashesStmt            *sql.Stmt
 }
 
 // New creates a new SQL database
@@ -69,6 +100,30 @@ func New(cfg Config) (*Database, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare saveComment query: %w", err)
 	}
+	savePriorityStmt, err := db.Prepare(savePriorityQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare savePriority query: %w", err)
+	}
+	prioritiesStmt, err := db.Prepare(prioritiesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare priorities query: %w", err)
+	}
+	saveEscalationStmt, err := db.Prepare(saveEscalationQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare saveEscalation query: %w", err)
+	}
+	escalationLevelStmt, err := db.Prepare(escalationLevelQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare escalationLevel query: %w", err)
+	}
+	deliveriesStmt, err := db.Prepare(deliveriesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare deliveries query: %w", err)
+	}
+	saveDeliveryStmt, err := db.Prepare(saveDeliveryQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare saveDelivery query: %w", err)
+	}
 	viewIncidentStmt, err := db.Prepare(viewIncidentQuery)
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare viewIncident query: %w", err)
@@ -77,6 +132,10 @@ func New(cfg Config) (*Database, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare viewComments query: %w", err)
 	}
+	incidentByImageStmt, err := db.Prepare(incidentByImageQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare incidentByImage query: %w", err)
+	}
 	incidentsWithoutReviewStmt, err := db.Prepare(incidentsWithoutReviewQuery)
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare incidentsWithoutReview query: %w", err)
@@ -101,6 +160,90 @@ func New(cfg Config) (*Database, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to prepare isValidSession query: %w", err)
 	}
+	savePushSubscriptionStmt, err := db.Prepare(savePushSubscriptionQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare savePushSubscription query: %w", err)
+	}
+	savePushTileStmt, err := db.Prepare(savePushTileQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare savePushTile query: %w", err)
+	}
+	deletePushTilesStmt, err := db.Prepare(deletePushTilesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare deletePushTiles query: %w", err)
+	}
+	deletePushSubscriptionStmt, err := db.Prepare(deletePushSubscriptionQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare deletePushSubscription query: %w", err)
+	}
+	pushOwnerStmt, err := db.Prepare(pushOwnerQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare pushOwner query: %w", err)
+	}
+	savePushOwnerStmt, err := db.Prepare(savePushOwnerQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare savePushOwner query: %w", err)
+	}
+	deletePushOwnerStmt, err := db.Prepare(deletePushOwnerQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare deletePushOwner query: %w", err)
+	}
+	pushSubscriptionsAtStmt, err := db.Prepare(pushSubscriptionsAtQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare pushSubscriptionsAt query: %w", err)
+	}
+	saveReporterStmt, err := db.Prepare(saveReporterQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare saveReporter query: %w", err)
+	}
+	reporterStmt, err := db.Prepare(reporterQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare reporter query: %w", err)
+	}
+	saveReporterPrefsStmt, err := db.Prepare(saveReporterPrefsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare saveReporterPrefs query: %w", err)
+	}
+	reporterPrefsStmt, err := db.Prepare(reporterPrefsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare reporterPrefs query: %w", err)
+	}
+	saveUploadStmt, err := db.Prepare(saveUploadQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare saveUpload query: %w", err)
+	}
+	uploadStmt, err := db.Prepare(uploadQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare upload query: %w", err)
+	}
+	attachUploadStmt, err := db.Prepare(attachUploadQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare attachUpload query: %w", err)
+	}
+	detachUploadStmt, err := db.Prepare(detachUploadQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare detachUpload query: %w", err)
+	}
+	tryLockStmt, err := db.Prepare(tryLockQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare tryLock query: %w", err)
+	}
+	unlockStmt, err := db.Prepare(unlockQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare unlock query: %w", err)
+	}
+	saveImageHashStmt, err := db.Prepare(saveImageHashQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare saveImageHash query: %w", err)
+	}
+	imageHashStmt, err := db.Prepare(imageHashQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare imageHash query: %w", err)
+	}
+	imageHashesStmt, err := db.Prepare(imageHashesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to prepare imageHashes query: %w", err)
+	}
 
 	return &Database{
 		db:                         db,
@@ -108,14 +251,42 @@ func New(cfg Config) (*Database, error) {
 		saveIncidentStmt:           saveIncidentStmt,
 		updateResolutionStmt:       updateResolutionStmt,
 		saveCommentStmt:            saveCommentStmt,
+		savePriorityStmt:           savePriorityStmt,
+		prioritiesStmt:             prioritiesStmt,
+		saveEscalationStmt:         saveEscalationStmt,
+		escalationLevelStmt:        escalationLevelStmt,
+		deliveriesStmt:             deliveriesStmt,
+		saveDeliveryStmt:           saveDeliveryStmt,
 		viewIncidentStmt:           viewIncidentStmt,
 		viewCommentsStmt:           viewCommentsStmt,
+		incidentByImageStmt:        incidentByImageStmt,
 		incidentsWithoutReviewStmt: incidentsWithoutReviewStmt,
 		incidentsInRadiusStmt:      incidentsInRadiusStmt,
 		saveSessionStmt:            saveSessionStmt,
 		isValidSessionStmt:         isValidSessionStmt,
 		alertingIncidentsStmt:      alertingIncidentsStmt,
 		incidentsInRegionStmt:      incidentsInRegionStmt,
+		savePushSubscriptionStmt:   savePushSubscriptionStmt,
+		savePushTileStmt:           savePushTileStmt,
+		deletePushTilesStmt:        deletePushTilesStmt,
+		deletePushSubscriptionStmt: deletePushSubscriptionStmt,
+		pushOwnerStmt:              pushOwnerStmt,
+		savePushOwnerStmt:          savePushOwnerStmt,
+		deletePushOwnerStmt:        deletePushOwnerStmt,
+		pushSubscriptionsAtStmt:    pushSubscriptionsAtStmt,
+		saveReporterStmt:           saveReporterStmt,
+		reporterStmt:               reporterStmt,
+		saveReporterPrefsStmt:      saveReporterPrefsStmt,
+		reporterPrefsStmt:          reporterPrefsStmt,
+		saveUploadStmt:             saveUploadStmt,
+		uploadStmt:                 uploadStmt,
+		attachUploadStmt:           attachUploadStmt,
+		detachUploadStmt:           detachUploadStmt,
+		tryLockStmt:                tryLockStmt,
+		unlockStmt:                 unlockStmt,
+		saveImageHashStmt:          saveImageHashStmt,
+		imageHashStmt:              imageHashStmt,
+		imageHashesStmt:            imageHashesStmt,
 	}, nil
 }
 
@@ -197,6 +368,88 @@ func (db *Database) SaveReview(
 	return nil
 }
 
+// SavePriority sets the priority of the incident, replacing any previously saved priority.
+func (db *Database) SavePriority(ctx context.Context, id string, priority int) error {
+	if _, err := db.savePriorityStmt.ExecContext(ctx, id, priority); err != nil {
+		return fmt.Errorf("unable to save priority: %w", err)
+	}
+
+	return nil
+}
+
+// Priorities returns the saved priorities of all incidents without review, by incident ID.
+func (db *Database) Priorities(ctx context.Context) (map[string]int, error) {
+	rows, err := db.prioritiesStmt.QueryContext(ctx,
+		incident.Resolution_RESOLUTION_UNSPECIFIED.String(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list priorities: %w", err)
+	}
+	defer rows.Close()
+
+	priorities := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var priority int
+		if err := rows.Scan(&id, &priority); err != nil {
+			return nil, fmt.Errorf("unable to scan priority: %w", err)
+		}
+		priorities[id] = priority
+	}
+
+	return priorities, rows.Err()
+}
+
+// SaveEscalation records the escalation level the incident has reached.
+func (db *Database) SaveEscalation(ctx context.Context, id string, level int) error {
+	if _, err := db.saveEscalationStmt.ExecContext(ctx, id, level); err != nil {
+		return fmt.Errorf("unable to save escalation: %w", err)
+	}
+
+	return nil
+}
+
+// EscalationLevel returns the escalation level the incident has reached, or 0 if the incident
+// was never escalated.
+func (db *Database) EscalationLevel(ctx context.Context, id string) (int, error) {
+	var level int
+	if err := db.escalationLevelStmt.QueryRowContext(ctx, id).Scan(&level); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to get escalation level: %w", err)
+	}
+
+	return level, nil
+}
+
+// NotificationDeliveries returns the targets the notification of the incident was delivered to.
+func (db *Database) NotificationDeliveries(ctx context.Context, id, notification string) ([]string, error) {
+	rows, err := db.deliveriesStmt.QueryContext(ctx, id, notification)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get notification deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var targets []string
+	for rows.Next() {
+		var target string
+		if err := rows.Scan(&target); err != nil {
+			return nil, fmt.Errorf("unable to scan notification delivery: %w", err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+// SaveNotificationDelivery records the notification of the incident was delivered to the target.
+func (db *Database) SaveNotificationDelivery(ctx context.Context, id, notification, target string) error {
+	if _, err := db.saveDeliveryStmt.ExecContext(ctx, id, notification, target); err != nil {
+		return fmt.Errorf("unable to save notification delivery: %w", err)
+	}
+	return nil
+}
+
 // ViewIncident recovers incident information
 func (db *Database) ViewIncident(ctx context.Context, id string) (*incident.Incident, error) {
 	tx, err := db.db.BeginTx(ctx, nil)
@@ -245,6 +498,18 @@ func (db *Database) ViewIncident(ctx context.Context, id string) (*incident.Inci
 	return inc, nil
 }
 
+// IncidentByImage returns the incident the image is attached to, without the comments.
+func (db *Database) IncidentByImage(ctx context.Context, image string) (*incident.Incident, error) {
+	inc, err := scanIncident(db.incidentByImageStmt.QueryRowContext(ctx, image))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, database.ErrDoesNotExist
+		}
+		return nil, fmt.Errorf("unable to get incident info: %w", err)
+	}
+	return inc, nil
+}
+
 // IncidentsWithoutReview gets all the incidents which have the UNDEFINED
 func (db *Database) IncidentsWithoutReview(ctx context.Context) ([]*incident.Incident, error) {
 	rows, err := db.incidentsWithoutReviewStmt.QueryContext(ctx,
@@ -384,6 +649,367 @@ func (db *Database) AlertingIncidents(
 	return incidents, nil
 }
 
+// SavePushSubscription saves the subscription, replacing the keys and tiles of an existing
+// subscription with the same endpoint. It returns ErrAlreadyExists if the endpoint is owned by
+// another user.
+func (db *Database) SavePushSubscription(ctx context.Context, sub *database.PushSubscription) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := db.claimPushSubscription(ctx, tx, sub); err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(db.savePushSubscriptionStmt).ExecContext(ctx,
+		sub.Endpoint, sub.P256dh, sub.Auth, time.Now().Unix(),
+	); err != nil {
+		return fmt.Errorf("unable to save push subscription: %w", err)
+	}
+	if _, err := tx.Stmt(db.deletePushTilesStmt).ExecContext(ctx, sub.Endpoint); err != nil {
+		return fmt.Errorf("unable to delete push subscription tiles: %w", err)
+	}
+	for _, tile := range sub.Tiles {
+		if _, err := tx.Stmt(db.savePushTileStmt).ExecContext(ctx, sub.Endpoint, tile); err != nil {
+			return fmt.Errorf("unable to save push subscription tile: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePushSubscription deletes the subscription with the endpoint.
+func (db *Database) DeletePushSubscription(ctx context.Context, endpoint string) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Stmt(db.deletePushTilesStmt).ExecContext(ctx, endpoint); err != nil {
+		return fmt.Errorf("unable to delete push subscription tiles: %w", err)
+	}
+	if _, err := tx.Stmt(db.deletePushSubscriptionStmt).ExecContext(ctx, endpoint); err != nil {
+		return fmt.Errorf("unable to delete push subscription: %w", err)
+	}
+	if _, err := tx.Stmt(db.deletePushOwnerStmt).ExecContext(ctx, endpoint); err != nil {
+		return fmt.Errorf("unable to delete push subscription owner: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// PushSubscriptionOwner returns the email of the user who saved the subscription, which is empty
+// for the subscriptions saved without an owner, or ErrDoesNotExist if there is no subscription.
+func (db *Database) PushSubscriptionOwner(ctx context.Context, endpoint string) (string, error) {
+	var owner string
+	if err := db.pushOwnerStmt.QueryRowContext(ctx, endpoint).Scan(&owner); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", database.ErrDoesNotExist
+		}
+		return "", fmt.Errorf("unable to get push subscription owner: %w", err)
+	}
+	return owner, nil
+}
+
+// claimPushSubscription records the owner of the subscription, unless it is owned by another user.
+func (db *Database) claimPushSubscription(ctx context.Context, tx *sql.Tx, sub *database.PushSubscription) error {
+	var owner sql.NullString
+	if err := tx.Stmt(db.pushOwnerStmt).QueryRowContext(ctx, sub.Endpoint).Scan(&owner); err != nil &&
+		!errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("unable to get push subscription owner: %w", err)
+	}
+	if owner.String != "" && owner.String != sub.Owner {
+		return database.ErrAlreadyExists
+	}
+	if sub.Owner == "" {
+		return nil
+	}
+	if _, err := tx.Stmt(db.savePushOwnerStmt).ExecContext(ctx, sub.Endpoint, sub.Owner); err != nil {
+		return fmt.Errorf("unable to save push subscription owner: %w", err)
+	}
+	return nil
+}
+
+// PushSubscriptionsAt returns the subscriptions with a tile covering the coordinates. Only the
+// covering tiles are included in the returned subscriptions.
+func (db *Database) PushSubscriptionsAt(
+	ctx context.Context, c *incident.Coordinates,
+) ([]*database.PushSubscription, error) {
+	tiles := geo.TilesAt(c.Lat, c.Lon)
+	args := make([]any, 0, len(tiles))
+	for _, tile := range tiles {
+		args = append(args, tile.String())
+	}
+
+	rows, err := db.pushSubscriptionsAtStmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list push subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subs := make([]*database.PushSubscription, 0)
+	byEndpoint := make(map[string]*database.PushSubscription)
+	for rows.Next() {
+		var sub database.PushSubscription
+		var tile string
+		if err := rows.Scan(&sub.Endpoint, &sub.P256dh, &sub.Auth, &tile); err != nil {
+			return nil, fmt.Errorf("unable to scan push subscription: %w", err)
+		}
+		if existing, ok := byEndpoint[sub.Endpoint]; ok {
+			existing.Tiles = append(existing.Tiles, tile)
+			continue
+		}
+		sub.Tiles = []string{tile}
+		byEndpoint[sub.Endpoint] = &sub
+		subs = append(subs, &sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// SaveReporter saves the email of the user who reported the incident.
+func (db *Database) SaveReporter(ctx context.Context, id, email string) error {
+	if _, err := db.saveReporterStmt.ExecContext(ctx, id, email); err != nil {
+		return fmt.Errorf("unable to save reporter: %w", err)
+	}
+	return nil
+}
+
+// Reporter returns the email of the user who reported the incident, or ErrDoesNotExist if the
+// reporter is not known.
+func (db *Database) Reporter(ctx context.Context, id string) (string, error) {
+	var email string
+	if err := db.reporterStmt.QueryRowContext(ctx, id).Scan(&email); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", database.ErrDoesNotExist
+		}
+		return "", fmt.Errorf("unable to get reporter: %w", err)
+	}
+	return email, nil
+}
+
+// SaveReporterPreferences saves the preferences, including the keys of the push subscription.
+// The tiles of an existing push subscription with the same endpoint are kept.
+func (db *Database) SaveReporterPreferences(
+	ctx context.Context, prefs *database.ReporterPreferences,
+) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var endpoint sql.NullString
+	if prefs.Push != nil {
+		endpoint = sql.NullString{String: prefs.Push.Endpoint, Valid: true}
+		if err := db.claimPushSubscription(ctx, tx, &database.PushSubscription{
+			Endpoint: prefs.Push.Endpoint,
+			Owner:    prefs.Email,
+		}); err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(db.savePushSubscriptionStmt).ExecContext(ctx,
+			prefs.Push.Endpoint, prefs.Push.P256dh, prefs.Push.Auth, time.Now().Unix(),
+		); err != nil {
+			return fmt.Errorf("unable to save push subscription: %w", err)
+		}
+	}
+	if _, err := tx.Stmt(db.saveReporterPrefsStmt).ExecContext(ctx,
+		prefs.Email, string(prefs.Channel), endpoint,
+	); err != nil {
+		return fmt.Errorf("unable to save reporter preferences: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// ReporterPreferences returns the preferences of the reporter. Reporters who never set their
+// preferences are notified by email.
+func (db *Database) ReporterPreferences(
+	ctx context.Context, email string,
+) (*database.ReporterPreferences, error) {
+	prefs := &database.ReporterPreferences{
+		Email:   email,
+		Channel: database.ReporterChannelEmail,
+	}
+
+	var (
+		channel                string
+		endpoint, p256dh, auth sql.NullString
+	)
+	if err := db.reporterPrefsStmt.QueryRowContext(ctx, email).Scan(
+		&channel, &endpoint, &p256dh, &auth,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return prefs, nil
+		}
+		return nil, fmt.Errorf("unable to get reporter preferences: %w", err)
+	}
+
+	prefs.Channel = database.ReporterChannel(channel)
+	// The subscription is gone if it was deleted after the push service rejected it.
+	if endpoint.Valid {
+		prefs.Push = &database.PushSubscription{
+			Endpoint: endpoint.String,
+			P256dh:   p256dh.String,
+			Auth:     auth.String,
+		}
+	}
+
+	return prefs, nil
+}
+
+// SaveUpload saves the token of the uploaded image.
+func (db *Database) SaveUpload(ctx context.Context, u *database.Upload) error {
+	if _, err := db.saveUploadStmt.ExecContext(ctx,
+		u.Reference, u.Uploader, u.Expires.Unix(), u.Incident,
+	); err != nil {
+		return fmt.Errorf("unable to save upload: %w", err)
+	}
+	return nil
+}
+
+// Upload returns the token of the uploaded image, or ErrDoesNotExist if the image was not
+// uploaded.
+func (db *Database) Upload(ctx context.Context, reference string) (*database.Upload, error) {
+	u := &database.Upload{Reference: reference}
+	var expires int64
+	if err := db.uploadStmt.QueryRowContext(ctx, reference).Scan(
+		&u.Uploader, &expires, &u.Incident,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, database.ErrDoesNotExist
+		}
+		return nil, fmt.Errorf("unable to get upload: %w", err)
+	}
+	u.Expires = time.Unix(expires, 0)
+	return u, nil
+}
+
+// AttachUpload attaches the uploaded image to the incident. It returns ErrAlreadyExists if the
+// image is already attached to an incident, or ErrDoesNotExist if the image was not uploaded.
+func (db *Database) AttachUpload(ctx context.Context, reference, id string) error {
+	res, err := db.attachUploadStmt.ExecContext(ctx, id, reference)
+	if err != nil {
+		return fmt.Errorf("unable to attach upload: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to attach upload: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	if _, err := db.Upload(ctx, reference); err != nil {
+		return err
+	}
+	return database.ErrAlreadyExists
+}
+
+// DetachUpload detaches the uploaded image from the incident, so it can be attached again. It
+// does nothing if the image is attached to another incident.
+func (db *Database) DetachUpload(ctx context.Context, reference, id string) error {
+	if _, err := db.detachUploadStmt.ExecContext(ctx, reference, id); err != nil {
+		return fmt.Errorf("unable to detach upload: %w", err)
+	}
+	return nil
+}
+
+// TryLock takes the lock with the name for the holder until it expires, returning false if another
+// holder has it. Expired locks are taken over.
+func (db *Database) TryLock(ctx context.Context, name, holder string, expires time.Time) (bool, error) {
+	res, err := db.tryLockStmt.ExecContext(ctx, name, holder, expires.Unix(), time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("unable to lock: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("unable to lock: %w", err)
+	}
+	return n == 1, nil
+}
+
+// Unlock releases the lock with the name, if it is still held by the holder.
+func (db *Database) Unlock(ctx context.Context, name, holder string) error {
+	if _, err := db.unlockStmt.ExecContext(ctx, name, holder); err != nil {
+		return fmt.Errorf("unable to unlock: %w", err)
+	}
+	return nil
+}
+
+// SaveImageHash saves the perceptual hash of the image.
+func (db *Database) SaveImageHash(ctx context.Context, reference string, hash uint64) error {
+	// The driver does not support uint64 with the high bit set, the bits are kept as they are.
+	if _, err := db.saveImageHashStmt.ExecContext(ctx, reference, int64(hash)); err != nil {
+		return fmt.Errorf("unable to save image hash: %w", err)
+	}
+	return nil
+}
+
+// SimilarIncidents returns at most limit other incidents reported within the window around the
+// incident, whose images are within the distance of the image of the incident, from the most
+// similar. There are none when the incident does not have a hashed image.
+func (db *Database) SimilarIncidents(
+	ctx context.Context, id string, maxDistance int, window time.Duration, limit int,
+) ([]*database.SimilarIncident, error) {
+	var timestamp, hash int64
+	if err := db.imageHashStmt.QueryRowContext(ctx, id).Scan(&timestamp, &hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to get image hash: %w", err)
+	}
+
+	// Most SQL databases cannot count the bits, so the hashes within the window are compared here.
+	seconds := int64(window / time.Second)
+	rows, err := db.imageHashesStmt.QueryContext(ctx, timestamp-seconds, timestamp+seconds, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list image hashes: %w", err)
+	}
+	defer rows.Close()
+
+	similar := make([]*database.SimilarIncident, 0)
+	for rows.Next() {
+		var (
+			other string
+			h     int64
+		)
+		if err := rows.Scan(&other, &h); err != nil {
+			return nil, fmt.Errorf("unable to scan image hash: %w", err)
+		}
+		if d := imaging.Distance(uint64(hash), uint64(h)); d <= maxDistance {
+			similar = append(similar, &database.SimilarIncident{ID: other, Distance: d})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list image hashes: %w", err)
+	}
+
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Distance < similar[j].Distance
+	})
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+
+	return similar, nil
+}
+
 // IsValidSession determines if the session is still active and within date.
 // It returns nil if the session is valid, otherwise some error.
 // TODO: If the session is expired, delete it
@@ -464,6 +1090,8 @@ CREATE TABLE IF NOT EXISTS incidents (
 );
 CREATE INDEX IF NOT EXISTS lat ON incidents (lat);
 CREATE INDEX IF NOT EXISTS lon ON incidents (lon);
+CREATE INDEX IF NOT EXISTS images ON incidents (image);
+CREATE INDEX IF NOT EXISTS timestamps ON incidents (timestamp);
 
 CREATE TABLE IF NOT EXISTS comments (
 	id TEXT PRIMARY KEY,
@@ -475,10 +1103,75 @@ CREATE TABLE IF NOT EXISTS comments (
 );
 CREATE INDEX IF NOT EXISTS incident_ids ON comments (incident_id);
 
+CREATE TABLE IF NOT EXISTS priorities (
+	incident_id TEXT PRIMARY KEY,
+	priority    INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS escalations (
+	incident_id TEXT PRIMARY KEY,
+	level       INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+	incident_id  TEXT NOT NULL,
+	notification TEXT NOT NULL,
+	target       TEXT NOT NULL,
+	PRIMARY KEY (incident_id, notification, target)
+);
+
 CREATE TABLE IF NOT EXISTS sessions (
 	id     TEXT PRIMARY KEY,
 	expiry INTEGER NOT NULL
 );
+
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+	endpoint   TEXT PRIMARY KEY,
+	p256dh     TEXT NOT NULL,
+	auth       TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS push_subscription_tiles (
+	endpoint TEXT NOT NULL,
+	tile     TEXT NOT NULL,
+	PRIMARY KEY (endpoint, tile)
+);
+CREATE INDEX IF NOT EXISTS push_tiles ON push_subscription_tiles (tile);
+
+CREATE TABLE IF NOT EXISTS push_subscription_owners (
+	endpoint TEXT PRIMARY KEY,
+	owner    TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS reporters (
+	incident_id TEXT PRIMARY KEY,
+	email       TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS reporter_preferences (
+	email    TEXT PRIMARY KEY,
+	channel  TEXT NOT NULL,
+	endpoint TEXT
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+	reference   TEXT PRIMARY KEY,
+	uploader    TEXT NOT NULL,
+	expires     INTEGER NOT NULL,
+	incident_id TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS image_hashes (
+	reference TEXT PRIMARY KEY,
+	hash      INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS locks (
+	name    TEXT PRIMARY KEY,
+	holder  TEXT NOT NULL,
+	expires INTEGER NOT NULL
+);
 `
 
 var saveIncidentQuery = `
@@ -503,6 +1196,45 @@ VALUES
 	(?, ?, ?, ?, ?, ?);
 `
 
+var savePriorityQuery = `
+INSERT INTO priorities
+	(incident_id, priority)
+VALUES
+	(?, ?)
+ON CONFLICT(incident_id) DO UPDATE SET priority=excluded.priority;
+`
+
+var prioritiesQuery = `
+SELECT priorities.incident_id, priorities.priority
+FROM priorities
+JOIN incidents ON incidents.id = priorities.incident_id
+WHERE incidents.resolution=?;
+`
+
+var saveEscalationQuery = `
+INSERT INTO escalations
+	(incident_id, level)
+VALUES
+	(?, ?)
+ON CONFLICT(incident_id) DO UPDATE SET level=excluded.level;
+`
+
+var escalationLevelQuery = `
+SELECT level FROM escalations WHERE incident_id=?;
+`
+
+var deliveriesQuery = `
+SELECT target FROM notification_deliveries WHERE incident_id=? AND notification=?;
+`
+
+var saveDeliveryQuery = `
+INSERT INTO notification_deliveries
+	(incident_id, notification, target)
+VALUES
+	(?, ?, ?)
+ON CONFLICT DO NOTHING;
+`
+
 var viewIncidentQuery = `
 SELECT * FROM incidents WHERE id=?;
 `
@@ -511,6 +1243,10 @@ var viewCommentsQuery = `
 SELECT * FROM comments WHERE incident_id=?;
 `
 
+var incidentByImageQuery = `
+SELECT * FROM incidents WHERE image=? LIMIT 1;
+`
+
 var incidentsWithoutReviewQuery = `
 SELECT * FROM incidents WHERE resolution=?;
 `
@@ -529,6 +1265,160 @@ WHERE
 	incident.Resolution_RESOLUTION_ALERTED,
 )
 
+var savePushSubscriptionQuery = `
+INSERT INTO push_subscriptions
+	(endpoint, p256dh, auth, created_at)
+VALUES
+	(?, ?, ?, ?)
+ON CONFLICT(endpoint) DO UPDATE SET p256dh=excluded.p256dh, auth=excluded.auth;
+`
+
+var savePushTileQuery = `
+INSERT OR IGNORE INTO push_subscription_tiles
+	(endpoint, tile)
+VALUES
+	(?, ?);
+`
+
+var deletePushTilesQuery = `
+DELETE FROM push_subscription_tiles WHERE endpoint=?;
+`
+
+var deletePushSubscriptionQuery = `
+DELETE FROM push_subscriptions WHERE endpoint=?;
+`
+
+// pushOwnerQuery only finds the owner while the subscription exists, the subscriptions saved
+// without an owner have an empty owner.
+var pushOwnerQuery = `
+SELECT COALESCE(push_subscription_owners.owner, '')
+FROM push_subscriptions
+LEFT JOIN push_subscription_owners ON push_subscription_owners.endpoint = push_subscriptions.endpoint
+WHERE push_subscriptions.endpoint=?;
+`
+
+var savePushOwnerQuery = `
+INSERT INTO push_subscription_owners
+	(endpoint, owner)
+VALUES
+	(?, ?)
+ON CONFLICT(endpoint) DO UPDATE SET owner=excluded.owner;
+`
+
+var deletePushOwnerQuery = `
+DELETE FROM push_subscription_owners WHERE endpoint=?;
+`
+
+// pushSubscriptionsAtQuery gets the subscriptions to any of the tiles containing the
+// coordinates, one for every zoom level.
+var pushSubscriptionsAtQuery = fmt.Sprintf(`
+SELECT push_subscriptions.endpoint, push_subscriptions.p256dh, push_subscriptions.auth, push_subscription_tiles.tile
+FROM push_subscriptions
+JOIN push_subscription_tiles ON push_subscription_tiles.endpoint = push_subscriptions.endpoint
+WHERE push_subscription_tiles.tile IN (%s)
+ORDER BY push_subscriptions.endpoint;
+`,
+	strings.TrimSuffix(strings.Repeat("?, ", geo.MaxTileZoom+1), ", "),
+)
+
+var saveReporterQuery = `
+INSERT INTO reporters
+	(incident_id, email)
+VALUES
+	(?, ?);
+`
+
+var reporterQuery = `
+SELECT email FROM reporters WHERE incident_id=?;
+`
+
+var saveUploadQuery = `
+INSERT INTO uploads
+	(reference, uploader, expires, incident_id)
+VALUES
+	(?, ?, ?, ?);
+`
+
+var uploadQuery = `
+SELECT uploader, expires, incident_id FROM uploads WHERE reference=?;
+`
+
+// attachUploadQuery only attaches the images which are not attached yet, so the same image cannot
+// be attached to two incidents reported at the same time.
+var attachUploadQuery = `
+UPDATE uploads
+SET
+	incident_id=?
+WHERE
+	reference=? AND incident_id='';
+`
+
+var detachUploadQuery = `
+UPDATE uploads
+SET
+	incident_id=''
+WHERE
+	reference=? AND incident_id=?;
+`
+
+var tryLockQuery = `
+INSERT INTO locks
+	(name, holder, expires)
+VALUES
+	(?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET
+	holder=excluded.holder,
+	expires=excluded.expires
+WHERE
+	locks.expires<?;
+`
+
+var unlockQuery = `
+DELETE FROM locks WHERE name=? AND holder=?;
+`
+
+var saveImageHashQuery = `
+INSERT INTO image_hashes
+	(reference, hash)
+VALUES
+	(?, ?)
+ON CONFLICT(reference) DO UPDATE SET hash=excluded.hash;
+`
+
+var imageHashQuery = `
+SELECT incidents.timestamp, image_hashes.hash
+FROM incidents
+JOIN image_hashes ON image_hashes.reference = incidents.image
+WHERE incidents.id=?;
+`
+
+var imageHashesQuery = `
+SELECT incidents.id, image_hashes.hash
+FROM incidents
+JOIN image_hashes ON image_hashes.reference = incidents.image
+WHERE incidents.timestamp BETWEEN ? AND ? AND incidents.id!=?;
+`
+
+var saveReporterPrefsQuery = `
+INSERT INTO reporter_preferences
+	(email, channel, endpoint)
+VALUES
+	(?, ?, ?)
+ON CONFLICT(email) DO UPDATE SET channel=excluded.channel, endpoint=excluded.endpoint;
+`
+
+// reporterPrefsQuery only returns the push subscription while it still exists.
+var reporterPrefsQuery = `
+SELECT
+	reporter_preferences.channel,
+	push_subscriptions.endpoint,
+	push_subscriptions.p256dh,
+	push_subscriptions.auth
+FROM reporter_preferences
+LEFT JOIN push_subscriptions ON push_subscriptions.endpoint = reporter_preferences.endpoint
+WHERE reporter_preferences.email=?;
+`
+
 var saveSessionQuery = `
 INSERT INTO sessions
 	(id, expiry)
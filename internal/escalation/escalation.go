@@ -0,0 +1,192 @@
+// Copyright 2023 SaferPlace
+
+// Package escalation periodically looks for incidents which have been waiting for a review for
+// too long, and notifies about them again with increasing urgency.
+package escalation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/notifier"
+)
+
+// Config of the escalation job.
+type Config struct {
+	// Interval between checks for stale incidents.
+	Interval time.Duration `yaml:"interval" default:"5m"`
+	// Levels of escalation. Each level is notified once, when the incident has been waiting for
+	// a review for longer than the level threshold.
+	Levels []Level `yaml:"levels" ignored:"true"`
+}
+
+// Level of escalation.
+type Level struct {
+	// After is how long the incident must be unreviewed before escalating.
+	After time.Duration `yaml:"after"`
+	// Notifier used for this level, the default notifier is used if empty.
+	Notifier string `yaml:"notifier"`
+	// Urgency of the notification.
+	Urgency notifier.Urgency `yaml:"urgency"`
+}
+
+// Escalator checks for stale incidents.
+type Escalator struct {
+	interval  time.Duration
+	levels    []Level
+	db        database.Database
+	notifier  notifier.Notifier
+	notifiers map[string]notifier.Notifier
+	log       *zap.Logger
+
+	oldest    prometheus.Gauge
+	escalated *prometheus.CounterVec
+}
+
+// New creates the escalation job. Metrics are registered with the provided registerer.
+func New(
+	cfg Config,
+	log *zap.Logger,
+	db database.Database,
+	n notifier.Notifier,
+	reg prometheus.Registerer,
+	opts ...Option,
+) (*Escalator, error) {
+	levels := append([]Level{}, cfg.Levels...)
+	sort.SliceStable(levels, func(i, j int) bool {
+		return levels[i].After < levels[j].After
+	})
+
+	e := &Escalator{
+		interval: cfg.Interval,
+		levels:   levels,
+		db:       db,
+		notifier: n,
+		log:      log,
+		oldest: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "saferplace",
+			Subsystem: "review",
+			Name:      "oldest_unreviewed_incident_age_seconds",
+			Help:      "Age of the oldest incident still waiting for a review.",
+		}),
+		escalated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "saferplace",
+			Subsystem: "review",
+			Name:      "escalations_total",
+			Help:      "Number of escalations sent for stale incidents, by level.",
+		}, []string{"level"}),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	if err := reg.Register(e.oldest); err != nil {
+		return nil, fmt.Errorf("unable to register oldest incident gauge: %w", err)
+	}
+	if err := reg.Register(e.escalated); err != nil {
+		return nil, fmt.Errorf("unable to register escalations counter: %w", err)
+	}
+
+	return e, nil
+}
+
+// Run the escalation job until the context is cancelled.
+func (e *Escalator) Run(ctx context.Context) error {
+	e.log.Info("checking for stale incidents", zap.Duration("interval", e.interval))
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.check(ctx); err != nil {
+			e.log.Error("unable to check for stale incidents", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// check all incidents without review and escalate the ones which passed a threshold.
+func (e *Escalator) check(ctx context.Context) error {
+	incidents, err := e.db.IncidentsWithoutReview(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list incidents without review: %w", err)
+	}
+
+	now := time.Now()
+	var oldest time.Duration
+	for _, inc := range incidents {
+		age := now.Sub(inc.Timestamp.AsTime())
+		if age > oldest {
+			oldest = age
+		}
+
+		if err := e.escalate(ctx, inc, age); err != nil {
+			e.log.Error("unable to escalate incident",
+				zap.String("id", inc.Id),
+				zap.Error(err),
+			)
+		}
+	}
+	e.oldest.Set(oldest.Seconds())
+
+	return nil
+}
+
+// escalate the incident to the highest level it has reached, if it wasn't notified about it
+// already. Levels are counted from 1, 0 meaning the incident was never escalated.
+func (e *Escalator) escalate(ctx context.Context, inc *incident.Incident, age time.Duration) error {
+	reached := 0
+	for i, level := range e.levels {
+		if age >= level.After {
+			reached = i + 1
+		}
+	}
+	if reached == 0 {
+		return nil
+	}
+
+	current, err := e.db.EscalationLevel(ctx, inc.Id)
+	if err != nil {
+		return err
+	}
+	if current >= reached {
+		return nil
+	}
+
+	level := e.levels[reached-1]
+	e.log.Info("escalating stale incident",
+		zap.String("id", inc.Id),
+		zap.Int("level", reached),
+		zap.Duration("age", age),
+	)
+
+	ctx = notifier.WithEvent(notifier.WithUrgency(ctx, level.Urgency), notifier.EventEscalation)
+	// The escalation is retried on the next check when it fails, and only the targets which
+	// failed are notified again.
+	ctx = notifier.WithDelivery(ctx, fmt.Sprintf("escalation-%d", reached))
+	if err := e.notifierFor(level.Notifier).Notify(ctx, inc); err != nil {
+		return fmt.Errorf("unable to notify: %w", err)
+	}
+	e.escalated.WithLabelValues(fmt.Sprint(reached)).Inc()
+
+	return e.db.SaveEscalation(ctx, inc.Id, reached)
+}
+
+func (e *Escalator) notifierFor(name string) notifier.Notifier {
+	if n, ok := e.notifiers[name]; ok && name != "" {
+		return n
+	}
+	return e.notifier
+}
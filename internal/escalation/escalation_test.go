@@ -0,0 +1,153 @@
+// Copyright 2023 SaferPlace
+
+package escalation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"safer.place/internal/database"
+	"safer.place/internal/notifier"
+)
+
+type fakeDatabase struct {
+	database.Database
+	incidents []*incident.Incident
+	levels    map[string]int
+}
+
+func (db *fakeDatabase) IncidentsWithoutReview(context.Context) ([]*incident.Incident, error) {
+	return db.incidents, nil
+}
+
+func (db *fakeDatabase) EscalationLevel(_ context.Context, id string) (int, error) {
+	return db.levels[id], nil
+}
+
+func (db *fakeDatabase) SaveEscalation(_ context.Context, id string, level int) error {
+	db.levels[id] = level
+	return nil
+}
+
+// notification received by the fake notifier.
+type notification struct {
+	notifier string
+	id       string
+	urgency  notifier.Urgency
+}
+
+type fakeNotifier struct {
+	name          string
+	notifications *[]notification
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, inc *incident.Incident) error {
+	*n.notifications = append(*n.notifications, notification{
+		notifier: n.name,
+		id:       inc.Id,
+		urgency:  notifier.UrgencyFromContext(ctx),
+	})
+	return nil
+}
+
+func newEscalator(t *testing.T, db database.Database, notifications *[]notification) *Escalator {
+	t.Helper()
+	e, err := New(Config{
+		Interval: time.Minute,
+		// Out of order, the levels are sorted by their threshold.
+		Levels: []Level{
+			{After: 4 * time.Hour, Notifier: "oncall", Urgency: notifier.UrgencyCritical},
+			{After: time.Hour, Urgency: notifier.UrgencyHigh},
+		},
+	},
+		zap.NewNop(),
+		db,
+		&fakeNotifier{name: "default", notifications: notifications},
+		prometheus.NewRegistry(),
+		Notifiers(map[string]notifier.Notifier{
+			"oncall": &fakeNotifier{name: "oncall", notifications: notifications},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEscalate(t *testing.T) {
+	testCases := map[string]struct {
+		age     time.Duration
+		current int
+		want    []notification
+		level   int
+	}{
+		"too recent": {age: 30 * time.Minute},
+		"first level": {
+			age:   2 * time.Hour,
+			want:  []notification{{"default", "inc", notifier.UrgencyHigh}},
+			level: 1,
+		},
+		"second level": {
+			age:   5 * time.Hour,
+			want:  []notification{{"oncall", "inc", notifier.UrgencyCritical}},
+			level: 2,
+		},
+		"skipped level": {
+			age:     5 * time.Hour,
+			current: 1,
+			want:    []notification{{"oncall", "inc", notifier.UrgencyCritical}},
+			level:   2,
+		},
+		"already escalated":            {age: 2 * time.Hour, current: 1, level: 1},
+		"already at the highest level": {age: 5 * time.Hour, current: 2, level: 2},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			db := &fakeDatabase{
+				incidents: []*incident.Incident{
+					{Id: "inc", Timestamp: timestamppb.New(time.Now().Add(-tc.age))},
+				},
+				levels: map[string]int{"inc": tc.current},
+			}
+			var notifications []notification
+			e := newEscalator(t, db, &notifications)
+
+			if err := e.check(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(notifications) != len(tc.want) || (len(tc.want) > 0 && notifications[0] != tc.want[0]) {
+				t.Errorf("notifications = %v, want %v", notifications, tc.want)
+			}
+			if db.levels["inc"] != tc.level {
+				t.Errorf("level = %d, want %d", db.levels["inc"], tc.level)
+			}
+		})
+	}
+}
+
+func TestEscalateOnce(t *testing.T) {
+	db := &fakeDatabase{
+		incidents: []*incident.Incident{
+			{Id: "inc", Timestamp: timestamppb.New(time.Now().Add(-2 * time.Hour))},
+		},
+		levels: map[string]int{},
+	}
+	var notifications []notification
+	e := newEscalator(t, db, &notifications)
+
+	for i := 0; i < 3; i++ {
+		if err := e.check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(notifications) != 1 {
+		t.Errorf("notified %d times at the same level, want once", len(notifications))
+	}
+}
@@ -0,0 +1,13 @@
+package escalation
+
+import "safer.place/internal/notifier"
+
+// Option extends the functionality of the escalation job.
+type Option func(*Escalator)
+
+// Notifiers which can be selected by name by the escalation levels.
+func Notifiers(notifiers map[string]notifier.Notifier) Option {
+	return func(e *Escalator) {
+		e.notifiers = notifiers
+	}
+}
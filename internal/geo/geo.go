@@ -0,0 +1,23 @@
+// Copyright 2023 SaferPlace
+
+// Package geo contains helpers for working with coordinates.
+package geo
+
+import "math"
+
+const earthRadius = 6371009
+
+// Distance in meters between two points, calculated using the haversine formula.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	lat1, lon1, lat2, lon2 = dtor(lat1), dtor(lon1), dtor(lat2), dtor(lon2)
+
+	a := math.Pow(math.Sin((lat2-lat1)/2), 2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin((lon2-lon1)/2), 2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// dtor converts degrees to radians
+func dtor(d float64) float64 {
+	return (d * math.Pi) / 180
+}
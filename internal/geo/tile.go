@@ -0,0 +1,78 @@
+// Copyright 2023 SaferPlace
+
+package geo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MaxTileZoom is the highest zoom level of the supported tiles.
+const MaxTileZoom = 18
+
+// Tile is a slippy map tile, as used by OpenStreetMap.
+// https://wiki.openstreetmap.org/wiki/Slippy_map_tilenames
+type Tile struct {
+	Z, X, Y int
+}
+
+var errInvalidTile = errors.New("invalid tile")
+
+// ParseTile parses the tile from its "z/x/y" name.
+func ParseTile(s string) (Tile, error) {
+	var t Tile
+	if _, err := fmt.Sscanf(s, "%d/%d/%d", &t.Z, &t.X, &t.Y); err != nil {
+		return Tile{}, fmt.Errorf("%w %q", errInvalidTile, s)
+	}
+	if t.String() != s || t.Z < 0 || t.Z > MaxTileZoom {
+		return Tile{}, fmt.Errorf("%w %q", errInvalidTile, s)
+	}
+	if n := 1 << t.Z; t.X < 0 || t.X >= n || t.Y < 0 || t.Y >= n {
+		return Tile{}, fmt.Errorf("%w %q", errInvalidTile, s)
+	}
+
+	return t, nil
+}
+
+func (t Tile) String() string {
+	return fmt.Sprintf("%d/%d/%d", t.Z, t.X, t.Y)
+}
+
+// Center returns the coordinates of the centre of the tile.
+func (t Tile) Center() (lat, lon float64) {
+	n := float64(int(1) << t.Z)
+	lon = (float64(t.X)+0.5)/n*360 - 180
+	lat = math.Atan(math.Sinh(math.Pi*(1-2*(float64(t.Y)+0.5)/n))) * 180 / math.Pi
+	return lat, lon
+}
+
+// TileAt returns the tile at the zoom level containing the coordinates.
+func TileAt(lat, lon float64, z int) Tile {
+	n := float64(int(1) << z)
+	lat = math.Max(math.Min(lat, 85.0511), -85.0511)
+
+	x := int(math.Floor((lon + 180) / 360 * n))
+	y := int(math.Floor((1 - math.Asinh(math.Tan(dtor(lat)))/math.Pi) / 2 * n))
+
+	return Tile{Z: z, X: clamp(x, int(n)), Y: clamp(y, int(n))}
+}
+
+// TilesAt returns the tiles at all zoom levels containing the coordinates, from the lowest zoom.
+func TilesAt(lat, lon float64) []Tile {
+	tiles := make([]Tile, 0, MaxTileZoom+1)
+	for z := 0; z <= MaxTileZoom; z++ {
+		tiles = append(tiles, TileAt(lat, lon, z))
+	}
+	return tiles
+}
+
+func clamp(v, n int) int {
+	if v < 0 {
+		return 0
+	}
+	if v >= n {
+		return n - 1
+	}
+	return v
+}
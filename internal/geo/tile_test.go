@@ -0,0 +1,34 @@
+// Copyright 2023 SaferPlace
+
+package geo
+
+import "testing"
+
+func TestTileAt(t *testing.T) {
+	// Dublin city centre
+	got := TileAt(53.3498, -6.2603, 12)
+	if want := (Tile{Z: 12, X: 1976, Y: 1327}); got != want {
+		t.Errorf("TileAt() = %s, want %s", got, want)
+	}
+
+	if lat, lon := got.Center(); TileAt(lat, lon, 12) != got {
+		t.Errorf("Center() = %f, %f, outside of the tile", lat, lon)
+	}
+
+	tiles := TilesAt(53.3498, -6.2603)
+	if len(tiles) != MaxTileZoom+1 || tiles[0] != (Tile{}) || tiles[12] != got {
+		t.Errorf("TilesAt() = %v", tiles)
+	}
+}
+
+func TestParseTile(t *testing.T) {
+	if tile, err := ParseTile("12/1976/1327"); err != nil || tile != (Tile{Z: 12, X: 1976, Y: 1327}) {
+		t.Errorf("ParseTile() = %v, %v", tile, err)
+	}
+
+	for _, s := range []string{"", "12/1976", "1/2/0", "19/0/0", "12/-1/0", "12/1976/1327/1"} {
+		if _, err := ParseTile(s); err == nil {
+			t.Errorf("ParseTile(%q) expected an error", s)
+		}
+	}
+}
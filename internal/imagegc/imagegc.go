@@ -0,0 +1,291 @@
+// Copyright 2023 SaferPlace
+
+// Package imagegc periodically removes the uploaded images which are not attached to any
+// incident, such as the images of reports which were never submitted, the abandoned resumable
+// uploads and the quarantined images. The variants of the images are removed together with them.
+package imagegc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/storage"
+)
+
+// Config of the garbage collection job.
+type Config struct {
+	// Interval between the collections.
+	Interval time.Duration `yaml:"interval" default:"1h"`
+	// GracePeriod the images are kept for before they are removed. It must be longer than it
+	// takes to submit the report after uploading its image, and longer than the expiry of the
+	// resumable uploads. The quarantined images are kept for the grace period too.
+	GracePeriod time.Duration `yaml:"grace_period" split_words:"true" default:"72h"`
+	// DryRun only logs the orphaned images, without removing them.
+	DryRun bool `yaml:"dry_run" split_words:"true" default:"false"`
+}
+
+// Collector removes the orphaned images.
+type Collector struct {
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+	db          database.Database
+	storage     storage.Storage
+	originals   storage.Storage
+	resumable   storage.Storage
+	quarantine  storage.Storage
+	log         *zap.Logger
+
+	orphans      *prometheus.CounterVec
+	deleted      *prometheus.CounterVec
+	deletedBytes *prometheus.CounterVec
+	lastRun      prometheus.Gauge
+}
+
+// New creates the garbage collection job of the images in the storage. Metrics are registered
+// with the provided registerer.
+func New(
+	cfg Config,
+	log *zap.Logger,
+	db database.Database,
+	store storage.Storage,
+	reg prometheus.Registerer,
+	opts ...Option,
+) (*Collector, error) {
+	c := &Collector{
+		interval:    cfg.Interval,
+		gracePeriod: cfg.GracePeriod,
+		dryRun:      cfg.DryRun,
+		db:          db,
+		storage:     store,
+		log:         log,
+		orphans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "saferplace",
+			Subsystem: "gc",
+			Name:      "orphaned_images_total",
+			Help:      "Number of images found which are not attached to any incident, by storage.",
+		}, []string{"storage"}),
+		deleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "saferplace",
+			Subsystem: "gc",
+			Name:      "deleted_objects_total",
+			Help:      "Number of objects deleted from the storage, including the image variants.",
+		}, []string{"storage"}),
+		deletedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "saferplace",
+			Subsystem: "gc",
+			Name:      "deleted_bytes_total",
+			Help:      "Size of the objects deleted from the storage.",
+		}, []string{"storage"}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "saferplace",
+			Subsystem: "gc",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Time of the last successful collection.",
+		}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	for _, collector := range []prometheus.Collector{c.orphans, c.deleted, c.deletedBytes, c.lastRun} {
+		if err := reg.Register(collector); err != nil {
+			return nil, fmt.Errorf("unable to register gc metrics: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// Run the garbage collection until the context is cancelled.
+func (c *Collector) Run(ctx context.Context) error {
+	c.log.Info("collecting orphaned images",
+		zap.Duration("interval", c.interval),
+		zap.Duration("grace_period", c.gracePeriod),
+		zap.Bool("dry_run", c.dryRun),
+	)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.collect(ctx); err != nil {
+			c.log.Error("unable to collect orphaned images", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect the orphaned images from all storages. The originals share the references with the
+// images, so the lookups are shared between them. The resumable uploads and the quarantined
+// images are never attached, they are removed once they are older than the grace period.
+func (c *Collector) collect(ctx context.Context) error {
+	cache := make(map[string]bool)
+	attached := func(ctx context.Context, ref string) (bool, error) {
+		if isAttached, ok := cache[ref]; ok {
+			return isAttached, nil
+		}
+		isAttached, err := c.isAttached(ctx, ref)
+		if err != nil {
+			return false, err
+		}
+		cache[ref] = isAttached
+		return isAttached, nil
+	}
+
+	if err := c.sweep(ctx, "images", c.storage, attached); err != nil {
+		return err
+	}
+	if c.originals != nil {
+		if err := c.sweep(ctx, "originals", c.originals, attached); err != nil {
+			return err
+		}
+	}
+	if c.resumable != nil {
+		if err := c.sweep(ctx, "resumable", c.resumable, never); err != nil {
+			return err
+		}
+	}
+	if c.quarantine != nil {
+		if err := c.sweep(ctx, "quarantine", c.quarantine, never); err != nil {
+			return err
+		}
+	}
+
+	c.lastRun.SetToCurrentTime()
+	return nil
+}
+
+// sweep the storage, removing the images which were not attached to an incident within the
+// grace period.
+func (c *Collector) sweep(
+	ctx context.Context,
+	name string,
+	store storage.Storage,
+	attached func(context.Context, string) (bool, error),
+) error {
+	// The objects are grouped by their image, so an image is only removed once all of its
+	// objects are older than the grace period.
+	images := make(map[string][]*storage.Object)
+	if err := store.List(ctx, func(obj *storage.Object) error {
+		ref := imageReference(obj.Reference)
+		images[ref] = append(images[ref], obj)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to list %s: %w", name, err)
+	}
+
+	cutoff := time.Now().Add(-c.gracePeriod)
+	for ref, objects := range images {
+		if !olderThan(objects, cutoff) {
+			continue
+		}
+
+		isAttached, err := attached(ctx, ref)
+		if err != nil {
+			// The image is kept if we cannot tell whether it is used.
+			c.log.Error("unable to check image", zap.String("reference", ref), zap.Error(err))
+			continue
+		}
+		if isAttached {
+			continue
+		}
+
+		c.orphans.WithLabelValues(name).Inc()
+		if c.dryRun {
+			c.log.Info("found orphaned image",
+				zap.String("storage", name),
+				zap.String("reference", ref),
+				zap.Int("objects", len(objects)),
+			)
+			continue
+		}
+		c.delete(ctx, name, store, ref, objects)
+	}
+
+	return nil
+}
+
+// delete the objects of the orphaned image.
+func (c *Collector) delete(ctx context.Context, name string, store storage.Storage, ref string, objects []*storage.Object) {
+	c.log.Info("deleting orphaned image",
+		zap.String("storage", name),
+		zap.String("reference", ref),
+		zap.Int("objects", len(objects)),
+	)
+
+	for _, obj := range objects {
+		if err := store.Delete(ctx, obj.Reference); err != nil {
+			c.log.Error("unable to delete orphaned object",
+				zap.String("storage", name),
+				zap.String("reference", obj.Reference),
+				zap.Error(err),
+			)
+			continue
+		}
+		c.deleted.WithLabelValues(name).Inc()
+		c.deletedBytes.WithLabelValues(name).Add(float64(obj.Size))
+	}
+}
+
+// isAttached checks whether the image is attached to an incident. The image is attached as soon
+// as its report is accepted, before the report is taken from the queue and saved as an incident.
+// Images uploaded before the uploads were recorded are looked up in the incidents instead.
+func (c *Collector) isAttached(ctx context.Context, ref string) (bool, error) {
+	upload, err := c.db.Upload(ctx, ref)
+	if err == nil {
+		return upload.Incident != "", nil
+	}
+	if !errors.Is(err, database.ErrDoesNotExist) {
+		return false, err
+	}
+
+	_, err = c.db.IncidentByImage(ctx, ref)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, database.ErrDoesNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// never attached objects are removed once they are older than the grace period.
+func never(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+// imageReference returns the reference of the image the object belongs to. The variants of the
+// images and the parts of the resumable uploads have the reference of the image or upload,
+// followed by an underscore and a suffix.
+func imageReference(reference string) string {
+	rest, resumable := strings.CutPrefix(reference, storage.ResumablePrefix)
+	ref, _, _ := strings.Cut(rest, "_")
+	if resumable {
+		return storage.ResumablePrefix + ref
+	}
+	return ref
+}
+
+// olderThan checks whether all the objects were last modified before the cutoff.
+func olderThan(objects []*storage.Object, cutoff time.Time) bool {
+	for _, obj := range objects {
+		if obj.ModTime.After(cutoff) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 SaferPlace
+
+package imagegc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/storage"
+	"safer.place/internal/storage/filesystem"
+)
+
+type fakeDatabase struct {
+	database.Database
+	images map[string]bool
+	// uploads are the incidents the uploaded images are attached to.
+	uploads map[string]string
+	err     error
+}
+
+func (db *fakeDatabase) Upload(_ context.Context, reference string) (*database.Upload, error) {
+	if db.err != nil {
+		return nil, db.err
+	}
+	id, ok := db.uploads[reference]
+	if !ok {
+		return nil, database.ErrDoesNotExist
+	}
+	return &database.Upload{Reference: reference, Incident: id}, nil
+}
+
+func (db *fakeDatabase) IncidentByImage(_ context.Context, image string) (*incident.Incident, error) {
+	if db.err != nil {
+		return nil, db.err
+	}
+	if !db.images[image] {
+		return nil, database.ErrDoesNotExist
+	}
+	return &incident.Incident{ImageId: image}, nil
+}
+
+// fixture stores the objects in the filesystem storage, modified the given time ago.
+type fixture struct {
+	t     *testing.T
+	store *filesystem.Storage
+	dir   string
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+
+	dir := t.TempDir()
+	store, err := filesystem.New(&filesystem.Config{Dir: dir},
+		filesystem.Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fixture{t: t, store: store, dir: dir}
+}
+
+func (f *fixture) put(reference string, age time.Duration) {
+	f.t.Helper()
+
+	if err := f.store.Put(context.Background(), reference, strings.NewReader("image"), 5, "image/png"); err != nil {
+		f.t.Fatal(err)
+	}
+	// The images are sharded into subdirectories.
+	paths, err := filepath.Glob(filepath.Join(f.dir, "*", reference))
+	if err != nil || len(paths) != 1 {
+		f.t.Fatalf("unable to find %s: %v", reference, err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(paths[0], modTime, modTime); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fixture) exists(reference string) bool {
+	f.t.Helper()
+
+	_, err := f.store.Stat(context.Background(), reference)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		f.t.Fatal(err)
+	}
+	return err == nil
+}
+
+func newCollector(t *testing.T, cfg Config, db database.Database, store storage.Storage) *Collector {
+	t.Helper()
+
+	c, err := New(cfg, zap.NewNop(), db, store, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCollect(t *testing.T) {
+	f := newFixture(t)
+	old := 100 * time.Hour
+
+	attached, orphan, recent, uploading := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+	abandoned := storage.ResumablePrefix + uuid.NewString()
+	f.put(attached, old)
+	f.put(attached+"_thumbnail", old)
+	f.put(orphan, old)
+	f.put(orphan+"_thumbnail", old)
+	f.put(recent, time.Hour)
+	// The upload was continued recently, so its first part is kept.
+	f.put("tus_"+uploading, time.Hour)
+	f.put("tus_"+uploading+"_0", old)
+	f.put(abandoned, old)
+	f.put(abandoned+"_0", old)
+
+	db := &fakeDatabase{images: map[string]bool{attached: true}}
+	c := newCollector(t, Config{GracePeriod: 72 * time.Hour}, db, f.store)
+	if err := c.collect(context.Background()); err != nil {
+		t.Fatalf("collect() = %v", err)
+	}
+
+	for ref, want := range map[string]bool{
+		attached:                  true,
+		attached + "_thumbnail":   true,
+		orphan:                    false,
+		orphan + "_thumbnail":     false,
+		recent:                    true,
+		"tus_" + uploading:        true,
+		"tus_" + uploading + "_0": true,
+		abandoned:                 false,
+		abandoned + "_0":          false,
+	} {
+		if got := f.exists(ref); got != want {
+			t.Errorf("%s exists = %v, want %v", ref, got, want)
+		}
+	}
+
+	if got := testutil.ToFloat64(c.orphans.WithLabelValues("images")); got != 2 {
+		t.Errorf("orphans = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(c.deleted.WithLabelValues("images")); got != 4 {
+		t.Errorf("deleted = %v, want 4", got)
+	}
+	if got := testutil.ToFloat64(c.deletedBytes.WithLabelValues("images")); got != 20 {
+		t.Errorf("deleted bytes = %v, want 20", got)
+	}
+}
+
+func TestCollectDryRun(t *testing.T) {
+	f := newFixture(t)
+	orphan := uuid.NewString()
+	f.put(orphan, 100*time.Hour)
+
+	c := newCollector(t, Config{GracePeriod: 72 * time.Hour, DryRun: true}, &fakeDatabase{}, f.store)
+	if err := c.collect(context.Background()); err != nil {
+		t.Fatalf("collect() = %v", err)
+	}
+
+	if !f.exists(orphan) {
+		t.Error("orphan deleted in dry run")
+	}
+	if got := testutil.ToFloat64(c.orphans.WithLabelValues("images")); got != 1 {
+		t.Errorf("orphans = %v, want 1", got)
+	}
+}
+
+func TestCollectDatabaseError(t *testing.T) {
+	f := newFixture(t)
+	image := uuid.NewString()
+	f.put(image, 100*time.Hour)
+
+	db := &fakeDatabase{err: errors.New("database unavailable")}
+	c := newCollector(t, Config{GracePeriod: 72 * time.Hour}, db, f.store)
+	if err := c.collect(context.Background()); err != nil {
+		t.Fatalf("collect() = %v", err)
+	}
+
+	if !f.exists(image) {
+		t.Error("image deleted when the database failed")
+	}
+}
+
+func TestCollectOriginals(t *testing.T) {
+	images, originals := newFixture(t), newFixture(t)
+	attached, orphan := uuid.NewString(), uuid.NewString()
+	for _, f := range []*fixture{images, originals} {
+		f.put(attached, 100*time.Hour)
+		f.put(orphan, 100*time.Hour)
+	}
+
+	db := &fakeDatabase{images: map[string]bool{attached: true}}
+	c, err := New(Config{GracePeriod: 72 * time.Hour}, zap.NewNop(), db, images.store,
+		prometheus.NewRegistry(), Originals(originals.store),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.collect(context.Background()); err != nil {
+		t.Fatalf("collect() = %v", err)
+	}
+
+	if !originals.exists(attached) {
+		t.Error("attached original deleted")
+	}
+	if originals.exists(orphan) {
+		t.Error("orphaned original not deleted")
+	}
+}
+
+func TestCollectUploads(t *testing.T) {
+	f := newFixture(t)
+	queued, unused := uuid.NewString(), uuid.NewString()
+	f.put(queued, 100*time.Hour)
+	f.put(unused, 100*time.Hour)
+
+	// The report of the queued image was accepted, but it was not saved as an incident yet.
+	db := &fakeDatabase{uploads: map[string]string{queued: "incident", unused: ""}}
+	c := newCollector(t, Config{GracePeriod: 72 * time.Hour}, db, f.store)
+	if err := c.collect(context.Background()); err != nil {
+		t.Fatalf("collect() = %v", err)
+	}
+
+	if !f.exists(queued) {
+		t.Error("image of the queued report deleted")
+	}
+	if f.exists(unused) {
+		t.Error("unused upload not deleted")
+	}
+}
+
+func TestCollectQuarantine(t *testing.T) {
+	images, quarantine := newFixture(t), newFixture(t)
+	old, recent := uuid.NewString(), uuid.NewString()
+	quarantine.put(old, 100*time.Hour)
+	quarantine.put(old+storage.OriginalSuffix, 100*time.Hour)
+	quarantine.put(recent, time.Hour)
+
+	// The quarantined images are removed even if the database knows about them.
+	db := &fakeDatabase{images: map[string]bool{old: true}}
+	c, err := New(Config{GracePeriod: 72 * time.Hour}, zap.NewNop(), db, images.store,
+		prometheus.NewRegistry(), Quarantine(quarantine.store),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.collect(context.Background()); err != nil {
+		t.Fatalf("collect() = %v", err)
+	}
+
+	if quarantine.exists(old) || quarantine.exists(old+storage.OriginalSuffix) {
+		t.Error("expired quarantined image not deleted")
+	}
+	if !quarantine.exists(recent) {
+		t.Error("recent quarantined image deleted")
+	}
+}
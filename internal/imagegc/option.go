@@ -0,0 +1,27 @@
+package imagegc
+
+import "safer.place/internal/storage"
+
+// Option extends the functionality of the garbage collection job.
+type Option func(*Collector)
+
+// Originals also removes the originals of the orphaned images.
+func Originals(store storage.Storage) Option {
+	return func(c *Collector) {
+		c.originals = store
+	}
+}
+
+// Quarantine also removes the quarantined images once they are older than the grace period.
+func Quarantine(store storage.Storage) Option {
+	return func(c *Collector) {
+		c.quarantine = store
+	}
+}
+
+// Resumable also removes the abandoned resumable uploads.
+func Resumable(store storage.Storage) Option {
+	return func(c *Collector) {
+		c.resumable = store
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2023 SaferPlace
+
+// Package imaging detects, sanitizes and transforms the uploaded images. JPEG, PNG and WebP images
+// can be decoded, but there is no HEIC decoder, so HEIC images are handled at the container level,
+// without touching their pixels.
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// HeaderSize is the number of bytes from the start of the image needed to detect its format and
+// dimensions. The dimensions must be found within the header, without decoding the image. The
+// JPEG application segments do not count towards it, see ReadHeader.
+const HeaderSize = 64 << 10
+
+// ReadHeader reads the header of the image, returning it together with the reader of the whole
+// image. Read errors are returned by the image reader, so shorter images are detected using what
+// has been read.
+//
+// JPEG application segments, such as the EXIF, ICC profiles and thumbnails, can be larger than the
+// header, so they are skipped by their length until the frame header. Only the EXIF segment is
+// kept in the header, for the orientation.
+func ReadHeader(r io.Reader) (header []byte, image io.Reader) {
+	br := bufio.NewReaderSize(r, HeaderSize)
+	header, _ = br.Peek(HeaderSize)
+	if !matchJPEG(header) {
+		return header, br
+	}
+
+	var read bytes.Buffer
+	header = jpegHeader(io.TeeReader(br, &read))
+	rest, _ := br.Peek(HeaderSize)
+	header = append(header, rest...)
+	return header, io.MultiReader(&read, br)
+}
+
+// jpegHeader reads the start of image and the application segments, returning the start of image
+// and the EXIF segment.
+func jpegHeader(r io.Reader) []byte {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return header
+	}
+
+	exif := false
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xff {
+			return header
+		}
+		if marker[1] != jpegCOM && (marker[1] < jpegAPP0 || marker[1] > jpegAPP15) {
+			// The marker is already read, so it is put back in front of the rest of the image.
+			return append(header, marker[:2]...)
+		}
+		if _, err := io.ReadFull(r, marker[2:]); err != nil {
+			return header
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:]))
+		if length < 2 {
+			return header
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return header
+		}
+		if !exif && marker[1] == jpegAPP1 && bytes.HasPrefix(segment, []byte(exifHeader)) {
+			exif = true
+			header = append(append(header, marker[:]...), segment...)
+		}
+	}
+}
+
+// Content types of the supported formats.
+const (
+	JPEG = "image/jpeg"
+	PNG  = "image/png"
+	WebP = "image/webp"
+	HEIC = "image/heic"
+)
+
+// Format is a supported image format.
+type Format struct {
+	ContentType string
+	// match reports whether the header has the magic bytes of the format.
+	match func(header []byte) bool
+	// dimensions reads the pixel dimensions from the header.
+	dimensions func(header []byte) (width, height int, err error)
+}
+
+// Dimensions reads the pixel dimensions from the header, without decoding the image.
+func (f Format) Dimensions(header []byte) (width, height int, err error) {
+	return f.dimensions(header)
+}
+
+// formats which are supported.
+var formats = []Format{
+	{JPEG, matchJPEG, jpegDimensions},
+	{PNG, matchPNG, pngDimensions},
+	{WebP, matchWebP, webpDimensions},
+	{HEIC, matchHEIC, heicDimensions},
+}
+
+// Detect the format from the magic bytes, returning false if the format is not supported.
+func Detect(header []byte) (Format, bool) {
+	for _, f := range formats {
+		if f.match(header) {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// ErrMalformed is returned when the image could not be parsed.
+var ErrMalformed = errors.New("malformed image")
+
+func matchJPEG(b []byte) bool {
+	return bytes.HasPrefix(b, []byte{0xff, 0xd8, 0xff})
+}
+
+func jpegDimensions(b []byte) (int, int, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return 0, 0, ErrMalformed
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+func matchPNG(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n"))
+}
+
+func pngDimensions(b []byte) (int, int, error) {
+	cfg, err := png.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return 0, 0, ErrMalformed
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+func matchWebP(b []byte) bool {
+	return len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WEBP"
+}
+
+// webpDimensions reads the dimensions from the first chunk, which is either a simple lossy
+// (VP8), simple lossless (VP8L) or extended (VP8X) image.
+// https://developers.google.com/speed/webp/docs/riff_container
+func webpDimensions(b []byte) (int, int, error) {
+	if len(b) < 30 {
+		return 0, 0, ErrMalformed
+	}
+	data := b[20:]
+
+	switch string(b[12:16]) {
+	case "VP8 ":
+		// 3 bytes frame tag followed by the start code and 14 bit dimensions.
+		if !bytes.Equal(data[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, ErrMalformed
+		}
+		w := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff)
+		h := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff)
+		return w, h, nil
+	case "VP8L":
+		// Signature followed by 14 bits of width-1 and 14 bits of height-1.
+		if data[0] != 0x2f {
+			return 0, 0, ErrMalformed
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	case "VP8X":
+		// 4 bytes of flags followed by 24 bits of canvas width-1 and height-1.
+		w := int(data[4]) | int(data[5])<<8 | int(data[6])<<16
+		h := int(data[7]) | int(data[8])<<8 | int(data[9])<<16
+		return w + 1, h + 1, nil
+	default:
+		return 0, 0, ErrMalformed
+	}
+}
+
+// heicBrands are the ISO base media file brands of HEIC images.
+var heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx"}
+
+// matchHEIC checks the major and compatible brands of the ftyp box. Generic HEIF brands such as
+// mif1 are also used by other formats, like AVIF, so they are not enough on their own.
+func matchHEIC(b []byte) bool {
+	if len(b) < 16 || string(b[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(b[0:4]))
+	if size < 16 || size > len(b) {
+		return false
+	}
+	// Major brand, minor version and the compatible brands.
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue
+		}
+		for _, brand := range heicBrands {
+			if string(b[i:i+4]) == brand {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// heicDimensions finds the image spatial extents (ispe) properties in meta/iprp/ipco. The image
+// can contain multiple, such as for the thumbnail and the tiles, so the largest is used.
+func heicDimensions(b []byte) (int, int, error) {
+	meta, ok := findBox(b, "meta")
+	if !ok || len(meta) < 4 {
+		return 0, 0, ErrMalformed
+	}
+	// meta is a full box, starting with the version and flags.
+	iprp, ok := findBox(meta[4:], "iprp")
+	if !ok {
+		return 0, 0, ErrMalformed
+	}
+	ipco, ok := findBox(iprp, "ipco")
+	if !ok {
+		return 0, 0, ErrMalformed
+	}
+
+	var w, h int
+	for rest := ipco; ; {
+		ispe, next, ok := nextBox(rest, "ispe")
+		if !ok {
+			break
+		}
+		rest = next
+		if len(ispe) < 12 {
+			return 0, 0, ErrMalformed
+		}
+		iw := int(binary.BigEndian.Uint32(ispe[4:8]))
+		ih := int(binary.BigEndian.Uint32(ispe[8:12]))
+		if iw*ih > w*h {
+			w, h = iw, ih
+		}
+	}
+	if w == 0 || h == 0 {
+		return 0, 0, ErrMalformed
+	}
+	return w, h, nil
+}
+
+// findBox returns the contents of the first box of the type.
+func findBox(b []byte, typ string) ([]byte, bool) {
+	box, _, ok := nextBox(b, typ)
+	return box, ok
+}
+
+// nextBox returns the contents of the next box of the type, and the boxes after it. Boxes
+// extending past the header are not found.
+func nextBox(b []byte, typ string) (box, rest []byte, ok bool) {
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b[0:4]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			// The box extends to the end of the file.
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, nil, false
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)) {
+			return nil, nil, false
+		}
+		if string(b[4:8]) == typ {
+			return b[header:size], b[size:], true
+		}
+		b = b[size:]
+	}
+	return nil, nil, false
+}
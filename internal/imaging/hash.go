@@ -0,0 +1,39 @@
+// Copyright 2023 SaferPlace
+
+package imaging
+
+import (
+	"image"
+	"math/bits"
+)
+
+// DifferenceHash is the perceptual hash (dHash) of the image. Every bit compares the brightness
+// of neighbouring pixels of the image shrunk to 9x8, so the hash survives resizing, recompression
+// and small edits, and similar images have hashes with a small Distance.
+// https://www.hackerfactor.com/blog/index.php?/archives/529-Kind-of-Like-That.html
+func DifferenceHash(img image.Image) uint64 {
+	small := resize(img, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luma(small, x, y) < luma(small, x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// luma of the pixel, ignoring its transparency.
+func luma(img *image.NRGBA, x, y int) int {
+	p := img.Pix[img.PixOffset(x, y):]
+	return 299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])
+}
+
+// Distance between the hashes, as the number of different bits. Hashes of the same image are
+// usually within 10 of each other.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
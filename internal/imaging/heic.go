@@ -0,0 +1,201 @@
+// Copyright 2023 SaferPlace
+
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// heicMetadataMIME is the content type of the XMP metadata items.
+const heicMetadataMIME = "application/rdf+xml"
+
+// stripHEIC overwrites the EXIF and XMP metadata items with zeros, leaving the structure of the
+// file intact. The items are found in the item information (iinf) box and their data is located
+// using the item location (iloc) box.
+// https://www.iso.org/standard/83650.html
+func stripHEIC(b []byte) ([]byte, error) {
+	out := append([]byte(nil), b...)
+
+	meta, ok := findBox(out, "meta")
+	if !ok || len(meta) < 4 {
+		return nil, ErrMalformed
+	}
+	// meta is a full box, starting with the version and flags.
+	meta = meta[4:]
+
+	items, err := heicMetadataItems(meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return out, nil
+	}
+
+	idat, _ := findBox(meta, "idat")
+	iloc, ok := findBox(meta, "iloc")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	extents, err := heicExtents(iloc, items)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range extents {
+		data := out
+		if e.idat {
+			data = idat
+		}
+		if e.length == 0 {
+			// The extent continues to the end of the data.
+			e.length = uint64(len(data)) - e.offset
+		}
+		if e.offset > uint64(len(data)) || e.length > uint64(len(data))-e.offset {
+			return nil, ErrMalformed
+		}
+		clear(data[e.offset : e.offset+e.length])
+	}
+
+	return out, nil
+}
+
+// heicMetadataItems returns the IDs of the EXIF and XMP items.
+func heicMetadataItems(meta []byte) (map[uint32]bool, error) {
+	iinf, ok := findBox(meta, "iinf")
+	if !ok || len(iinf) < 6 {
+		return nil, ErrMalformed
+	}
+	// Full box, followed by the entry count which is larger from version 1.
+	rest := iinf[6:]
+	if iinf[0] != 0 {
+		if len(iinf) < 8 {
+			return nil, ErrMalformed
+		}
+		rest = iinf[8:]
+	}
+
+	items := map[uint32]bool{}
+	for {
+		infe, next, ok := nextBox(rest, "infe")
+		if !ok {
+			break
+		}
+		rest = next
+
+		// Versions before 2 do not have the item type, and are not used by HEIC.
+		if len(infe) < 4 || infe[0] < 2 {
+			continue
+		}
+		var id uint32
+		var fields []byte
+		switch {
+		case infe[0] == 2 && len(infe) >= 12:
+			id = uint32(binary.BigEndian.Uint16(infe[4:6]))
+			fields = infe[8:]
+		case infe[0] == 3 && len(infe) >= 14:
+			id = binary.BigEndian.Uint32(infe[4:8])
+			fields = infe[10:]
+		default:
+			return nil, ErrMalformed
+		}
+
+		switch string(fields[0:4]) {
+		case "Exif":
+			items[id] = true
+		case "mime":
+			// The item name and the content type are null terminated strings.
+			parts := bytes.SplitN(fields[4:], []byte{0}, 3)
+			if len(parts) >= 2 && string(parts[1]) == heicMetadataMIME {
+				items[id] = true
+			}
+		}
+	}
+	return items, nil
+}
+
+// heicExtent is the location of a part of the item data.
+type heicExtent struct {
+	// idat is set when the offset is within the idat box, instead of the file.
+	idat   bool
+	offset uint64
+	length uint64
+}
+
+// heicExtents returns the extents of the items from the iloc box.
+func heicExtents(iloc []byte, items map[uint32]bool) ([]heicExtent, error) {
+	r := &boxReader{b: iloc}
+	version := r.uint(1)
+	r.uint(3) // flags
+	sizes := r.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0xf)
+	sizes = r.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), int(sizes&0xf)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	count := r.uint(2)
+	if version == 2 {
+		count = r.uint(4)
+	}
+
+	var extents []heicExtent
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(r.uint(2))
+		} else {
+			id = uint32(r.uint(4))
+		}
+		var method uint64
+		if version > 0 {
+			method = r.uint(2) & 0xf
+		}
+		r.uint(2) // data reference index
+		base := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+
+		for j := uint64(0); j < extentCount && r.err == nil; j++ {
+			r.uint(indexSize)
+			offset := r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			if !items[id] {
+				continue
+			}
+			// Items constructed from other items only reference them, which are stripped
+			// themselves if they contain metadata.
+			if method > 1 {
+				continue
+			}
+			extents = append(extents, heicExtent{idat: method == 1, offset: base + offset, length: length})
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return extents, nil
+}
+
+// boxReader reads the big endian fields of a box, remembering if it ran out of data.
+type boxReader struct {
+	b   []byte
+	err error
+}
+
+// uint reads an unsigned integer of the size in bytes, which can be 0.
+func (r *boxReader) uint(size int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if size > 8 || size > len(r.b) {
+		r.err = ErrMalformed
+		return 0
+	}
+	var v uint64
+	for _, c := range r.b[:size] {
+		v = v<<8 | uint64(c)
+	}
+	r.b = r.b[size:]
+	return v
+}
@@ -0,0 +1,274 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// exif creates the little endian TIFF structure with the orientation and a GPS IFD pointer.
+func exif(o Orientation) []byte {
+	b := []byte("II\x2a\x00\x08\x00\x00\x00\x02\x00")
+	// Orientation, SHORT, count 1.
+	b = append(b, 0x12, 0x01, 0x03, 0x00, 0x01, 0, 0, 0, byte(o), 0, 0, 0)
+	// GPSInfo, LONG, count 1.
+	b = append(b, 0x25, 0x88, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0)
+	return append(b, 0, 0, 0, 0)
+}
+
+// jpegWithEXIF inserts the APP1 segment after the start of image marker.
+func jpegWithEXIF(t *testing.T, img image.Image, o Orientation) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	segment := append([]byte(exifHeader), exif(o)...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xff, jpegAPP1}, uint16(len(segment)+2))
+	return append(append(append([]byte{}, b.Bytes()[:2]...), append(app1, segment...)...), b.Bytes()[2:]...)
+}
+
+func sanitize(b []byte, contentType string) ([]byte, error) {
+	var out bytes.Buffer
+	_, err := Sanitize(&out, bytes.NewReader(b), contentType, DefaultQuality)
+	return out.Bytes(), err
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+	// A 4x2 image with the top left pixel set, which ends up in the top right once rotated.
+	img := image.NewGray(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	b := jpegWithEXIF(t, img, OrientationRotate90)
+
+	out, err := sanitize(b, JPEG)
+	if err != nil {
+		t.Fatalf("Sanitize() = %v", err)
+	}
+	if bytes.Contains(out, []byte(exifHeader)) {
+		t.Error("EXIF was not removed")
+	}
+
+	got, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds().Dx() != 16 || got.Bounds().Dy() != 32 {
+		t.Fatalf("bounds = %v, want rotated to 16x32", got.Bounds())
+	}
+	if y, _, _, _ := got.At(12, 4).RGBA(); y < 0x8000 {
+		t.Errorf("top right pixel is dark, orientation not applied")
+	}
+}
+
+func TestReadHeaderLargeSegments(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 32, 16))
+	b := jpegWithEXIF(t, img, OrientationRotate90)
+
+	// A large EXIF segment with a thumbnail and an ICC profile push the frame header past the
+	// header size.
+	var large []byte
+	for _, marker := range []byte{jpegAPP1, 0xe2} {
+		segment := make([]byte, 0xfff0)
+		app := binary.BigEndian.AppendUint16([]byte{0xff, marker}, uint16(len(segment)+2))
+		large = append(large, append(app, segment...)...)
+	}
+	b = append(append(append([]byte{}, b[:2]...), large...), b[2:]...)
+
+	header, r := ReadHeader(bytes.NewReader(b))
+	f, ok := Detect(header)
+	if !ok || f.ContentType != JPEG {
+		t.Fatalf("Detect() = %v, %v, want JPEG", f.ContentType, ok)
+	}
+	w, h, err := f.Dimensions(header)
+	if err != nil || w != 32 || h != 16 {
+		t.Errorf("Dimensions() = %d, %d, %v, want 32, 16", w, h, err)
+	}
+	if o := jpegOrientation(header); o != OrientationRotate90 {
+		t.Errorf("orientation = %v, want %v", o, OrientationRotate90)
+	}
+
+	// The whole image is still read.
+	var got bytes.Buffer
+	if _, err := got.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), b) {
+		t.Errorf("read %d bytes, want the %d bytes of the image", got.Len(), len(b))
+	}
+}
+
+func TestSanitizeWebP(t *testing.T) {
+	chunk := func(fourcc string, data []byte) []byte {
+		b := binary.LittleEndian.AppendUint32([]byte(fourcc), uint32(len(data)))
+		b = append(b, data...)
+		if len(data)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	// VP8X flags of the EXIF and XMP chunks, and a 1x1 canvas.
+	vp8x := chunk("VP8X", []byte{0x08 | 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	// A single red pixel, using single symbol prefix codes for each channel.
+	vp8l := chunk("VP8L", []byte{0x2f, 0, 0, 0, 0, 0x28, 0x40, 0xff, 0x0b, 0xd0, 0xff, 0})
+	xmp := []byte("<x:xmpmeta/>")
+	b := append([]byte("RIFF\x00\x00\x00\x00WEBP"), vp8x...)
+	b = append(b, vp8l...)
+	b = append(b, chunk("EXIF", exif(OrientationNormal))...)
+	b = append(b, chunk("XMP ", xmp)...)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(b)-8))
+
+	out, err := sanitize(b, WebP)
+	if err != nil {
+		t.Fatalf("Sanitize() = %v", err)
+	}
+	if SanitizedType(WebP) != PNG {
+		t.Fatalf("SanitizedType() = %q, want %q", SanitizedType(WebP), PNG)
+	}
+	if bytes.Contains(out, exif(OrientationNormal)) || bytes.Contains(out, xmp) {
+		t.Error("metadata was not removed")
+	}
+
+	got, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, a := got.At(0, 0).RGBA(); got.Bounds().Dx() != 1 || r != 0xffff || g != 0 || b != 0 || a != 0xffff {
+		t.Errorf("Sanitize() = %v image with %v pixel, want a single red pixel", got.Bounds(), got.At(0, 0))
+	}
+}
+
+func TestSanitizeHEIC(t *testing.T) {
+	box := func(typ string, contents ...[]byte) []byte {
+		b := bytes.Join(contents, nil)
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(b)+8)), append([]byte(typ), b...)...)
+	}
+	infe := func(id uint16, typ string, extra string) []byte {
+		b := binary.BigEndian.AppendUint16([]byte{2, 0, 0, 0}, id)
+		return box("infe", append(append(b, 0, 0), typ+"\x00"+extra...))
+	}
+
+	gps := append([]byte("\x00\x00\x00\x00"), exif(OrientationNormal)...)
+	pixels := []byte("hevc-encoded-pixels")
+	xmp := []byte("<x:xmpmeta/>")
+	mdat := bytes.Join([][]byte{pixels, gps, xmp}, nil)
+	// Only the EXIF and XMP items are stripped, the other metadata such as the vendor specific
+	// boxes cannot be told apart from the image data, so it is kept.
+	vendor := box("uuid", []byte("vendor-metadata"))
+
+	build := func(mdatOffset uint32) []byte {
+		// Version 1, 4 byte offsets and lengths, no base offset.
+		iloc := []byte{1, 0, 0, 0, 0x44, 0x00, 0, 3}
+		for i, item := range [][]byte{pixels, gps, xmp} {
+			offset := mdatOffset + uint32(len(bytes.Join([][]byte{pixels, gps, xmp}[:i], nil)))
+			iloc = append(iloc, 0, byte(i+1), 0, 0, 0, 0, 0, 1)
+			iloc = binary.BigEndian.AppendUint32(iloc, offset)
+			iloc = binary.BigEndian.AppendUint32(iloc, uint32(len(item)))
+		}
+		return bytes.Join([][]byte{
+			box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")),
+			box("meta", make([]byte, 4),
+				box("iinf", []byte{0, 0, 0, 0, 0, 3}, infe(1, "hvc1", ""), infe(2, "Exif", ""), infe(3, "mime", heicMetadataMIME+"\x00")),
+				box("iloc", iloc),
+			),
+			vendor,
+			box("mdat", mdat),
+		}, nil)
+	}
+	// The offsets depend on the size of the boxes before mdat, which do not depend on them.
+	b := build(0)
+	b = build(uint32(len(b) - len(mdat)))
+
+	out, err := sanitize(b, HEIC)
+	if err != nil {
+		t.Fatalf("Sanitize() = %v", err)
+	}
+	if len(out) != len(b) {
+		t.Fatalf("size changed from %d to %d", len(b), len(out))
+	}
+
+	if !bytes.Contains(out, vendor) {
+		t.Error("vendor metadata was changed")
+	}
+
+	got := out[len(out)-len(mdat):]
+	want := append(append(append([]byte{}, pixels...), make([]byte, len(gps))...), make([]byte, len(xmp))...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("mdat = %q, want %q", got, want)
+	}
+}
+
+func TestResize(t *testing.T) {
+	// Alternating black and white columns average to grey once halved.
+	img := image.NewGray(image.Rect(0, 0, 640, 200))
+	for x := 0; x < 640; x += 2 {
+		for y := 0; y < 200; y++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+
+	v := Variant{Name: "thumbnail", MaxSize: 320}
+	got, ok := v.Resize(img)
+	if !ok {
+		t.Fatal("Resize() did not resize")
+	}
+	if got.Bounds().Dx() != 320 || got.Bounds().Dy() != 100 {
+		t.Fatalf("bounds = %v, want 320x100", got.Bounds())
+	}
+	if c := color.GrayModel.Convert(got.At(10, 10)).(color.Gray); c.Y < 120 || c.Y > 135 {
+		t.Errorf("pixel = %d, want the average of black and white", c.Y)
+	}
+
+	if _, ok := v.Resize(image.NewGray(image.Rect(0, 0, 100, 320))); ok {
+		t.Error("Resize() resized an image which already fits")
+	}
+}
+
+func TestDifferenceHash(t *testing.T) {
+	// A diagonal gradient with a bright square, and the same image shrunk and recompressed.
+	gradient := func(size int, square bool) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, size, size))
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				v := uint8((x + y) * 200 / (2 * size))
+				if square && x > size/4 && x < size/2 && y > size/4 && y < size/2 {
+					v = 255
+				}
+				img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+			}
+		}
+		return img
+	}
+	original := DifferenceHash(gradient(400, true))
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, gradient(123, true), &jpeg.Options{Quality: 40}); err != nil {
+		t.Fatal(err)
+	}
+	recompressed, err := jpeg.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := Distance(original, DifferenceHash(recompressed)); d > 6 {
+		t.Errorf("distance to the recompressed image = %d, want at most 6", d)
+	}
+
+	// Mirroring the image flips the comparisons of the neighbouring pixels.
+	mirrored := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	src := gradient(400, true)
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 400; x++ {
+			mirrored.Set(399-x, y, src.At(x, y))
+		}
+	}
+	if d := Distance(original, DifferenceHash(mirrored)); d < 20 {
+		t.Errorf("distance to the mirrored image = %d, want at least 20", d)
+	}
+}
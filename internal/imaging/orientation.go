@@ -0,0 +1,172 @@
+// Copyright 2023 SaferPlace
+
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+// Orientation of the image as defined by the EXIF orientation tag, describing how the stored
+// pixels must be transformed to display the image upright.
+type Orientation int
+
+const (
+	OrientationNormal     Orientation = 1
+	OrientationFlipH      Orientation = 2
+	OrientationRotate180  Orientation = 3
+	OrientationFlipV      Orientation = 4
+	OrientationTranspose  Orientation = 5
+	OrientationRotate90   Orientation = 6
+	OrientationTransverse Orientation = 7
+	OrientationRotate270  Orientation = 8
+)
+
+const (
+	// exifHeader starts the EXIF in the JPEG APP1 segment.
+	exifHeader = "Exif\x00\x00"
+
+	jpegSOS   = 0xda
+	jpegAPP0  = 0xe0
+	jpegAPP1  = 0xe1
+	jpegAPP15 = 0xef
+	jpegCOM   = 0xfe
+
+	pngSignatureLength = 8
+
+	tiffMagic       = 42
+	tiffEntryLength = 12
+	orientationTag  = 0x0112
+	typeShort       = 3
+)
+
+// jpegOrientation reads the orientation from the EXIF in the APP1 segment.
+func jpegOrientation(b []byte) Orientation {
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			break
+		}
+		marker := b[i+1]
+		if marker == jpegSOS {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(b) {
+			break
+		}
+		if segment := b[i+4 : end]; marker == jpegAPP1 && bytes.HasPrefix(segment, []byte(exifHeader)) {
+			return tiffOrientation(segment[len(exifHeader):])
+		}
+		i = end
+	}
+	return OrientationNormal
+}
+
+// pngOrientation reads the orientation from the EXIF in the eXIf chunk.
+func pngOrientation(b []byte) Orientation {
+	for i := pngSignatureLength; i+8 <= len(b); {
+		length := int(binary.BigEndian.Uint32(b[i : i+4]))
+		typ := string(b[i+4 : i+8])
+		// Length, type, data and CRC.
+		end := i + 12 + length
+		if length < 0 || end > len(b) || typ == "IDAT" {
+			break
+		}
+		if typ == "eXIf" {
+			return tiffOrientation(b[i+8 : i+8+length])
+		}
+		i = end
+	}
+	return OrientationNormal
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of the EXIF TIFF structure.
+func tiffOrientation(b []byte) Orientation {
+	if len(b) < 8 {
+		return OrientationNormal
+	}
+
+	var order binary.ByteOrder
+	switch string(b[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return OrientationNormal
+	}
+	if order.Uint16(b[2:4]) != tiffMagic {
+		return OrientationNormal
+	}
+
+	ifd := int(order.Uint32(b[4:8]))
+	if ifd < 8 || ifd+2 > len(b) {
+		return OrientationNormal
+	}
+	entries := int(order.Uint16(b[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*tiffEntryLength
+		if entry+tiffEntryLength > len(b) {
+			break
+		}
+		if order.Uint16(b[entry:entry+2]) != orientationTag {
+			continue
+		}
+		if order.Uint16(b[entry+2:entry+4]) != typeShort {
+			break
+		}
+		o := Orientation(order.Uint16(b[entry+8 : entry+10]))
+		if o < OrientationNormal || o > OrientationRotate270 {
+			break
+		}
+		return o
+	}
+	return OrientationNormal
+}
+
+// Apply the orientation to the pixels, returning the upright image.
+func (o Orientation) Apply(img image.Image) image.Image {
+	if o <= OrientationNormal || o > OrientationRotate270 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= OrientationTranspose {
+		dw, dh = h, w
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case OrientationFlipH:
+				sx, sy = w-1-x, y
+			case OrientationRotate180:
+				sx, sy = w-1-x, h-1-y
+			case OrientationFlipV:
+				sx, sy = x, h-1-y
+			case OrientationTranspose:
+				sx, sy = y, x
+			case OrientationRotate90:
+				sx, sy = y, h-1-x
+			case OrientationTransverse:
+				sx, sy = w-1-y, h-1-x
+			case OrientationRotate270:
+				sx, sy = w-1-y, x
+			}
+			i, j := dst.PixOffset(x, y), src.PixOffset(sx, sy)
+			copy(dst.Pix[i:i+4], src.Pix[j:j+4])
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 SaferPlace
+
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+// DefaultQuality of the re-encoded JPEG images.
+const DefaultQuality = 90
+
+// ErrUnsupported is returned when the image format cannot be decoded.
+var ErrUnsupported = errors.New("unsupported image format")
+
+// Decode the JPEG, PNG or WebP image, applying its EXIF orientation to the pixels. The EXIF must
+// be within the header of the image. WebP ignores the EXIF orientation.
+func Decode(r io.Reader, contentType string) (image.Image, error) {
+	// The error is returned by the decoder if the image is shorter than the header.
+	header, br := ReadHeader(r)
+
+	var (
+		img image.Image
+		o   Orientation
+		err error
+	)
+	switch contentType {
+	case JPEG:
+		o = jpegOrientation(header)
+		img, err = jpeg.Decode(br)
+	case PNG:
+		o = pngOrientation(header)
+		img, err = png.Decode(br)
+	case WebP:
+		img, err = webp.Decode(br)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return o.Apply(img), nil
+}
+
+// Encode the image in the format, WebP and HEIC are not supported.
+func Encode(w io.Writer, img image.Image, contentType string, quality int) error {
+	var err error
+	switch contentType {
+	case JPEG:
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case PNG:
+		err = png.Encode(w, img)
+	default:
+		return ErrUnsupported
+	}
+	if err != nil {
+		return fmt.Errorf("unable to encode image: %w", err)
+	}
+	return nil
+}
+
+// SanitizedType returns the content type of the sanitized image. There is no WebP encoder, so
+// WebP images are re-encoded as PNG, which keeps them lossless.
+func SanitizedType(contentType string) string {
+	if contentType == WebP {
+		return PNG
+	}
+	return contentType
+}
+
+// Sanitize removes all the metadata from the image read from r, such as the EXIF GPS coordinates,
+// device serials and timestamps, and writes the result to w in the SanitizedType format. The
+// decoded image is returned, or nil if the format cannot be decoded.
+//
+// JPEG, PNG and WebP images are decoded and re-encoded while they are read, which drops everything
+// but the pixels, with the EXIF orientation applied to them.
+//
+// HEIC images cannot be decoded, so their EXIF and XMP items are overwritten with zeros instead,
+// leaving the pixels and the rest of the container as they are. This needs the whole image, as
+// the items can be anywhere in the file. Any other metadata is kept, such as vendor specific
+// items and boxes, and the embedded thumbnails and auxiliary images, like depth maps.
+//
+// The decoders stop at the end of the image, so r might not be read to the end.
+func Sanitize(w io.Writer, r io.Reader, contentType string, quality int) (image.Image, error) {
+	switch contentType {
+	case JPEG, PNG, WebP:
+		img, err := Decode(r, contentType)
+		if err != nil {
+			return nil, err
+		}
+		return img, Encode(w, img, SanitizedType(contentType), quality)
+	case HEIC:
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = stripHEIC(b); err != nil {
+			return nil, err
+		}
+		_, err = w.Write(b)
+		return nil, err
+	default:
+		return nil, ErrUnsupported
+	}
+}
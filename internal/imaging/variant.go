@@ -0,0 +1,86 @@
+// Copyright 2023 SaferPlace
+
+package imaging
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Variant is a smaller version of the uploaded image, stored under a reference derived from it.
+type Variant struct {
+	Name string
+	// MaxSize of the longest side of the image in pixels.
+	MaxSize int
+}
+
+// Variants generated for the uploaded images.
+var Variants = []Variant{
+	{Name: "thumbnail", MaxSize: 320},
+	{Name: "medium", MaxSize: 1280},
+}
+
+// LookupVariant returns the variant with the name.
+func LookupVariant(name string) (Variant, bool) {
+	for _, v := range Variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variant{}, false
+}
+
+// Reference of the variant of the image with the reference.
+func (v Variant) Reference(reference string) string {
+	return reference + "_" + v.Name
+}
+
+// Resize the image to fit within the variant, returning false if it already fits.
+func (v Variant) Resize(img image.Image) (image.Image, bool) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= v.MaxSize && h <= v.MaxSize {
+		return img, false
+	}
+
+	dw, dh := v.MaxSize, h*v.MaxSize/w
+	if h > w {
+		dw, dh = w*v.MaxSize/h, v.MaxSize
+	}
+	return resize(img, max(dw, 1), max(dh, 1)), true
+}
+
+// resize the image by averaging the source pixels covered by each destination pixel, which
+// avoids the aliasing of sampling when shrinking the image.
+func resize(img image.Image, dw, dh int) *image.NRGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	src := image.NewNRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[src.PixOffset(x0, sy):src.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[i+c])
+					}
+				}
+			}
+
+			n := (x1 - x0) * (y1 - y0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	return dst
+}
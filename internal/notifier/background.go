@@ -0,0 +1,42 @@
+package notifier
+
+import (
+	"context"
+	"sync"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+)
+
+// Background sends the notifications without making the caller wait for them to be delivered.
+// The notifications in progress are tracked, so they can be waited for on shutdown.
+type Background struct {
+	log *zap.Logger
+	wg  sync.WaitGroup
+}
+
+// NewBackground creates the background notifications, logging the failed notifications.
+func NewBackground(log *zap.Logger) *Background {
+	return &Background{log: log}
+}
+
+// Notify sends the notification about the incident in the background. The notification is
+// sent even if the context is cancelled, such as when the request which caused it is done.
+func (b *Background) Notify(ctx context.Context, n Notifier, inc *incident.Incident, what string) {
+	ctx = context.WithoutCancel(ctx)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		if err := n.Notify(ctx, inc); err != nil {
+			b.log.Error("unable to send "+what,
+				zap.String("id", inc.Id),
+				zap.Error(err),
+			)
+		}
+	}()
+}
+
+// Wait until the notifications in progress are sent.
+func (b *Background) Wait() {
+	b.wg.Wait()
+}
@@ -0,0 +1,335 @@
+// Package content renders the content of the notifications, so all notifiers link to the same
+// review UI and describe the incidents the same way.
+package content
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"api.safer.place/incident/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"safer.place/internal/notifier"
+)
+
+// Config of the notification content.
+type Config struct {
+	// ReviewURL is the base URL of the review UI, used to link to the incidents.
+	ReviewURL string `yaml:"review_url" default:"https://review.safer.place" split_words:"true"`
+	// Templates override the default templates of the events.
+	Templates map[notifier.Event]Template `yaml:"templates" ignored:"true"`
+}
+
+// Template of the notification for an event. Empty templates use the default.
+type Template struct {
+	Title string `yaml:"title"`
+	Body  string `yaml:"body"`
+}
+
+var defaultTemplates = map[notifier.Event]Template{
+	notifier.EventReview: {
+		Title: "New incident for review",
+		Body:  "{{ truncate 2000 .Incident.Description }}",
+	},
+	notifier.EventEscalation: {
+		Title: "[{{ upper .Urgency.String }}] Incident waiting for review",
+		Body: "Reported {{ since .Incident.Timestamp }} and still waiting for a review.\n\n" +
+			"{{ truncate 2000 .Incident.Description }}",
+	},
+	notifier.EventAlert: {
+		Title: "Incident reported near you",
+		Body:  "{{ truncate 200 .Incident.Description }}",
+	},
+	notifier.EventResolution: {
+		Title: "Your report was {{ outcome .Incident.Resolution }}",
+		Body: "Thank you for your report from {{ since .Incident.Timestamp }}, " +
+			"it was {{ outcome .Incident.Resolution }} by our reviewers." +
+			"{{ with .Comment }}\n\n{{ . }}{{ end }}",
+	},
+	notifier.EventDigest: {
+		Title: "{{ plural .Digest.Count \"new incident\" }} for review",
+		Body: "{{ range .Digest.Areas }}{{ len .Incidents }} near {{ .Name }} {{ mapURL .Center }}\n" +
+			"{{ range .Incidents }}- {{ truncate 100 .Description }} {{ incidentURL .Id }}\n{{ end }}\n" +
+			"{{ end }}",
+	},
+}
+
+// reporterEvents are sent to the reporters and the public, who cannot open the review UI.
+var reporterEvents = map[notifier.Event]bool{
+	notifier.EventAlert:      true,
+	notifier.EventResolution: true,
+}
+
+// PublicCommentPrefix marks the reviewer comments which are shared with the reporter. All
+// other comments are only visible to the reviewers.
+const PublicCommentPrefix = "public:"
+
+// Message is the rendered content of the notification.
+type Message struct {
+	Title string
+	Body  string
+	// URL to review the incident, empty for the events sent to the reporters and the public.
+	URL string
+}
+
+// Data is available to the templates.
+type Data struct {
+	Event    notifier.Event
+	Urgency  notifier.Urgency
+	Urgent   bool
+	Incident *incident.Incident
+	// URL to review the incident, empty for the events sent to the reporters and the public.
+	URL string
+	// Comment is the public message of the latest reviewer comment, see PublicComment.
+	Comment string
+	// Digest is only set for the digest event, which has no Incident.
+	Digest *notifier.Digest
+	// Now is the time the notification is rendered at.
+	Now time.Time
+}
+
+var errUnknownEvent = errors.New("unknown event")
+
+// Renderer renders the notifications.
+type Renderer struct {
+	reviewURL string
+	templates map[notifier.Event]*template.Template
+}
+
+// New creates the renderer. All templates are parsed and rendered with an example incident, so
+// a broken template fails on startup instead of when a notification is sent.
+func New(cfg *Config) (*Renderer, error) {
+	r := &Renderer{
+		reviewURL: strings.TrimRight(cfg.ReviewURL, "/"),
+		templates: make(map[notifier.Event]*template.Template, len(defaultTemplates)),
+	}
+
+	for event := range cfg.Templates {
+		if _, ok := defaultTemplates[event]; !ok {
+			return nil, fmt.Errorf("%w %q", errUnknownEvent, event)
+		}
+	}
+
+	for _, event := range notifier.Events {
+		tmpl := defaultTemplates[event]
+		if override, ok := cfg.Templates[event]; ok {
+			if override.Title != "" {
+				tmpl.Title = override.Title
+			}
+			if override.Body != "" {
+				tmpl.Body = override.Body
+			}
+		}
+
+		t, err := r.parse(event, tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %q template: %w", event, err)
+		}
+		r.templates[event] = t
+	}
+
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Renderer) parse(event notifier.Event, tmpl Template) (*template.Template, error) {
+	t := template.New(string(event)).
+		Funcs(funcs).
+		Funcs(template.FuncMap{"incidentURL": r.IncidentURL}).
+		Option("missingkey=error")
+	if _, err := t.New("title").Parse(tmpl.Title); err != nil {
+		return nil, fmt.Errorf("title: %w", err)
+	}
+	if _, err := t.New("body").Parse(tmpl.Body); err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+	return t, nil
+}
+
+// validate renders all templates with an example incident.
+func (r *Renderer) validate() error {
+	example := &incident.Incident{
+		Id:          "example",
+		Timestamp:   timestamppb.New(time.Now().Add(-time.Hour)),
+		Location:    incident.Location_LOCATION_OUTSIDE,
+		Coordinates: &incident.Coordinates{Lat: 53.3498, Lon: -6.2603},
+		Description: "example incident",
+	}
+	for _, event := range notifier.Events {
+		if event == notifier.EventDigest {
+			continue
+		}
+		ctx := notifier.WithEvent(context.Background(), event)
+		if _, err := r.Render(ctx, example); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.RenderDigest(context.Background(), &notifier.Digest{
+		Since: example.Timestamp.AsTime(),
+		Until: time.Now(),
+		Areas: []*notifier.DigestArea{{
+			Name:      "53.350, -6.260",
+			Center:    example.Coordinates,
+			Incidents: []*incident.Incident{example},
+		}},
+	})
+	return err
+}
+
+// Render the notification about the incident, using the event and urgency from the context.
+func (r *Renderer) Render(ctx context.Context, inc *incident.Incident) (*Message, error) {
+	event := notifier.EventFromContext(ctx)
+	if event == notifier.EventDigest {
+		return nil, fmt.Errorf("%w %q, use RenderDigest", errUnknownEvent, event)
+	}
+
+	urgency := notifier.UrgencyFromContext(ctx)
+	data := &Data{
+		Event:    event,
+		Urgency:  urgency,
+		Urgent:   urgency != notifier.UrgencyNormal,
+		Incident: inc,
+		Comment:  PublicComment(inc),
+		Now:      time.Now(),
+	}
+	if !reporterEvents[event] {
+		data.URL = r.IncidentURL(inc.Id)
+	}
+
+	return r.execute(data)
+}
+
+// RenderDigest renders the digest, linking to the review queue.
+func (r *Renderer) RenderDigest(ctx context.Context, d *notifier.Digest) (*Message, error) {
+	urgency := notifier.UrgencyFromContext(ctx)
+	return r.execute(&Data{
+		Event:   notifier.EventDigest,
+		Urgency: urgency,
+		Urgent:  urgency != notifier.UrgencyNormal,
+		URL:     r.reviewURL,
+		Digest:  d,
+		Now:     time.Now(),
+	})
+}
+
+func (r *Renderer) execute(data *Data) (*Message, error) {
+	t, ok := r.templates[data.Event]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownEvent, data.Event)
+	}
+
+	var title, body bytes.Buffer
+	if err := t.ExecuteTemplate(&title, "title", data); err != nil {
+		return nil, fmt.Errorf("unable to render %q title: %w", data.Event, err)
+	}
+	if err := t.ExecuteTemplate(&body, "body", data); err != nil {
+		return nil, fmt.Errorf("unable to render %q body: %w", data.Event, err)
+	}
+
+	return &Message{
+		Title: strings.TrimSpace(title.String()),
+		Body:  strings.TrimSpace(body.String()),
+		URL:   data.URL,
+	}, nil
+}
+
+// IncidentURL is the link to review the incident.
+func (r *Renderer) IncidentURL(id string) string {
+	return fmt.Sprintf("%s/incident/%s", r.reviewURL, url.PathEscape(id))
+}
+
+// PublicComment returns the message of the latest reviewer comment if it is marked with the
+// PublicCommentPrefix, without the prefix.
+func PublicComment(inc *incident.Incident) string {
+	if len(inc.ReviewerComments) == 0 {
+		return ""
+	}
+	latest := inc.ReviewerComments[len(inc.ReviewerComments)-1]
+	msg := strings.TrimSpace(latest.Message)
+	if len(msg) < len(PublicCommentPrefix) ||
+		!strings.EqualFold(msg[:len(PublicCommentPrefix)], PublicCommentPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(msg[len(PublicCommentPrefix):])
+}
+
+// MapURL links to the coordinates on OpenStreetMap.
+func MapURL(c *incident.Coordinates) string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=17/%.6f/%.6f",
+		c.Lat, c.Lon, c.Lat, c.Lon)
+}
+
+var funcs = template.FuncMap{
+	"mapURL":   MapURL,
+	"outcome":  outcome,
+	"plural":   plural,
+	"since":    since,
+	"truncate": truncate,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+}
+
+// outcome describes the resolution to the reporter.
+func outcome(r incident.Resolution) string {
+	switch r {
+	case incident.Resolution_RESOLUTION_REJECTED:
+		return "rejected"
+	case incident.Resolution_RESOLUTION_ACCEPTED:
+		return "accepted"
+	case incident.Resolution_RESOLUTION_ALERTED:
+		return "accepted and alerted to people nearby"
+	default:
+		return "returned for another review"
+	}
+}
+
+// since describes how long ago the timestamp was, such as "5 minutes ago".
+func since(ts *timestamppb.Timestamp) string {
+	if ts == nil {
+		return "some time ago"
+	}
+
+	d := time.Since(ts.AsTime())
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute") + " ago"
+	case d < 24*time.Hour:
+		return plural(int(d/time.Hour), "hour") + " ago"
+	default:
+		return plural(int(d/(24*time.Hour)), "day") + " ago"
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// truncate the text to at most n characters, marking truncated text with an ellipsis.
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 1 {
+		return "…"
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
@@ -0,0 +1,151 @@
+package content
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"safer.place/internal/notifier"
+)
+
+func TestRender(t *testing.T) {
+	r, err := New(&Config{
+		ReviewURL: "https://staging.safer.place/",
+		Templates: map[notifier.Event]Template{
+			notifier.EventReview: {Body: "{{ truncate 10 .Incident.Description }} {{ mapURL .Incident.Coordinates }}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inc := &incident.Incident{
+		Id:          "abc",
+		Timestamp:   timestamppb.New(time.Now().Add(-2 * time.Hour)),
+		Coordinates: &incident.Coordinates{Lat: 53.3498, Lon: -6.2603},
+		Description: "something happened on the bus",
+	}
+
+	msg, err := r.Render(context.Background(), inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://staging.safer.place/incident/abc"; msg.URL != want {
+		t.Errorf("url = %q, want %q", msg.URL, want)
+	}
+	if want := "New incident for review"; msg.Title != want {
+		t.Errorf("title = %q, want %q", msg.Title, want)
+	}
+	if want := "something… https://www.openstreetmap.org/?mlat=53.349800&mlon=-6.260300#map=17/53.349800/-6.260300"; msg.Body != want {
+		t.Errorf("body = %q, want %q", msg.Body, want)
+	}
+
+	ctx := notifier.WithEvent(
+		notifier.WithUrgency(context.Background(), notifier.UrgencyCritical),
+		notifier.EventEscalation,
+	)
+	msg, err = r.Render(ctx, inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[CRITICAL] Incident waiting for review"; msg.Title != want {
+		t.Errorf("title = %q, want %q", msg.Title, want)
+	}
+	if !strings.Contains(msg.Body, "Reported 2 hours ago") {
+		t.Errorf("body = %q, want relative time", msg.Body)
+	}
+}
+
+func TestRenderResolution(t *testing.T) {
+	r, err := New(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inc := &incident.Incident{
+		Id:         "abc",
+		Timestamp:  timestamppb.New(time.Now().Add(-2 * time.Hour)),
+		Resolution: incident.Resolution_RESOLUTION_REJECTED,
+		ReviewerComments: []*incident.Comment{
+			{Message: "public: this is not a safety issue"},
+		},
+	}
+
+	ctx := notifier.WithEvent(context.Background(), notifier.EventResolution)
+	msg, err := r.Render(ctx, inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Your report was rejected"; msg.Title != want {
+		t.Errorf("title = %q, want %q", msg.Title, want)
+	}
+	if !strings.HasSuffix(msg.Body, "\n\nthis is not a safety issue") {
+		t.Errorf("body = %q, want the public comment", msg.Body)
+	}
+	if msg.URL != "" {
+		t.Errorf("url = %q, reporters must not be linked to the review UI", msg.URL)
+	}
+
+	inc.ReviewerComments = append(inc.ReviewerComments, &incident.Comment{Message: "duplicate"})
+	msg, err = r.Render(ctx, inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg.Body, "safety") || strings.Contains(msg.Body, "duplicate") {
+		t.Errorf("body = %q, want no comment", msg.Body)
+	}
+}
+
+func TestRenderDigest(t *testing.T) {
+	r, err := New(&Config{ReviewURL: "https://review.safer.place"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := r.RenderDigest(context.Background(), &notifier.Digest{
+		Areas: []*notifier.DigestArea{{
+			Name:   "53.350, -6.260",
+			Center: &incident.Coordinates{Lat: 53.35, Lon: -6.26},
+			Incidents: []*incident.Incident{
+				{Id: "a", Description: "first"},
+				{Id: "b", Description: "second"},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2 new incidents for review"; msg.Title != want {
+		t.Errorf("title = %q, want %q", msg.Title, want)
+	}
+	for _, want := range []string{
+		"2 near 53.350, -6.260",
+		"- first https://review.safer.place/incident/a",
+		"- second https://review.safer.place/incident/b",
+	} {
+		if !strings.Contains(msg.Body, want) {
+			t.Errorf("body = %q, want %q", msg.Body, want)
+		}
+	}
+	if msg.URL != "https://review.safer.place" {
+		t.Errorf("url = %q, want the review queue", msg.URL)
+	}
+}
+
+func TestNewInvalidTemplates(t *testing.T) {
+	for name, templates := range map[string]map[notifier.Event]Template{
+		"syntax":        {notifier.EventReview: {Title: "{{ .Incident.Id"}},
+		"unknown field": {notifier.EventReview: {Body: "{{ .Nope }}"}},
+		"unknown func":  {notifier.EventEscalation: {Body: "{{ nope .Incident }}"}},
+		"unknown event": {"deleted": {Title: "deleted"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(&Config{Templates: templates}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package notifier
+
+import "context"
+
+type deliveryKey struct{}
+
+// WithDelivery names the notification of the incident, such as "review" or "escalation-2". The
+// notifiers sending it to multiple targets remember which targets it was delivered to, so when
+// it is sent again after a failure, only the failed targets get it.
+func WithDelivery(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, name)
+}
+
+// DeliveryFromContext returns the name of the notification, or an empty string if the
+// notification is delivered to all targets every time it is sent.
+func DeliveryFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(deliveryKey{}).(string)
+	return name
+}
@@ -0,0 +1,39 @@
+package notifier
+
+import (
+	"context"
+	"time"
+
+	"api.safer.place/incident/v1"
+)
+
+// Digest summarises the incidents collected over a period of time in a single notification.
+type Digest struct {
+	Since time.Time
+	Until time.Time
+	// Areas group the incidents by where they were reported, from the busiest area.
+	Areas []*DigestArea
+}
+
+// DigestArea is a group of nearby incidents.
+type DigestArea struct {
+	// Name describes where the area is.
+	Name string
+	// Center of the area.
+	Center    *incident.Coordinates
+	Incidents []*incident.Incident
+}
+
+// Count returns the number of incidents in the digest.
+func (d *Digest) Count() int {
+	var n int
+	for _, a := range d.Areas {
+		n += len(a.Incidents)
+	}
+	return n
+}
+
+// DigestNotifier is implemented by the notifiers able to send a digest as a single message.
+type DigestNotifier interface {
+	NotifyDigest(context.Context, *Digest) error
+}
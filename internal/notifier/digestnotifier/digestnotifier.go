@@ -0,0 +1,252 @@
+// Package digestnotifier collects the incidents waiting for review and sends them to another
+// notifier as a single digest, so busy channels are not flooded with one message per incident.
+package digestnotifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"safer.place/internal/geo"
+	"safer.place/internal/notifier"
+)
+
+// Config of the digest.
+type Config struct {
+	// Window is how long the incidents are collected for before the digest is sent. The digest
+	// is disabled when both the window and the maximum number of items are zero.
+	Window time.Duration `yaml:"window"`
+	// MaxItems sends the digest early once it contains this many incidents.
+	MaxItems int `yaml:"max_items" split_words:"true"`
+	// AreaZoom is the zoom level of the map tiles grouping the incidents into areas. Zoom 12
+	// tiles are roughly 10km wide.
+	AreaZoom int `yaml:"area_zoom" split_words:"true" default:"12"`
+	// Bypass is the urgency from which the notifications are sent immediately.
+	Bypass notifier.Urgency `yaml:"bypass" default:"high"`
+}
+
+const (
+	// minRetryDelay is the delay before the failed digest is sent again when there is no window.
+	minRetryDelay = time.Minute
+	// maxRetryDelay limits the delay between the attempts to send the failed digest.
+	maxRetryDelay = time.Hour
+)
+
+// Enabled returns true if the digest should be used.
+func (c *Config) Enabled() bool {
+	return c != nil && (c.Window > 0 || c.MaxItems > 0)
+}
+
+// Notifier collects the incidents into digests.
+type Notifier struct {
+	next     notifier.Notifier
+	log      *zap.Logger
+	window   time.Duration
+	maxItems int
+	zoom     int
+	bypass   notifier.Urgency
+	now      func() time.Time
+
+	mu      sync.Mutex
+	pending []*incident.Incident
+	since   time.Time
+	timer   *time.Timer
+	// batch identifies the digest being collected, so a late timer does not send the next one.
+	batch uint64
+	// failures counts the digests which failed to send in a row, to back off the retries.
+	failures int
+}
+
+// New wraps the notifier. Notifiers which are unable to send digests get all the collected
+// incidents one by one when the digest is sent.
+func New(cfg *Config, next notifier.Notifier, log *zap.Logger) (*Notifier, error) {
+	if !cfg.Enabled() {
+		return nil, errors.New("digest requires a window or the maximum number of items")
+	}
+	if cfg.AreaZoom < 0 || cfg.AreaZoom > geo.MaxTileZoom {
+		return nil, fmt.Errorf("area zoom must be between 0 and %d", geo.MaxTileZoom)
+	}
+
+	return &Notifier{
+		next:     next,
+		log:      log,
+		window:   cfg.Window,
+		maxItems: cfg.MaxItems,
+		zoom:     cfg.AreaZoom,
+		bypass:   cfg.Bypass,
+		now:      time.Now,
+	}, nil
+}
+
+// Notify adds the incident waiting for review to the digest. Urgent notifications and other
+// events are sent immediately.
+func (n *Notifier) Notify(ctx context.Context, inc *incident.Incident) error {
+	if notifier.EventFromContext(ctx) != notifier.EventReview ||
+		notifier.UrgencyFromContext(ctx) >= n.bypass {
+		return n.next.Notify(ctx, inc)
+	}
+
+	n.mu.Lock()
+	if len(n.pending) == 0 {
+		n.since = n.now()
+		n.batch++
+		if n.window > 0 {
+			batch := n.batch
+			n.timer = time.AfterFunc(n.window, func() { n.flushWindow(batch) })
+		}
+	}
+	n.pending = append(n.pending, inc)
+	full := n.maxItems > 0 && len(n.pending) >= n.maxItems
+	n.mu.Unlock()
+
+	if full {
+		return n.Flush(context.WithoutCancel(ctx))
+	}
+	return nil
+}
+
+// flushWindow sends the digest once the window has passed, unless it was already sent.
+func (n *Notifier) flushWindow(batch uint64) {
+	n.mu.Lock()
+	current := n.batch == batch
+	n.mu.Unlock()
+	if !current {
+		return
+	}
+
+	if err := n.Flush(context.Background()); err != nil {
+		n.log.Error("unable to send digest", zap.Error(err))
+	}
+}
+
+// Flush sends the collected incidents right away, if there are any. It should be called on
+// shutdown so the pending incidents are not lost. The incidents which could not be sent are put
+// back into the digest, and sent again with backoff.
+func (n *Notifier) Flush(ctx context.Context) error {
+	n.mu.Lock()
+	pending, since := n.pending, n.since
+	n.pending = nil
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	n.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ctx = notifier.WithEvent(ctx, notifier.EventDigest)
+	if d, ok := n.next.(notifier.DigestNotifier); ok {
+		if err := d.NotifyDigest(ctx, n.digest(pending, since)); err != nil {
+			n.restore(pending, since)
+			return err
+		}
+		n.sent()
+		return nil
+	}
+
+	ctx = notifier.WithEvent(ctx, notifier.EventReview)
+	for i, inc := range pending {
+		if err := n.next.Notify(ctx, inc); err != nil {
+			n.restore(pending[i:], since)
+			return err
+		}
+	}
+	n.sent()
+	return nil
+}
+
+// restore puts the incidents which could not be sent back in front of the incidents collected
+// since, and schedules the retry unless the next digest is already scheduled.
+func (n *Notifier) restore(incidents []*incident.Incident, since time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.pending) == 0 || since.Before(n.since) {
+		n.since = since
+	}
+	n.pending = append(append([]*incident.Incident(nil), incidents...), n.pending...)
+	n.failures++
+
+	if n.timer != nil {
+		return
+	}
+	n.batch++
+	batch := n.batch
+	n.timer = time.AfterFunc(n.retryDelay(), func() { n.flushWindow(batch) })
+}
+
+// retryDelay doubles the window, or the minimum delay, with every failure in a row.
+func (n *Notifier) retryDelay() time.Duration {
+	delay := n.window
+	if delay <= 0 {
+		delay = minRetryDelay
+	}
+	for i := 1; i < n.failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// sent resets the backoff once the digest is sent.
+func (n *Notifier) sent() {
+	n.mu.Lock()
+	n.failures = 0
+	n.mu.Unlock()
+}
+
+// digest groups the incidents into areas, from the busiest area. Incidents keep the order in
+// which they were reported.
+func (n *Notifier) digest(incidents []*incident.Incident, since time.Time) *notifier.Digest {
+	var (
+		areas  []*notifier.DigestArea
+		byTile = make(map[string]*notifier.DigestArea)
+	)
+	for _, inc := range incidents {
+		// Incidents without coordinates are grouped under the empty tile name.
+		var tile *geo.Tile
+		var name string
+		if inc.Coordinates != nil {
+			t := geo.TileAt(inc.Coordinates.Lat, inc.Coordinates.Lon, n.zoom)
+			tile, name = &t, t.String()
+		}
+
+		area, ok := byTile[name]
+		if !ok {
+			area = newArea(tile)
+			byTile[name] = area
+			areas = append(areas, area)
+		}
+		area.Incidents = append(area.Incidents, inc)
+	}
+
+	sort.SliceStable(areas, func(i, j int) bool {
+		return len(areas[i].Incidents) > len(areas[j].Incidents)
+	})
+
+	return &notifier.Digest{
+		Since: since,
+		Until: n.now(),
+		Areas: areas,
+	}
+}
+
+func newArea(tile *geo.Tile) *notifier.DigestArea {
+	if tile == nil {
+		return &notifier.DigestArea{Name: "unknown location"}
+	}
+	lat, lon := tile.Center()
+	return &notifier.DigestArea{
+		Name:   fmt.Sprintf("%.3f, %.3f", lat, lon),
+		Center: &incident.Coordinates{Lat: lat, Lon: lon},
+	}
+}
@@ -0,0 +1,177 @@
+package digestnotifier
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"safer.place/internal/notifier"
+)
+
+type fakeNotifier struct {
+	mu        sync.Mutex
+	incidents []string
+	digests   []*notifier.Digest
+	sent      chan struct{}
+	// fail makes the next notifications fail.
+	fail bool
+}
+
+func newFakeNotifier() *fakeNotifier {
+	return &fakeNotifier{sent: make(chan struct{}, 10)}
+}
+
+func (f *fakeNotifier) Notify(_ context.Context, inc *incident.Incident) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return errors.New("unavailable")
+	}
+	f.incidents = append(f.incidents, inc.Id)
+	return nil
+}
+
+// digestNotifier is also able to send digests.
+type digestNotifier struct {
+	*fakeNotifier
+}
+
+func (f digestNotifier) NotifyDigest(ctx context.Context, d *notifier.Digest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return errors.New("unavailable")
+	}
+	if e := notifier.EventFromContext(ctx); e != notifier.EventDigest {
+		return nil
+	}
+	f.digests = append(f.digests, d)
+	f.sent <- struct{}{}
+	return nil
+}
+
+var (
+	dublin = &incident.Coordinates{Lat: 53.3498, Lon: -6.2603}
+	cork   = &incident.Coordinates{Lat: 51.8985, Lon: -8.4756}
+)
+
+func TestMaxItems(t *testing.T) {
+	f := newFakeNotifier()
+	n, err := New(&Config{MaxItems: 3, AreaZoom: 12, Bypass: notifier.UrgencyHigh}, digestNotifier{f}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, inc := range []*incident.Incident{
+		{Id: "cork", Coordinates: cork},
+		{Id: "dublin-1", Coordinates: dublin},
+		{Id: "urgent", Coordinates: dublin},
+		{Id: "dublin-2", Coordinates: dublin},
+	} {
+		ctx := ctx
+		if inc.Id == "urgent" {
+			ctx = notifier.WithUrgency(ctx, notifier.UrgencyCritical)
+		}
+		if err := n.Notify(ctx, inc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(f.incidents) != 1 || f.incidents[0] != "urgent" {
+		t.Errorf("sent immediately = %v, want only the urgent incident", f.incidents)
+	}
+	if len(f.digests) != 1 {
+		t.Fatalf("digests = %d, want 1", len(f.digests))
+	}
+
+	d := f.digests[0]
+	if d.Count() != 3 || len(d.Areas) != 2 {
+		t.Fatalf("digest = %d incidents in %d areas", d.Count(), len(d.Areas))
+	}
+	if d.Areas[0].Incidents[0].Id != "dublin-1" || len(d.Areas[0].Incidents) != 2 {
+		t.Errorf("busiest area = %+v, want dublin", d.Areas[0])
+	}
+
+	if err := n.Flush(ctx); err != nil || len(f.digests) != 1 {
+		t.Errorf("Flush() = %v, sent an empty digest", err)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	f := newFakeNotifier()
+	n, err := New(&Config{Window: 10 * time.Millisecond, Bypass: notifier.UrgencyHigh}, digestNotifier{f}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.Notify(context.Background(), &incident.Incident{Id: "a", Coordinates: dublin}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-f.sent:
+	case <-time.After(time.Second):
+		t.Fatal("digest not sent after the window")
+	}
+}
+
+func TestUnsupportedNotifier(t *testing.T) {
+	f := newFakeNotifier()
+	n, err := New(&Config{MaxItems: 2, Bypass: notifier.UrgencyHigh}, f, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b"} {
+		if err := n.Notify(context.Background(), &incident.Incident{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.incidents) != 2 {
+		t.Errorf("incidents = %v, want both sent one by one", f.incidents)
+	}
+}
+
+func TestFlushFailure(t *testing.T) {
+	f := newFakeNotifier()
+	n, err := New(&Config{Window: time.Hour, Bypass: notifier.UrgencyHigh}, digestNotifier{f}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := n.Notify(ctx, &incident.Incident{Id: "a", Coordinates: dublin}); err != nil {
+		t.Fatal(err)
+	}
+	f.fail = true
+	if err := n.Flush(ctx); err == nil {
+		t.Fatal("Flush() = nil, want the error of the notifier")
+	}
+
+	// The failed incidents are sent together with the ones collected since.
+	f.fail = false
+	if err := n.Notify(ctx, &incident.Incident{Id: "b", Coordinates: cork}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.digests) != 1 {
+		t.Fatalf("digests = %d, want 1", len(f.digests))
+	}
+	var ids []string
+	for _, area := range f.digests[0].Areas {
+		for _, inc := range area.Incidents {
+			ids = append(ids, inc.Id)
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("digest incidents = %v, want both a and b", ids)
+	}
+}
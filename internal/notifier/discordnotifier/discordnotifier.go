@@ -4,91 +4,272 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/kelseyhightower/envconfig"
 
 	"api.safer.place/incident/v1"
+	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/content"
 )
 
+// Config used to parse the notifier configuration
+type Config struct {
+	// Endpoint is the discord webhook URL.
+	Endpoint string `yaml:"endpoint"`
+	// ImageURL is the base URL from which the incident images can be loaded. Thumbnails are not
+	// included if empty.
+	ImageURL string `yaml:"image_url" split_words:"true"`
+	// MaxRetries when discord responds that we are being rate limited.
+	MaxRetries int `yaml:"max_retries" default:"3" split_words:"true"`
+	// Interactive adds buttons to review the incident directly from discord. Requires the
+	// webhook to be owned by an application with the interactions endpoint configured.
+	Interactive bool `yaml:"interactive"`
+}
+
 // Notifier sends a notification to discord about an incident.
 type Notifier struct {
-	client   *http.Client
-	endpoint string
+	client      *http.Client
+	renderer    *content.Renderer
+	endpoint    string
+	imageURL    string
+	maxRetries  int
+	interactive bool
 }
 
+var errMissingEndpoint = errors.New("missing endpoint")
+
 // New creates a new discord notifier
-func New(c *http.Client) (*Notifier, error) {
-	var cfg Config
-	if err := envconfig.Process("discord", &cfg); err != nil {
-		return nil, fmt.Errorf("unable to process discord settings: %w", err)
+func New(cfg *Config, c *http.Client, r *content.Renderer) (*Notifier, error) {
+	if cfg.Endpoint == "" {
+		return nil, errMissingEndpoint
 	}
 
 	return &Notifier{
-		client:   c,
-		endpoint: cfg.Endpoint,
+		client:      c,
+		renderer:    r,
+		endpoint:    cfg.Endpoint,
+		imageURL:    strings.TrimRight(cfg.ImageURL, "/"),
+		maxRetries:  cfg.MaxRetries,
+		interactive: cfg.Interactive,
 	}, nil
 }
 
 // Notify sends the discord webhook notification
 func (n *Notifier) Notify(ctx context.Context, i *incident.Incident) error {
-	msg := fmt.Sprintf(messageFmt,
-		i.Id, i.Coordinates.Lat, i.Coordinates.Lon, i.Description, i.Id)
+	msg, err := n.renderer.Render(ctx, i)
+	if err != nil {
+		return err
+	}
+
+	return n.deliver(ctx, n.message(ctx, i, msg))
+}
+
+// NotifyDigest sends the digest as a single message linking to the review queue.
+func (n *Notifier) NotifyDigest(ctx context.Context, d *notifier.Digest) error {
+	msg, err := n.renderer.RenderDigest(ctx, d)
+	if err != nil {
+		return err
+	}
+
+	description := msg.Body
+	if runes := []rune(description); len(runes) > maxEmbedDescription {
+		description = string(runes[:maxEmbedDescription-1]) + "…"
+	}
 
-	data := discordgo.WebhookParams{
-		Content:    msg,
+	return n.deliver(ctx, &discordgo.WebhookParams{
+		Embeds: []*discordgo.MessageEmbed{{
+			Title:       msg.Title,
+			URL:         msg.URL,
+			Description: description,
+			Color:       urgencyColors[notifier.UrgencyFromContext(ctx)],
+			Timestamp:   d.Until.Format(time.RFC3339),
+		}},
 		Components: []discordgo.MessageComponent{
-			// discordgo.Button{
-			// 	Label: "Review Incident",
-			// 	// Style: discordgo.LinkButton,
-			// 	// TODO: Maybe this can be customized?
-			// 	URL: "https://review.safer.place/incident/" + i.Id,
-			// },
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label: "Review Incidents",
+					Style: discordgo.LinkButton,
+					URL:   msg.URL,
+				},
+			}},
 		},
-	}
+	})
+}
+
+// maxEmbedDescription is the maximum length of the embed description allowed by discord.
+const maxEmbedDescription = 4096
 
-	body := new(bytes.Buffer)
-	if err := json.NewEncoder(body).Encode(data); err != nil {
+// deliver the webhook message, retrying while discord is rate limiting us.
+func (n *Notifier) deliver(ctx context.Context, params *discordgo.WebhookParams) error {
+	body, err := json.Marshal(params)
+	if err != nil {
 		return fmt.Errorf("unable to encode webhook body: %w", err)
 	}
 
-	log.Println(body)
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := n.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if retryAfter == 0 || attempt >= n.maxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryAfter):
+		}
+	}
+}
 
-	req, err := http.NewRequest(http.MethodPost, n.endpoint, body)
+// send the webhook request. If discord is rate limiting the request, the duration after which
+// the request can be retried is returned with the error.
+func (n *Notifier) send(ctx context.Context, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.endpoint, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("unable to create request: %w", err)
+		return 0, fmt.Errorf("unable to create request: %w", err)
 	}
-	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := n.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("unable to send discord notification: %w", err)
+		return 0, fmt.Errorf("unable to send discord notification: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected response %q: %s", string(respBody), resp.Status)
+	respBody, _ := io.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return 0, nil
+	case http.StatusTooManyRequests:
+		return retryAfter(resp.Header, respBody), fmt.Errorf("rate limited: %s", string(respBody))
+	default:
+		return 0, fmt.Errorf("unexpected response %q: %s", string(respBody), resp.Status)
 	}
+}
 
-	return nil
+// retryAfter reads how long we have to wait before retrying from the rate limit response.
+// https://discord.com/developers/docs/topics/rate-limits
+func retryAfter(header http.Header, body []byte) time.Duration {
+	var limit struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if err := json.Unmarshal(body, &limit); err == nil && limit.RetryAfter > 0 {
+		return time.Duration(limit.RetryAfter * float64(time.Second))
+	}
+	if seconds, err := strconv.ParseFloat(header.Get("Retry-After"), 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	// Rate limited without telling us for how long, wait a bit anyway.
+	return time.Second
 }
 
-// Config used to parse the notifier confiuration
-type Config struct {
-	Endpoint string `required:"true"`
+var urgencyColors = map[notifier.Urgency]int{
+	notifier.UrgencyNormal:   0x5865f2,
+	notifier.UrgencyHigh:     0xf0b232,
+	notifier.UrgencyCritical: 0xed4245,
+}
+
+// message builds the webhook message with the incident embed and a link to review it.
+func (n *Notifier) message(
+	ctx context.Context, i *incident.Incident, msg *content.Message,
+) *discordgo.WebhookParams {
+	embed := &discordgo.MessageEmbed{
+		Title:       msg.Title,
+		URL:         msg.URL,
+		Description: msg.Body,
+		Color:       urgencyColors[notifier.UrgencyFromContext(ctx)],
+		Footer:      &discordgo.MessageEmbedFooter{Text: i.Id},
+	}
+	if i.Timestamp != nil {
+		embed.Timestamp = i.Timestamp.AsTime().Format(time.RFC3339)
+	}
+	if i.Coordinates != nil {
+		embed.Fields = append(embed.Fields,
+			&discordgo.MessageEmbedField{
+				Name:   "Coordinates",
+				Value:  fmt.Sprintf("%.6f, %.6f", i.Coordinates.Lat, i.Coordinates.Lon),
+				Inline: true,
+			},
+			&discordgo.MessageEmbedField{
+				Name:   "Map",
+				Value:  fmt.Sprintf("[OpenStreetMap](%s)", content.MapURL(i.Coordinates)),
+				Inline: true,
+			},
+		)
+	}
+	if i.ImageId != "" && n.imageURL != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{
+			URL: fmt.Sprintf("%s/%s", n.imageURL, url.PathEscape(i.ImageId)),
+		}
+	}
+
+	buttons := []discordgo.MessageComponent{
+		discordgo.Button{
+			Label: "Review Incident",
+			Style: discordgo.LinkButton,
+			URL:   msg.URL,
+		},
+	}
+	if n.interactive {
+		buttons = append(buttons,
+			discordgo.Button{
+				Label:    "Accept",
+				Style:    discordgo.SuccessButton,
+				CustomID: ReviewButtonID(i.Id, incident.Resolution_RESOLUTION_ACCEPTED),
+			},
+			discordgo.Button{
+				Label:    "Reject",
+				Style:    discordgo.SecondaryButton,
+				CustomID: ReviewButtonID(i.Id, incident.Resolution_RESOLUTION_REJECTED),
+			},
+			discordgo.Button{
+				Label:    "Alert",
+				Style:    discordgo.DangerButton,
+				CustomID: ReviewButtonID(i.Id, incident.Resolution_RESOLUTION_ALERTED),
+			},
+		)
+	}
+
+	return &discordgo.WebhookParams{
+		Embeds: []*discordgo.MessageEmbed{embed},
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: buttons},
+		},
+	}
+}
+
+const reviewButtonPrefix = "review"
+
+var errInvalidButtonID = errors.New("invalid review button id")
+
+// ReviewButtonID is the custom ID of the button which reviews the incident with the resolution.
+func ReviewButtonID(id string, res incident.Resolution) string {
+	return fmt.Sprintf("%s:%s:%s", reviewButtonPrefix, res, id)
 }
 
-var messageFmt = `
-New Incident for review: %s
-Lat: %.6f
-Lon: %.6f
-Description: %s
+// ParseReviewButtonID returns the incident ID and the resolution from the review button ID.
+func ParseReviewButtonID(customID string) (string, incident.Resolution, error) {
+	parts := strings.SplitN(customID, ":", 3)
+	if len(parts) != 3 || parts[0] != reviewButtonPrefix || parts[2] == "" {
+		return "", incident.Resolution_RESOLUTION_UNSPECIFIED, errInvalidButtonID
+	}
+
+	res, ok := incident.Resolution_value[parts[1]]
+	if !ok || res == int32(incident.Resolution_RESOLUTION_UNSPECIFIED) {
+		return "", incident.Resolution_RESOLUTION_UNSPECIFIED, errInvalidButtonID
+	}
 
-REVIEW: https://review.safer.place/incident/%s
-`
+	return parts[2], incident.Resolution(res), nil
+}
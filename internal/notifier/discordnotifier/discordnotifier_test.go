@@ -0,0 +1,102 @@
+package discordnotifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"api.safer.place/incident/v1"
+	"safer.place/internal/notifier/content"
+)
+
+func newRenderer(t *testing.T) *content.Renderer {
+	t.Helper()
+
+	r, err := content.New(&content.Config{ReviewURL: "https://review.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNotify(t *testing.T) {
+	var requests int
+	var got struct {
+		Embeds []struct {
+			URL         string `json:"url"`
+			Description string `json:"description"`
+			Thumbnail   struct {
+				URL string `json:"url"`
+			} `json:"thumbnail"`
+		} `json:"embeds"`
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message": "You are being rate limited.", "retry_after": 0.01, "global": false}`))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	n, err := New(&Config{
+		Endpoint:   srv.URL,
+		ImageURL:   "https://images.example.com",
+		MaxRetries: 1,
+	}, srv.Client(), newRenderer(t))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	inc := &incident.Incident{
+		Id:          "abc",
+		Description: "something happened",
+		Coordinates: &incident.Coordinates{Lat: 53.3498, Lon: -6.2603},
+		ImageId:     "image",
+	}
+	if err := n.Notify(context.Background(), inc); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+	if len(got.Embeds) != 1 {
+		t.Fatalf("embeds = %d, want 1", len(got.Embeds))
+	}
+	embed := got.Embeds[0]
+	if want := "https://review.example.com/incident/abc"; embed.URL != want {
+		t.Errorf("embed url = %q, want %q", embed.URL, want)
+	}
+	if embed.Description != inc.Description {
+		t.Errorf("embed description = %q, want %q", embed.Description, inc.Description)
+	}
+	if want := "https://images.example.com/image"; embed.Thumbnail.URL != want {
+		t.Errorf("embed thumbnail = %q, want %q", embed.Thumbnail.URL, want)
+	}
+}
+
+func TestNotifyRateLimitExhausted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0.01")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	n, err := New(&Config{Endpoint: srv.URL, MaxRetries: 2}, srv.Client(), newRenderer(t))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	if err := n.Notify(context.Background(), &incident.Incident{Id: "abc"}); err == nil {
+		t.Errorf("Notify() = nil, want error")
+	}
+}
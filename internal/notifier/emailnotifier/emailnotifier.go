@@ -0,0 +1,320 @@
+// Package emailnotifier sends email notifications about incidents through an SMTP relay.
+package emailnotifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"text/template"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"github.com/google/uuid"
+	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/content"
+)
+
+// Config of the email notifier.
+type Config struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port" default:"587"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// StartTLS requires the relay to support STARTTLS before authenticating and sending.
+	StartTLS bool          `yaml:"starttls" default:"true"`
+	Timeout  time.Duration `yaml:"timeout" default:"30s"`
+
+	From string `yaml:"from"`
+	// Recipients receive their own copy of every notification.
+	Recipients []string `yaml:"recipients"`
+
+	// TextTemplate and HTMLTemplate are paths to the template files laying out the body. The
+	// built in templates are used when empty. The subject is the title of the notification.
+	TextTemplate string `yaml:"text_template" split_words:"true"`
+	HTMLTemplate string `yaml:"html_template" split_words:"true"`
+}
+
+//go:embed templates/*.tmpl
+var templates embed.FS
+
+var (
+	errMissingHost       = errors.New("missing host")
+	errMissingFrom       = errors.New("missing from address")
+	errMissingRecipients = errors.New("missing recipients")
+	errStartTLS          = errors.New("relay does not support STARTTLS")
+)
+
+// Notifier sends the emails.
+type Notifier struct {
+	addr       string
+	host       string
+	auth       smtp.Auth
+	startTLS   bool
+	timeout    time.Duration
+	from       string
+	recipients []string
+	renderer   *content.Renderer
+
+	text *template.Template
+	html *htmltemplate.Template
+}
+
+// New creates the email notifier, parsing all the templates.
+func New(cfg *Config, r *content.Renderer) (*Notifier, error) {
+	if len(cfg.Recipients) == 0 {
+		return nil, errMissingRecipients
+	}
+	return NewSender(cfg, r)
+}
+
+// NewSender creates the email notifier without any configured recipients, which only sends the
+// emails to the recipients passed to NotifyTo.
+func NewSender(cfg *Config, r *content.Renderer) (*Notifier, error) {
+	if cfg.Host == "" {
+		return nil, errMissingHost
+	}
+	if cfg.From == "" {
+		return nil, errMissingFrom
+	}
+
+	n := &Notifier{
+		addr:       net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		host:       cfg.Host,
+		startTLS:   cfg.StartTLS,
+		timeout:    cfg.Timeout,
+		from:       cfg.From,
+		recipients: cfg.Recipients,
+		renderer:   r,
+	}
+	if cfg.Username != "" {
+		n.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	var err error
+	if cfg.TextTemplate != "" {
+		n.text, err = template.ParseFiles(cfg.TextTemplate)
+	} else {
+		n.text, err = template.ParseFS(templates, "templates/incident.txt.tmpl")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse text template: %w", err)
+	}
+
+	if cfg.HTMLTemplate != "" {
+		n.html, err = htmltemplate.ParseFiles(cfg.HTMLTemplate)
+	} else {
+		n.html, err = htmltemplate.ParseFS(templates, "templates/incident.html.tmpl")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse html template: %w", err)
+	}
+
+	return n, nil
+}
+
+// templateData is available to all templates.
+type templateData struct {
+	*content.Message
+	// Incident is nil for digests.
+	Incident *incident.Incident
+	Urgency  notifier.Urgency
+	Urgent   bool
+}
+
+// Notify sends the email to all configured recipients.
+func (n *Notifier) Notify(ctx context.Context, inc *incident.Incident) error {
+	return n.NotifyTo(ctx, inc, n.recipients...)
+}
+
+// NotifyTo sends the email to the recipients. Every recipient gets their own email, and a failure
+// to deliver to one of them does not stop delivery to the others.
+func (n *Notifier) NotifyTo(ctx context.Context, inc *incident.Incident, recipients ...string) error {
+	if len(recipients) == 0 {
+		return errMissingRecipients
+	}
+
+	msg, err := n.renderer.Render(ctx, inc)
+	if err != nil {
+		return err
+	}
+
+	return n.deliver(ctx, msg, inc, recipients)
+}
+
+// NotifyDigest sends the digest to all configured recipients. The templates are rendered without
+// an incident.
+func (n *Notifier) NotifyDigest(ctx context.Context, d *notifier.Digest) error {
+	msg, err := n.renderer.RenderDigest(ctx, d)
+	if err != nil {
+		return err
+	}
+
+	return n.deliver(ctx, msg, nil, n.recipients)
+}
+
+// deliver the rendered notification to the recipients over a single connection.
+func (n *Notifier) deliver(
+	ctx context.Context, msg *content.Message, inc *incident.Incident, recipients []string,
+) error {
+	urgency := notifier.UrgencyFromContext(ctx)
+	text, html, err := n.render(templateData{
+		Message:  msg,
+		Incident: inc,
+		Urgency:  urgency,
+		Urgent:   urgency != notifier.UrgencyNormal,
+	})
+	if err != nil {
+		return err
+	}
+
+	c, err := n.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var errs []error
+	for _, to := range recipients {
+		email, err := n.message(to, msg.Title, text, html)
+		if err != nil {
+			return err
+		}
+		if err := n.send(c, to, email); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", to, err))
+			// Reset the transaction so the next recipient can be sent to.
+			if err := c.Reset(); err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+		}
+	}
+
+	if err := c.Quit(); err != nil {
+		errs = append(errs, fmt.Errorf("unable to close connection: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) render(data templateData) (text, html []byte, err error) {
+	var textBuf, htmlBuf bytes.Buffer
+	if err := n.text.Execute(&textBuf, data); err != nil {
+		return nil, nil, fmt.Errorf("unable to render text body: %w", err)
+	}
+	if err := n.html.Execute(&htmlBuf, data); err != nil {
+		return nil, nil, fmt.Errorf("unable to render html body: %w", err)
+	}
+	return textBuf.Bytes(), htmlBuf.Bytes(), nil
+}
+
+// dial the relay, upgrading the connection with STARTTLS and authenticating.
+func (n *Notifier) dial(ctx context.Context) (*smtp.Client, error) {
+	d := net.Dialer{Timeout: n.timeout}
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to relay: %w", err)
+	}
+	if n.timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(n.timeout)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to set deadline: %w", err)
+		}
+	}
+
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to create smtp client: %w", err)
+	}
+
+	if n.startTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, errStartTLS
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("unable to start tls: %w", err)
+		}
+	}
+
+	if n.auth != nil {
+		if err := c.Auth(n.auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("unable to authenticate: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (n *Notifier) send(c *smtp.Client, to string, msg []byte) error {
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// message builds the multipart/alternative email with the text and html bodies.
+func (n *Notifier) message(to, subject string, text, html []byte) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create part: %w", err)
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, fmt.Errorf("unable to write part: %w", err)
+		}
+		if err := qp.Close(); err != nil {
+			return nil, fmt.Errorf("unable to write part: %w", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("unable to close message: %w", err)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", uuid.New().String(), n.host)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
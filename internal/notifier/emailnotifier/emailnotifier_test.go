@@ -0,0 +1,231 @@
+package emailnotifier
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"api.safer.place/incident/v1"
+	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/content"
+)
+
+// smtpServer is a minimal in-process SMTP server recording the received messages.
+type smtpServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	messages map[string]string
+	// reject recipients with a permanent error.
+	reject map[string]bool
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &smtpServer{l: l, messages: map[string]string{}, reject: map[string]bool{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+
+	var rcpt string
+	_ = c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			_ = c.PrintfLine("250-localhost")
+			_ = c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			_ = c.PrintfLine("235 authenticated")
+		case "MAIL":
+			_ = c.PrintfLine("250 ok")
+		case "RCPT":
+			rcpt = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if s.reject[rcpt] {
+				_ = c.PrintfLine("550 no such user")
+				continue
+			}
+			_ = c.PrintfLine("250 ok")
+		case "DATA":
+			_ = c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages[rcpt] = string(data)
+			s.mu.Unlock()
+			_ = c.PrintfLine("250 ok")
+		case "RSET":
+			_ = c.PrintfLine("250 ok")
+		case "QUIT":
+			_ = c.PrintfLine("221 bye")
+			return
+		default:
+			_ = c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func newRenderer(t *testing.T) *content.Renderer {
+	t.Helper()
+
+	r, err := content.New(&content.Config{ReviewURL: "https://review.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNotify(t *testing.T) {
+	s := newSMTPServer(t)
+	s.reject["unknown@safer.place"] = true
+
+	n, err := New(&Config{
+		Host:       "127.0.0.1",
+		Port:       s.port(),
+		Username:   "user",
+		Password:   "pass",
+		From:       "noreply@safer.place",
+		Recipients: []string{"a@safer.place", "unknown@safer.place", "b@safer.place"},
+	}, newRenderer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := notifier.WithEvent(
+		notifier.WithUrgency(context.Background(), notifier.UrgencyHigh),
+		notifier.EventEscalation,
+	)
+	err = n.Notify(ctx, &incident.Incident{
+		Id:          "incident-id",
+		Description: "something <happened>",
+		Coordinates: &incident.Coordinates{Lat: 53.35, Lon: -6.26},
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown@safer.place") {
+		t.Errorf("error = %v, want error for the rejected recipient", err)
+	}
+
+	for _, to := range []string{"a@safer.place", "b@safer.place"} {
+		raw, ok := s.messages[to]
+		if !ok {
+			t.Errorf("no message delivered to %s", to)
+			continue
+		}
+
+		msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			t.Fatalf("unable to read message: %v", err)
+		}
+		if want := "[HIGH] Incident waiting for review"; msg.Header.Get("Subject") != want {
+			t.Errorf("subject = %q, want %q", msg.Header.Get("Subject"), want)
+		}
+		if got := msg.Header.Get("To"); got != to {
+			t.Errorf("to = %q, want %q", got, to)
+		}
+
+		_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := map[string]string{}
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(p)
+			mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			parts[mediaType] = string(body)
+		}
+
+		for _, want := range []string{
+			"something <happened>",
+			"53.350000, -6.260000",
+			"https://review.example.com/incident/incident-id",
+		} {
+			if !strings.Contains(parts["text/plain"], want) {
+				t.Errorf("text body = %q, want to contain %q", parts["text/plain"], want)
+			}
+		}
+		if !strings.Contains(parts["text/html"], "something &lt;happened&gt;") {
+			t.Errorf("html body = %q, want escaped description", parts["text/html"])
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for name, cfg := range map[string]*Config{
+		"missing host":       {From: "a@safer.place", Recipients: []string{"b@safer.place"}},
+		"missing recipients": {Host: "localhost", From: "a@safer.place"},
+		"missing template": {
+			Host: "localhost", From: "a@safer.place", Recipients: []string{"b@safer.place"},
+			TextTemplate: "does-not-exist.tmpl",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(cfg, newRenderer(t)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRequireStartTLS(t *testing.T) {
+	s := newSMTPServer(t)
+
+	n, err := New(&Config{
+		Host:       "127.0.0.1",
+		Port:       s.port(),
+		StartTLS:   true,
+		From:       "noreply@safer.place",
+		Recipients: []string{"a@safer.place"},
+	}, newRenderer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.Notify(context.Background(), &incident.Incident{Id: "id"}); err != errStartTLS {
+		t.Errorf("error = %v, want %v", err, errStartTLS)
+	}
+}
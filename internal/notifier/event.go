@@ -0,0 +1,37 @@
+package notifier
+
+import "context"
+
+// Event is the reason for sending the notification.
+type Event string
+
+const (
+	// EventReview is sent when a new incident is waiting for a review.
+	EventReview Event = "review"
+	// EventEscalation is sent when an incident is waiting for a review for too long.
+	EventEscalation Event = "escalation"
+	// EventAlert is sent to the public when an incident is alerting.
+	EventAlert Event = "alert"
+	// EventResolution is sent to the reporter when the resolution of their incident changes.
+	EventResolution Event = "resolution"
+	// EventDigest summarises the incidents waiting for review, collected over a period of time.
+	EventDigest Event = "digest"
+)
+
+// Events lists all the events a notification can be sent for.
+var Events = []Event{EventReview, EventEscalation, EventAlert, EventResolution, EventDigest}
+
+type eventKey struct{}
+
+// WithEvent attaches the event to the notification context.
+func WithEvent(ctx context.Context, e Event) context.Context {
+	return context.WithValue(ctx, eventKey{}, e)
+}
+
+// EventFromContext returns the event of the notification, defaulting to a review.
+func EventFromContext(ctx context.Context) Event {
+	if e, ok := ctx.Value(eventKey{}).(Event); ok {
+		return e
+	}
+	return EventReview
+}
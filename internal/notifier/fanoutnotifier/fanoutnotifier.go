@@ -0,0 +1,316 @@
+// Package fanoutnotifier sends notifications to multiple notifiers in parallel, routing each
+// incident only to the targets interested in it.
+package fanoutnotifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"safer.place/internal/notifier"
+)
+
+// Route decides which incidents are sent to a target. Empty conditions match all incidents, and
+// an incident has to match all non empty conditions to be sent.
+type Route struct {
+	// Regions in which the incident has to be.
+	Regions []Region `yaml:"regions" ignored:"true"`
+	// Resolutions of the incident, such as "unspecified" or "alerted".
+	Resolutions []string `yaml:"resolutions"`
+	// Locations of the incident, such as "transportation".
+	Locations []string `yaml:"locations"`
+	// Windows of the day during which the notifications are sent, such as "22:00-06:00".
+	Windows []string `yaml:"windows"`
+	// Timezone of the windows.
+	Timezone string `yaml:"timezone" default:"UTC"`
+}
+
+// Region is a bounding box of coordinates.
+type Region struct {
+	MinLat float64 `yaml:"min_lat"`
+	MinLon float64 `yaml:"min_lon"`
+	MaxLat float64 `yaml:"max_lat"`
+	MaxLon float64 `yaml:"max_lon"`
+}
+
+// Target is a notifier with its route.
+type Target struct {
+	Name     string
+	Notifier notifier.Notifier
+	Route    Route
+}
+
+// Error is returned when the notification could not be delivered to some of the targets. The
+// other targets were notified successfully.
+type Error struct {
+	// Targets maps the failed target names to their errors.
+	Targets map[string]error
+}
+
+// Failed returns the names of the failed targets.
+func (e *Error) Failed() []string {
+	names := make([]string, 0, len(e.Targets))
+	for name := range e.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, 0, len(e.Targets))
+	for _, name := range e.Failed() {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e.Targets[name]))
+	}
+	return fmt.Sprintf("unable to notify %d target(s): %s", len(e.Targets), strings.Join(msgs, "; "))
+}
+
+func (e *Error) Unwrap() []error {
+	errs := make([]error, 0, len(e.Targets))
+	for _, name := range e.Failed() {
+		errs = append(errs, e.Targets[name])
+	}
+	return errs
+}
+
+var (
+	errMissingTargets    = errors.New("missing targets")
+	errMissingName       = errors.New("missing target name")
+	errDuplicateName     = errors.New("duplicate target name")
+	errUnknownResolution = errors.New("unknown resolution")
+	errUnknownLocation   = errors.New("unknown location")
+	errInvalidWindow     = errors.New("invalid window")
+)
+
+// Notifier sends the notifications to all matching targets.
+type Notifier struct {
+	targets    []target
+	deliveries DeliveryStore
+	now        func() time.Time
+}
+
+type target struct {
+	name     string
+	notifier notifier.Notifier
+
+	regions     []Region
+	resolutions map[incident.Resolution]bool
+	locations   map[incident.Location]bool
+	windows     []window
+	loc         *time.Location
+}
+
+// window of the day in minutes since midnight. Windows ending before they start wrap around
+// midnight.
+type window struct {
+	from, to int
+}
+
+// New creates the notifier, validating the routes of all targets.
+func New(targets []Target, opts ...Option) (*Notifier, error) {
+	if len(targets) == 0 {
+		return nil, errMissingTargets
+	}
+
+	n := &Notifier{now: time.Now}
+	for _, opt := range opts {
+		opt(n)
+	}
+	names := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		if t.Name == "" {
+			return nil, errMissingName
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%w %q", errDuplicateName, t.Name)
+		}
+		names[t.Name] = true
+
+		compiled, err := compile(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route of %q: %w", t.Name, err)
+		}
+		n.targets = append(n.targets, compiled)
+	}
+
+	return n, nil
+}
+
+func compile(t Target) (target, error) {
+	c := target{
+		name:        t.Name,
+		notifier:    t.Notifier,
+		regions:     t.Route.Regions,
+		resolutions: make(map[incident.Resolution]bool, len(t.Route.Resolutions)),
+		locations:   make(map[incident.Location]bool, len(t.Route.Locations)),
+	}
+
+	for _, name := range t.Route.Resolutions {
+		v, ok := incident.Resolution_value["RESOLUTION_"+strings.ToUpper(name)]
+		if !ok {
+			return target{}, fmt.Errorf("%w %q", errUnknownResolution, name)
+		}
+		c.resolutions[incident.Resolution(v)] = true
+	}
+
+	for _, name := range t.Route.Locations {
+		v, ok := incident.Location_value["LOCATION_"+strings.ToUpper(name)]
+		if !ok {
+			return target{}, fmt.Errorf("%w %q", errUnknownLocation, name)
+		}
+		c.locations[incident.Location(v)] = true
+	}
+
+	for _, w := range t.Route.Windows {
+		parsed, err := parseWindow(w)
+		if err != nil {
+			return target{}, err
+		}
+		c.windows = append(c.windows, parsed)
+	}
+
+	tz := t.Route.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return target{}, fmt.Errorf("unable to load timezone: %w", err)
+	}
+	c.loc = loc
+
+	return c, nil
+}
+
+// parseWindow parses windows in the "15:04-15:04" format.
+func parseWindow(s string) (window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return window{}, fmt.Errorf("%w %q", errInvalidWindow, s)
+	}
+
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return window{}, fmt.Errorf("%w %q: %v", errInvalidWindow, s, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return window{}, fmt.Errorf("%w %q: %v", errInvalidWindow, s, err)
+	}
+
+	return window{
+		from: start.Hour()*60 + start.Minute(),
+		to:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+func (w window) contains(minute int) bool {
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+// matches returns if the incident should be sent to the target at the given time.
+func (t *target) matches(inc *incident.Incident, now time.Time) bool {
+	if len(t.resolutions) > 0 && !t.resolutions[inc.Resolution] {
+		return false
+	}
+	if len(t.locations) > 0 && !t.locations[inc.Location] {
+		return false
+	}
+
+	if len(t.regions) > 0 {
+		if inc.Coordinates == nil {
+			return false
+		}
+		in := false
+		for _, r := range t.regions {
+			if inc.Coordinates.Lat >= r.MinLat && inc.Coordinates.Lat <= r.MaxLat &&
+				inc.Coordinates.Lon >= r.MinLon && inc.Coordinates.Lon <= r.MaxLon {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+
+	if len(t.windows) > 0 {
+		local := now.In(t.loc)
+		minute := local.Hour()*60 + local.Minute()
+		in := false
+		for _, w := range t.windows {
+			if w.contains(minute) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Notify sends the notification to all matching targets in parallel. A failing target does not
+// stop the others from being notified, and all failed targets are reported in the returned
+// *Error. When the deliveries are tracked, the named notifications are only sent to the targets
+// they were not delivered to yet.
+func (n *Notifier) Notify(ctx context.Context, inc *incident.Incident) error {
+	now := n.now()
+
+	name := notifier.DeliveryFromContext(ctx)
+	delivered := map[string]bool{}
+	if n.deliveries != nil && name != "" {
+		targets, err := n.deliveries.NotificationDeliveries(ctx, inc.Id, name)
+		if err != nil {
+			return fmt.Errorf("unable to get notification deliveries: %w", err)
+		}
+		for _, t := range targets {
+			delivered[t] = true
+		}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = map[string]error{}
+	)
+	for i := range n.targets {
+		t := &n.targets[i]
+		if delivered[t.name] || !t.matches(inc, now) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := t.notifier.Notify(ctx, inc)
+			if err == nil && n.deliveries != nil && name != "" {
+				// The target is notified again if the delivery could not be saved.
+				if err = n.deliveries.SaveNotificationDelivery(ctx, inc.Id, name, t.name); err != nil {
+					err = fmt.Errorf("unable to save notification delivery: %w", err)
+				}
+			}
+			if err != nil {
+				mu.Lock()
+				failed[t.name] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &Error{Targets: failed}
+	}
+	return nil
+}
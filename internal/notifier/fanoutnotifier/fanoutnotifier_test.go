@@ -0,0 +1,164 @@
+package fanoutnotifier
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"safer.place/internal/notifier"
+)
+
+type fakeNotifier struct {
+	mu  sync.Mutex
+	ids []string
+	err error
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, inc *incident.Incident) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ids = append(n.ids, inc.Id)
+	return n.err
+}
+
+func TestNotify(t *testing.T) {
+	var (
+		all       = &fakeNotifier{}
+		dublin    = &fakeNotifier{}
+		alerted   = &fakeNotifier{}
+		transport = &fakeNotifier{}
+		night     = &fakeNotifier{}
+		broken    = &fakeNotifier{err: errors.New("broken")}
+	)
+
+	n, err := New([]Target{
+		{Name: "all", Notifier: all},
+		{Name: "dublin", Notifier: dublin, Route: Route{
+			Regions: []Region{{MinLat: 53.2, MinLon: -6.5, MaxLat: 53.5, MaxLon: -6}},
+		}},
+		{Name: "alerted", Notifier: alerted, Route: Route{Resolutions: []string{"alerted"}}},
+		{Name: "transport", Notifier: transport, Route: Route{Locations: []string{"transportation"}}},
+		{Name: "night", Notifier: night, Route: Route{
+			Windows:  []string{"22:00-06:00"},
+			Timezone: "Europe/Dublin",
+		}},
+		{Name: "broken", Notifier: broken},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 23:30 in Dublin during winter time.
+	n.now = func() time.Time { return time.Date(2023, 12, 1, 23, 30, 0, 0, time.UTC) }
+
+	err = n.Notify(context.Background(), &incident.Incident{
+		Id:          "dublin-transport",
+		Location:    incident.Location_LOCATION_TRANSPORTATION,
+		Coordinates: &incident.Coordinates{Lat: 53.35, Lon: -6.26},
+	})
+
+	var notifyErr *Error
+	if !errors.As(err, &notifyErr) {
+		t.Fatalf("error = %v, want *Error", err)
+	}
+	if got := notifyErr.Failed(); !reflect.DeepEqual(got, []string{"broken"}) {
+		t.Errorf("failed targets = %v, want [broken]", got)
+	}
+
+	n.now = func() time.Time { return time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC) }
+	_ = n.Notify(context.Background(), &incident.Incident{
+		Id:          "cork-alerted",
+		Resolution:  incident.Resolution_RESOLUTION_ALERTED,
+		Coordinates: &incident.Coordinates{Lat: 51.9, Lon: -8.47},
+	})
+
+	for name, tc := range map[string]struct {
+		n    *fakeNotifier
+		want []string
+	}{
+		"all":       {all, []string{"dublin-transport", "cork-alerted"}},
+		"dublin":    {dublin, []string{"dublin-transport"}},
+		"alerted":   {alerted, []string{"cork-alerted"}},
+		"transport": {transport, []string{"dublin-transport"}},
+		"night":     {night, []string{"dublin-transport"}},
+	} {
+		if !reflect.DeepEqual(tc.n.ids, tc.want) {
+			t.Errorf("%s notified about %v, want %v", name, tc.n.ids, tc.want)
+		}
+	}
+}
+
+func TestNewInvalidRoute(t *testing.T) {
+	for name, route := range map[string]Route{
+		"resolution": {Resolutions: []string{"maybe"}},
+		"location":   {Locations: []string{"space"}},
+		"window":     {Windows: []string{"22:00"}},
+		"timezone":   {Timezone: "Nowhere/Nothing"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New([]Target{{Name: name, Route: route}}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// fakeDeliveries is saved to by the targets concurrently.
+type fakeDeliveries struct {
+	mu        sync.Mutex
+	delivered map[string][]string
+}
+
+func (f *fakeDeliveries) NotificationDeliveries(_ context.Context, id, notification string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.delivered[id+"/"+notification]...), nil
+}
+
+func (f *fakeDeliveries) SaveNotificationDelivery(_ context.Context, id, notification, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delivered[id+"/"+notification] = append(f.delivered[id+"/"+notification], target)
+	return nil
+}
+
+func TestNotifyRetry(t *testing.T) {
+	var (
+		ok     = &fakeNotifier{}
+		broken = &fakeNotifier{err: errors.New("broken")}
+	)
+	n, err := New([]Target{
+		{Name: "ok", Notifier: ok},
+		{Name: "broken", Notifier: broken},
+	}, Deliveries(&fakeDeliveries{delivered: make(map[string][]string)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := notifier.WithDelivery(context.Background(), "escalation-1")
+	inc := &incident.Incident{Id: "inc"}
+	if err := n.Notify(ctx, inc); err == nil {
+		t.Fatal("expected the broken target to fail")
+	}
+	broken.err = nil
+	if err := n.Notify(ctx, inc); err != nil {
+		t.Fatalf("retry = %v", err)
+	}
+	if err := n.Notify(ctx, inc); err != nil {
+		t.Fatalf("delivered notification = %v", err)
+	}
+	// Another notification of the same incident is delivered to all targets.
+	if err := n.Notify(notifier.WithDelivery(context.Background(), "escalation-2"), inc); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"inc", "inc"}; !reflect.DeepEqual(ok.ids, want) {
+		t.Errorf("ok notified %v, want %v", ok.ids, want)
+	}
+	if want := []string{"inc", "inc", "inc"}; !reflect.DeepEqual(broken.ids, want) {
+		t.Errorf("broken notified %v, want %v", broken.ids, want)
+	}
+}
@@ -0,0 +1,25 @@
+package fanoutnotifier
+
+import "context"
+
+// Option extends the functionality of the notifier.
+type Option func(*Notifier)
+
+// DeliveryStore remembers the targets the notifications were delivered to.
+type DeliveryStore interface {
+	// NotificationDeliveries returns the targets the notification of the incident was delivered
+	// to.
+	NotificationDeliveries(ctx context.Context, id, notification string) ([]string, error)
+	// SaveNotificationDelivery records the notification of the incident was delivered to the
+	// target.
+	SaveNotificationDelivery(ctx context.Context, id, notification, target string) error
+}
+
+// Deliveries tracks the delivery of the named notifications to every target, so the targets
+// which were already notified are skipped when the notification is sent again after a failure.
+// See notifier.WithDelivery.
+func Deliveries(store DeliveryStore) Option {
+	return func(n *Notifier) {
+		n.deliveries = store
+	}
+}
@@ -2,23 +2,45 @@ package lognotifier
 
 import (
 	"context"
-	"fmt"
 
 	"api.safer.place/incident/v1"
 	"go.uber.org/zap"
+	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/content"
 )
 
 type Notifier struct {
-	log *zap.Logger
+	log      *zap.Logger
+	renderer *content.Renderer
 }
 
-func New(log *zap.Logger) *Notifier {
-	return &Notifier{log: log}
+func New(log *zap.Logger, r *content.Renderer) *Notifier {
+	return &Notifier{log: log, renderer: r}
 }
 
 func (n *Notifier) Notify(ctx context.Context, inc *incident.Incident) error {
-	n.log.Info("incident for review",
-		zap.String("url", fmt.Sprintf("https://review.safer.place/incident/%s", inc.Id)),
+	msg, err := n.renderer.Render(ctx, inc)
+	if err != nil {
+		return err
+	}
+
+	n.log.Info(msg.Title,
+		zap.String("url", msg.URL),
+		zap.Stringer("urgency", notifier.UrgencyFromContext(ctx)),
+	)
+	return nil
+}
+
+func (n *Notifier) NotifyDigest(ctx context.Context, d *notifier.Digest) error {
+	msg, err := n.renderer.RenderDigest(ctx, d)
+	if err != nil {
+		return err
+	}
+
+	n.log.Info(msg.Title,
+		zap.String("url", msg.URL),
+		zap.Int("incidents", d.Count()),
+		zap.Int("areas", len(d.Areas)),
 	)
 	return nil
 }
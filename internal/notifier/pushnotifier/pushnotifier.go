@@ -0,0 +1,148 @@
+// Package pushnotifier sends Web Push messages about alerting incidents to the users subscribed
+// to the region tiles covering the incident.
+package pushnotifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/content"
+	"safer.place/internal/webpush"
+)
+
+// Config of the push notifications.
+type Config struct {
+	// KeyFile contains the VAPID private key, generated using `saferplace vapid generate`. Push
+	// notifications are disabled when empty.
+	KeyFile string `yaml:"key_file" split_words:"true"`
+	// Subject is a mailto: or https: URL the push services can use to contact us.
+	Subject string `yaml:"subject" default:"mailto:admin@safer.place"`
+	// TTL is how long the push services keep the message while the device is offline.
+	TTL time.Duration `yaml:"ttl" default:"24h"`
+}
+
+// Subscriptions stores the push subscriptions.
+type Subscriptions interface {
+	PushSubscriptionsAt(context.Context, *incident.Coordinates) ([]*database.PushSubscription, error)
+	DeletePushSubscription(context.Context, string) error
+}
+
+// Payload is the JSON message received by the service worker of the PWA.
+type Payload struct {
+	Title      string  `json:"title"`
+	Body       string  `json:"body"`
+	IncidentID string  `json:"incident_id"`
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+}
+
+// Notifier sends the push notifications.
+type Notifier struct {
+	client   *webpush.Client
+	subs     Subscriptions
+	renderer *content.Renderer
+	log      *zap.Logger
+	ttl      time.Duration
+}
+
+// New creates the push notifier.
+func New(
+	cfg *Config,
+	c *webpush.Client,
+	subs Subscriptions,
+	r *content.Renderer,
+	log *zap.Logger,
+) *Notifier {
+	return &Notifier{
+		client:   c,
+		subs:     subs,
+		renderer: r,
+		log:      log,
+		ttl:      cfg.TTL,
+	}
+}
+
+// Notify sends the alert to all subscribers of the tiles covering the incident. Subscriptions
+// which are gone are removed.
+func (n *Notifier) Notify(ctx context.Context, inc *incident.Incident) error {
+	if inc.Coordinates == nil {
+		return nil
+	}
+
+	subs, err := n.subs.PushSubscriptionsAt(ctx, inc.Coordinates)
+	if err != nil {
+		return fmt.Errorf("unable to get subscriptions: %w", err)
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+
+	return n.Send(notifier.WithEvent(ctx, notifier.EventAlert), inc, subs)
+}
+
+// Send the notification about the incident to the subscriptions, rendered for the event in the
+// context. Subscriptions which are gone are removed.
+func (n *Notifier) Send(
+	ctx context.Context, inc *incident.Incident, subs []*database.PushSubscription,
+) error {
+	msg, err := n.renderer.Render(ctx, inc)
+	if err != nil {
+		return err
+	}
+	payload := &Payload{
+		Title:      msg.Title,
+		Body:       msg.Body,
+		IncidentID: inc.Id,
+	}
+	if inc.Coordinates != nil {
+		payload.Lat = inc.Coordinates.Lat
+		payload.Lon = inc.Coordinates.Lon
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to encode payload: %w", err)
+	}
+
+	push := &webpush.Message{
+		Payload: body,
+		TTL:     n.ttl,
+		Urgency: webpush.UrgencyHigh,
+		// Topics are limited to 32 URL safe base64 characters, which fits the UUID without dashes.
+		Topic: topic(inc.Id),
+	}
+
+	var errs []error
+	for _, sub := range subs {
+		err := n.client.Send(ctx, &webpush.Subscription{
+			Endpoint: sub.Endpoint,
+			Keys:     webpush.SubscriptionKeys{P256dh: sub.P256dh, Auth: sub.Auth},
+		}, push)
+		switch {
+		case errors.Is(err, webpush.ErrGone):
+			n.log.Debug("removing expired push subscription", zap.String("endpoint", sub.Endpoint))
+			if err := n.subs.DeletePushSubscription(ctx, sub.Endpoint); err != nil {
+				errs = append(errs, fmt.Errorf("unable to delete subscription: %w", err))
+			}
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", sub.Endpoint, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func topic(id string) string {
+	t := strings.ReplaceAll(id, "-", "")
+	if len(t) > 32 {
+		t = t[:32]
+	}
+	return t
+}
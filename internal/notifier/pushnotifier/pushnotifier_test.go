@@ -0,0 +1,97 @@
+package pushnotifier
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/notifier/content"
+	"safer.place/internal/webpush"
+)
+
+type fakeSubscriptions struct {
+	subs    []*database.PushSubscription
+	deleted []string
+}
+
+func (f *fakeSubscriptions) PushSubscriptionsAt(
+	context.Context, *incident.Coordinates,
+) ([]*database.PushSubscription, error) {
+	return f.subs, nil
+}
+
+func (f *fakeSubscriptions) DeletePushSubscription(_ context.Context, endpoint string) error {
+	f.deleted = append(f.deleted, endpoint)
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		mu.Lock()
+		received = append(received, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256dh := base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	auth := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+
+	subs := &fakeSubscriptions{subs: []*database.PushSubscription{
+		{Endpoint: srv.URL + "/active", P256dh: p256dh, Auth: auth},
+		{Endpoint: srv.URL + "/gone", P256dh: p256dh, Auth: auth},
+	}}
+
+	keys, err := webpush.GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := content.New(&content.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(
+		&Config{},
+		webpush.NewClient(srv.Client(), keys, "mailto:admin@safer.place"),
+		subs,
+		r,
+		zap.NewNop(),
+	)
+
+	if err := n.Notify(context.Background(), &incident.Incident{
+		Id:          "d7c6e1a4-0c1b-4a56-8b8e-3f1d1c4c2f00",
+		Description: "alert",
+		Coordinates: &incident.Coordinates{Lat: 53.3498, Lon: -6.2603},
+	}); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+
+	if !reflect.DeepEqual(received, []string{"/active"}) {
+		t.Errorf("received = %v, want [/active]", received)
+	}
+	if want := []string{srv.URL + "/gone"}; !reflect.DeepEqual(subs.deleted, want) {
+		t.Errorf("deleted = %v, want %v", subs.deleted, want)
+	}
+}
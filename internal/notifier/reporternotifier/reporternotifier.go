@@ -0,0 +1,93 @@
+// Package reporternotifier tells the reporters about the outcome of their reports, using the
+// channel they prefer.
+package reporternotifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/emailnotifier"
+)
+
+// Config of the reporter notifications.
+type Config struct {
+	// Email is the SMTP relay used to email the reporters. The recipients are ignored. Reporters
+	// are not emailed when the host is empty.
+	Email *emailnotifier.Config `yaml:"email"`
+}
+
+// Store contains the reporters and their preferences.
+type Store interface {
+	Reporter(context.Context, string) (string, error)
+	ReporterPreferences(context.Context, string) (*database.ReporterPreferences, error)
+}
+
+// Mailer emails the notification to the recipients.
+type Mailer interface {
+	NotifyTo(context.Context, *incident.Incident, ...string) error
+}
+
+// Pusher sends the notification to the push subscriptions.
+type Pusher interface {
+	Send(context.Context, *incident.Incident, []*database.PushSubscription) error
+}
+
+// Notifier notifies the reporter of the incident.
+type Notifier struct {
+	store  Store
+	mailer Mailer
+	pusher Pusher
+	log    *zap.Logger
+}
+
+// New creates the notifier. The mailer or the pusher can be nil if the channel is not
+// configured.
+func New(store Store, mailer Mailer, pusher Pusher, log *zap.Logger) *Notifier {
+	return &Notifier{
+		store:  store,
+		mailer: mailer,
+		pusher: pusher,
+		log:    log,
+	}
+}
+
+// Notify tells the reporter about the current resolution of the incident, along with the public
+// comment of the reviewer. Incidents without a known reporter, and reporters who opted out, are
+// skipped.
+func (n *Notifier) Notify(ctx context.Context, inc *incident.Incident) error {
+	reporter, err := n.store.Reporter(ctx, inc.Id)
+	if err != nil {
+		if errors.Is(err, database.ErrDoesNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to get reporter: %w", err)
+	}
+
+	prefs, err := n.store.ReporterPreferences(ctx, reporter)
+	if err != nil {
+		return fmt.Errorf("unable to get reporter preferences: %w", err)
+	}
+
+	ctx = notifier.WithEvent(ctx, notifier.EventResolution)
+	switch prefs.Channel {
+	case database.ReporterChannelNone:
+		return nil
+	case database.ReporterChannelPush:
+		if prefs.Push != nil && n.pusher != nil {
+			return n.pusher.Send(ctx, inc, []*database.PushSubscription{prefs.Push})
+		}
+		// The subscription expired, so email is the only way left to reach the reporter.
+		n.log.Debug("push unavailable, falling back to email", zap.String("id", inc.Id))
+	}
+
+	if n.mailer == nil {
+		n.log.Debug("email unavailable, reporter not notified", zap.String("id", inc.Id))
+		return nil
+	}
+	return n.mailer.NotifyTo(ctx, inc, reporter)
+}
@@ -0,0 +1,99 @@
+package reporternotifier
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/notifier"
+)
+
+type fakeStore struct {
+	reporters map[string]string
+	prefs     map[string]*database.ReporterPreferences
+}
+
+func (f *fakeStore) Reporter(_ context.Context, id string) (string, error) {
+	email, ok := f.reporters[id]
+	if !ok {
+		return "", database.ErrDoesNotExist
+	}
+	return email, nil
+}
+
+func (f *fakeStore) ReporterPreferences(
+	_ context.Context, email string,
+) (*database.ReporterPreferences, error) {
+	if prefs, ok := f.prefs[email]; ok {
+		return prefs, nil
+	}
+	return &database.ReporterPreferences{Email: email, Channel: database.ReporterChannelEmail}, nil
+}
+
+type sent struct {
+	channel string
+	to      string
+	event   notifier.Event
+}
+
+type fakeChannels struct {
+	sent []sent
+}
+
+func (f *fakeChannels) NotifyTo(ctx context.Context, _ *incident.Incident, to ...string) error {
+	for _, rcpt := range to {
+		f.sent = append(f.sent, sent{"email", rcpt, notifier.EventFromContext(ctx)})
+	}
+	return nil
+}
+
+func (f *fakeChannels) Send(
+	ctx context.Context, _ *incident.Incident, subs []*database.PushSubscription,
+) error {
+	for _, sub := range subs {
+		f.sent = append(f.sent, sent{"push", sub.Endpoint, notifier.EventFromContext(ctx)})
+	}
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	store := &fakeStore{
+		reporters: map[string]string{
+			"default": "default@safer.place",
+			"push":    "push@safer.place",
+			"expired": "expired@safer.place",
+			"optout":  "optout@safer.place",
+		},
+		prefs: map[string]*database.ReporterPreferences{
+			"push@safer.place": {
+				Channel: database.ReporterChannelPush,
+				Push:    &database.PushSubscription{Endpoint: "https://push.example/abc"},
+			},
+			"expired@safer.place": {Channel: database.ReporterChannelPush},
+			"optout@safer.place":  {Channel: database.ReporterChannelNone},
+		},
+	}
+
+	for id, want := range map[string][]sent{
+		"default":   {{"email", "default@safer.place", notifier.EventResolution}},
+		"push":      {{"push", "https://push.example/abc", notifier.EventResolution}},
+		"expired":   {{"email", "expired@safer.place", notifier.EventResolution}},
+		"optout":    nil,
+		"anonymous": nil,
+	} {
+		t.Run(id, func(t *testing.T) {
+			channels := &fakeChannels{}
+			n := New(store, channels, channels, zap.NewNop())
+
+			if err := n.Notify(context.Background(), &incident.Incident{Id: id}); err != nil {
+				t.Fatalf("Notify() = %v", err)
+			}
+			if !reflect.DeepEqual(channels.sent, want) {
+				t.Errorf("sent = %v, want %v", channels.sent, want)
+			}
+		})
+	}
+}
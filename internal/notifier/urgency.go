@@ -0,0 +1,53 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Urgency describes how quickly the notification needs attention.
+type Urgency int
+
+const (
+	UrgencyNormal Urgency = iota
+	UrgencyHigh
+	UrgencyCritical
+)
+
+var urgencyNames = map[Urgency]string{
+	UrgencyNormal:   "normal",
+	UrgencyHigh:     "high",
+	UrgencyCritical: "critical",
+}
+
+func (u Urgency) String() string {
+	if name, ok := urgencyNames[u]; ok {
+		return name
+	}
+	return fmt.Sprintf("urgency(%d)", int(u))
+}
+
+// UnmarshalText parses the urgency from its name.
+func (u *Urgency) UnmarshalText(text []byte) error {
+	for v, name := range urgencyNames {
+		if strings.EqualFold(name, string(text)) {
+			*u = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown urgency %q", string(text))
+}
+
+type urgencyKey struct{}
+
+// WithUrgency attaches the urgency to the notification context.
+func WithUrgency(ctx context.Context, u Urgency) context.Context {
+	return context.WithValue(ctx, urgencyKey{}, u)
+}
+
+// UrgencyFromContext returns the urgency of the notification, defaulting to normal.
+func UrgencyFromContext(ctx context.Context) Urgency {
+	u, _ := ctx.Value(urgencyKey{}).(Urgency)
+	return u
+}
@@ -0,0 +1,198 @@
+// Package webhooknotifier sends signed webhooks about incidents to third parties. Receivers can
+// verify the requests using the safer.place/pkg/webhook package.
+package webhooknotifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"safer.place/internal/notifier/content"
+	"safer.place/pkg/webhook"
+)
+
+// Config of the webhook notifier.
+type Config struct {
+	// Endpoints which receive the webhooks.
+	Endpoints []Endpoint `yaml:"endpoints" ignored:"true"`
+	// Secret used to sign the requests to endpoints without their own secret.
+	Secret string `yaml:"secret"`
+	// Format of the body, either "json" or "protobuf". Only the json envelope contains the
+	// rendered content of the notification, the protobuf body is the incident alone.
+	Format string `yaml:"format" default:"json"`
+	// MaxRetries of a failed request, with exponential backoff between them.
+	MaxRetries int           `yaml:"max_retries" default:"3" split_words:"true"`
+	Backoff    time.Duration `yaml:"backoff" default:"500ms"`
+}
+
+// Endpoint receiving the webhooks.
+type Endpoint struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+}
+
+// EventIncident is the event sent when a new incident is waiting for a review.
+const EventIncident = "incident.review"
+
+const (
+	formatJSON     = "json"
+	formatProtobuf = "protobuf"
+)
+
+var (
+	errMissingEndpoints = errors.New("missing endpoints")
+	errMissingSecret    = errors.New("missing secret")
+	errUnknownFormat    = errors.New("unknown format")
+)
+
+// Notifier sends the webhooks.
+type Notifier struct {
+	client     *http.Client
+	endpoints  []Endpoint
+	format     string
+	maxRetries int
+	backoff    time.Duration
+	renderer   *content.Renderer
+}
+
+// New creates the webhook notifier.
+func New(cfg *Config, c *http.Client, r *content.Renderer) (*Notifier, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errMissingEndpoints
+	}
+	if cfg.Format != formatJSON && cfg.Format != formatProtobuf {
+		return nil, fmt.Errorf("%w %q", errUnknownFormat, cfg.Format)
+	}
+
+	endpoints := make([]Endpoint, 0, len(cfg.Endpoints))
+	for _, e := range cfg.Endpoints {
+		if e.Secret == "" {
+			e.Secret = cfg.Secret
+		}
+		if e.Secret == "" {
+			return nil, fmt.Errorf("%s: %w", e.URL, errMissingSecret)
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	return &Notifier{
+		client:     c,
+		endpoints:  endpoints,
+		format:     cfg.Format,
+		maxRetries: cfg.MaxRetries,
+		backoff:    cfg.Backoff,
+		renderer:   r,
+	}, nil
+}
+
+// Notify sends the webhook to all endpoints. A failing endpoint does not stop the others from
+// being notified.
+func (n *Notifier) Notify(ctx context.Context, inc *incident.Incident) error {
+	body, contentType, err := n.encode(ctx, inc)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, e := range n.endpoints {
+		if err := n.deliver(ctx, e, body, contentType); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.URL, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) encode(ctx context.Context, inc *incident.Incident) ([]byte, string, error) {
+	if n.format == formatProtobuf {
+		body, err := proto.Marshal(inc)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to encode incident: %w", err)
+		}
+		return body, "application/x-protobuf", nil
+	}
+
+	encoded, err := protojson.Marshal(inc)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to encode incident: %w", err)
+	}
+	msg, err := n.renderer.Render(ctx, inc)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to render message: %w", err)
+	}
+	body, err := json.Marshal(webhook.Payload{
+		Version:   webhook.Version,
+		Event:     EventIncident,
+		Timestamp: time.Now().UTC(),
+		Incident:  encoded,
+		Title:     msg.Title,
+		Body:      msg.Body,
+		URL:       msg.URL,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to encode payload: %w", err)
+	}
+
+	return body, "application/json", nil
+}
+
+// deliver the webhook to the endpoint, retrying with exponential backoff.
+func (n *Notifier) deliver(ctx context.Context, e Endpoint, body []byte, contentType string) error {
+	backoff := n.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := n.send(ctx, e, body, contentType)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.maxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send a single signed request, returning if the request can be retried on error.
+func (n *Notifier) send(ctx context.Context, e Endpoint, body []byte, contentType string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	now := time.Now()
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(webhook.VersionHeader, webhook.Version)
+	req.Header.Set(webhook.EventHeader, EventIncident)
+	req.Header.Set(webhook.TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign([]byte(e.Secret), now, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("unable to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected response: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+}
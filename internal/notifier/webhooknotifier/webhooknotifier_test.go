@@ -0,0 +1,85 @@
+package webhooknotifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"safer.place/internal/notifier/content"
+	"safer.place/pkg/webhook"
+)
+
+func TestNotify(t *testing.T) {
+	secret := []byte("secret")
+
+	var attempts int
+	var (
+		got     *incident.Incident
+		payload webhook.Payload
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := webhook.Verify(r, secret, webhook.DefaultTolerance)
+		if err != nil {
+			t.Errorf("Verify() = %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("unable to decode payload: %v", err)
+		}
+		got = &incident.Incident{}
+		if err := protojson.Unmarshal(payload.Incident, got); err != nil {
+			t.Errorf("unable to decode incident: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	renderer, err := content.New(&content.Config{ReviewURL: "https://review.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := New(&Config{
+		Endpoints:  []Endpoint{{URL: rejecting.URL}, {URL: srv.URL}},
+		Secret:     string(secret),
+		Format:     formatJSON,
+		MaxRetries: 2,
+		Backoff:    time.Millisecond,
+	}, http.DefaultClient, renderer)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	err = n.Notify(context.Background(), &incident.Incident{Id: "abc", Description: "something"})
+	if err == nil {
+		t.Errorf("Notify() = nil, want error from the rejecting endpoint")
+	}
+
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+	if got.GetId() != "abc" {
+		t.Errorf("received incident = %v, want id abc", got)
+	}
+	if payload.Title != "New incident for review" || payload.Body != "something" ||
+		payload.URL != "https://review.example.com/incident/abc" {
+		t.Errorf("payload content = %q, %q, %q", payload.Title, payload.Body, payload.URL)
+	}
+}
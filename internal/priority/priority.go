@@ -0,0 +1,155 @@
+// Copyright 2023 SaferPlace
+
+// Package priority computes how urgently an incident should be reviewed.
+//
+// The base priority is calculated once, when the incident is received, from the location and
+// keywords in the description. Corroborating reports and the time the incident has been waiting
+// change over time, so they are added when the incidents are ranked.
+package priority
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"safer.place/internal/geo"
+)
+
+// Config of the priority weights.
+type Config struct {
+	// Locations maps the location name, such as "transportation", to its weight. DefaultLocations
+	// are used when it is not set, an empty map does not weight any location.
+	Locations map[string]int `yaml:"locations"`
+	// Keywords maps a case insensitive keyword found in the description to its weight.
+	// DefaultKeywords are used when it is not set, an empty map does not weight any keyword.
+	Keywords map[string]int `yaml:"keywords"`
+	// PerHour is the weight added for every hour the incident is waiting for a review.
+	PerHour int `yaml:"per_hour" default:"1" split_words:"true"`
+	// Corroboration adds weight for every other report nearby.
+	Corroboration CorroborationConfig `yaml:"corroboration"`
+}
+
+// Default weights used when they are not configured. They are not set as the defaults of the
+// config, as the configured maps would be merged into them instead of replacing them.
+var (
+	DefaultLocations = map[string]int{"transportation": 20}
+	DefaultKeywords  = map[string]int{
+		"assault": 50, "attack": 50, "knife": 50, "weapon": 50, "harass": 20, "follow": 20,
+	}
+)
+
+// CorroborationConfig defines when two reports are considered to describe the same incident.
+type CorroborationConfig struct {
+	Radius float64       `yaml:"radius" default:"250"`
+	Window time.Duration `yaml:"window" default:"1h"`
+	Weight int           `yaml:"weight" default:"10"`
+}
+
+// Scorer calculates the priorities.
+type Scorer struct {
+	locations map[incident.Location]int
+	keywords  map[string]int
+	perHour   int
+
+	corroboration CorroborationConfig
+}
+
+// New creates a new scorer from the configuration.
+func New(cfg Config) (*Scorer, error) {
+	if cfg.Locations == nil {
+		cfg.Locations = DefaultLocations
+	}
+	if cfg.Keywords == nil {
+		cfg.Keywords = DefaultKeywords
+	}
+
+	s := &Scorer{
+		locations:     make(map[incident.Location]int, len(cfg.Locations)),
+		keywords:      make(map[string]int, len(cfg.Keywords)),
+		perHour:       cfg.PerHour,
+		corroboration: cfg.Corroboration,
+	}
+
+	for name, weight := range cfg.Locations {
+		v, ok := incident.Location_value["LOCATION_"+strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown location %q", name)
+		}
+		s.locations[incident.Location(v)] = weight
+	}
+
+	for keyword, weight := range cfg.Keywords {
+		s.keywords[strings.ToLower(keyword)] = weight
+	}
+
+	return s, nil
+}
+
+// Base priority of the incident which does not change over time.
+func (s *Scorer) Base(inc *incident.Incident) int {
+	if s == nil {
+		return 0
+	}
+
+	priority := s.locations[inc.Location]
+
+	description := strings.ToLower(inc.Description)
+	for keyword, weight := range s.keywords {
+		if strings.Contains(description, keyword) {
+			priority += weight
+		}
+	}
+
+	return priority
+}
+
+// Rank sorts the incidents from the highest to the lowest priority. The base priorities are
+// the ones saved when the incident was received, missing incidents are treated as 0. Incidents
+// with equal priority are sorted from the oldest.
+func (s *Scorer) Rank(incidents []*incident.Incident, base map[string]int, now time.Time) {
+	priorities := make(map[string]int, len(incidents))
+	for _, inc := range incidents {
+		priorities[inc.Id] = s.current(inc, incidents, base[inc.Id], now)
+	}
+
+	sort.SliceStable(incidents, func(i, j int) bool {
+		pi, pj := priorities[incidents[i].Id], priorities[incidents[j].Id]
+		if pi != pj {
+			return pi > pj
+		}
+		return incidents[i].Timestamp.AsTime().Before(incidents[j].Timestamp.AsTime())
+	})
+}
+
+// current priority of the incident, based on its base priority, the age and other reports.
+func (s *Scorer) current(
+	inc *incident.Incident, others []*incident.Incident, base int, now time.Time,
+) int {
+	priority := base
+
+	reported := inc.Timestamp.AsTime()
+	priority += int(now.Sub(reported)/time.Hour) * s.perHour
+
+	if inc.Coordinates == nil {
+		return priority
+	}
+	for _, other := range others {
+		if other.Id == inc.Id || other.Coordinates == nil {
+			continue
+		}
+		if diff := other.Timestamp.AsTime().Sub(reported).Abs(); diff > s.corroboration.Window {
+			continue
+		}
+		if geo.Distance(
+			inc.Coordinates.Lat, inc.Coordinates.Lon,
+			other.Coordinates.Lat, other.Coordinates.Lon,
+		) > s.corroboration.Radius {
+			continue
+		}
+		priority += s.corroboration.Weight
+	}
+
+	return priority
+}
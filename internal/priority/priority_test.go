@@ -0,0 +1,129 @@
+// Copyright 2023 SaferPlace
+
+package priority
+
+import (
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"github.com/kelseyhightower/envconfig"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/yaml.v3"
+)
+
+var testConfig = Config{
+	Locations: map[string]int{"transportation": 20},
+	Keywords:  map[string]int{"assault": 50},
+	PerHour:   1,
+	Corroboration: CorroborationConfig{
+		Radius: 250,
+		Window: time.Hour,
+		Weight: 10,
+	},
+}
+
+func TestBase(t *testing.T) {
+	s, err := New(testConfig)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	testCases := map[string]struct {
+		inc  *incident.Incident
+		want int
+	}{
+		"nothing":          {inc: &incident.Incident{Description: "illegal parking"}, want: 0},
+		"location":         {inc: &incident.Incident{Location: incident.Location_LOCATION_TRANSPORTATION}, want: 20},
+		"keyword":          {inc: &incident.Incident{Description: "I saw an Assault"}, want: 50},
+		"keyword on a bus": {inc: &incident.Incident{Description: "assault", Location: incident.Location_LOCATION_TRANSPORTATION}, want: 70},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := s.Base(tc.inc); got != tc.want {
+				t.Errorf("Base(%v) = %d, want %d", tc.inc, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRank(t *testing.T) {
+	s, err := New(testConfig)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration) *timestamppb.Timestamp {
+		return timestamppb.New(now.Add(-ago))
+	}
+	coords := func(lat, lon float64) *incident.Coordinates {
+		return &incident.Coordinates{Lat: lat, Lon: lon}
+	}
+
+	incidents := []*incident.Incident{
+		{Id: "parking", Timestamp: at(time.Hour), Coordinates: coords(52, -7)},
+		{Id: "old-parking", Timestamp: at(5 * time.Hour), Coordinates: coords(51, -8)},
+		{Id: "assault", Timestamp: at(time.Minute), Coordinates: coords(53, -6)},
+		{Id: "corroborated-a", Timestamp: at(30 * time.Minute), Coordinates: coords(54, -6)},
+		{Id: "corroborated-b", Timestamp: at(20 * time.Minute), Coordinates: coords(54.0001, -6)},
+		{Id: "bus", Timestamp: at(time.Minute)},
+	}
+	base := map[string]int{
+		"assault": 50,
+		"bus":     20,
+	}
+
+	s.Rank(incidents, base, now)
+
+	want := []string{"assault", "bus", "corroborated-a", "corroborated-b", "old-parking", "parking"}
+	for i, inc := range incidents {
+		if inc.Id != want[i] {
+			t.Errorf("Rank()[%d] = %s, want %s", i, inc.Id, want[i])
+		}
+	}
+}
+
+func TestNewUnknownLocation(t *testing.T) {
+	if _, err := New(Config{Locations: map[string]int{"space": 1}}); err == nil {
+		t.Errorf("New() = nil, want error")
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	inc := &incident.Incident{
+		Description: "knife on the train",
+		Location:    incident.Location_LOCATION_TRANSPORTATION,
+	}
+
+	testCases := map[string]struct {
+		yaml string
+		want int
+	}{
+		"defaults":           {"per_hour: 1", 70},
+		"replaced keywords":  {"keywords: {train: 5}", 25},
+		"disabled keywords":  {"keywords: {}", 20},
+		"disabled locations": {"locations: {}\nkeywords: {}", 0},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var cfg Config
+			if err := envconfig.Process("test", &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tc.yaml), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Base(inc); got != tc.want {
+				t.Errorf("Base() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,22 @@
 package memory
 
 import (
+	"container/heap"
 	"context"
+	"sync"
 
 	"google.golang.org/protobuf/proto"
 	"safer.place/internal/queue"
 )
 
 type Queue[T proto.Message] struct {
-	messages chan T
+	mu    sync.Mutex
+	items items[T]
+	seq   uint64
+	// ready is signalled whenever there might be messages waiting to be consumed.
+	ready chan struct{}
+
+	priority func(T) int
 }
 
 type Message[T proto.Message] struct {
@@ -26,26 +34,113 @@ func (m *Message[T]) Ack() {}
 
 // Nack restacks the message to the queue again
 func (m *Message[T]) Nack() {
-	m.q.messages <- m.body
+	m.q.push(m.body)
+}
+
+// Option configures the queue
+type Option[T proto.Message] func(*Queue[T])
+
+// Priority is used to order the messages in the queue. Messages with higher priority are
+// consumed first, and messages with the same priority in the order they were produced.
+func Priority[T proto.Message](fn func(T) int) Option[T] {
+	return func(q *Queue[T]) {
+		q.priority = fn
+	}
 }
 
-// New creates a simple in memory queue based on Go channels.
-func New[T proto.Message]() *Queue[T] {
-	return &Queue[T]{
-		messages: make(chan T),
+// New creates a simple in memory queue.
+func New[T proto.Message](opts ...Option[T]) *Queue[T] {
+	q := &Queue[T]{
+		ready:    make(chan struct{}, 1),
+		priority: func(T) int { return 0 },
+	}
+
+	for _, opt := range opts {
+		opt(q)
 	}
+
+	return q
 }
 
 // Produce the message to the queue
 func (q *Queue[T]) Produce(ctx context.Context, t T) error {
-	q.messages <- t
+	q.push(t)
 	return nil
 }
 
-// Consume the message
+// Consume the message with the highest priority, waiting until one is available.
 func (q *Queue[T]) Consume(ctx context.Context) (queue.Message[T], error) {
-	return &Message[T]{
-		q:    q,
-		body: <-q.messages,
-	}, nil
+	for {
+		if body, ok := q.pop(); ok {
+			return &Message[T]{
+				q:    q,
+				body: body,
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.ready:
+		}
+	}
+}
+
+func (q *Queue[T]) push(t T) {
+	q.mu.Lock()
+	q.seq++
+	heap.Push(&q.items, item[T]{body: t, priority: q.priority(t), seq: q.seq})
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+func (q *Queue[T]) pop() (T, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.items.Len() == 0 {
+		var zero T
+		return zero, false
+	}
+
+	it := heap.Pop(&q.items).(item[T])
+	// Wake up other consumers if there are more messages waiting.
+	if q.items.Len() > 0 {
+		q.signal()
+	}
+
+	return it.body, true
+}
+
+func (q *Queue[T]) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+type item[T proto.Message] struct {
+	body     T
+	priority int
+	seq      uint64
+}
+
+// items implements heap.Interface ordered by priority and then by sequence.
+type items[T proto.Message] []item[T]
+
+func (h items[T]) Len() int { return len(h) }
+func (h items[T]) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h items[T]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *items[T]) Push(x any)   { *h = append(*h, x.(item[T])) }
+func (h *items[T]) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
 }
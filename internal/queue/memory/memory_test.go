@@ -0,0 +1,42 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestPriority(t *testing.T) {
+	ctx := context.Background()
+	q := New(Priority(func(m *wrapperspb.Int64Value) int {
+		return int(m.Value / 10)
+	}))
+
+	for _, v := range []int64{1, 20, 2, 30, 21} {
+		if err := q.Produce(ctx, wrapperspb.Int64(v)); err != nil {
+			t.Fatalf("Produce(%d) = %v", v, err)
+		}
+	}
+
+	for _, want := range []int64{30, 20, 21, 1, 2} {
+		msg, err := q.Consume(ctx)
+		if err != nil {
+			t.Fatalf("Consume() = %v", err)
+		}
+		if got := msg.Body().Value; got != want {
+			t.Errorf("Consume() = %d, want %d", got, want)
+		}
+		msg.Ack()
+	}
+}
+
+func TestConsumeCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := New[*wrapperspb.Int64Value]().Consume(ctx); err == nil {
+		t.Errorf("Consume() on empty queue = nil, want error")
+	}
+}
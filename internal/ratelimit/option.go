@@ -0,0 +1,21 @@
+package ratelimit
+
+import "go.uber.org/zap"
+
+// Option extends the functionality of the limiter.
+type Option func(*Limiter)
+
+// Logger sets the logger of the limiter.
+func Logger(log *zap.Logger) Option {
+	return func(l *Limiter) {
+		l.log = log
+	}
+}
+
+// Buckets keeps the token buckets in the store instead of the memory, so they can be shared by
+// all the replicas.
+func Buckets(store Store) Option {
+	return func(l *Limiter) {
+		l.store = store
+	}
+}
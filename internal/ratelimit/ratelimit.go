@@ -0,0 +1,226 @@
+// Copyright 2023 SaferPlace
+
+// Package ratelimit limits how often the users can call the endpoints, so a single client cannot
+// flood the review queue or fill the storage. Every endpoint has a token bucket for every
+// authenticated user and for every client IP address, and the request is rejected when either of
+// them is empty.
+//
+// The limits are applied by the Connect interceptor to the Connect services, and by the HTTP
+// middleware to the other handlers. The rejected requests are told when to retry with the
+// Retry-After header.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+)
+
+// Config of the rate limits.
+type Config struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// ClientIPHeader contains the IP address of the client when the server is behind a proxy,
+	// such as X-Forwarded-For. The last address is used, as it is the one added by the proxy.
+	// The address of the connection is used when it is empty.
+	ClientIPHeader string `yaml:"client_ip_header" split_words:"true" default:""`
+	// Endpoints are the limited Connect procedures, such as /report.v1.ReportService/SendReport,
+	// or HTTP paths. Paths ending with a slash limit all the paths starting with them.
+	Endpoints map[string]EndpointConfig `yaml:"endpoints"`
+}
+
+// EndpointConfig has the limits of the endpoint. A zero limit does not limit the requests.
+type EndpointConfig struct {
+	// User limits every authenticated user.
+	User Limit `yaml:"user"`
+	// IP limits every client IP address, including the unauthenticated requests.
+	IP Limit `yaml:"ip"`
+}
+
+// Limit allows the number of requests at once, after which the requests are allowed at the same
+// rate as they are refilled over the period.
+type Limit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+}
+
+// ErrRateLimited is returned when the request is over the limit of the endpoint.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// retryAfterHeader tells the client how many seconds to wait before retrying.
+const retryAfterHeader = "Retry-After"
+
+// Limiter limits the requests to the configured endpoints.
+type Limiter struct {
+	endpoints      map[string]EndpointConfig
+	clientIPHeader string
+	store          Store
+	log            *zap.Logger
+
+	rejected *prometheus.CounterVec
+}
+
+// New creates the limiter using the memory store, unless another store is provided. Metrics are
+// registered with the provided registerer.
+func New(cfg *Config, reg prometheus.Registerer, opts ...Option) (*Limiter, error) {
+	l := &Limiter{
+		endpoints:      cfg.Endpoints,
+		clientIPHeader: cfg.ClientIPHeader,
+		store:          NewMemoryStore(),
+		log:            zap.NewNop(),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "saferplace",
+			Subsystem: "ratelimit",
+			Name:      "rejected_requests_total",
+			Help:      "Number of requests rejected by the rate limits, by endpoint and the limit.",
+		}, []string{"endpoint", "limit"}),
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if err := validate(l); err != nil {
+		return nil, fmt.Errorf("ratelimit validation failed: %w", err)
+	}
+
+	if err := reg.Register(l.rejected); err != nil {
+		return nil, fmt.Errorf("unable to register ratelimit metrics: %w", err)
+	}
+
+	return l, nil
+}
+
+// Interceptor limits the unary Connect procedures. The rejected requests fail with
+// connect.CodeResourceExhausted.
+func (l *Limiter) Interceptor() connect.UnaryInterceptorFunc {
+	return connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return connect.UnaryFunc(func(
+			ctx context.Context,
+			req connect.AnyRequest,
+		) (connect.AnyResponse, error) {
+			ip := l.clientIP(req.Header(), req.Peer().Addr)
+			if retryAfter, ok := l.allow(ctx, req.Spec().Procedure, ip); !ok {
+				err := connect.NewError(connect.CodeResourceExhausted, ErrRateLimited)
+				err.Meta().Set(retryAfterHeader, seconds(retryAfter))
+				return nil, err
+			}
+			return next(ctx, req)
+		})
+	})
+}
+
+// Middleware limits the HTTP handlers. The rejected requests fail with 429 Too Many Requests.
+// It must be wrapped by the authentication middleware to limit the users.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := l.clientIP(r.Header, r.RemoteAddr)
+		if retryAfter, ok := l.allow(r.Context(), r.URL.Path, ip); !ok {
+			w.Header().Set(retryAfterHeader, seconds(retryAfter))
+			http.Error(w, ErrRateLimited.Error(), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow the request to the endpoint, or return how long to wait until it is allowed.
+func (l *Limiter) allow(ctx context.Context, path, ip string) (time.Duration, bool) {
+	endpoint, cfg, ok := l.endpoint(path)
+	if !ok {
+		return 0, true
+	}
+
+	if user := auth.UserFromContext(ctx); user != "" && cfg.User.Requests > 0 {
+		if retryAfter, ok := l.take(ctx, endpoint, "user", user, cfg.User); !ok {
+			return retryAfter, false
+		}
+	}
+	if ip != "" && cfg.IP.Requests > 0 {
+		if retryAfter, ok := l.take(ctx, endpoint, "ip", ip, cfg.IP); !ok {
+			return retryAfter, false
+		}
+	}
+
+	return 0, true
+}
+
+// take a token from the bucket of the client. The requests are allowed when the store is not
+// available, so the endpoints keep working without it.
+func (l *Limiter) take(ctx context.Context, endpoint, limit, client string, cfg Limit) (time.Duration, bool) {
+	ok, retryAfter, err := l.store.Take(ctx, endpoint+"|"+limit+"|"+client, cfg)
+	if err != nil {
+		l.log.Warn("unable to check rate limit",
+			zap.String("endpoint", endpoint),
+			zap.String("limit", limit),
+			zap.Error(err),
+		)
+		return 0, true
+	}
+	if !ok {
+		l.rejected.WithLabelValues(endpoint, limit).Inc()
+	}
+	return retryAfter, ok
+}
+
+// endpoint limiting the path, preferring the exact match and then the longest prefix.
+func (l *Limiter) endpoint(path string) (string, EndpointConfig, bool) {
+	if cfg, ok := l.endpoints[path]; ok {
+		return path, cfg, true
+	}
+
+	var (
+		match string
+		cfg   EndpointConfig
+	)
+	for endpoint, c := range l.endpoints {
+		if strings.HasSuffix(endpoint, "/") && strings.HasPrefix(path, endpoint) && len(endpoint) > len(match) {
+			match, cfg = endpoint, c
+		}
+	}
+	return match, cfg, match != ""
+}
+
+// clientIP of the request, from the header when the server is behind a proxy.
+func (l *Limiter) clientIP(header http.Header, addr string) string {
+	if l.clientIPHeader != "" {
+		if values := header.Values(l.clientIPHeader); len(values) > 0 {
+			forwarded := strings.Split(values[len(values)-1], ",")
+			return strings.TrimSpace(forwarded[len(forwarded)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// seconds to wait, rounded up as Retry-After does not allow fractions.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
+
+var errInvalidLimit = errors.New("invalid limit")
+
+func validate(l *Limiter) error {
+	for endpoint, cfg := range l.endpoints {
+		for _, limit := range []Limit{cfg.User, cfg.IP} {
+			if limit.Requests < 0 || (limit.Requests > 0 && limit.Per <= 0) {
+				return fmt.Errorf("%w of %s: %d per %v", errInvalidLimit, endpoint, limit.Requests, limit.Per)
+			}
+		}
+	}
+	return nil
+}
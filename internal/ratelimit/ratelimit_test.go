@@ -0,0 +1,169 @@
+// Copyright 2023 SaferPlace
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"safer.place/internal/auth"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	limit := Limit{Requests: 2, Per: time.Minute}
+
+	take := func(key string) (bool, time.Duration) {
+		t.Helper()
+		ok, retryAfter, err := s.Take(context.Background(), key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok, retryAfter
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := take("a"); !ok {
+			t.Fatalf("request %d rejected within the limit", i)
+		}
+	}
+	if ok, retryAfter := take("a"); ok || retryAfter != 30*time.Second {
+		t.Errorf("Take() = %v, %v, want rejected for 30s", ok, retryAfter)
+	}
+	if ok, _ := take("b"); !ok {
+		t.Error("bucket shared between the keys")
+	}
+
+	// A token is added every 30 seconds.
+	now = now.Add(20 * time.Second)
+	if ok, retryAfter := take("a"); ok || retryAfter != 10*time.Second {
+		t.Errorf("Take() = %v, %v, want rejected for 10s", ok, retryAfter)
+	}
+	now = now.Add(10 * time.Second)
+	if ok, _ := take("a"); !ok {
+		t.Error("request rejected after the bucket was refilled")
+	}
+
+	// The full buckets are removed.
+	now = now.Add(time.Hour)
+	take("c")
+	if _, ok := s.buckets["a"]; ok {
+		t.Error("full bucket was not removed")
+	}
+}
+
+func newLimiter(t *testing.T, cfg *Config) *Limiter {
+	t.Helper()
+	l, err := New(cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestMiddleware(t *testing.T) {
+	l := newLimiter(t, &Config{
+		ClientIPHeader: "X-Forwarded-For",
+		Endpoints: map[string]EndpointConfig{
+			"/v1/upload":   {User: Limit{Requests: 1, Per: time.Minute}, IP: Limit{Requests: 2, Per: time.Minute}},
+			"/v1/uploads/": {IP: Limit{Requests: 1, Per: time.Hour}},
+		},
+	})
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(path, user, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.Header.Set("X-Forwarded-For", "10.0.0.1, "+ip)
+		if user != "" {
+			r = r.WithContext(auth.WithUser(r.Context(), user))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	testCases := []struct {
+		name, path, user, ip string
+		code                 int
+	}{
+		{"first upload", "/v1/upload", "a@example.com", "192.0.2.1", http.StatusOK},
+		{"user limit", "/v1/upload", "a@example.com", "192.0.2.2", http.StatusTooManyRequests},
+		{"another user", "/v1/upload", "b@example.com", "192.0.2.1", http.StatusOK},
+		{"ip limit", "/v1/upload", "c@example.com", "192.0.2.1", http.StatusTooManyRequests},
+		{"prefix", "/v1/uploads/1", "", "192.0.2.1", http.StatusOK},
+		{"prefix limit", "/v1/uploads/2", "", "192.0.2.1", http.StatusTooManyRequests},
+		{"not limited", "/v1/other", "a@example.com", "192.0.2.1", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		rec := request(tc.path, tc.user, tc.ip)
+		if rec.Code != tc.code {
+			t.Errorf("%s: code = %d, want %d", tc.name, rec.Code, tc.code)
+		}
+		if retryAfter := rec.Header().Get("Retry-After"); (retryAfter != "") != (tc.code != http.StatusOK) {
+			t.Errorf("%s: Retry-After = %q", tc.name, retryAfter)
+		}
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	const procedure = "/report.v1.ReportService/SendReport"
+	l := newLimiter(t, &Config{
+		Endpoints: map[string]EndpointConfig{
+			procedure: {User: Limit{Requests: 1, Per: time.Hour}},
+		},
+	})
+	next := l.Interceptor()(func(context.Context, connect.AnyRequest) (connect.AnyResponse, error) {
+		return nil, nil
+	})
+
+	ctx := auth.WithUser(context.Background(), "a@example.com")
+	if _, err := next(ctx, &fakeRequest{procedure: procedure}); err != nil {
+		t.Fatalf("request within the limit = %v", err)
+	}
+
+	_, err := next(ctx, &fakeRequest{procedure: procedure})
+	var connectErr *connect.Error
+	if !errors.As(err, &connectErr) || connectErr.Code() != connect.CodeResourceExhausted {
+		t.Fatalf("request over the limit = %v, want %v", err, connect.CodeResourceExhausted)
+	}
+	if retryAfter := connectErr.Meta().Get("Retry-After"); retryAfter != "3600" {
+		t.Errorf("Retry-After = %q, want 3600", retryAfter)
+	}
+}
+
+type fakeRequest struct {
+	connect.AnyRequest
+	procedure string
+}
+
+func (r *fakeRequest) Spec() connect.Spec {
+	return connect.Spec{Procedure: r.procedure}
+}
+
+func (r *fakeRequest) Peer() connect.Peer {
+	return connect.Peer{Addr: "192.0.2.1:1234"}
+}
+
+func (r *fakeRequest) Header() http.Header {
+	return http.Header{}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&Config{
+		Endpoints: map[string]EndpointConfig{
+			"/v1/upload": {User: Limit{Requests: 1}},
+		},
+	}, prometheus.NewRegistry())
+	if !errors.Is(err, errInvalidLimit) {
+		t.Errorf("New() = %v, want %v", err, errInvalidLimit)
+	}
+}
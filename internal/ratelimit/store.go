@@ -0,0 +1,89 @@
+// Copyright 2023 SaferPlace
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store keeps the token buckets. The buckets are only shared by the replicas of the server when
+// they use the same shared store, such as a Redis server, instead of the memory store.
+type Store interface {
+	// Take a token from the bucket with the key, which holds up to the requests of the limit and
+	// is refilled over its period. When the bucket is empty, it returns false and how long it
+	// takes until the next token is added.
+	Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+}
+
+// sweepInterval between removing the full buckets from the memory store.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps the token buckets in memory, so every replica has its own buckets.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// bucket has the tokens left at the time it was last updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is the time the bucket is refilled, after which it is the same as a new bucket.
+	full time.Time
+}
+
+// NewMemoryStore creates an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take a token from the bucket with the key.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	capacity := float64(limit.Requests)
+	// interval between adding the tokens to the bucket.
+	interval := limit.Per / time.Duration(limit.Requests)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = min(capacity, b.tokens+float64(now.Sub(b.updated))/float64(interval))
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(interval)), nil
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((capacity - b.tokens) * float64(interval)))
+	return true, 0, nil
+}
+
+// sweep removes the full buckets, so the store does not grow with every client ever seen.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package review
+
+import (
+	"safer.place/internal/notifier"
+	"safer.place/internal/priority"
+	"safer.place/internal/triage"
+)
+
+// Option extends the functionality of the review consumer.
+type Option func(*Review)
+
+// Triage evaluates the triage rules against every incoming incident.
+func Triage(e *triage.Engine) Option {
+	return func(r *Review) {
+		r.triage = e
+	}
+}
+
+// Notifiers which can be selected by name by the triage rules. The default notifier is used
+// when no notifier has been selected or the name is not known.
+func Notifiers(notifiers map[string]notifier.Notifier) Option {
+	return func(r *Review) {
+		r.notifiers = notifiers
+	}
+}
+
+// Priority calculates the base priority of every incoming incident.
+func Priority(s *priority.Scorer) Option {
+	return func(r *Review) {
+		r.priority = s
+	}
+}
+
+// Alerts notifies the public when a triage rule resolves the incident as alerting.
+func Alerts(n notifier.Notifier) Option {
+	return func(r *Review) {
+		r.alerts = n
+	}
+}
+
+// Reporters notifies the reporter when a triage rule resolves their incident.
+func Reporters(n notifier.Notifier) Option {
+	return func(r *Review) {
+		r.reporters = n
+	}
+}
@@ -4,19 +4,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"api.safer.place/incident/v1"
 	"go.uber.org/zap"
 	"safer.place/internal/database"
 	"safer.place/internal/notifier"
+	"safer.place/internal/notifier/fanoutnotifier"
+	"safer.place/internal/priority"
 	"safer.place/internal/queue"
+	"safer.place/internal/triage"
 )
 
+// TriageAuthor is the author of the comments left when a triage rule resolves the incident.
+const TriageAuthor = "triage"
+
 // Review is a big wrapper around incoming reviews
 type Review struct {
 	incoming       queue.Consumer[*incident.Incident]
 	reviewNotifier notifier.Notifier
+	notifiers      map[string]notifier.Notifier
+	alerts         notifier.Notifier
+	reporters      notifier.Notifier
 	db             database.Database
+	triage         *triage.Engine
+	priority       *priority.Scorer
 
 	log *zap.Logger
 }
@@ -27,33 +39,42 @@ func New(
 	incoming queue.Consumer[*incident.Incident],
 	db database.Database,
 	reviewNotifier notifier.Notifier,
+	opts ...Option,
 ) *Review {
-	return &Review{
+	r := &Review{
 		log:            log,
 		reviewNotifier: reviewNotifier,
 		db:             db,
 		incoming:       incoming,
 	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
 }
 
 // Run the review process
 func (r *Review) Run(ctx context.Context) error {
 	r.log.Info("listening for incoming reviews")
 	for {
-		if err := r.handleIncoming(ctx); err != nil {
+		msg, err := r.incoming.Consume(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("unable to receive: %w", err)
+		}
+		// The incident is requeued when it could not be handled, the other incidents are
+		// still handled.
+		if err := r.handleIncoming(ctx, msg); err != nil {
 			r.log.Error("incident handling failed", zap.Error(err))
-			// TODO: For debugging. We typically don't actually want to shut
-			//       down.
-			return err
 		}
 	}
 }
 
-func (r *Review) handleIncoming(ctx context.Context) (err error) {
-	msg, err := r.incoming.Consume(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to receive: %w", err)
-	}
+func (r *Review) handleIncoming(ctx context.Context, msg queue.Message[*incident.Incident]) (err error) {
 	defer func() {
 		if err != nil {
 			r.log.Debug("nacking incident", zap.Error(err))
@@ -76,10 +97,90 @@ func (r *Review) handleIncoming(ctx context.Context) (err error) {
 		return fmt.Errorf("unable to save incident: %w", err)
 	}
 
-	// Notify about incoming review
-	if err := r.reviewNotifier.Notify(ctx, inc); err != nil {
-		return fmt.Errorf("unable to notify about incoming review: %w", err)
+	decision := r.triage.Evaluate(ctx, inc)
+	if err := r.applyDecision(ctx, inc, decision); err != nil {
+		return fmt.Errorf("unable to apply triage decision: %w", err)
+	}
+
+	// The incident resolved by the triage is treated like one resolved by a reviewer.
+	if inc.Resolution == incident.Resolution_RESOLUTION_ALERTED {
+		r.notify(ctx, r.alerts, inc, "alert")
+	}
+	if inc.Resolution != incident.Resolution_RESOLUTION_UNSPECIFIED {
+		r.notify(ctx, r.reporters, inc, "reporter notification")
+	}
+
+	// Notify about incoming review. The incident is already saved, so it is not requeued when
+	// the notification fails, as it would only be found to exist already.
+	ctx = notifier.WithUrgency(ctx, decision.Urgency)
+	if err := r.notifier(decision.Notifier).Notify(ctx, inc); err != nil {
+		fields := []zap.Field{zap.String("id", inc.Id), zap.Error(err)}
+		var fanoutErr *fanoutnotifier.Error
+		if errors.As(err, &fanoutErr) {
+			fields = append(fields, zap.Strings("failed_targets", fanoutErr.Failed()))
+		}
+		r.log.Error("unable to notify about incoming review", fields...)
 	}
 
 	return nil
 }
+
+// applyDecision saves the outcome of the triage rules together with the incident priority.
+func (r *Review) applyDecision(ctx context.Context, inc *incident.Incident, d triage.Decision) error {
+	if p := r.priority.Base(inc) + d.Priority; p != 0 {
+		if err := r.db.SavePriority(ctx, inc.Id, p); err != nil {
+			return fmt.Errorf("unable to save priority: %w", err)
+		}
+	}
+
+	if !d.Matched() {
+		return nil
+	}
+
+	r.log.Info("incident triaged",
+		zap.String("id", inc.Id),
+		zap.String("rule", d.Rule),
+	)
+
+	if d.Resolution != incident.Resolution_RESOLUTION_UNSPECIFIED {
+		comment := &incident.Comment{
+			AuthorId:  TriageAuthor,
+			Timestamp: time.Now().Unix(),
+			Message:   fmt.Sprintf("resolved by triage rule %q", d.Rule),
+		}
+		if err := r.db.SaveReview(ctx, inc.Id, d.Resolution, comment); err != nil {
+			return fmt.Errorf("unable to save review: %w", err)
+		}
+		inc.Resolution = d.Resolution
+		inc.ReviewerComments = append(inc.ReviewerComments, comment)
+	}
+
+	return nil
+}
+
+// notify sends the notification about the resolved incident, which is not retried when it fails,
+// the same as when a reviewer resolves the incident.
+func (r *Review) notify(ctx context.Context, n notifier.Notifier, inc *incident.Incident, what string) {
+	if n == nil {
+		return
+	}
+	if err := n.Notify(ctx, inc); err != nil {
+		r.log.Error("unable to send "+what,
+			zap.String("id", inc.Id),
+			zap.Error(err),
+		)
+	}
+}
+
+// notifier returns the notifier with the given name, or the default notifier.
+func (r *Review) notifier(name string) notifier.Notifier {
+	if name == "" {
+		return r.reviewNotifier
+	}
+	if n, ok := r.notifiers[name]; ok {
+		return n
+	}
+
+	r.log.Warn("unknown notifier selected, using default", zap.String("notifier", name))
+	return r.reviewNotifier
+}
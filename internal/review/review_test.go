@@ -0,0 +1,171 @@
+// Copyright 2023 SaferPlace
+
+package review
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/notifier/fanoutnotifier"
+	"safer.place/internal/queue"
+	"safer.place/internal/triage"
+)
+
+type fakeMessage struct {
+	body  *incident.Incident
+	acked chan bool
+}
+
+func (m *fakeMessage) Body() *incident.Incident { return m.body }
+func (m *fakeMessage) Ack()                     { m.acked <- true }
+func (m *fakeMessage) Nack()                    { m.acked <- false }
+
+// fakeConsumer returns the messages, and then blocks until the context is cancelled.
+type fakeConsumer struct {
+	messages chan queue.Message[*incident.Incident]
+}
+
+func (c *fakeConsumer) Consume(ctx context.Context) (queue.Message[*incident.Incident], error) {
+	select {
+	case msg := <-c.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type fakeDatabase struct {
+	database.Database
+	resolutions map[string]incident.Resolution
+}
+
+func (fakeDatabase) SaveIncident(context.Context, *incident.Incident) error {
+	return nil
+}
+
+func (db fakeDatabase) SaveReview(
+	_ context.Context,
+	id string,
+	resolution incident.Resolution,
+	_ *incident.Comment,
+) error {
+	db.resolutions[id] = resolution
+	return nil
+}
+
+type failingNotifier struct{}
+
+func (failingNotifier) Notify(context.Context, *incident.Incident) error {
+	return &fanoutnotifier.Error{Targets: map[string]error{"discord": errors.New("unavailable")}}
+}
+
+func TestRunNotificationFailure(t *testing.T) {
+	consumer := &fakeConsumer{messages: make(chan queue.Message[*incident.Incident], 2)}
+	first := &fakeMessage{body: &incident.Incident{Id: "first"}, acked: make(chan bool, 1)}
+	second := &fakeMessage{body: &incident.Incident{Id: "second"}, acked: make(chan bool, 1)}
+	consumer.messages <- first
+	consumer.messages <- second
+
+	r := New(zap.NewNop(), consumer, fakeDatabase{}, failingNotifier{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	// The saved incidents are acknowledged, so they are not requeued, and the failure does not
+	// stop the other incidents from being handled.
+	for _, msg := range []*fakeMessage{first, second} {
+		select {
+		case acked := <-msg.acked:
+			if !acked {
+				t.Errorf("%s was not acknowledged", msg.body.Id)
+			}
+		case err := <-done:
+			t.Fatalf("Run() = %v, stopped before handling %s", err, msg.body.Id)
+		case <-time.After(time.Second):
+			t.Fatalf("%s was not handled", msg.body.Id)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run() = %v, want nil once cancelled", err)
+	}
+}
+
+// recordingNotifier records the incidents it was notified about.
+type recordingNotifier struct {
+	notified []string
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, inc *incident.Incident) error {
+	n.notified = append(n.notified, inc.Id)
+	return nil
+}
+
+func TestHandleIncomingTriageResolution(t *testing.T) {
+	engine, err := triage.New(triage.Config{
+		Timezone: "UTC",
+		Rules: []triage.Rule{{
+			Name:       "fire",
+			Expression: `incident.description.contains("fire")`,
+			Action:     triage.Action{Resolution: "ALERTED"},
+		}},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("triage.New() = %v", err)
+	}
+
+	testCases := map[string]struct {
+		description string
+		resolution  incident.Resolution
+		notified    bool
+	}{
+		"resolved by triage": {
+			description: "fire in the building",
+			resolution:  incident.Resolution_RESOLUTION_ALERTED,
+			notified:    true,
+		},
+		"not resolved": {
+			description: "broken window",
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			db := fakeDatabase{resolutions: make(map[string]incident.Resolution)}
+			alerts := &recordingNotifier{}
+			reporters := &recordingNotifier{}
+			r := New(zap.NewNop(), nil, db, &recordingNotifier{},
+				Triage(engine),
+				Alerts(alerts),
+				Reporters(reporters),
+			)
+
+			msg := &fakeMessage{
+				body:  &incident.Incident{Id: "id", Description: tc.description},
+				acked: make(chan bool, 1),
+			}
+			if err := r.handleIncoming(context.Background(), msg); err != nil {
+				t.Fatalf("handleIncoming() = %v", err)
+			}
+
+			if got := db.resolutions["id"]; got != tc.resolution {
+				t.Errorf("saved resolution = %v, want %v", got, tc.resolution)
+			}
+			if got := len(alerts.notified) == 1; got != tc.notified {
+				t.Errorf("alerts notified = %v, want %v", alerts.notified, tc.notified)
+			}
+			if got := len(reporters.notified) == 1; got != tc.notified {
+				t.Errorf("reporters notified = %v, want %v", reporters.notified, tc.notified)
+			}
+		})
+	}
+}
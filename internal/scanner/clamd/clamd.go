@@ -0,0 +1,155 @@
+// Copyright 2023 SaferPlace
+
+// Package clamd scans the files with a ClamAV daemon, or any daemon implementing its INSTREAM
+// command. The file is streamed to the daemon in chunks, so it is never written to its disk.
+// https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"safer.place/internal/scanner"
+)
+
+// Config of the connection to the daemon.
+type Config struct {
+	// Address of the daemon, either host:port or the path of its unix socket.
+	Address string `yaml:"address" default:"localhost:3310"`
+	// Timeout of the scan, including streaming the file to the daemon.
+	Timeout time.Duration `yaml:"timeout" default:"30s"`
+	// StreamMaxLength must match the StreamMaxLength of the daemon, 25 MiB by default. The daemon
+	// fails the scans of the larger files, so the uploads must not be larger.
+	StreamMaxLength int64 `yaml:"stream_max_length" split_words:"true" default:"26214400"`
+}
+
+// chunkSize of the file sent to the daemon at once.
+const chunkSize = 32 << 10
+
+// Scanner scans the files using the daemon. Every scan uses a new connection.
+type Scanner struct {
+	network string
+	address string
+	timeout time.Duration
+	dialer  net.Dialer
+}
+
+var _ scanner.Scanner = (*Scanner)(nil)
+
+// New creates the scanner, without connecting to the daemon.
+func New(cfg *Config) (*Scanner, error) {
+	s := &Scanner{
+		network: "tcp",
+		address: cfg.Address,
+		timeout: cfg.Timeout,
+	}
+	if strings.HasPrefix(s.address, "/") {
+		s.network = "unix"
+	}
+
+	if err := validate(s); err != nil {
+		return nil, fmt.Errorf("clamd validation failed: %w", err)
+	}
+
+	return s, nil
+}
+
+// Scan the file read from r with the INSTREAM command.
+func (s *Scanner) Scan(ctx context.Context, r io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	conn, err := s.dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return fmt.Errorf("unable to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	// The reads and writes are interrupted when the scan is cancelled or times out.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := stream(conn, r); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("unable to read clamd reply: %w", err)
+	}
+	return parseReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// stream the file to the daemon, as chunks prefixed by their size and ending with an empty one.
+// The command is prefixed with z, so the reply is terminated by a null byte.
+func stream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("unable to send command to clamd: %w", err)
+	}
+
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("unable to send file to clamd: %w", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Write(make([]byte, 4)); err != nil {
+		return fmt.Errorf("unable to send file to clamd: %w", err)
+	}
+	return nil
+}
+
+// parseReply of the daemon, such as "stream: OK", "stream: Eicar-Signature FOUND" or
+// "INSTREAM size limit exceeded. ERROR".
+func parseReply(reply string) error {
+	result, ok := strings.CutPrefix(reply, "stream: ")
+	switch {
+	case ok && result == "OK":
+		return nil
+	case ok && strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", scanner.ErrInfected, strings.TrimSuffix(result, " FOUND"))
+	default:
+		return fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+var (
+	errMissingAddress = errors.New("missing address")
+	errMissingTimeout = errors.New("missing timeout")
+)
+
+func validate(s *Scanner) error {
+	if s.address == "" {
+		return errMissingAddress
+	}
+	if s.timeout <= 0 {
+		return errMissingTimeout
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 SaferPlace
+
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"safer.place/internal/scanner"
+)
+
+// fakeClamd accepts INSTREAM commands and replies with the result of the reply function.
+func fakeClamd(t *testing.T, reply func(file []byte) string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				file, err := readStream(bufio.NewReader(conn))
+				if err != nil {
+					t.Errorf("invalid stream: %v", err)
+					return
+				}
+				io.WriteString(conn, reply(file)+"\x00")
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func readStream(r *bufio.Reader) ([]byte, error) {
+	command, err := r.ReadString(0)
+	if err != nil {
+		return nil, err
+	}
+	if command != "zINSTREAM\x00" {
+		return nil, errors.New("unexpected command " + command)
+	}
+
+	var file bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return file.Bytes(), nil
+		}
+		if _, err := io.CopyN(&file, r, int64(size)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	addr := fakeClamd(t, func(file []byte) string {
+		switch {
+		case bytes.Contains(file, []byte("EICAR")):
+			return "stream: Eicar-Signature FOUND"
+		case len(file) > 100<<10:
+			return "INSTREAM size limit exceeded. ERROR"
+		default:
+			return "stream: OK"
+		}
+	})
+	s, err := New(&Config{Address: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		file     string
+		infected bool
+		err      bool
+	}{
+		"clean":      {file: "clean image"},
+		"empty":      {file: ""},
+		"infected":   {file: strings.Repeat("a", 2*chunkSize) + "EICAR", infected: true, err: true},
+		"size limit": {file: strings.Repeat("a", 200<<10), err: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			err := s.Scan(context.Background(), strings.NewReader(tc.file))
+			if (err != nil) != tc.err || errors.Is(err, scanner.ErrInfected) != tc.infected {
+				t.Errorf("Scan() = %v, want error %v, infected %v", err, tc.err, tc.infected)
+			}
+		})
+	}
+}
+
+func TestScanUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s, err := New(&Config{Address: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Scan(context.Background(), strings.NewReader("image")); err == nil || errors.Is(err, scanner.ErrInfected) {
+		t.Errorf("Scan() = %v, want connection error", err)
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	// The daemon never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	s, err := New(&Config{Address: l.Addr().String(), Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Scan(context.Background(), strings.NewReader("image")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Scan() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2023 SaferPlace
+
+// Package scanner checks the uploaded files for malware.
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrInfected is returned when malware was found in the file.
+var ErrInfected = errors.New("scanner: file is infected")
+
+// Scanner scans the files for malware.
+type Scanner interface {
+	// Scan the file read from r until its end. It returns an error wrapping ErrInfected if
+	// malware was found, or any other error if the file could not be scanned.
+	Scan(ctx context.Context, r io.Reader) error
+}
@@ -0,0 +1,210 @@
+// Copyright 2023 SaferPlace
+
+// Package discord allows reviewers to review incidents directly from discord, using the buttons
+// attached to the incident notification.
+package discord
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"connectrpc.com/connect"
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+	"safer.place/internal/notifier/discordnotifier"
+	"safer.place/internal/service"
+)
+
+// Config of the discord interactions.
+type Config struct {
+	// PublicKey of the discord application, hex encoded.
+	PublicKey string `yaml:"public_key" split_words:"true"`
+}
+
+// Reviewer saves the review of the incident.
+type Reviewer interface {
+	Review(ctx context.Context, id string, res incident.Resolution, comment *incident.Comment) error
+}
+
+// Service handles the discord interactions.
+type Service struct {
+	key      ed25519.PublicKey
+	reviewer Reviewer
+	log      *zap.Logger
+}
+
+// Register registers the discord interactions service.
+func Register(opts ...Option) service.Service {
+	s := &Service{}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := validate(s); err != nil {
+		panic(err)
+	}
+
+	// We can ignore the interceptors as this is a non-connect service
+	return func(_ ...connect.Interceptor) (string, http.Handler) {
+		return "/v1/discord/interactions", s
+	}
+}
+
+// ServeHTTP verifies the signature of the interaction and handles it.
+// https://discord.com/developers/docs/interactions/receiving-and-responding
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !discordgo.VerifyInteraction(r, s.key) {
+		http.Error(w, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var interaction discordgo.Interaction
+	if err := json.NewDecoder(r.Body).Decode(&interaction); err != nil {
+		s.log.Error("unable to decode interaction", zap.Error(err))
+		http.Error(w, "invalid interaction", http.StatusBadRequest)
+		return
+	}
+
+	var resp *discordgo.InteractionResponse
+	switch interaction.Type {
+	case discordgo.InteractionPing:
+		resp = &discordgo.InteractionResponse{Type: discordgo.InteractionResponsePong}
+	case discordgo.InteractionMessageComponent:
+		resp = s.review(r.Context(), &interaction)
+	default:
+		http.Error(w, "unsupported interaction", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.log.Error("unable to encode interaction response", zap.Error(err))
+	}
+}
+
+// review the incident using the resolution from the clicked button, and update the original
+// message to show the decision.
+func (s *Service) review(
+	ctx context.Context, interaction *discordgo.Interaction,
+) *discordgo.InteractionResponse {
+	id, res, err := discordnotifier.ParseReviewButtonID(interaction.MessageComponentData().CustomID)
+	if err != nil {
+		return ephemeral(err.Error())
+	}
+
+	user := interaction.User
+	if interaction.Member != nil {
+		user = interaction.Member.User
+	}
+	if user == nil {
+		return ephemeral("unable to identify the reviewer")
+	}
+
+	comment := &incident.Comment{
+		AuthorId:  "discord:" + user.Username,
+		Timestamp: time.Now().Unix(),
+		Message:   "Reviewed from discord",
+	}
+	if err := s.reviewer.Review(ctx, id, res, comment); err != nil {
+		s.log.Error("unable to review incident from discord",
+			zap.String("id", id),
+			zap.Error(err),
+		)
+		return ephemeral(fmt.Sprintf("unable to review the incident: %v", err))
+	}
+
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: decided(interaction.Message, res, user),
+	}
+}
+
+var resolutionColors = map[incident.Resolution]int{
+	incident.Resolution_RESOLUTION_REJECTED: 0x80848e,
+	incident.Resolution_RESOLUTION_ACCEPTED: 0x23a55a,
+	incident.Resolution_RESOLUTION_ALERTED:  0xed4245,
+}
+
+// decided updates the original message with the decision and removes the review buttons, so the
+// incident can't be reviewed twice by accident.
+func decided(
+	msg *discordgo.Message, res incident.Resolution, user *discordgo.User,
+) *discordgo.InteractionResponseData {
+	data := &discordgo.InteractionResponseData{
+		Components: []discordgo.MessageComponent{},
+	}
+	if msg == nil {
+		return data
+	}
+
+	data.Content = msg.Content
+	data.Embeds = msg.Embeds
+	for _, embed := range data.Embeds {
+		embed.Color = resolutionColors[res]
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "Decision",
+			Value: fmt.Sprintf("%s by %s", res, user.Username),
+		})
+	}
+
+	// Keep only the link buttons
+	for _, component := range msg.Components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		links := []discordgo.MessageComponent{}
+		for _, c := range row.Components {
+			if button, ok := c.(*discordgo.Button); ok && button.Style == discordgo.LinkButton {
+				links = append(links, button)
+			}
+		}
+		if len(links) > 0 {
+			data.Components = append(data.Components, discordgo.ActionsRow{Components: links})
+		}
+	}
+
+	return data
+}
+
+// ephemeral responds with a message only visible to the user who clicked the button.
+func ephemeral(msg string) *discordgo.InteractionResponse {
+	return &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: msg,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	}
+}
+
+var (
+	errMissingLogger    = errors.New("missing logger")
+	errMissingPublicKey = errors.New("missing public key")
+	errMissingReviewer  = errors.New("missing reviewer")
+)
+
+func validate(s *Service) error {
+	if s.log == nil {
+		return errMissingLogger
+	}
+	if len(s.key) != ed25519.PublicKeySize {
+		return errMissingPublicKey
+	}
+	if s.reviewer == nil {
+		return errMissingReviewer
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 SaferPlace
+
+package discord
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+)
+
+type fakeReviewer struct {
+	id      string
+	res     incident.Resolution
+	comment *incident.Comment
+}
+
+func (r *fakeReviewer) Review(
+	_ context.Context, id string, res incident.Resolution, comment *incident.Comment,
+) error {
+	r.id, r.res, r.comment = id, res, comment
+	return nil
+}
+
+// buttonInteraction is a trimmed down interaction sent by discord when a button is clicked.
+const buttonInteraction = `{
+	"id": "1",
+	"application_id": "2",
+	"type": 3,
+	"token": "token",
+	"version": 1,
+	"data": {
+		"custom_id": "review:RESOLUTION_ALERTED:incident-id",
+		"component_type": 2
+	},
+	"member": {
+		"user": {"id": "3", "username": "reviewer"}
+	},
+	"message": {
+		"id": "4",
+		"channel_id": "5",
+		"content": "",
+		"embeds": [{"title": "New incident for review", "description": "something happened"}],
+		"components": [{
+			"type": 1,
+			"components": [
+				{"type": 2, "style": 5, "label": "Review Incident", "url": "https://review.safer.place/incident/incident-id"},
+				{"type": 2, "style": 3, "label": "Accept", "custom_id": "review:RESOLUTION_ACCEPTED:incident-id"}
+			]
+		}]
+	}
+}`
+
+func TestInteractions(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reviewer := &fakeReviewer{}
+	_, handler := Register(
+		Logger(zap.NewNop()),
+		PublicKey(pub),
+		WithReviewer(reviewer),
+	)()
+
+	send := func(body string, key ed25519.PrivateKey) *httptest.ResponseRecorder {
+		timestamp := "1700000000"
+		req := httptest.NewRequest(http.MethodPost, "/v1/discord/interactions", bytes.NewBufferString(body))
+		req.Header.Set("X-Signature-Timestamp", timestamp)
+		req.Header.Set("X-Signature-Ed25519",
+			hex.EncodeToString(ed25519.Sign(key, []byte(timestamp+body))))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("ping", func(t *testing.T) {
+		rec := send(`{"type": 1}`, priv)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+		if got := rec.Body.String(); !bytes.Contains([]byte(got), []byte(`"type":1`)) {
+			t.Errorf("body = %s, want pong", got)
+		}
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		_, other, _ := ed25519.GenerateKey(nil)
+		if rec := send(`{"type": 1}`, other); rec.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("review button", func(t *testing.T) {
+		rec := send(buttonInteraction, priv)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+		}
+
+		if reviewer.id != "incident-id" {
+			t.Errorf("reviewed incident = %q, want %q", reviewer.id, "incident-id")
+		}
+		if reviewer.res != incident.Resolution_RESOLUTION_ALERTED {
+			t.Errorf("resolution = %s, want %s", reviewer.res, incident.Resolution_RESOLUTION_ALERTED)
+		}
+		if reviewer.comment.AuthorId != "discord:reviewer" {
+			t.Errorf("author = %q, want %q", reviewer.comment.AuthorId, "discord:reviewer")
+		}
+
+		var resp struct {
+			Type int `json:"type"`
+			Data struct {
+				Embeds []struct {
+					Fields []struct {
+						Name  string `json:"name"`
+						Value string `json:"value"`
+					} `json:"fields"`
+				} `json:"embeds"`
+				Components []struct {
+					Components []struct {
+						Style int `json:"style"`
+					} `json:"components"`
+				} `json:"components"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unable to decode response: %v", err)
+		}
+
+		if resp.Type != 7 {
+			t.Errorf("response type = %d, want update message (7)", resp.Type)
+		}
+		if len(resp.Data.Embeds) != 1 || len(resp.Data.Embeds[0].Fields) != 1 {
+			t.Fatalf("embeds = %+v, want a single embed with the decision", resp.Data.Embeds)
+		}
+		if want := "RESOLUTION_ALERTED by reviewer"; resp.Data.Embeds[0].Fields[0].Value != want {
+			t.Errorf("decision = %q, want %q", resp.Data.Embeds[0].Fields[0].Value, want)
+		}
+		if len(resp.Data.Components) != 1 || len(resp.Data.Components[0].Components) != 1 {
+			t.Errorf("components = %+v, want only the link button", resp.Data.Components)
+		}
+	})
+}
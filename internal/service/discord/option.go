@@ -0,0 +1,31 @@
+package discord
+
+import (
+	"crypto/ed25519"
+
+	"go.uber.org/zap"
+)
+
+// Option to provide configuration to the service.
+type Option func(*Service)
+
+// Logger provides the logger
+func Logger(log *zap.Logger) Option {
+	return func(s *Service) {
+		s.log = log
+	}
+}
+
+// PublicKey of the discord application used to verify the interactions.
+func PublicKey(key ed25519.PublicKey) Option {
+	return func(s *Service) {
+		s.key = key
+	}
+}
+
+// WithReviewer provides the reviewer which saves the reviews made from discord.
+func WithReviewer(r Reviewer) Option {
+	return func(s *Service) {
+		s.reviewer = r
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2023 SaferPlace
+
+// Package images serves the uploaded images by their reference. Reviewers can see all images,
+// while the public can only see the images of accepted incidents.
+//
+// Smaller variants of the images can be requested with the variant query parameter, for example
+// /v1/images/<reference>?variant=thumbnail. The full size image is served, without caching, when
+// the variant does not exist yet, and the variant is generated in the background.
+//
+// When the originals are kept, reviewers can request the image before its metadata was stripped
+// with the original query parameter, e.g. /v1/review/images/<reference>?original=true.
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"connectrpc.com/connect"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/imaging"
+	"safer.place/internal/service"
+	"safer.place/internal/storage"
+)
+
+const (
+	// PublicPath serves the images of the accepted incidents.
+	PublicPath = "/v1/images/"
+	// ReviewerPath serves all images. It must only be mounted behind the reviewer authentication.
+	ReviewerPath = "/v1/review/images/"
+)
+
+// Incidents finds the incident the image is attached to.
+type Incidents interface {
+	IncidentByImage(context.Context, string) (*incident.Incident, error)
+}
+
+// Service serves the images.
+type Service struct {
+	storage   storage.Storage
+	originals storage.Storage
+	incidents Incidents
+	log       *zap.Logger
+	reviewer  bool
+	// presignExpiry redirects to presigned URLs when the storage supports them and it is set.
+	presignExpiry time.Duration
+	// variants generates the missing variants of the images, nil if they are not generated.
+	variants VariantQueue
+}
+
+// VariantQueue generates the variants of the images in the background.
+type VariantQueue interface {
+	Enqueue(reference string) bool
+}
+
+// Register registers the images service.
+func Register(opts ...Option) service.Service {
+	s := &Service{}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := validate(s); err != nil {
+		panic(err)
+	}
+
+	path := PublicPath
+	if s.reviewer {
+		path = ReviewerPath
+	}
+
+	// We can ignore the interceptors as this is a non-connect service
+	return func(_ ...connect.Interceptor) (string, http.Handler) {
+		return path, http.StripPrefix(path, s)
+	}
+}
+
+var (
+	// Images never change once uploaded, but the public can lose access when the incident is
+	// no longer accepted, so they are cached for a shorter time.
+	publicCacheControl   = "public, max-age=3600"
+	reviewerCacheControl = "private, max-age=86400, immutable"
+	// The full size image served in place of the missing variant must not be cached, so the
+	// variant is used once it has been generated.
+	fallbackCacheControl = "no-store"
+)
+
+// ServeHTTP serves the image with the reference in the path.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reference := r.URL.Path
+	if reference == "" || strings.Contains(reference, "/") || !servable(reference) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !s.reviewer {
+		if err := s.public(r.Context(), reference); err != nil {
+			s.error(w, r, reference, err)
+			return
+		}
+	}
+
+	store := s.storage
+	fallback := false
+	if s.reviewer && s.originals != nil && r.URL.Query().Get("original") == "true" {
+		// The originals have no variants.
+		store = s.originals
+	} else if name := r.URL.Query().Get("variant"); name != "" {
+		v, ok := imaging.LookupVariant(name)
+		if !ok {
+			http.Error(w, "unknown variant", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if reference, fallback, err = s.variant(r.Context(), store, reference, v); err != nil {
+			s.error(w, r, reference, err)
+			return
+		}
+	}
+
+	if s.presignExpiry > 0 {
+		if p, ok := store.(storage.Presigner); ok {
+			s.redirect(w, r, p, reference, fallback)
+			return
+		}
+	}
+
+	img, obj, err := store.Get(r.Context(), reference)
+	if err != nil {
+		s.error(w, r, reference, err)
+		return
+	}
+	defer img.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", obj.ContentType)
+	h.Set("ETag", fmt.Sprintf("%q", obj.Reference))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	h.Set("Cache-Control", s.cacheControl(fallback))
+
+	http.ServeContent(w, r, "", obj.ModTime, img)
+}
+
+// servable returns false for the objects which are stored next to the images but are never
+// served, such as the unfinished resumable uploads, the originals and the images being scanned.
+func servable(reference string) bool {
+	return !strings.HasPrefix(reference, storage.ResumablePrefix) &&
+		!strings.HasSuffix(reference, storage.OriginalSuffix) &&
+		!strings.HasSuffix(reference, storage.StagingSuffix)
+}
+
+// variant returns the reference of the variant if it exists. Otherwise the variant is generated
+// in the background, and the reference of the image is returned as the fallback.
+func (s *Service) variant(
+	ctx context.Context, store storage.Storage, reference string, v imaging.Variant,
+) (ref string, fallback bool, err error) {
+	_, err = store.Stat(ctx, v.Reference(reference))
+	switch {
+	case err == nil:
+		return v.Reference(reference), false, nil
+	case errors.Is(err, storage.ErrNotFound):
+		// The objects derived from the images, such as the variants, have no variants.
+		if s.variants != nil && !strings.Contains(reference, "_") {
+			s.variants.Enqueue(reference)
+		}
+		return reference, true, nil
+	default:
+		return reference, false, err
+	}
+}
+
+// redirect to the presigned URL, cached for a bit less than it is valid for unless it is the
+// fallback for the missing variant.
+func (s *Service) redirect(w http.ResponseWriter, r *http.Request, p storage.Presigner, reference string, fallback bool) {
+	u, err := p.PresignedURL(r.Context(), reference, s.presignExpiry)
+	if err != nil {
+		s.error(w, r, reference, err)
+		return
+	}
+
+	cacheControl := fmt.Sprintf("private, max-age=%d", int(s.presignExpiry/time.Second)/2)
+	if fallback {
+		cacheControl = fallbackCacheControl
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+}
+
+var errNotPublic = errors.New("image is not public")
+
+// public checks the image is attached to an accepted incident.
+func (s *Service) public(ctx context.Context, reference string) error {
+	inc, err := s.incidents.IncidentByImage(ctx, reference)
+	if err != nil {
+		if errors.Is(err, database.ErrDoesNotExist) {
+			return errNotPublic
+		}
+		return err
+	}
+
+	switch inc.Resolution {
+	case incident.Resolution_RESOLUTION_ACCEPTED, incident.Resolution_RESOLUTION_ALERTED:
+		return nil
+	default:
+		return errNotPublic
+	}
+}
+
+func (s *Service) cacheControl(fallback bool) string {
+	if fallback {
+		return fallbackCacheControl
+	}
+	if s.reviewer {
+		return reviewerCacheControl
+	}
+	return publicCacheControl
+}
+
+// error responds with the error. Images which are not public are not found, so the public
+// cannot tell whether they exist.
+func (s *Service) error(w http.ResponseWriter, r *http.Request, reference string, err error) {
+	switch {
+	case errors.Is(err, errNotPublic),
+		errors.Is(err, storage.ErrNotFound),
+		errors.Is(err, storage.ErrInvalidReference):
+		http.NotFound(w, r)
+	default:
+		s.log.Error("unable to serve image", zap.String("reference", reference), zap.Error(err))
+		http.Error(w, "unable to get image", http.StatusInternalServerError)
+	}
+}
+
+var (
+	errMissingLogger    = errors.New("missing logger")
+	errMissingStorage   = errors.New("missing storage")
+	errMissingIncidents = errors.New("missing incidents")
+	errPublicOriginals  = errors.New("originals must only be served to the reviewers")
+)
+
+func validate(s *Service) error {
+	if s.log == nil {
+		return errMissingLogger
+	}
+	if s.storage == nil {
+		return errMissingStorage
+	}
+	if !s.reviewer && s.incidents == nil {
+		return errMissingIncidents
+	}
+	if !s.reviewer && s.originals != nil {
+		return errPublicOriginals
+	}
+	return nil
+}
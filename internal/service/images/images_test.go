@@ -0,0 +1,139 @@
+package images
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"api.safer.place/incident/v1"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"safer.place/internal/database"
+	"safer.place/internal/imaging"
+	"safer.place/internal/storage/filesystem"
+)
+
+type fakeIncidents map[string]incident.Resolution
+
+func (f fakeIncidents) IncidentByImage(_ context.Context, image string) (*incident.Incident, error) {
+	res, ok := f[image]
+	if !ok {
+		return nil, database.ErrDoesNotExist
+	}
+	return &incident.Incident{ImageId: image, Resolution: res}, nil
+}
+
+// fakeVariants records the images queued for their variants.
+type fakeVariants []string
+
+func (f *fakeVariants) Enqueue(reference string) bool {
+	*f = append(*f, reference)
+	return true
+}
+
+func TestServeHTTP(t *testing.T) {
+	ctx := context.Background()
+	newStorage := func(dir string) *filesystem.Storage {
+		store, err := filesystem.New(
+			&filesystem.Config{Dir: filepath.Join(t.TempDir(), dir)},
+			filesystem.Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	store, originals := newStorage("images"), newStorage("originals")
+
+	upload := func() string {
+		id, err := store.Upload(ctx, strings.NewReader("image"), 5, "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	accepted, rejected, unattached := upload(), upload(), upload()
+	thumbnail := imaging.Variants[0]
+	if err := store.Put(ctx, thumbnail.Reference(accepted), strings.NewReader("thumb"), 5, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := originals.Put(ctx, rejected, strings.NewReader("original"), 8, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, unattached+"_staging", strings.NewReader("staged"), 6, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	incidents := fakeIncidents{
+		accepted: incident.Resolution_RESOLUTION_ACCEPTED,
+		rejected: incident.Resolution_RESOLUTION_REJECTED,
+	}
+
+	variants := &fakeVariants{}
+	_, public := Register(Logger(zap.NewNop()), Storage(store), IncidentLookup(incidents), Variants(variants))()
+	_, reviewer := Register(Logger(zap.NewNop()), Storage(store), Originals(originals), Reviewer(), Variants(variants))()
+
+	testcases := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		want    int
+		body    string
+	}{
+		{"public accepted", public, PublicPath + accepted, http.StatusOK, "image"},
+		{"public thumbnail", public, PublicPath + accepted + "?variant=thumbnail", http.StatusOK, "thumb"},
+		{"reviewer missing thumbnail", reviewer, ReviewerPath + rejected + "?variant=thumbnail", http.StatusOK, "image"},
+		{"unknown variant", public, PublicPath + accepted + "?variant=huge", http.StatusBadRequest, ""},
+		{"public rejected", public, PublicPath + rejected, http.StatusNotFound, ""},
+		{"public unattached", public, PublicPath + unattached, http.StatusNotFound, ""},
+		{"reviewer rejected", reviewer, ReviewerPath + rejected, http.StatusOK, "image"},
+		{"reviewer unattached", reviewer, ReviewerPath + unattached, http.StatusOK, "image"},
+		{"reviewer original", reviewer, ReviewerPath + rejected + "?original=true", http.StatusOK, "original"},
+		{"public original", public, PublicPath + accepted + "?original=true", http.StatusOK, "image"},
+		{"missing original", reviewer, ReviewerPath + unattached + "?original=true", http.StatusNotFound, ""},
+		{"resumable upload", reviewer, ReviewerPath + "tus_" + rejected, http.StatusNotFound, ""},
+		{"quarantined original", reviewer, ReviewerPath + rejected + "_original", http.StatusNotFound, ""},
+		{"staged image", reviewer, ReviewerPath + unattached + "_staging", http.StatusNotFound, ""},
+		{"reviewer missing", reviewer, ReviewerPath + "missing", http.StatusNotFound, ""},
+		{"reviewer invalid", reviewer, ReviewerPath + "..%2Fimages", http.StatusNotFound, ""},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tc.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if rec.Code != tc.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.want)
+			}
+			if tc.want != http.StatusOK {
+				return
+			}
+			if rec.Body.String() != tc.body || rec.Header().Get("Content-Type") != "image/jpeg" {
+				t.Errorf("response = %q (%s)", rec.Body, rec.Header().Get("Content-Type"))
+			}
+			if rec.Header().Get("Cache-Control") == "" || rec.Header().Get("ETag") == "" {
+				t.Errorf("missing caching headers: %v", rec.Header())
+			}
+		})
+	}
+
+	// The full size image served in place of the missing variant is not cached, and the variant
+	// is generated.
+	rec := httptest.NewRecorder()
+	reviewer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ReviewerPath+rejected+"?variant=thumbnail", nil))
+	if cc := rec.Header().Get("Cache-Control"); cc != fallbackCacheControl {
+		t.Errorf("fallback Cache-Control = %q, want %q", cc, fallbackCacheControl)
+	}
+	if len(*variants) == 0 || (*variants)[len(*variants)-1] != rejected {
+		t.Errorf("queued variants = %v, want %q", *variants, rejected)
+	}
+	rec = httptest.NewRecorder()
+	reviewer.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ReviewerPath+accepted+"?variant=thumbnail", nil))
+	if cc := rec.Header().Get("Cache-Control"); cc != reviewerCacheControl {
+		t.Errorf("variant Cache-Control = %q, want %q", cc, reviewerCacheControl)
+	}
+}
@@ -0,0 +1,61 @@
+package images
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"safer.place/internal/storage"
+)
+
+// Option to provide configuration to the service.
+type Option func(*Service)
+
+// Logger provides the logger
+func Logger(log *zap.Logger) Option {
+	return func(s *Service) {
+		s.log = log
+	}
+}
+
+// Storage provides the storage containing the images.
+func Storage(storage storage.Storage) Option {
+	return func(s *Service) {
+		s.storage = storage
+	}
+}
+
+// IncidentLookup provides the incidents used to decide whether the image is public.
+func IncidentLookup(incidents Incidents) Option {
+	return func(s *Service) {
+		s.incidents = incidents
+	}
+}
+
+// Originals provides the images before their metadata was stripped, served to the reviewers
+// with the original query parameter.
+func Originals(originals storage.Storage) Option {
+	return func(s *Service) {
+		s.originals = originals
+	}
+}
+
+// Variants generates the missing variants of the images when they are requested.
+func Variants(q VariantQueue) Option {
+	return func(s *Service) {
+		s.variants = q
+	}
+}
+
+// Reviewer serves all the images, regardless of the incident they are attached to.
+func Reviewer() Option {
+	return func(s *Service) {
+		s.reviewer = true
+	}
+}
+
+// Presign redirects to temporary URLs valid for the expiry, when the storage supports them.
+func Presign(expiry time.Duration) Option {
+	return func(s *Service) {
+		s.presignExpiry = expiry
+	}
+}
@@ -1,30 +1,133 @@
 // Copyright 2023 SaferPlace
 
 // Package imageupload allows for HTTP image uploads to a cloud storage.
+//
+// The uploads are validated and all their metadata, such as the EXIF GPS coordinates, is stripped
+// before they are stored. The format is detected from the magic bytes rather than trusting the
+// client, and only JPEG, PNG, WebP and HEIC images are accepted. The dimensions are read from the
+// image header without decoding it, so images which would decompress into huge bitmaps are
+// rejected before anything allocates them. WebP images are stored as PNG, and HEIC images keep
+// the metadata other than EXIF and XMP, see imaging.Sanitize.
+//
+// The image is streamed from the request into the storage while it is sanitized, without
+// buffering the form. The perceptual hash of the decoded image is saved before the upload
+// completes, while the smaller variants of the images are generated in the background.
+//
+// The uploads can be scanned for malware while they are stored. The scanned uploads are staged
+// under a reference which is never served, and only published once they are clean. The infected
+// uploads, and the ones which could not be scanned, are rejected and moved to the quarantine.
+//
+// Every uploaded image gets a token binding it to the user who uploaded it, so only they can
+// attach it to a report, and only until the token expires.
 package imageupload
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"time"
 
 	"connectrpc.com/connect"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
+	"safer.place/internal/imaging"
+	"safer.place/internal/scanner"
 	"safer.place/internal/service"
 	"safer.place/internal/storage"
 )
 
+// Config of the upload validation.
+type Config struct {
+	// MaxSize of the uploaded image in bytes.
+	MaxSize int64 `yaml:"max_size" split_words:"true" default:"10485760"`
+	// MaxWidth and MaxHeight of the image in pixels.
+	MaxWidth  int `yaml:"max_width" split_words:"true" default:"8192"`
+	MaxHeight int `yaml:"max_height" split_words:"true" default:"8192"`
+	// MaxPixels limits the decoded size of the image, protecting from decompression bombs which
+	// are within the maximum width and height.
+	MaxPixels int `yaml:"max_pixels" split_words:"true" default:"40000000"`
+	// MaxDecodes limits the uploaded images decoded at the same time, the variants are limited by
+	// their workers. A decoded image takes a few copies of its pixels in memory, about 160 MB at
+	// 40 million pixels. Zero does not limit them.
+	MaxDecodes int `yaml:"max_decodes" split_words:"true" default:"4"`
+	// Quality of the re-encoded JPEG images, from 1 to 100.
+	Quality int `yaml:"quality" default:"90"`
+	// VariantWorkers generate the resized variants of the images in the background.
+	VariantWorkers int `yaml:"variant_workers" split_words:"true" default:"2"`
+	// VariantQueue is the number of images waiting for their variants. The variants of the images
+	// uploaded while it is full are generated when they are first requested.
+	VariantQueue int `yaml:"variant_queue" split_words:"true" default:"64"`
+	// ResumableExpiry is how long the resumable uploads can be continued after the last part.
+	ResumableExpiry time.Duration `yaml:"resumable_expiry" split_words:"true" default:"24h"`
+	// TokenExpiry is how long the user has to attach the uploaded image to their report.
+	TokenExpiry time.Duration `yaml:"token_expiry" split_words:"true" default:"1h"`
+}
+
+// formOverhead is allowed on top of the image size for the rest of the multipart form.
+const formOverhead = 64 << 10
+
 // Service is the image upload service
 type Service struct {
 	tracer  trace.Tracer
 	storage storage.Storage
-	log     *zap.Logger
+	// originals keeps the images before their metadata is stripped, for the reviewers only.
+	originals storage.Storage
+	// uploads issues the tokens binding the images to the users who uploaded them.
+	uploads UploadStore
+	// hashes keeps the perceptual hashes of the images, used to find the reused images.
+	hashes HashStore
+	// scanner checks the uploads for malware, the rejected uploads are moved to the quarantine.
+	scanner    scanner.Scanner
+	quarantine storage.Storage
+	log        *zap.Logger
+	cfg        *Config
+	reg        prometheus.Registerer
+	rejected   *prometheus.CounterVec
+	// decodes holds a slot for every image being decoded, nil when they are not limited.
+	decodes chan struct{}
+	// variants generates the resized variants of the stored images in the background.
+	variants VariantQueue
+	// resumable keeps the resumable uploads until they are complete, locked by locks.
+	resumable storage.Storage
+	locks     Locker
+}
+
+// UploadStore saves the tokens of the uploaded images.
+type UploadStore interface {
+	SaveUpload(context.Context, *database.Upload) error
+}
+
+// HashStore saves the perceptual hashes of the uploaded images.
+type HashStore interface {
+	SaveImageHash(context.Context, string, uint64) error
+}
+
+// VariantQueue generates the variants of the stored images in the background.
+type VariantQueue interface {
+	Enqueue(reference string) bool
 }
 
 // Register registers the image upload service.
 func Register(opts ...Option) service.Service {
+	s := newService(opts...)
+
+	// We can ignore the interceptors as this is a non-connect service
+	return func(_ ...connect.Interceptor) (string, http.Handler) {
+		return "/v1/upload", s
+	}
+}
+
+func newService(opts ...Option) *Service {
 	s := &Service{}
 
 	for _, opt := range opts {
@@ -35,51 +138,493 @@ func Register(opts ...Option) service.Service {
 		panic(err)
 	}
 
-	// We can ignore the interceptors as this is a non-connect service
-	return func(_ ...connect.Interceptor) (string, http.Handler) {
-		return "/v1/upload", s
+	s.rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "saferplace",
+		Subsystem: "upload",
+		Name:      "rejected_total",
+		Help:      "Number of rejected image uploads, by reason.",
+	}, []string{"reason"})
+	if err := s.reg.Register(s.rejected); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			panic(err)
+		}
+		s.rejected = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+
+	if s.cfg.MaxDecodes > 0 {
+		s.decodes = make(chan struct{}, s.cfg.MaxDecodes)
 	}
+
+	return s
 }
 
 // ServeHTTP is the handler accepting the image upload.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, span := s.tracer.Start(r.Context(), "upload")
 	defer span.End()
-	if err := r.ParseForm(); err != nil {
-		s.log.Error("unable to parse form data", zap.Error(err))
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		http.Error(w, "unable to parse form", http.StatusBadRequest)
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxSize+formOverhead)
+	part, err := imagePart(r)
+	if err != nil {
+		s.reject(w, span, err)
 		return
 	}
-	file, header, err := r.FormFile("image")
+	defer part.Close()
+
+	reference, err := s.upload(ctx, part)
 	if err != nil {
-		s.log.Error("unable to get image from user", zap.Error(err))
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		http.Error(w, "image upload failed", http.StatusBadRequest)
+		s.reject(w, span, err)
 		return
 	}
-	defer file.Close()
 
-	reference, err := s.storage.Upload(
-		ctx, file, header.Size, header.Header.Get("Content-Type"))
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, reference)
+}
+
+// upload validates and stores the image read from r, returning its reference.
+func (s *Service) upload(ctx context.Context, r io.Reader) (string, error) {
+	image := &limitedReader{r: r, remaining: s.cfg.MaxSize}
+	// Shorter images are checked using what has been read, other errors are returned below.
+	header, br := imaging.ReadHeader(image)
+
+	f, err := s.check(header)
+	if err == nil {
+		var reference string
+		if reference, err = s.store(ctx, br, f.ContentType); err == nil {
+			if err := s.issueToken(ctx, reference); err != nil {
+				return "", err
+			}
+			return reference, nil
+		}
+	}
+
+	// The limit and reading errors are reported over any error they caused.
+	switch {
+	case image.exceeded:
+		err = tooLarge(s.cfg.MaxSize)
+	case image.err != nil:
+		err = &rejection{reasonAborted, http.StatusBadRequest, "upload interrupted"}
+	}
+	return "", err
+}
+
+// issueToken binds the image to the user who uploaded it, who is the only one who can attach it
+// to a report before the token expires.
+func (s *Service) issueToken(ctx context.Context, reference string) error {
+	if s.uploads == nil {
+		return nil
+	}
+
+	if err := s.uploads.SaveUpload(ctx, &database.Upload{
+		Reference: reference,
+		Uploader:  auth.UserFromContext(ctx),
+		Expires:   time.Now().Add(s.cfg.TokenExpiry),
+	}); err != nil {
+		return fmt.Errorf("unable to issue upload token: %w", err)
+	}
+	return nil
+}
+
+// imagePart finds the image in the multipart form, skipping any other parts before it.
+func imagePart(r *http.Request) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, &rejection{reasonInvalidForm, http.StatusBadRequest, "unable to parse form"}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, &rejection{reasonInvalidForm, http.StatusBadRequest, "missing image"}
+		}
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return nil, &rejection{reasonInvalidForm, http.StatusRequestEntityTooLarge, "form is too large"}
+		}
+		if err != nil {
+			return nil, &rejection{reasonInvalidForm, http.StatusBadRequest, "unable to parse form"}
+		}
+		if part.FormName() == "image" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// limitedReader fails once more than the remaining bytes are read, and remembers if reading
+// failed, for example because the client disconnected.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+	err       error
+}
+
+var errTooLarge = errors.New("image is too large")
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errTooLarge
+	}
+	// Reading one more byte than allowed detects images over the limit.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return 0, errTooLarge
+	}
+	if err != nil && err != io.EOF {
+		l.err = err
+	}
+	return n, err
+}
+
+// store the image with its metadata stripped, keeping the original if configured. Both are
+// streamed into the storage while the image is read, and the uploads are aborted if reading or
+// sanitizing the image fails, for example when the client disconnects.
+func (s *Service) store(ctx context.Context, r io.Reader, contentType string) (string, error) {
+	release, err := s.acquireDecode(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	// The reference is created here, so the original can be stored under the same reference,
+	// making it easy for the reviewers to find it from the incident.
+	reference := uuid.New().String()
+	// The scanned images are staged until they are clean.
+	staged := reference
+	if s.scanner != nil {
+		staged = reference + storage.StagingSuffix
+	}
+	sanitizedType := imaging.SanitizedType(contentType)
+	eg, ctx := errgroup.WithContext(ctx)
+
+	var (
+		scanWriter *io.PipeWriter
+		scanErr    error
+	)
+	if s.scanner != nil {
+		var pr *io.PipeReader
+		pr, scanWriter = io.Pipe()
+		r = io.TeeReader(r, scanWriter)
+		eg.Go(func() error {
+			scanErr = s.scan(ctx, pr)
+			// Stop the image from being read if it cannot be scanned.
+			pr.CloseWithError(scanErr)
+			return scanErr
+		})
+	}
+
+	var originalWriter *io.PipeWriter
+	if s.originals != nil {
+		var pr *io.PipeReader
+		pr, originalWriter = io.Pipe()
+		r = io.TeeReader(r, originalWriter)
+		eg.Go(func() error {
+			err := s.originals.Put(ctx, staged, pr, -1, contentType)
+			if err != nil {
+				err = &storageError{fmt.Errorf("unable to keep original image: %w", err)}
+			}
+			// Stop the image from being read if the original could not be stored.
+			pr.CloseWithError(err)
+			return err
+		})
+	}
+
+	pr, pw := io.Pipe()
+	eg.Go(func() error {
+		err := s.storage.Put(ctx, staged, pr, -1, sanitizedType)
+		if err != nil {
+			err = &storageError{fmt.Errorf("unable to upload image: %w", err)}
+		}
+		pr.CloseWithError(err)
+		return err
+	})
+
+	var (
+		img         image.Image
+		sanitizeErr error
+	)
+	eg.Go(func() error {
+		img, sanitizeErr = imaging.Sanitize(pw, r, contentType, s.cfg.Quality)
+		if sanitizeErr == nil {
+			// The rest of the image is read, so the original is complete and the size is checked.
+			_, sanitizeErr = io.Copy(io.Discard, r)
+		}
+		// A nil error completes the uploads.
+		pw.CloseWithError(sanitizeErr)
+		if originalWriter != nil {
+			originalWriter.CloseWithError(sanitizeErr)
+		}
+		if scanWriter != nil {
+			scanWriter.CloseWithError(sanitizeErr)
+		}
+		return sanitizeErr
+	})
+
+	err = eg.Wait()
+	// The image has been staged by the time it was scanned, so it is moved to the quarantine. The
+	// context of the errgroup is cancelled once it is done.
+	if scanErr != nil {
+		s.quarantineImage(context.WithoutCancel(ctx), staged, reference)
+		return "", scanErr
+	}
+	// The storage fails when the sanitizing does, and the other way around, so the error which
+	// caused the other is returned.
+	var serr *storageError
+	if sanitizeErr != nil && !errors.As(sanitizeErr, &serr) {
+		err = sanitizeErr
+	}
+	switch {
+	case err == nil:
+	case errors.As(err, &serr):
+		return "", serr.err
+	case errors.Is(err, imaging.ErrMalformed):
+		return "", &rejection{reasonMalformed, http.StatusBadRequest, "unable to decode image"}
+	default:
+		return "", err
+	}
+
+	if staged != reference {
+		if err := s.publish(context.WithoutCancel(ctx), staged, reference); err != nil {
+			return "", err
+		}
+	}
+
+	// The hash is saved before the image can be attached to a report, so every report can be
+	// compared to the others. HEIC images cannot be decoded, so they are never compared.
+	if s.hashes != nil && img != nil {
+		if err := s.hashes.SaveImageHash(context.WithoutCancel(ctx), reference, imaging.DifferenceHash(img)); err != nil {
+			return "", fmt.Errorf("unable to save image hash: %w", err)
+		}
+	}
+
+	if s.variants != nil && !s.variants.Enqueue(reference) {
+		s.log.Warn("variant queue full, the variants are generated once requested",
+			zap.String("reference", reference),
+		)
+	}
+
+	return reference, nil
+}
+
+// scan the image read from r, rejecting it if it is infected or cannot be scanned. The scan fails
+// when the upload does, in which case the error of the upload is returned instead.
+func (s *Service) scan(ctx context.Context, r io.Reader) error {
+	image := &scanReader{r: r}
+	err := s.scanner.Scan(ctx, image)
+	switch {
+	case err == nil, image.err != nil, ctx.Err() != nil:
+		return nil
+	case errors.Is(err, scanner.ErrInfected):
+		s.log.Warn("infected image uploaded", zap.Error(err))
+		return &rejection{reasonInfected, http.StatusUnprocessableEntity, "image rejected by the malware scan"}
+	default:
+		s.log.Error("unable to scan image", zap.Error(err))
+		return &rejection{reasonUnscannable, http.StatusServiceUnavailable, "unable to scan image"}
+	}
+}
+
+// scanReader remembers the error of reading the image.
+type scanReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *scanReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// publish the staged image, and its original, under the reference once they are clean. The staged
+// objects are removed, or left to the garbage collection if they cannot be.
+func (s *Service) publish(ctx context.Context, staged, reference string) error {
+	if err := s.publishObject(ctx, s.storage, staged, reference); err != nil {
+		return &storageError{fmt.Errorf("unable to publish image: %w", err)}
+	}
+	if s.originals != nil {
+		if err := s.publishObject(ctx, s.originals, staged, reference); err != nil {
+			if err := s.storage.Delete(ctx, reference); err != nil {
+				s.log.Error("unable to delete published image", zap.String("reference", reference), zap.Error(err))
+			}
+			return &storageError{fmt.Errorf("unable to publish original image: %w", err)}
+		}
+	}
+	return nil
+}
+
+func (s *Service) publishObject(ctx context.Context, store storage.Storage, staged, reference string) error {
+	r, obj, err := store.Get(ctx, staged)
+	if err != nil {
+		return err
+	}
+	err = store.Put(ctx, reference, r, obj.Size, obj.ContentType)
+	r.Close()
 	if err != nil {
+		return err
+	}
+
+	if err := store.Delete(ctx, staged); err != nil {
+		s.log.Error("unable to delete staged image", zap.String("reference", staged), zap.Error(err))
+	}
+	return nil
+}
+
+// quarantineImage moves the rejected staged image, and its original, out of the storages the
+// reviewers can see. They are deleted if there is no quarantine.
+func (s *Service) quarantineImage(ctx context.Context, staged, reference string) {
+	s.quarantineObject(ctx, s.storage, staged, reference)
+	if s.originals != nil {
+		s.quarantineObject(ctx, s.originals, staged, reference+storage.OriginalSuffix)
+	}
+}
+
+func (s *Service) quarantineObject(ctx context.Context, from storage.Storage, reference, to string) {
+	log := s.log.With(zap.String("reference", reference))
+
+	if s.quarantine != nil {
+		r, obj, err := from.Get(ctx, reference)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			// The upload failed before it was stored.
+			return
+		case err != nil:
+			log.Error("unable to get image for the quarantine", zap.Error(err))
+		default:
+			err = s.quarantine.Put(ctx, to, r, obj.Size, obj.ContentType)
+			r.Close()
+			if err != nil {
+				log.Error("unable to quarantine image", zap.Error(err))
+			}
+		}
+	}
+
+	// The image is deleted even if it could not be quarantined, so it cannot be served.
+	if err := from.Delete(ctx, reference); err != nil {
+		log.Error("unable to delete rejected image", zap.Error(err))
+	}
+}
+
+// storageError is returned when the image could not be stored, and passed through the pipes
+// to stop reading the image.
+type storageError struct {
+	err error
+}
+
+func (e *storageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *storageError) Unwrap() error {
+	return e.err
+}
+
+// acquireDecode waits until the image can be decoded, returning the function releasing it.
+func (s *Service) acquireDecode(ctx context.Context) (func(), error) {
+	if s.decodes == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.decodes <- struct{}{}:
+		return func() { <-s.decodes }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// check the format and the dimensions of the image from its header.
+func (s *Service) check(header []byte) (imaging.Format, error) {
+	f, ok := imaging.Detect(header)
+	if !ok {
+		return imaging.Format{}, &rejection{
+			reasonUnsupportedType, http.StatusUnsupportedMediaType,
+			"unsupported image type, must be JPEG, PNG, WebP or HEIC",
+		}
+	}
+
+	width, height, err := f.Dimensions(header)
+	if err != nil || width <= 0 || height <= 0 {
+		return imaging.Format{}, &rejection{reasonMalformed, http.StatusBadRequest, "unable to read image dimensions"}
+	}
+	if width > s.cfg.MaxWidth || height > s.cfg.MaxHeight {
+		return imaging.Format{}, &rejection{
+			reasonDimensions, http.StatusUnprocessableEntity,
+			fmt.Sprintf("image is %dx%d, must be at most %dx%d pixels", width, height, s.cfg.MaxWidth, s.cfg.MaxHeight),
+		}
+	}
+	// Checked in 64 bits, the dimensions alone can overflow on 32 bit platforms.
+	if int64(width)*int64(height) > int64(s.cfg.MaxPixels) {
+		return imaging.Format{}, &rejection{
+			reasonPixels, http.StatusUnprocessableEntity,
+			fmt.Sprintf("image has too many pixels, must be at most %d", s.cfg.MaxPixels),
+		}
+	}
+
+	return f, nil
+}
+
+// Reasons the upload has been rejected, used as the metric label.
+const (
+	reasonInvalidForm     = "invalid_form"
+	reasonTooLarge        = "too_large"
+	reasonUnsupportedType = "unsupported_type"
+	reasonMalformed       = "malformed"
+	reasonDimensions      = "dimensions"
+	reasonPixels          = "pixels"
+	reasonAborted         = "aborted"
+	reasonInfected        = "infected"
+	reasonUnscannable     = "unscannable"
+)
+
+// rejection is returned when the upload is invalid, and explains why to the client.
+type rejection struct {
+	reason  string
+	status  int
+	message string
+}
+
+func (r *rejection) Error() string {
+	return r.message
+}
+
+func tooLarge(max int64) *rejection {
+	return &rejection{
+		reasonTooLarge, http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("image is too large, must be at most %d bytes", max),
+	}
+}
+
+// reject responds to the client with the rejection, or an internal error for any other error.
+func (s *Service) reject(w http.ResponseWriter, span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	var rej *rejection
+	if !errors.As(err, &rej) {
 		s.log.Error("image upload failed", zap.Error(err))
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
 		http.Error(w, "image upload failed", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, reference)
+	s.log.Debug("image upload rejected", zap.String("reason", rej.reason), zap.Error(err))
+	s.rejected.WithLabelValues(rej.reason).Inc()
+	http.Error(w, rej.message, rej.status)
 }
 
 var (
-	errMissingLogger  = errors.New("missing logger")
-	errMissingTrace   = errors.New("missing tracer")
-	errMissingStorage = errors.New("missing storage")
+	errMissingLogger    = errors.New("missing logger")
+	errMissingTrace     = errors.New("missing tracer")
+	errMissingStorage   = errors.New("missing storage")
+	errMissingConfig    = errors.New("missing config")
+	errMissingMetrics   = errors.New("missing metrics")
+	errMissingResumable = errors.New("missing resumable storage or locks")
 )
 
 func validate(s *Service) error {
@@ -92,5 +637,11 @@ func validate(s *Service) error {
 	if s.storage == nil {
 		return errMissingStorage
 	}
+	if s.cfg == nil {
+		return errMissingConfig
+	}
+	if s.reg == nil {
+		return errMissingMetrics
+	}
 	return nil
 }
@@ -0,0 +1,522 @@
+package imageupload
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
+	"safer.place/internal/imaging"
+	"safer.place/internal/scanner"
+	"safer.place/internal/storage"
+)
+
+type fakeStorage struct {
+	storage.Storage
+	mu     sync.Mutex
+	images map[string]*stored
+	// puts are the references of the stored images, in order.
+	puts []string
+	// err is returned after the first byte of the image is read.
+	err error
+}
+
+type stored struct {
+	contentType string
+	data        []byte
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{images: map[string]*stored{}}
+}
+
+func (f *fakeStorage) Put(_ context.Context, reference string, r io.Reader, _ int64, contentType string) error {
+	if f.err != nil {
+		r.Read(make([]byte, 1))
+		return f.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[reference] = &stored{contentType, data}
+	f.puts = append(f.puts, reference)
+	return nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (f *fakeStorage) Get(_ context.Context, reference string) (io.ReadSeekCloser, *storage.Object, error) {
+	img := f.get(reference)
+	if img == nil {
+		return nil, nil, storage.ErrNotFound
+	}
+	return nopCloser{bytes.NewReader(img.data)}, &storage.Object{Reference: reference}, nil
+}
+
+func (f *fakeStorage) Delete(_ context.Context, reference string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.images, reference)
+	return nil
+}
+
+func (f *fakeStorage) get(reference string) *stored {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.images[reference]
+}
+
+func encode(t *testing.T, enc func(io.Writer, image.Image) error, w, h int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := enc(&b, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, nil)
+}
+
+// pngHeader is a PNG which only has the header claiming the dimensions, like a decompression bomb.
+func pngHeader(w, h uint32) []byte {
+	b := []byte("\x89PNG\r\n\x1a\n")
+	chunk := []byte("IHDR")
+	chunk = binary.BigEndian.AppendUint32(chunk, w)
+	chunk = binary.BigEndian.AppendUint32(chunk, h)
+	chunk = append(chunk, 8, 0, 0, 0, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(chunk)-4))
+	b = append(b, chunk...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(chunk))
+}
+
+// webp creates the header of a simple lossless WebP.
+func webp(w, h uint32) []byte {
+	b := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f")
+	b = binary.LittleEndian.AppendUint32(b, (w-1)|(h-1)<<14)
+	return append(b, make([]byte, 16)...)
+}
+
+func box(typ string, contents ...[]byte) []byte {
+	b := bytes.Join(contents, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b)+8)), append([]byte(typ), b...)...)
+}
+
+func ispe(w, h uint32) []byte {
+	b := binary.BigEndian.AppendUint32(make([]byte, 4), w)
+	return box("ispe", binary.BigEndian.AppendUint32(b, h))
+}
+
+// heic creates the boxes of a HEIC up to the image properties, with a thumbnail and the image.
+func heic(w, h uint32) []byte {
+	return append(
+		box("ftyp", []byte("mif1\x00\x00\x00\x00mif1heic")),
+		box("meta", make([]byte, 4), box("hdlr", make([]byte, 24)), box("iprp", box("ipco", ispe(320, 240), ispe(w, h))))...,
+	)
+}
+
+func TestCheck(t *testing.T) {
+	s := &Service{cfg: &Config{MaxWidth: 4000, MaxHeight: 4000, MaxPixels: 10_000_000}}
+
+	testcases := []struct {
+		name        string
+		image       []byte
+		contentType string
+		reason      string
+	}{
+		{"jpeg", encode(t, encodeJPEG, 64, 48), "image/jpeg", ""},
+		{"png", encode(t, png.Encode, 64, 48), "image/png", ""},
+		{"webp", webp(1024, 768), "image/webp", ""},
+		{"heic", heic(4000, 2000), "image/heic", ""},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "", reasonUnsupportedType},
+		{"html", []byte("<html><script>alert(1)</script></html>"), "", reasonUnsupportedType},
+		{"avif", box("ftyp", []byte("avif\x00\x00\x00\x00mif1avif")), "", reasonUnsupportedType},
+		{"truncated", []byte("\x89PNG\r\n\x1a\n\x00\x00"), "", reasonMalformed},
+		{"heic without properties", box("ftyp", []byte("heic\x00\x00\x00\x00")), "", reasonMalformed},
+		{"too wide", webp(8000, 10), "", reasonDimensions},
+		{"decompression bomb", pngHeader(4000, 4000), "", reasonPixels},
+		{"heic too many pixels", heic(4000, 4000), "", reasonPixels},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := s.check(tc.image)
+			if tc.reason != "" {
+				rej, ok := err.(*rejection)
+				if !ok || rej.reason != tc.reason {
+					t.Fatalf("check() = %v, want rejection %q", err, tc.reason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("check() = %v", err)
+			}
+			if f.ContentType != tc.contentType {
+				t.Errorf("content type = %q, want %q", f.ContentType, tc.contentType)
+			}
+		})
+	}
+}
+
+// fakeVariants records the images queued for their variants.
+type fakeVariants struct {
+	mu     sync.Mutex
+	queued []string
+}
+
+func (f *fakeVariants) Enqueue(reference string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queued = append(f.queued, reference)
+	return true
+}
+
+func newUploader(t *testing.T, store, originals *fakeStorage, variants *fakeVariants) http.Handler {
+	t.Helper()
+	_, handler := Register(
+		Logger(zap.NewNop()),
+		Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+		Storage(store),
+		Originals(originals),
+		Variants(variants),
+		Limits(&Config{
+			MaxSize: 2048, MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1_000_000,
+			Quality: 90, VariantWorkers: 1, VariantQueue: 1,
+		}),
+		Metrics(prometheus.NewRegistry()),
+	)()
+	return handler
+}
+
+func post(handler http.Handler, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+// form containing the image after another field.
+func form(t *testing.T, image []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("description", "ignored"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := mw.CreateFormFile("image", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(image)
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func TestServeHTTP(t *testing.T) {
+	store, originals, variants := newFakeStorage(), newFakeStorage(), &fakeVariants{}
+	handler := newUploader(t, store, originals, variants)
+
+	img := encode(t, png.Encode, 400, 200)
+	body, contentType := form(t, img)
+	rec := post(handler, body, contentType)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload = %d %q", rec.Code, rec.Body)
+	}
+	reference := rec.Body.String()
+
+	got := store.get(reference)
+	if got == nil {
+		t.Fatalf("image %q not stored", reference)
+	}
+	if cfg, err := png.DecodeConfig(bytes.NewReader(got.data)); err != nil || got.contentType != imaging.PNG || cfg.Width != 400 {
+		t.Errorf("stored %q (%v), want the re-encoded png", got.contentType, err)
+	}
+	if original := originals.get(reference); original == nil || !bytes.Equal(original.data, img) {
+		t.Errorf("original = %v, want the whole png", original)
+	}
+
+	if len(variants.queued) != 1 || variants.queued[0] != reference {
+		t.Errorf("queued variants = %v, want %q", variants.queued, reference)
+	}
+}
+
+type fakeHashes struct {
+	mu     sync.Mutex
+	hashes map[string]uint64
+}
+
+func (f *fakeHashes) SaveImageHash(_ context.Context, reference string, hash uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hashes[reference] = hash
+	return nil
+}
+
+func (f *fakeHashes) get(reference string) (uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hash, ok := f.hashes[reference]
+	return hash, ok
+}
+
+func TestServeHTTPHash(t *testing.T) {
+	hashes := &fakeHashes{hashes: map[string]uint64{}}
+	store := newFakeStorage()
+	_, handler := Register(
+		Logger(zap.NewNop()),
+		Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+		Storage(store),
+		Hashes(hashes),
+		Limits(&Config{
+			MaxSize: 2048, MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1_000_000,
+			Quality: 90, VariantWorkers: 1, VariantQueue: 1,
+		}),
+		Metrics(prometheus.NewRegistry()),
+	)()
+
+	gradient := image.NewGray(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			gradient.SetGray(x, y, color.Gray{Y: uint8(x * y)})
+		}
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, gradient); err != nil {
+		t.Fatal(err)
+	}
+	body, contentType := form(t, img.Bytes())
+	rec := post(handler, body, contentType)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload = %d %q", rec.Code, rec.Body)
+	}
+	reference := rec.Body.String()
+
+	// The hash is saved by the time the upload completes.
+	hash, ok := hashes.get(reference)
+	if !ok {
+		t.Fatal("hash not saved")
+	}
+	stored, err := png.Decode(bytes.NewReader(store.get(reference).data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := imaging.DifferenceHash(stored); hash != want || hash == 0 {
+		t.Errorf("hash = %x, want %x", hash, want)
+	}
+}
+
+type fakeUploads struct {
+	uploads map[string]*database.Upload
+}
+
+func (f *fakeUploads) SaveUpload(_ context.Context, u *database.Upload) error {
+	f.uploads[u.Reference] = u
+	return nil
+}
+
+func TestServeHTTPToken(t *testing.T) {
+	uploads := &fakeUploads{uploads: map[string]*database.Upload{}}
+	_, handler := Register(
+		Logger(zap.NewNop()),
+		Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+		Storage(newFakeStorage()),
+		Uploads(uploads),
+		Limits(&Config{
+			MaxSize: 2048, MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1_000_000,
+			TokenExpiry: time.Hour,
+		}),
+		Metrics(prometheus.NewRegistry()),
+	)()
+
+	body, contentType := form(t, encode(t, png.Encode, 10, 10))
+	r := httptest.NewRequest(http.MethodPost, "/v1/upload", body)
+	r.Header.Set("Content-Type", contentType)
+	r = r.WithContext(auth.WithUser(r.Context(), "user@example.com"))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload = %d %q", rec.Code, rec.Body)
+	}
+
+	u := uploads.uploads[rec.Body.String()]
+	if u == nil {
+		t.Fatal("upload token not issued")
+	}
+	if u.Uploader != "user@example.com" {
+		t.Errorf("uploader = %q, want user@example.com", u.Uploader)
+	}
+	if expiry := time.Until(u.Expires); expiry <= 0 || expiry > time.Hour {
+		t.Errorf("token expires in %v, want within an hour", expiry)
+	}
+}
+
+// fakeScanner finds the files containing EICAR infected, or fails without reading them.
+type fakeScanner struct {
+	err error
+}
+
+func (f fakeScanner) Scan(_ context.Context, r io.Reader) error {
+	if f.err != nil {
+		return f.err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("EICAR")) {
+		return fmt.Errorf("%w: Eicar-Signature", scanner.ErrInfected)
+	}
+	return nil
+}
+
+func TestServeHTTPScanned(t *testing.T) {
+	img := encode(t, png.Encode, 10, 10)
+	testcases := []struct {
+		name       string
+		scanner    fakeScanner
+		image      []byte
+		want       int
+		quarantine bool
+	}{
+		{"clean", fakeScanner{}, img, http.StatusOK, false},
+		// The decoder stops at the end of the image, but the whole upload is scanned.
+		{"infected", fakeScanner{}, append(img, "EICAR"...), http.StatusUnprocessableEntity, true},
+		{"unavailable", fakeScanner{err: errors.New("connection refused")}, img, http.StatusServiceUnavailable, false},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store, originals, quarantine := newFakeStorage(), newFakeStorage(), newFakeStorage()
+			_, handler := Register(
+				Logger(zap.NewNop()),
+				Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+				Storage(store),
+				Originals(originals),
+				Scanner(tc.scanner, quarantine),
+				Limits(&Config{MaxSize: 2048, MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1_000_000}),
+				Metrics(prometheus.NewRegistry()),
+			)()
+
+			body, contentType := form(t, tc.image)
+			rec := post(handler, body, contentType)
+			if rec.Code != tc.want {
+				t.Fatalf("upload = %d %q, want %d", rec.Code, rec.Body, tc.want)
+			}
+			if tc.want == http.StatusOK {
+				reference := rec.Body.String()
+				// The image is only stored under its reference once it is clean.
+				for _, s := range []*fakeStorage{store, originals} {
+					want := []string{reference + storage.StagingSuffix, reference}
+					if !reflect.DeepEqual(s.puts, want) || len(s.images) != 1 || s.get(reference) == nil {
+						t.Errorf("stored %d images as %v, want %v published", len(s.images), s.puts, want)
+					}
+				}
+				return
+			}
+
+			if len(store.images) != 0 || len(originals.images) != 0 {
+				t.Errorf("rejected image stored: %d images, %d originals", len(store.images), len(originals.images))
+			}
+			if got := len(quarantine.images); tc.quarantine && got != 2 {
+				t.Errorf("quarantine has %d images, want the image and its original", got)
+			}
+		})
+	}
+}
+
+// interruptedReader fails after the data, like a client which disconnected.
+type interruptedReader struct {
+	r io.Reader
+}
+
+func (r interruptedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestServeHTTPRejected(t *testing.T) {
+	// The image is larger than the limit, but compresses into a small header.
+	large := append(encode(t, encodeJPEG, 64, 64), make([]byte, 4096)...)
+	valid := encode(t, encodeJPEG, 64, 64)
+	body, contentType := form(t, valid)
+	truncated := io.LimitReader(body, int64(body.Len()-100))
+
+	testcases := []struct {
+		name  string
+		image []byte
+		// body and contentType are used instead of the form with the image.
+		body        io.Reader
+		contentType string
+		storageErr  error
+		want        int
+		reason      string
+	}{
+		{"large", large, nil, "", nil, http.StatusRequestEntityTooLarge, reasonTooLarge},
+		{"unsupported", []byte("<svg></svg>"), nil, "", nil, http.StatusUnsupportedMediaType, reasonUnsupportedType},
+		{"not a form", nil, strings.NewReader("image"), "image/png", nil, http.StatusBadRequest, reasonInvalidForm},
+		{"interrupted", nil, interruptedReader{truncated}, contentType, nil, http.StatusBadRequest, reasonAborted},
+		{"storage failure", valid, nil, "", errors.New("storage failure"), http.StatusInternalServerError, ""},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store, originals := newFakeStorage(), newFakeStorage()
+			store.err = tc.storageErr
+			handler := newUploader(t, store, originals, &fakeVariants{})
+
+			body, contentType := tc.body, tc.contentType
+			if body == nil {
+				body, contentType = form(t, tc.image)
+			}
+
+			if rec := post(handler, body, contentType); rec.Code != tc.want {
+				t.Errorf("upload = %d %q, want %d", rec.Code, rec.Body, tc.want)
+			}
+			if len(store.images) != 0 || len(originals.images) != 0 {
+				t.Errorf("images stored after the upload failed")
+			}
+			if tc.reason != "" {
+				rejected := handler.(*Service).rejected.WithLabelValues(tc.reason)
+				if n := testutil.ToFloat64(rejected); n < 1 {
+					t.Errorf("%s rejections = %v, want at least 1", tc.reason, n)
+				}
+			}
+		})
+	}
+}
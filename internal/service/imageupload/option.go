@@ -1,8 +1,10 @@
 package imageupload
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"safer.place/internal/scanner"
 	"safer.place/internal/storage"
 )
 
@@ -29,3 +31,65 @@ func Storage(store storage.Storage) Option {
 		s.storage = store
 	}
 }
+
+// Originals keeps the uploaded images before their metadata is stripped, in a storage which must
+// only be available to the reviewers.
+func Originals(store storage.Storage) Option {
+	return func(s *Service) {
+		s.originals = store
+	}
+}
+
+// Uploads issues a token for every uploaded image, binding it to the user who uploaded it.
+func Uploads(store UploadStore) Option {
+	return func(s *Service) {
+		s.uploads = store
+	}
+}
+
+// Hashes saves the perceptual hash of every uploaded image which can be decoded, before the upload
+// completes. HEIC images cannot be decoded, so they have no hash.
+func Hashes(store HashStore) Option {
+	return func(s *Service) {
+		s.hashes = store
+	}
+}
+
+// Scanner checks the uploads for malware. The rejected uploads are moved to the quarantine
+// storage, or deleted if it is nil.
+func Scanner(sc scanner.Scanner, quarantine storage.Storage) Option {
+	return func(s *Service) {
+		s.scanner = sc
+		s.quarantine = quarantine
+	}
+}
+
+// Variants generates the resized variants of the uploaded images in the background.
+func Variants(q VariantQueue) Option {
+	return func(s *Service) {
+		s.variants = q
+	}
+}
+
+// Resumable keeps the resumable uploads in the storage until they are complete, it must never be
+// served. The locks serialize the requests of the upload across the replicas.
+func Resumable(store storage.Storage, locks Locker) Option {
+	return func(s *Service) {
+		s.resumable = store
+		s.locks = locks
+	}
+}
+
+// Limits provides the validation config of the uploaded images.
+func Limits(cfg *Config) Option {
+	return func(s *Service) {
+		s.cfg = cfg
+	}
+}
+
+// Metrics provides the registry of the rejected upload metrics.
+func Metrics(reg prometheus.Registerer) Option {
+	return func(s *Service) {
+		s.reg = reg
+	}
+}
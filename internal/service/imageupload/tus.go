@@ -0,0 +1,376 @@
+// Copyright 2023 SaferPlace
+
+package imageupload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+	"safer.place/internal/service"
+	"safer.place/internal/storage"
+)
+
+// ResumablePath is the tus endpoint of the resumable uploads.
+const ResumablePath = "/v1/upload/tus/"
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	// tusContentType of the PATCH requests.
+	tusContentType = "application/offset+octet-stream"
+	// referenceHeader contains the reference of the image once the upload is complete.
+	referenceHeader = "Image-Reference"
+)
+
+// tusLockExpiry is how long the upload stays locked when the request holding the lock never
+// releases it, such as when its replica stops.
+const tusLockExpiry = 10 * time.Minute
+
+// Locker takes the locks shared by all the replicas.
+type Locker interface {
+	TryLock(ctx context.Context, name, holder string, expires time.Time) (bool, error)
+	Unlock(ctx context.Context, name, holder string) error
+}
+
+// tusUpload is the state of the resumable upload, stored next to its parts.
+type tusUpload struct {
+	Length  int64     `json:"length"`
+	Offset  int64     `json:"offset"`
+	Parts   int       `json:"parts"`
+	Expires time.Time `json:"expires"`
+	// Reference of the image, once the upload is complete.
+	Reference string `json:"reference,omitempty"`
+	// Uploader is the email of the user who created the upload, the only one who can use it.
+	Uploader string `json:"uploader"`
+}
+
+// RegisterResumable registers the tus 1.0 resumable upload endpoint, supporting the creation,
+// expiration and termination extensions. The uploaded parts are kept in the resumable storage,
+// which is never served, until the upload is complete, when the image is validated and stored as
+// if it was uploaded at once.
+// https://tus.io/protocols/resumable-upload
+func RegisterResumable(opts ...Option) service.Service {
+	s := newService(opts...)
+	if s.resumable == nil || s.locks == nil {
+		panic(errMissingResumable)
+	}
+
+	// We can ignore the interceptors as this is a non-connect service
+	return func(_ ...connect.Interceptor) (string, http.Handler) {
+		return ResumablePath, http.StripPrefix(ResumablePath, http.HandlerFunc(s.serveResumable))
+	}
+}
+
+// serveResumable handles the tus requests, the path is the ID of the upload.
+func (s *Service) serveResumable(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "resumable")
+	defer span.End()
+
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		h.Set("Tus-Version", tusVersion)
+		h.Set("Tus-Extension", tusExtensions)
+		h.Set("Tus-Max-Size", strconv.FormatInt(s.cfg.MaxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		h.Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := r.URL.Path
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.createResumable(ctx, w, r, span)
+		return
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Requests for the same upload are serialized across the replicas, so the parts are written
+	// in order.
+	unlock, err := s.lockResumable(ctx, id)
+	if err != nil {
+		s.tusError(w, span, err)
+		return
+	}
+	defer unlock()
+
+	u, err := s.loadResumable(ctx, id)
+	if err != nil {
+		s.tusError(w, span, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		h.Set("Cache-Control", "no-store")
+		s.tusHeaders(h, u)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		s.patchResumable(ctx, w, r, span, id, u)
+	case http.MethodDelete:
+		if err := s.deleteResumable(ctx, id, u); err != nil {
+			s.tusError(w, span, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Service) createResumable(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		s.reject(w, span, &rejection{reasonInvalidForm, http.StatusBadRequest, "invalid Upload-Length"})
+		return
+	}
+	if length > s.cfg.MaxSize {
+		s.reject(w, span, tooLarge(s.cfg.MaxSize))
+		return
+	}
+
+	id := uuid.New().String()
+	u := &tusUpload{
+		Length:   length,
+		Expires:  time.Now().Add(s.cfg.ResumableExpiry),
+		Uploader: auth.UserFromContext(ctx),
+	}
+	if err := s.saveResumable(ctx, id, u); err != nil {
+		s.tusError(w, span, err)
+		return
+	}
+
+	w.Header().Set("Location", ResumablePath+id)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchResumable appends the part to the upload, completing it once all of it was received.
+func (s *Service) patchResumable(
+	ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span, id string, u *tusUpload,
+) {
+	if u.Reference != "" {
+		http.Error(w, "upload is already complete", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "content type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.Offset {
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	// The part received before the client disconnected is kept, so the upload can be resumed.
+	body := &partReader{r: io.LimitReader(r.Body, u.Length-u.Offset)}
+	if err := s.resumable.Put(ctx, tusPart(id, u.Parts), body, -1, tusContentType); err != nil {
+		s.tusError(w, span, err)
+		return
+	}
+	if body.n > 0 {
+		u.Offset += body.n
+		u.Parts++
+	} else if err := s.resumable.Delete(ctx, tusPart(id, u.Parts)); err != nil {
+		s.tusError(w, span, err)
+		return
+	}
+	u.Expires = time.Now().Add(s.cfg.ResumableExpiry)
+
+	if u.Offset == u.Length {
+		if err := s.completeResumable(ctx, id, u); err != nil {
+			s.reject(w, span, err)
+			return
+		}
+	}
+	if err := s.saveResumable(ctx, id, u); err != nil {
+		s.tusError(w, span, err)
+		return
+	}
+	if body.err != nil {
+		s.log.Debug("resumable upload interrupted", zap.String("id", id), zap.Error(body.err))
+	}
+
+	s.tusHeaders(w.Header(), u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeResumable uploads the image from its parts, which are removed afterwards.
+func (s *Service) completeResumable(ctx context.Context, id string, u *tusUpload) error {
+	parts := make([]io.Reader, 0, u.Parts)
+	for i := 0; i < u.Parts; i++ {
+		part, _, err := s.resumable.Get(ctx, tusPart(id, i))
+		if err != nil {
+			return fmt.Errorf("unable to get part: %w", err)
+		}
+		defer part.Close()
+		parts = append(parts, part)
+	}
+
+	reference, err := s.upload(ctx, io.MultiReader(parts...))
+	if err != nil {
+		var rej *rejection
+		if errors.As(err, &rej) {
+			// The upload cannot succeed, so it is removed straight away.
+			if err := s.deleteResumable(ctx, id, u); err != nil {
+				s.log.Error("unable to delete rejected upload", zap.String("id", id), zap.Error(err))
+			}
+		}
+		return err
+	}
+
+	u.Reference = reference
+	for i := 0; i < u.Parts; i++ {
+		if err := s.resumable.Delete(ctx, tusPart(id, i)); err != nil {
+			s.log.Error("unable to delete upload part", zap.String("id", id), zap.Error(err))
+		}
+	}
+	u.Parts = 0
+
+	return nil
+}
+
+// deleteResumable removes the upload and its parts.
+func (s *Service) deleteResumable(ctx context.Context, id string, u *tusUpload) error {
+	for i := 0; i < u.Parts; i++ {
+		if err := s.resumable.Delete(ctx, tusPart(id, i)); err != nil {
+			return err
+		}
+	}
+	return s.resumable.Delete(ctx, tusInfo(id))
+}
+
+var errUploadExpired = errors.New("upload expired")
+
+// loadResumable returns the upload, removing it if it has expired. The uploads of the other users
+// are not found.
+func (s *Service) loadResumable(ctx context.Context, id string) (*tusUpload, error) {
+	r, _, err := s.resumable.Get(ctx, tusInfo(id))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var u tusUpload
+	if err := json.NewDecoder(r).Decode(&u); err != nil {
+		return nil, fmt.Errorf("unable to decode upload: %w", err)
+	}
+	if u.Uploader != auth.UserFromContext(ctx) {
+		return nil, storage.ErrNotFound
+	}
+
+	if time.Now().After(u.Expires) {
+		if err := s.deleteResumable(ctx, id, &u); err != nil {
+			s.log.Error("unable to delete expired upload", zap.String("id", id), zap.Error(err))
+		}
+		return nil, errUploadExpired
+	}
+
+	return &u, nil
+}
+
+func (s *Service) saveResumable(ctx context.Context, id string, u *tusUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("unable to encode upload: %w", err)
+	}
+	return s.resumable.Put(ctx, tusInfo(id), bytes.NewReader(b), int64(len(b)), "application/json")
+}
+
+// tusHeaders describe the state of the upload.
+func (s *Service) tusHeaders(h http.Header, u *tusUpload) {
+	h.Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	h.Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	if u.Reference != "" {
+		h.Set(referenceHeader, u.Reference)
+	}
+}
+
+// tusError responds with the error of the storage.
+func (s *Service) tusError(w http.ResponseWriter, span trace.Span, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "upload not found", http.StatusNotFound)
+	case errors.Is(err, errUploadExpired):
+		http.Error(w, "upload expired", http.StatusGone)
+	case errors.Is(err, errUploadLocked):
+		http.Error(w, "upload is used by another request", http.StatusLocked)
+	default:
+		s.log.Error("resumable upload failed", zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, "upload failed", http.StatusInternalServerError)
+	}
+}
+
+var errUploadLocked = errors.New("upload locked")
+
+// lockResumable locks the upload for the request, returning the function unlocking it.
+func (s *Service) lockResumable(ctx context.Context, id string) (func(), error) {
+	holder := uuid.New().String()
+	ok, err := s.locks.TryLock(ctx, tusInfo(id), holder, time.Now().Add(tusLockExpiry))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errUploadLocked
+	}
+
+	return func() {
+		// The lock is released even when the client disconnected.
+		if err := s.locks.Unlock(context.WithoutCancel(ctx), tusInfo(id), holder); err != nil {
+			s.log.Error("unable to unlock upload", zap.String("id", id), zap.Error(err))
+		}
+	}, nil
+}
+
+func tusInfo(id string) string {
+	return storage.ResumablePrefix + id
+}
+
+func tusPart(id string, n int) string {
+	return storage.ResumablePrefix + id + "_" + strconv.Itoa(n)
+}
+
+// partReader ends the part when the request body fails, remembering the error and the size.
+type partReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if err != nil && err != io.EOF {
+		p.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
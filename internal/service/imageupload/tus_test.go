@@ -0,0 +1,229 @@
+package imageupload
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+	"safer.place/internal/storage"
+	"safer.place/internal/storage/filesystem"
+)
+
+// fakeLocks are held until they are unlocked, they never expire.
+type fakeLocks struct {
+	mu      sync.Mutex
+	holders map[string]string
+}
+
+func (f *fakeLocks) TryLock(_ context.Context, name, holder string, _ time.Time) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.holders[name]; ok {
+		return false, nil
+	}
+	f.holders[name] = holder
+	return true, nil
+}
+
+func (f *fakeLocks) Unlock(_ context.Context, name, holder string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.holders[name] == holder {
+		delete(f.holders, name)
+	}
+	return nil
+}
+
+// resumable is the resumable upload service with its storages.
+type resumable struct {
+	handler   http.Handler
+	store     storage.Storage
+	resumable storage.Storage
+	locks     *fakeLocks
+}
+
+func newResumable(t *testing.T, expiry time.Duration) *resumable {
+	t.Helper()
+	tracer := trace.NewNoopTracerProvider().Tracer("test")
+	newStorage := func(dir string) storage.Storage {
+		store, err := filesystem.New(&filesystem.Config{Dir: filepath.Join(t.TempDir(), dir)}, filesystem.Tracer(tracer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	r := &resumable{
+		store:     newStorage("images"),
+		resumable: newStorage("resumable"),
+		locks:     &fakeLocks{holders: make(map[string]string)},
+	}
+
+	_, r.handler = RegisterResumable(
+		Logger(zap.NewNop()),
+		Tracer(tracer),
+		Storage(r.store),
+		Resumable(r.resumable, r.locks),
+		Limits(&Config{
+			MaxSize: 1 << 20, MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1_000_000,
+			Quality: 90, ResumableExpiry: expiry,
+		}),
+		Metrics(prometheus.NewRegistry()),
+	)()
+	return r
+}
+
+func tus(handler http.Handler, method, path string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	return tusAs(handler, "", method, path, body, headers...)
+}
+
+// tusAs sends the request as the user.
+func tusAs(handler http.Handler, user, method, path string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	r = r.WithContext(auth.WithUser(r.Context(), user))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestResumable(t *testing.T) {
+	res := newResumable(t, time.Hour)
+	handler, store := res.handler, res.store
+	img := encode(t, png.Encode, 64, 64)
+	length := strconv.Itoa(len(img))
+
+	rec := tus(handler, http.MethodPost, ResumablePath, nil, "Upload-Length", length)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d %q", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+
+	// The client disconnects after sending the first half.
+	half := len(img) / 2
+	rec = tus(handler, http.MethodPatch, location, interruptedReader{bytes.NewReader(img[:half])},
+		"Content-Type", tusContentType, "Upload-Offset", "0")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("first patch = %d %q", rec.Code, rec.Body)
+	}
+
+	rec = tus(handler, http.MethodHead, location, nil)
+	if offset := rec.Header().Get("Upload-Offset"); offset != strconv.Itoa(half) {
+		t.Fatalf("offset = %q, want %d", offset, half)
+	}
+
+	rec = tus(handler, http.MethodPatch, location, bytes.NewReader(img[1:]),
+		"Content-Type", tusContentType, "Upload-Offset", "1")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("patch at the wrong offset = %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	rec = tus(handler, http.MethodPatch, location, bytes.NewReader(img[half:]),
+		"Content-Type", tusContentType, "Upload-Offset", strconv.Itoa(half))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != length {
+		t.Fatalf("last patch = %d %q", rec.Code, rec.Body)
+	}
+	reference := rec.Header().Get(referenceHeader)
+
+	r, obj, err := store.Get(context.Background(), reference)
+	if err != nil {
+		t.Fatalf("image %q not stored: %v", reference, err)
+	}
+	r.Close()
+	if obj.ContentType != "image/png" {
+		t.Errorf("content type = %q, want image/png", obj.ContentType)
+	}
+	id := location[len(ResumablePath):]
+	if _, err := res.resumable.Stat(context.Background(), tusPart(id, 0)); err != storage.ErrNotFound {
+		t.Errorf("part not removed after completion: %v", err)
+	}
+
+	rec = tus(handler, http.MethodHead, location, nil)
+	if rec.Header().Get(referenceHeader) != reference {
+		t.Errorf("reference = %q after completion, want %q", rec.Header().Get(referenceHeader), reference)
+	}
+}
+
+func TestResumableExpired(t *testing.T) {
+	handler := newResumable(t, -time.Second).handler
+
+	rec := tus(handler, http.MethodPost, ResumablePath, nil, "Upload-Length", "10")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d %q", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+
+	if rec := tus(handler, http.MethodHead, location, nil); rec.Code != http.StatusGone {
+		t.Errorf("expired = %d, want %d", rec.Code, http.StatusGone)
+	}
+	if rec := tus(handler, http.MethodHead, location, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("removed = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestResumableTooLarge(t *testing.T) {
+	handler := newResumable(t, time.Hour).handler
+
+	if rec := tus(handler, http.MethodPost, ResumablePath, nil, "Upload-Length", "2000000"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("create = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestResumableUploader(t *testing.T) {
+	handler := newResumable(t, time.Hour).handler
+
+	rec := tusAs(handler, "reporter@example.com", http.MethodPost, ResumablePath, nil, "Upload-Length", "10")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d %q", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+
+	// Only the user who created the upload can see or change it.
+	for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete} {
+		rec := tusAs(handler, "other@example.com", method, location, bytes.NewReader([]byte("part")),
+			"Content-Type", tusContentType, "Upload-Offset", "0")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s by another user = %d, want %d", method, rec.Code, http.StatusNotFound)
+		}
+	}
+	if rec := tusAs(handler, "reporter@example.com", http.MethodHead, location, nil); rec.Code != http.StatusOK {
+		t.Errorf("HEAD by the uploader = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestResumableLocked(t *testing.T) {
+	res := newResumable(t, time.Hour)
+
+	rec := tus(res.handler, http.MethodPost, ResumablePath, nil, "Upload-Length", "10")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d %q", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	id := location[len(ResumablePath):]
+
+	// Another replica is handling a request for the upload.
+	if ok, _ := res.locks.TryLock(context.Background(), tusInfo(id), "replica", time.Now()); !ok {
+		t.Fatal("unable to lock the upload")
+	}
+	if rec := tus(res.handler, http.MethodHead, location, nil); rec.Code != http.StatusLocked {
+		t.Errorf("locked = %d, want %d", rec.Code, http.StatusLocked)
+	}
+	res.locks.Unlock(context.Background(), tusInfo(id), "replica")
+	if rec := tus(res.handler, http.MethodHead, location, nil); rec.Code != http.StatusOK {
+		t.Errorf("unlocked = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,30 @@
+package push
+
+import (
+	"go.uber.org/zap"
+	"safer.place/internal/webpush"
+)
+
+// Option to provide configuration to the service.
+type Option func(*Service)
+
+// Logger provides the logger
+func Logger(log *zap.Logger) Option {
+	return func(s *Service) {
+		s.log = log
+	}
+}
+
+// Keys are the VAPID keys, the public key of which the browsers need to subscribe.
+func Keys(keys *webpush.Keys) Option {
+	return func(s *Service) {
+		s.keys = keys
+	}
+}
+
+// Subscriptions provides the storage of the subscriptions.
+func Subscriptions(subs Store) Option {
+	return func(s *Service) {
+		s.subs = subs
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 SaferPlace
+
+// Package push allows the PWA users to subscribe to Web Push alerts about incidents in the
+// region tiles they are interested in.
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"connectrpc.com/connect"
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
+	"safer.place/internal/geo"
+	"safer.place/internal/service"
+	"safer.place/internal/webpush"
+)
+
+// MaxTiles is the maximum number of tiles of a single subscription.
+const MaxTiles = 64
+
+// Store saves the subscriptions.
+type Store interface {
+	SavePushSubscription(context.Context, *database.PushSubscription) error
+	DeletePushSubscription(context.Context, string) error
+	PushSubscriptionOwner(context.Context, string) (string, error)
+}
+
+// Service handles the push subscriptions.
+type Service struct {
+	keys *webpush.Keys
+	subs Store
+	log  *zap.Logger
+}
+
+// Register registers the push subscription service.
+func Register(opts ...Option) service.Service {
+	s := &Service{}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := validate(s); err != nil {
+		panic(err)
+	}
+
+	// We can ignore the interceptors as this is a non-connect service
+	return func(_ ...connect.Interceptor) (string, http.Handler) {
+		return "/v1/push/", s
+	}
+}
+
+// SubscribeRequest subscribes the browser to the alerts in the tiles.
+type SubscribeRequest struct {
+	Subscription webpush.Subscription `json:"subscription"`
+	// Tiles are the "z/x/y" names of the region tiles.
+	Tiles []string `json:"tiles"`
+}
+
+// UnsubscribeRequest removes the subscription.
+type UnsubscribeRequest struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// KeyResponse contains the applicationServerKey used to subscribe.
+type KeyResponse struct {
+	PublicKey string `json:"public_key"`
+}
+
+// ServeHTTP routes the request to the handlers.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/push/key" && r.Method == http.MethodGet:
+		s.key(w)
+	case r.URL.Path == "/v1/push/subscriptions" && r.Method == http.MethodPost:
+		s.subscribe(w, r)
+	case r.URL.Path == "/v1/push/subscriptions" && r.Method == http.MethodDelete:
+		s.unsubscribe(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Service) key(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if err := json.NewEncoder(w).Encode(&KeyResponse{PublicKey: s.keys.PublicKey()}); err != nil {
+		s.log.Error("unable to encode key response", zap.Error(err))
+	}
+}
+
+func (s *Service) subscribe(w http.ResponseWriter, r *http.Request) {
+	var req SubscribeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid subscription", http.StatusBadRequest)
+		return
+	}
+	if err := validateSubscription(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.subs.SavePushSubscription(r.Context(), &database.PushSubscription{
+		Endpoint: req.Subscription.Endpoint,
+		Owner:    auth.UserFromContext(r.Context()),
+		P256dh:   req.Subscription.Keys.P256dh,
+		Auth:     req.Subscription.Keys.Auth,
+		Tiles:    req.Tiles,
+	}); err != nil {
+		if errors.Is(err, database.ErrAlreadyExists) {
+			http.Error(w, errNotOwner.Error(), http.StatusConflict)
+			return
+		}
+		s.log.Error("unable to save push subscription", zap.Error(err))
+		http.Error(w, "unable to save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Service) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	var req UnsubscribeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Endpoint == "" {
+		http.Error(w, "missing endpoint", http.StatusBadRequest)
+		return
+	}
+
+	// Only the user who subscribed can unsubscribe, the subscriptions saved without an owner can
+	// be removed by any user who knows their endpoint.
+	owner, err := s.subs.PushSubscriptionOwner(r.Context(), req.Endpoint)
+	if err != nil && !errors.Is(err, database.ErrDoesNotExist) {
+		s.log.Error("unable to get push subscription owner", zap.Error(err))
+		http.Error(w, "unable to delete subscription", http.StatusInternalServerError)
+		return
+	}
+	if errors.Is(err, database.ErrDoesNotExist) || (owner != "" && owner != auth.UserFromContext(r.Context())) {
+		http.Error(w, "subscription not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.subs.DeletePushSubscription(r.Context(), req.Endpoint); err != nil {
+		s.log.Error("unable to delete push subscription", zap.Error(err))
+		http.Error(w, "unable to delete subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	errMissingTiles     = errors.New("missing tiles")
+	errTooManyTiles     = fmt.Errorf("at most %d tiles can be subscribed to", MaxTiles)
+	errInsecureEndpoint = errors.New("endpoint must use https")
+	errNotOwner         = errors.New("endpoint is subscribed by another user")
+)
+
+func validateSubscription(req *SubscribeRequest) error {
+	if err := req.Subscription.Validate(); err != nil {
+		return err
+	}
+	if u, _ := url.Parse(req.Subscription.Endpoint); u.Scheme != "https" {
+		return errInsecureEndpoint
+	}
+
+	if len(req.Tiles) == 0 {
+		return errMissingTiles
+	}
+	if len(req.Tiles) > MaxTiles {
+		return errTooManyTiles
+	}
+	for _, tile := range req.Tiles {
+		if _, err := geo.ParseTile(tile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	errMissingLogger        = errors.New("missing logger")
+	errMissingKeys          = errors.New("missing keys")
+	errMissingSubscriptions = errors.New("missing subscriptions")
+)
+
+func validate(s *Service) error {
+	if s.log == nil {
+		return errMissingLogger
+	}
+	if s.keys == nil {
+		return errMissingKeys
+	}
+	if s.subs == nil {
+		return errMissingSubscriptions
+	}
+	return nil
+}
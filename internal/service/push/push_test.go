@@ -0,0 +1,83 @@
+// Copyright 2023 SaferPlace
+
+package push
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
+	"safer.place/internal/webpush"
+)
+
+type fakeStore struct {
+	owners map[string]string
+}
+
+func (f *fakeStore) SavePushSubscription(_ context.Context, sub *database.PushSubscription) error {
+	f.owners[sub.Endpoint] = sub.Owner
+	return nil
+}
+
+func (f *fakeStore) DeletePushSubscription(_ context.Context, endpoint string) error {
+	delete(f.owners, endpoint)
+	return nil
+}
+
+func (f *fakeStore) PushSubscriptionOwner(_ context.Context, endpoint string) (string, error) {
+	owner, ok := f.owners[endpoint]
+	if !ok {
+		return "", database.ErrDoesNotExist
+	}
+	return owner, nil
+}
+
+func TestUnsubscribe(t *testing.T) {
+	const endpoint = "https://push.example.com/endpoint"
+
+	testCases := map[string]struct {
+		owner   string
+		user    string
+		missing bool
+		code    int
+	}{
+		"owner":          {owner: "a@example.com", user: "a@example.com", code: http.StatusNoContent},
+		"other user":     {owner: "a@example.com", user: "b@example.com", code: http.StatusNotFound},
+		"no owner":       {owner: "", user: "b@example.com", code: http.StatusNoContent},
+		"not subscribed": {user: "a@example.com", missing: true, code: http.StatusNotFound},
+	}
+
+	keys, err := webpush.GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			store := &fakeStore{owners: map[string]string{}}
+			if !tc.missing {
+				store.owners[endpoint] = tc.owner
+			}
+			_, handler := Register(Logger(zap.NewNop()), Keys(keys), Subscriptions(store))()
+
+			r := httptest.NewRequest(http.MethodDelete, "/v1/push/subscriptions",
+				strings.NewReader(`{"endpoint": "`+endpoint+`"}`))
+			r = r.WithContext(auth.WithUser(r.Context(), tc.user))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tc.code {
+				t.Errorf("code = %d, want %d", rec.Code, tc.code)
+			}
+			if _, exists := store.owners[endpoint]; exists != (tc.code != http.StatusNoContent && !tc.missing) {
+				t.Errorf("subscription exists = %v after %d", exists, rec.Code)
+			}
+		})
+	}
+}
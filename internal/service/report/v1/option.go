@@ -0,0 +1,40 @@
+package report
+
+import (
+	"context"
+
+	"safer.place/internal/database"
+	"safer.place/internal/storage"
+)
+
+// Option to provide optional configuration to the service.
+type Option func(*Service)
+
+// ReporterStore saves who reported the incident.
+type ReporterStore interface {
+	SaveReporter(context.Context, string, string) error
+}
+
+// Reporters records the authenticated reporter of every incident, so they can be notified about
+// the outcome of their report.
+func Reporters(store ReporterStore) Option {
+	return func(s *Service) {
+		s.reporters = store
+	}
+}
+
+// UploadStore finds the tokens of the uploaded images and attaches the images to the incidents.
+type UploadStore interface {
+	Upload(context.Context, string) (*database.Upload, error)
+	AttachUpload(context.Context, string, string) error
+	DetachUpload(context.Context, string, string) error
+}
+
+// Images verifies the image of every report is in the storage, was uploaded by the reporter and
+// is not attached to another incident.
+func Images(store storage.Storage, uploads UploadStore) Option {
+	return func(s *Service) {
+		s.storage = store
+		s.uploads = uploads
+	}
+}
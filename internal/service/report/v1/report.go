@@ -4,16 +4,21 @@ package report
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
 	"safer.place/internal/queue"
 	"safer.place/internal/service"
+	"safer.place/internal/storage"
 
 	ipb "api.safer.place/incident/v1"
 	pb "api.safer.place/report/v1"
@@ -22,24 +27,36 @@ import (
 
 // Service is the report service
 type Service struct {
-	queue queue.Producer[*ipb.Incident]
-	log   *zap.Logger
+	queue     queue.Producer[*ipb.Incident]
+	log       *zap.Logger
+	reporters ReporterStore
+	storage   storage.Storage
+	uploads   UploadStore
 
 	validator Validator
 }
 
 // Register creates a new service and and returns the
-func Register(q queue.Producer[*ipb.Incident], log *zap.Logger) service.Service {
+func Register(
+	q queue.Producer[*ipb.Incident],
+	log *zap.Logger,
+	opts ...Option,
+) service.Service {
+	s := &Service{
+		queue: q,
+		log:   log,
+		validator: NewMultiValidator(
+			validateDescription,
+			validateCoordinates,
+		),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
 	return func(interceptors ...connect.Interceptor) (string, http.Handler) {
 		return connectpb.NewReportServiceHandler(
-			&Service{
-				queue: q,
-				log:   log,
-				validator: NewMultiValidator(
-					validateDescription,
-					validateCoordinates,
-				),
-			},
+			s,
 			connect.WithInterceptors(interceptors...),
 		)
 	}
@@ -62,11 +79,28 @@ func (s *Service) SendReport(
 		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
 
+	// The image is attached first, so another report cannot attach it in the meantime. It is
+	// detached again if the report is not queued, so it can be reported again.
+	reporter := auth.UserFromContext(ctx)
+	if err := s.attachImage(ctx, incident, reporter); err != nil {
+		return nil, err
+	}
+
 	s.log.Info("received report",
 		zap.String("id", incident.Id),
 	)
 
+	// The reporter is saved before the incident is queued, so it is known by the time the
+	// incident can be reviewed.
+	if s.reporters != nil && reporter != "" {
+		if err := s.reporters.SaveReporter(ctx, incident.Id, reporter); err != nil {
+			s.detachImage(ctx, incident)
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+	}
+
 	if err := s.queue.Produce(ctx, incident); err != nil {
+		s.detachImage(ctx, incident)
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
@@ -75,6 +109,67 @@ func (s *Service) SendReport(
 	}), nil
 }
 
+var (
+	errUnknownImage  = errors.New("image does not exist")
+	errImageOwner    = errors.New("image was uploaded by another user")
+	errImageAttached = errors.New("image is already attached to another incident")
+	errImageExpired  = errors.New("image upload expired, the image must be uploaded again")
+)
+
+// attachImage attaches the image to the incident, if it exists, was uploaded by the reporter and
+// is not attached to another incident already.
+func (s *Service) attachImage(ctx context.Context, incident *ipb.Incident, reporter string) error {
+	if s.uploads == nil || incident.ImageId == "" {
+		return nil
+	}
+
+	if _, err := s.storage.Stat(ctx, incident.ImageId); err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidReference) {
+			return connect.NewError(connect.CodeInvalidArgument, errUnknownImage)
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	upload, err := s.uploads.Upload(ctx, incident.ImageId)
+	switch {
+	case errors.Is(err, database.ErrDoesNotExist):
+		return connect.NewError(connect.CodeInvalidArgument, errUnknownImage)
+	case err != nil:
+		return connect.NewError(connect.CodeInternal, err)
+	case upload.Uploader != reporter:
+		return connect.NewError(connect.CodeInvalidArgument, errImageOwner)
+	case upload.Incident != "":
+		return connect.NewError(connect.CodeInvalidArgument, errImageAttached)
+	case time.Now().After(upload.Expires):
+		return connect.NewError(connect.CodeInvalidArgument, errImageExpired)
+	}
+
+	// Attaching the image fails if another report attached it in the meantime.
+	if err := s.uploads.AttachUpload(ctx, incident.ImageId, incident.Id); err != nil {
+		if errors.Is(err, database.ErrAlreadyExists) {
+			return connect.NewError(connect.CodeInvalidArgument, errImageAttached)
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+
+	return nil
+}
+
+// detachImage detaches the image from the incident which could not be queued. The request might
+// have been cancelled, so the image is detached regardless.
+func (s *Service) detachImage(ctx context.Context, incident *ipb.Incident) {
+	if s.uploads == nil || incident.ImageId == "" {
+		return
+	}
+	if err := s.uploads.DetachUpload(context.WithoutCancel(ctx), incident.ImageId, incident.Id); err != nil {
+		s.log.Error("unable to detach image",
+			zap.String("id", incident.Id),
+			zap.String("image", incident.ImageId),
+			zap.Error(err),
+		)
+	}
+}
+
 // CoordinateError is returned when the provided coordinate does not match the
 // max and min
 type CoordinateError struct {
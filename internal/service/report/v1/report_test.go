@@ -0,0 +1,180 @@
+// Copyright 2023 SaferPlace
+
+package report
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"go.uber.org/zap"
+
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
+	"safer.place/internal/storage"
+
+	ipb "api.safer.place/incident/v1"
+	pb "api.safer.place/report/v1"
+)
+
+type fakeQueue struct {
+	produced []*ipb.Incident
+	err      error
+}
+
+func (q *fakeQueue) Produce(_ context.Context, inc *ipb.Incident) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.produced = append(q.produced, inc)
+	return nil
+}
+
+type fakeStorage struct {
+	storage.Storage
+	images map[string]bool
+}
+
+func (f *fakeStorage) Stat(_ context.Context, reference string) (*storage.Object, error) {
+	if !f.images[reference] {
+		return nil, storage.ErrNotFound
+	}
+	return &storage.Object{Reference: reference}, nil
+}
+
+type fakeUploads struct {
+	uploads map[string]*database.Upload
+}
+
+func (f *fakeUploads) Upload(_ context.Context, reference string) (*database.Upload, error) {
+	u, ok := f.uploads[reference]
+	if !ok {
+		return nil, database.ErrDoesNotExist
+	}
+	return u, nil
+}
+
+func (f *fakeUploads) AttachUpload(_ context.Context, reference, id string) error {
+	f.uploads[reference].Incident = id
+	return nil
+}
+
+func (f *fakeUploads) DetachUpload(_ context.Context, reference, id string) error {
+	if u := f.uploads[reference]; u.Incident == id {
+		u.Incident = ""
+	}
+	return nil
+}
+
+func TestSendReportImage(t *testing.T) {
+	const reporter = "reporter@example.com"
+
+	testCases := map[string]struct {
+		image  string
+		stored bool
+		upload *database.Upload
+		err    error
+	}{
+		"without image": {},
+		"uploaded by reporter": {
+			image:  "image",
+			stored: true,
+			upload: &database.Upload{Uploader: reporter, Expires: time.Now().Add(time.Hour)},
+		},
+		"not stored": {
+			image:  "image",
+			upload: &database.Upload{Uploader: reporter, Expires: time.Now().Add(time.Hour)},
+			err:    errUnknownImage,
+		},
+		"not uploaded": {
+			image:  "image",
+			stored: true,
+			err:    errUnknownImage,
+		},
+		"uploaded by another user": {
+			image:  "image",
+			stored: true,
+			upload: &database.Upload{Uploader: "other@example.com", Expires: time.Now().Add(time.Hour)},
+			err:    errImageOwner,
+		},
+		"already attached": {
+			image:  "image",
+			stored: true,
+			upload: &database.Upload{
+				Uploader: reporter, Expires: time.Now().Add(time.Hour), Incident: "other",
+			},
+			err: errImageAttached,
+		},
+		"expired": {
+			image:  "image",
+			stored: true,
+			upload: &database.Upload{Uploader: reporter, Expires: time.Now().Add(-time.Minute)},
+			err:    errImageExpired,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			q := &fakeQueue{}
+			uploads := &fakeUploads{uploads: map[string]*database.Upload{}}
+			if tc.upload != nil {
+				tc.upload.Reference = tc.image
+				uploads.uploads[tc.image] = tc.upload
+			}
+			s := &Service{
+				queue:     q,
+				log:       zap.NewNop(),
+				storage:   &fakeStorage{images: map[string]bool{tc.image: tc.stored}},
+				uploads:   uploads,
+				validator: NewMultiValidator(),
+			}
+
+			ctx := auth.WithUser(context.Background(), reporter)
+			res, err := s.SendReport(ctx, connect.NewRequest(&pb.SendReportRequest{
+				Incident: &ipb.Incident{Description: "report", ImageId: tc.image},
+			}))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("SendReport() = %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				if connect.CodeOf(err) != connect.CodeInvalidArgument {
+					t.Errorf("code = %v, want %v", connect.CodeOf(err), connect.CodeInvalidArgument)
+				}
+				if len(q.produced) != 0 {
+					t.Error("rejected report was queued")
+				}
+				return
+			}
+
+			if tc.upload != nil && tc.upload.Incident != res.Msg.Id {
+				t.Errorf("image attached to %q, want %q", tc.upload.Incident, res.Msg.Id)
+			}
+		})
+	}
+}
+
+func TestSendReportImageNotQueued(t *testing.T) {
+	const reporter = "reporter@example.com"
+	upload := &database.Upload{Reference: "image", Uploader: reporter, Expires: time.Now().Add(time.Hour)}
+	s := &Service{
+		queue:     &fakeQueue{err: errors.New("queue unavailable")},
+		log:       zap.NewNop(),
+		storage:   &fakeStorage{images: map[string]bool{"image": true}},
+		uploads:   &fakeUploads{uploads: map[string]*database.Upload{"image": upload}},
+		validator: NewMultiValidator(),
+	}
+
+	ctx := auth.WithUser(context.Background(), reporter)
+	_, err := s.SendReport(ctx, connect.NewRequest(&pb.SendReportRequest{
+		Incident: &ipb.Incident{Description: "report", ImageId: "image"},
+	}))
+	if connect.CodeOf(err) != connect.CodeInternal {
+		t.Fatalf("SendReport() = %v, want %v", err, connect.CodeInternal)
+	}
+	if upload.Incident != "" {
+		t.Errorf("image attached to %q, want detached so it can be reported again", upload.Incident)
+	}
+}
@@ -0,0 +1,20 @@
+package reporter
+
+import "go.uber.org/zap"
+
+// Option to provide configuration to the service.
+type Option func(*Service)
+
+// Logger provides the logger
+func Logger(log *zap.Logger) Option {
+	return func(s *Service) {
+		s.log = log
+	}
+}
+
+// PreferencesStore provides the storage of the reporter preferences.
+func PreferencesStore(prefs Store) Option {
+	return func(s *Service) {
+		s.prefs = prefs
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 SaferPlace
+
+// Package reporter allows the reporters to choose how they are notified about the outcome of
+// their reports, or to opt out.
+package reporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"connectrpc.com/connect"
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
+	"safer.place/internal/service"
+	"safer.place/internal/webpush"
+)
+
+// Store saves the preferences of the reporters.
+type Store interface {
+	ReporterPreferences(context.Context, string) (*database.ReporterPreferences, error)
+	SaveReporterPreferences(context.Context, *database.ReporterPreferences) error
+}
+
+// Service handles the preferences of the authenticated reporter.
+type Service struct {
+	prefs Store
+	log   *zap.Logger
+}
+
+// Register registers the reporter preferences service.
+func Register(opts ...Option) service.Service {
+	s := &Service{}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := validate(s); err != nil {
+		panic(err)
+	}
+
+	// We can ignore the interceptors as this is a non-connect service
+	return func(_ ...connect.Interceptor) (string, http.Handler) {
+		return "/v1/reporter/", s
+	}
+}
+
+// Preferences of the reporter notifications.
+type Preferences struct {
+	// Channel is one of "email", "push" or "none" to opt out.
+	Channel database.ReporterChannel `json:"channel"`
+	// Subscription is required by the push channel.
+	Subscription *webpush.Subscription `json:"subscription,omitempty"`
+}
+
+// ServeHTTP routes the request to the handlers.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/reporter/preferences" {
+		http.NotFound(w, r)
+		return
+	}
+
+	email := auth.UserFromContext(r.Context())
+	if email == "" {
+		http.Error(w, auth.ErrUserUnauthenticated.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.get(w, r, email)
+	case http.MethodPut:
+		s.put(w, r, email)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Service) get(w http.ResponseWriter, r *http.Request, email string) {
+	prefs, err := s.prefs.ReporterPreferences(r.Context(), email)
+	if err != nil {
+		s.log.Error("unable to get reporter preferences", zap.Error(err))
+		http.Error(w, "unable to get preferences", http.StatusInternalServerError)
+		return
+	}
+
+	resp := &Preferences{Channel: prefs.Channel}
+	if prefs.Push != nil {
+		resp.Subscription = &webpush.Subscription{
+			Endpoint: prefs.Push.Endpoint,
+			Keys:     webpush.SubscriptionKeys{P256dh: prefs.Push.P256dh, Auth: prefs.Push.Auth},
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.log.Error("unable to encode preferences", zap.Error(err))
+	}
+}
+
+func (s *Service) put(w http.ResponseWriter, r *http.Request, email string) {
+	var req Preferences
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid preferences", http.StatusBadRequest)
+		return
+	}
+	if err := validatePreferences(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prefs := &database.ReporterPreferences{Email: email, Channel: req.Channel}
+	if req.Subscription != nil {
+		prefs.Push = &database.PushSubscription{
+			Endpoint: req.Subscription.Endpoint,
+			P256dh:   req.Subscription.Keys.P256dh,
+			Auth:     req.Subscription.Keys.Auth,
+		}
+	}
+
+	if err := s.prefs.SaveReporterPreferences(r.Context(), prefs); err != nil {
+		if errors.Is(err, database.ErrAlreadyExists) {
+			http.Error(w, errNotOwner.Error(), http.StatusConflict)
+			return
+		}
+		s.log.Error("unable to save reporter preferences", zap.Error(err))
+		http.Error(w, "unable to save preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	errUnknownChannel       = errors.New("unknown channel")
+	errMissingSubscription  = errors.New("push channel requires a subscription")
+	errInsecureSubscription = errors.New("endpoint must use https")
+	errNotOwner             = errors.New("endpoint is subscribed by another user")
+)
+
+func validatePreferences(p *Preferences) error {
+	switch p.Channel {
+	case database.ReporterChannelEmail, database.ReporterChannelNone:
+	case database.ReporterChannelPush:
+		if p.Subscription == nil {
+			return errMissingSubscription
+		}
+	default:
+		return fmt.Errorf("%w %q", errUnknownChannel, p.Channel)
+	}
+
+	if p.Subscription == nil {
+		return nil
+	}
+	if err := p.Subscription.Validate(); err != nil {
+		return err
+	}
+	if u, _ := url.Parse(p.Subscription.Endpoint); u.Scheme != "https" {
+		return errInsecureSubscription
+	}
+
+	return nil
+}
+
+var (
+	errMissingLogger      = errors.New("missing logger")
+	errMissingPreferences = errors.New("missing preferences")
+)
+
+func validate(s *Service) error {
+	if s.log == nil {
+		return errMissingLogger
+	}
+	if s.prefs == nil {
+		return errMissingPreferences
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 SaferPlace
+
+package reporter
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"safer.place/internal/auth"
+	"safer.place/internal/database"
+	"safer.place/internal/webpush"
+)
+
+func newSubscription(t *testing.T, endpoint string) *webpush.Subscription {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	return &webpush.Subscription{
+		Endpoint: endpoint,
+		Keys: webpush.SubscriptionKeys{
+			P256dh: base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(secret),
+		},
+	}
+}
+
+func TestValidatePreferences(t *testing.T) {
+	testCases := map[string]struct {
+		prefs *Preferences
+		err   error
+	}{
+		"email": {
+			prefs: &Preferences{Channel: database.ReporterChannelEmail},
+		},
+		"opt out": {
+			prefs: &Preferences{Channel: database.ReporterChannelNone},
+		},
+		"push": {
+			prefs: &Preferences{
+				Channel:      database.ReporterChannelPush,
+				Subscription: newSubscription(t, "https://push.example.com/endpoint"),
+			},
+		},
+		"push without subscription": {
+			prefs: &Preferences{Channel: database.ReporterChannelPush},
+			err:   errMissingSubscription,
+		},
+		"non https endpoint": {
+			prefs: &Preferences{
+				Channel:      database.ReporterChannelPush,
+				Subscription: newSubscription(t, "http://push.example.com/endpoint"),
+			},
+			err: errInsecureSubscription,
+		},
+		"unknown channel": {
+			prefs: &Preferences{Channel: "sms"},
+			err:   errUnknownChannel,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			if err := validatePreferences(tc.prefs); !errors.Is(err, tc.err) {
+				t.Errorf("validatePreferences() = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+type fakeStore struct {
+	prefs map[string]*database.ReporterPreferences
+	err   error
+}
+
+func (f *fakeStore) ReporterPreferences(_ context.Context, email string) (*database.ReporterPreferences, error) {
+	if prefs, ok := f.prefs[email]; ok {
+		return prefs, nil
+	}
+	return &database.ReporterPreferences{Email: email, Channel: database.ReporterChannelEmail}, nil
+}
+
+func (f *fakeStore) SaveReporterPreferences(_ context.Context, prefs *database.ReporterPreferences) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.prefs[prefs.Email] = prefs
+	return nil
+}
+
+func request(t *testing.T, store Store, method, user, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	_, handler := Register(Logger(zap.NewNop()), PreferencesStore(store))()
+
+	r := httptest.NewRequest(method, "/v1/reporter/preferences", strings.NewReader(body))
+	if user != "" {
+		r = r.WithContext(auth.WithUser(r.Context(), user))
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestPut(t *testing.T) {
+	encode := func(p *Preferences) string {
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	testCases := map[string]struct {
+		body    string
+		user    string
+		err     error
+		code    int
+		channel database.ReporterChannel
+	}{
+		"opt out": {
+			body:    `{"channel": "none"}`,
+			user:    "a@example.com",
+			code:    http.StatusNoContent,
+			channel: database.ReporterChannelNone,
+		},
+		"push": {
+			body: encode(&Preferences{
+				Channel:      database.ReporterChannelPush,
+				Subscription: newSubscription(t, "https://push.example.com/endpoint"),
+			}),
+			user:    "a@example.com",
+			code:    http.StatusNoContent,
+			channel: database.ReporterChannelPush,
+		},
+		"push without subscription": {
+			body: `{"channel": "push"}`,
+			user: "a@example.com",
+			code: http.StatusBadRequest,
+		},
+		"non https endpoint": {
+			body: encode(&Preferences{
+				Channel:      database.ReporterChannelPush,
+				Subscription: newSubscription(t, "http://push.example.com/endpoint"),
+			}),
+			user: "a@example.com",
+			code: http.StatusBadRequest,
+		},
+		"subscribed by another user": {
+			body: encode(&Preferences{
+				Channel:      database.ReporterChannelPush,
+				Subscription: newSubscription(t, "https://push.example.com/endpoint"),
+			}),
+			user: "a@example.com",
+			err:  database.ErrAlreadyExists,
+			code: http.StatusConflict,
+		},
+		"invalid json": {
+			body: `{`,
+			user: "a@example.com",
+			code: http.StatusBadRequest,
+		},
+		"unauthenticated": {
+			body: `{"channel": "none"}`,
+			code: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			store := &fakeStore{prefs: map[string]*database.ReporterPreferences{}, err: tc.err}
+			rec := request(t, store, http.MethodPut, tc.user, tc.body)
+
+			if rec.Code != tc.code {
+				t.Fatalf("code = %d, want %d: %s", rec.Code, tc.code, rec.Body)
+			}
+			saved, ok := store.prefs[tc.user]
+			if ok != (tc.code == http.StatusNoContent) {
+				t.Fatalf("preferences saved = %v", ok)
+			}
+			if ok && saved.Channel != tc.channel {
+				t.Errorf("channel = %q, want %q", saved.Channel, tc.channel)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	store := &fakeStore{prefs: map[string]*database.ReporterPreferences{
+		"a@example.com": {
+			Email:   "a@example.com",
+			Channel: database.ReporterChannelPush,
+			Push: &database.PushSubscription{
+				Endpoint: "https://push.example.com/endpoint",
+				P256dh:   "key",
+				Auth:     "secret",
+			},
+		},
+	}}
+
+	testCases := map[string]struct {
+		user string
+		want Preferences
+	}{
+		"push": {
+			user: "a@example.com",
+			want: Preferences{
+				Channel: database.ReporterChannelPush,
+				Subscription: &webpush.Subscription{
+					Endpoint: "https://push.example.com/endpoint",
+					Keys:     webpush.SubscriptionKeys{P256dh: "key", Auth: "secret"},
+				},
+			},
+		},
+		"default": {
+			user: "b@example.com",
+			want: Preferences{Channel: database.ReporterChannelEmail},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			rec := request(t, store, http.MethodGet, tc.user, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("code = %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			var got Preferences
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Channel != tc.want.Channel {
+				t.Errorf("channel = %q, want %q", got.Channel, tc.want.Channel)
+			}
+			if (got.Subscription == nil) != (tc.want.Subscription == nil) ||
+				(got.Subscription != nil && *got.Subscription != *tc.want.Subscription) {
+				t.Errorf("subscription = %+v, want %+v", got.Subscription, tc.want.Subscription)
+			}
+		})
+	}
+}
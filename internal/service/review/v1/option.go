@@ -0,0 +1,42 @@
+package review
+
+import (
+	"time"
+
+	"safer.place/internal/notifier"
+)
+
+// Option to provide optional configuration to the service.
+type Option func(*Service)
+
+// Alerts notifies the public when an incident is reviewed as alerting.
+func Alerts(n notifier.Notifier) Option {
+	return func(s *Service) {
+		s.alerts = n
+	}
+}
+
+// Reporters notifies the reporter when the resolution of their incident changes.
+func Reporters(n notifier.Notifier) Option {
+	return func(s *Service) {
+		s.reporters = n
+	}
+}
+
+// Background sends the notifications, so they can be waited for on shutdown.
+func Background(b *notifier.Background) Option {
+	return func(s *Service) {
+		s.background = b
+	}
+}
+
+// SimilarImages exposes at most maxResults incidents reported within the window around the viewed
+// incident, whose images are within the maximum distance of its image, see SimilarIncidentsHeader.
+func SimilarImages(maxDistance int, window time.Duration, maxResults int) Option {
+	return func(s *Service) {
+		s.similarImages = true
+		s.maxDistance = maxDistance
+		s.similarWindow = window
+		s.maxSimilar = maxResults
+	}
+}
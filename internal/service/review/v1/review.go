@@ -5,12 +5,17 @@ package review
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"safer.place/internal/database"
+	"safer.place/internal/notifier"
+	"safer.place/internal/priority"
 	"safer.place/internal/service"
 
 	"api.safer.place/incident/v1"
@@ -20,20 +25,76 @@ import (
 
 // Service is the review service
 type Service struct {
-	db  database.Database
-	log *zap.Logger
+	db       database.Database
+	log      *zap.Logger
+	priority *priority.Scorer
+	alerts   notifier.Notifier
+	// reporters are notified when the resolution of their incident changes.
+	reporters notifier.Notifier
+	// background sends the notifications, so the reviewer does not wait for them.
+	background *notifier.Background
+	// similarImages enables looking up the incidents with images within the maximum distance.
+	similarImages bool
+	maxDistance   int
+	similarWindow time.Duration
+	maxSimilar    int
+
+	timeToFirstReview prometheus.Histogram
+}
+
+// New creates the review service
+func New(
+	db database.Database,
+	log *zap.Logger,
+	reg prometheus.Registerer,
+	scorer *priority.Scorer,
+	opts ...Option,
+) *Service {
+	timeToFirstReview := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "saferplace",
+		Subsystem: "review",
+		Name:      "time_to_first_review_seconds",
+		Help:      "Time between the incident being reported and its first review.",
+		// 1 minute up to ~34 hours
+		Buckets: prometheus.ExponentialBuckets(60, 2, 12),
+	})
+	if err := reg.Register(timeToFirstReview); err != nil {
+		// The service can be created multiple times when it is used by different frontends,
+		// in which case they share the same metric.
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			panic(err)
+		}
+		timeToFirstReview = are.ExistingCollector.(prometheus.Histogram)
+	}
+
+	s := &Service{
+		db:                db,
+		log:               log,
+		priority:          scorer,
+		timeToFirstReview: timeToFirstReview,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.background == nil {
+		s.background = notifier.NewBackground(log)
+	}
+
+	return s
 }
 
 // Register the review service
 func Register(
 	db database.Database,
 	log *zap.Logger,
+	reg prometheus.Registerer,
+	scorer *priority.Scorer,
+	opts ...Option,
 ) service.Service {
+	s := New(db, log, reg, scorer, opts...)
 	return func(interceptors ...connect.Interceptor) (string, http.Handler) {
-		return connectpb.NewReviewServiceHandler(&Service{
-			db:  db,
-			log: log,
-		}, connect.WithInterceptors(interceptors...))
+		return connectpb.NewReviewServiceHandler(s, connect.WithInterceptors(interceptors...))
 	}
 }
 
@@ -45,11 +106,6 @@ func (s *Service) ReviewIncident(
 	*connect.Response[pb.ReviewIncidentResponse],
 	error,
 ) {
-	s.log.Info("review received",
-		zap.String("id", req.Msg.Id),
-		zap.String("resolution", req.Msg.Resolution.String()),
-	)
-
 	comment := &incident.Comment{
 		// TODO: Actually perform authentication and authorization and not just blindly accept this.
 		AuthorId:  req.Header().Get("email"),
@@ -57,18 +113,74 @@ func (s *Service) ReviewIncident(
 		Message:   req.Msg.Comment,
 	}
 
-	if err := s.db.SaveReview(
-		ctx,
-		req.Msg.Id,
-		req.Msg.Resolution,
-		comment,
-	); err != nil {
+	if err := s.Review(ctx, req.Msg.Id, req.Msg.Resolution, comment); err != nil {
+		if errors.Is(err, database.ErrDoesNotExist) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
 		return nil, connect.NewError(connect.CodeUnavailable, err)
 	}
 
 	return connect.NewResponse(&pb.ReviewIncidentResponse{}), nil
 }
 
+// Review saves the resolution and the comment of the reviewer. It is shared between all the
+// ways an incident can be reviewed. Comments starting with content.PublicCommentPrefix are shared
+// with the reporter when the resolution changes.
+func (s *Service) Review(
+	ctx context.Context,
+	id string,
+	resolution incident.Resolution,
+	comment *incident.Comment,
+) error {
+	s.log.Info("review received",
+		zap.String("id", id),
+		zap.String("resolution", resolution.String()),
+	)
+
+	inc, err := s.db.ViewIncident(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.SaveReview(ctx, id, resolution, comment); err != nil {
+		return err
+	}
+
+	previous := inc.Resolution
+	if previous == incident.Resolution_RESOLUTION_UNSPECIFIED {
+		s.timeToFirstReview.Observe(time.Since(inc.Timestamp.AsTime()).Seconds())
+	}
+
+	inc.Resolution = resolution
+	inc.ReviewerComments = append(inc.ReviewerComments, comment)
+
+	if resolution == incident.Resolution_RESOLUTION_ALERTED &&
+		previous != incident.Resolution_RESOLUTION_ALERTED {
+		s.notify(ctx, s.alerts, inc, "alert")
+	}
+	if resolution != previous {
+		s.notify(ctx, s.reporters, inc, "reporter notification")
+	}
+
+	return nil
+}
+
+// notify sends the notification about the incident in the background, so the reviewer does not
+// have to wait for all the notifications to be delivered.
+func (s *Service) notify(ctx context.Context, n notifier.Notifier, inc *incident.Incident, what string) {
+	if n == nil {
+		return
+	}
+	s.background.Notify(ctx, n, inc, what)
+}
+
+// SimilarIncidentsHeader lists the other incidents whose images are near-identical to the image of
+// the viewed incident, from the most similar, as "<id>;distance=<distance>" separated by commas.
+// The reviewers can spot the evidence reused across reports, or taken from the internet. It is a
+// header as the ViewIncidentResponse of the API has no field for them, and it is capped to the
+// most similar incidents so it stays within the header size limits.
+const SimilarIncidentsHeader = "Similar-Incidents"
+
 // ViewIncident shows the incident information
 func (s *Service) ViewIncident(
 	ctx context.Context,
@@ -88,12 +200,30 @@ func (s *Service) ViewIncident(
 		}
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
-	return connect.NewResponse(&pb.ViewIncidentResponse{
+	res := connect.NewResponse(&pb.ViewIncidentResponse{
 		Incident: inc,
-	}), nil
+	})
+
+	if s.similarImages && inc.ImageId != "" {
+		// The incident is still shown when the similar incidents are not available.
+		similar, err := s.db.SimilarIncidents(ctx, inc.Id, s.maxDistance, s.similarWindow, s.maxSimilar)
+		if err != nil {
+			s.log.Warn("unable to find similar incidents", zap.String("id", inc.Id), zap.Error(err))
+		}
+		values := make([]string, 0, len(similar))
+		for _, sim := range similar {
+			values = append(values, fmt.Sprintf("%s;distance=%d", sim.ID, sim.Distance))
+		}
+		if len(values) > 0 {
+			res.Header().Set(SimilarIncidentsHeader, strings.Join(values, ", "))
+		}
+	}
+
+	return res, nil
 }
 
-// IncidentsWithoutReview shows all the incidents that are not reviewed
+// IncidentsWithoutReview shows all the incidents that are not reviewed, from the highest to the
+// lowest priority.
 func (s *Service) IncidentsWithoutReview(
 	ctx context.Context,
 	req *connect.Request[pb.IncidentsWithoutReviewRequest],
@@ -105,6 +235,11 @@ func (s *Service) IncidentsWithoutReview(
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
+	priorities, err := s.db.Priorities(ctx)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	s.priority.Rank(incidents, priorities, time.Now())
 	basicIncidents := make([]*pb.BasicIncidentDetails, 0, len(incidents))
 	for _, inc := range incidents {
 		basicIncidents = append(basicIncidents, &pb.BasicIncidentDetails{
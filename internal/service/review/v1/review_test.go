@@ -0,0 +1,151 @@
+// Copyright 2023 SaferPlace
+
+package review
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"safer.place/internal/database"
+
+	"api.safer.place/incident/v1"
+	pb "api.safer.place/review/v1"
+)
+
+type fakeDatabase struct {
+	database.Database
+	resolution incident.Resolution
+	// similar are the incidents with similar images, the limit is the number requested.
+	similar []*database.SimilarIncident
+	limit   int
+}
+
+func (db *fakeDatabase) ViewIncident(_ context.Context, id string) (*incident.Incident, error) {
+	return &incident.Incident{
+		Id:         id,
+		Timestamp:  timestamppb.Now(),
+		Resolution: db.resolution,
+		ImageId:    "image",
+	}, nil
+}
+
+func (db *fakeDatabase) SimilarIncidents(
+	_ context.Context, _ string, _ int, _ time.Duration, limit int,
+) ([]*database.SimilarIncident, error) {
+	db.limit = limit
+	return db.similar, nil
+}
+
+func (db *fakeDatabase) SaveReview(
+	_ context.Context,
+	_ string,
+	resolution incident.Resolution,
+	_ *incident.Comment,
+) error {
+	db.resolution = resolution
+	return nil
+}
+
+// recordingNotifier records the incidents it was notified about. The notifications are sent in
+// the background, so it is safe for concurrent use.
+type recordingNotifier struct {
+	mu       sync.Mutex
+	notified []*incident.Incident
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, inc *incident.Incident) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notified = append(n.notified, inc)
+	return nil
+}
+
+func TestReviewNotifications(t *testing.T) {
+	testCases := map[string]struct {
+		previous   incident.Resolution
+		resolution incident.Resolution
+		alerted    bool
+		reported   bool
+	}{
+		"alerted": {
+			resolution: incident.Resolution_RESOLUTION_ALERTED,
+			alerted:    true,
+			reported:   true,
+		},
+		"already alerted": {
+			previous:   incident.Resolution_RESOLUTION_ALERTED,
+			resolution: incident.Resolution_RESOLUTION_ALERTED,
+		},
+		"resolution changed": {
+			previous:   incident.Resolution_RESOLUTION_ALERTED,
+			resolution: incident.Resolution_RESOLUTION_REJECTED,
+			reported:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			alerts := &recordingNotifier{}
+			reporters := &recordingNotifier{}
+			s := New(
+				&fakeDatabase{resolution: tc.previous},
+				zap.NewNop(),
+				prometheus.NewRegistry(),
+				nil,
+				Alerts(alerts),
+				Reporters(reporters),
+			)
+
+			comment := &incident.Comment{AuthorId: "reviewer", Message: "reviewed"}
+			if err := s.Review(context.Background(), "id", tc.resolution, comment); err != nil {
+				t.Fatalf("Review() = %v", err)
+			}
+			s.background.Wait()
+
+			if got := len(alerts.notified) == 1; got != tc.alerted {
+				t.Errorf("alerted = %v, want %v", got, tc.alerted)
+			}
+			if got := len(reporters.notified) == 1; got != tc.reported {
+				t.Fatalf("reported = %v, want %v", got, tc.reported)
+			}
+			if !tc.reported {
+				return
+			}
+			inc := reporters.notified[0]
+			if inc.Resolution != tc.resolution {
+				t.Errorf("reported resolution = %v, want %v", inc.Resolution, tc.resolution)
+			}
+			if n := len(inc.ReviewerComments); n != 1 || inc.ReviewerComments[0] != comment {
+				t.Errorf("reported comments = %v, want the review comment", inc.ReviewerComments)
+			}
+		})
+	}
+}
+
+func TestViewIncidentSimilar(t *testing.T) {
+	db := &fakeDatabase{similar: []*database.SimilarIncident{
+		{ID: "same", Distance: 0},
+		{ID: "cropped", Distance: 4},
+	}}
+	s := New(db, zap.NewNop(), prometheus.NewRegistry(), nil, SimilarImages(10, time.Hour, 2))
+
+	res, err := s.ViewIncident(context.Background(), connect.NewRequest(&pb.ViewIncidentRequest{Id: "id"}))
+	if err != nil {
+		t.Fatalf("ViewIncident() = %v", err)
+	}
+	if db.limit != 2 {
+		t.Errorf("limit = %d, want 2", db.limit)
+	}
+	want := "same;distance=0, cropped;distance=4"
+	if got := res.Header().Get(SimilarIncidentsHeader); got != want {
+		t.Errorf("%s = %q, want %q", SimilarIncidentsHeader, got, want)
+	}
+}
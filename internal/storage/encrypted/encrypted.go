@@ -0,0 +1,549 @@
+// Copyright 2023 SaferPlace
+
+// Package encrypted encrypts the images before they reach the storage, so the backend never
+// holds them in plaintext.
+//
+// Every image is encrypted with its own random data key using AES-256-GCM. The data key is
+// wrapped by a master key and stored in the header of the object, together with the ID of the
+// master key:
+//
+//	"SPE1" | key ID length (1 byte) | key ID | nonce (12 bytes) | wrapped data key (48 bytes)
+//
+// The wrapped data key is bound to the reference of the image, so objects cannot be swapped in
+// the backend. The image follows the header in chunks of 64 KiB, each sealed separately so they
+// can be decrypted independently when seeking. The nonce of every chunk is its index, with the
+// last chunk flagged, so chunks can neither be reordered nor dropped from the end.
+//
+// Master keys are rotated by adding a new key and making it the active one. New images are
+// encrypted with the active key, while the older keys are still used to read the images which
+// were encrypted with them, so they must be kept.
+//
+// Images stored before the encryption was enabled are only read, as they are, when AllowPlaintext
+// is set. Every such read is logged and counted, so the images can be re-encrypted before the
+// option is turned off again.
+package encrypted
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"safer.place/internal/storage"
+)
+
+// Config of the encryption.
+type Config struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// KeyID of the master key used to encrypt the new images.
+	KeyID string `yaml:"key_id" split_words:"true"`
+	// Keys are the base64 encoded 256 bit master keys, by their ID.
+	Keys map[string]string `yaml:"keys"`
+	// KeyFile contains more master keys, as a YAML map of the base64 encoded keys by their ID,
+	// so they can be kept out of the config.
+	KeyFile string `yaml:"key_file" split_words:"true"`
+	// AllowPlaintext reads the images which are not encrypted, such as the images stored before
+	// the encryption was enabled. Otherwise reading them fails with ErrNotEncrypted.
+	AllowPlaintext bool `yaml:"allow_plaintext" split_words:"true" default:"false"`
+}
+
+const (
+	magic = "SPE1"
+	// chunkSize of the plaintext sealed at once.
+	chunkSize = 64 << 10
+	// dataKeySize of the AES-256 data keys.
+	dataKeySize = 32
+	// wrappedKeySize is the size of the nonce and the sealed data key.
+	wrappedKeySize = 12 + dataKeySize + 16
+	// maxKeyIDLength fits the length of the key ID in a byte.
+	maxKeyIDLength = 255
+	// maxHeaderSize of the encrypted images.
+	maxHeaderSize = len(magic) + 1 + maxKeyIDLength + wrappedKeySize
+)
+
+var (
+	// ErrUnknownKey is returned when the image was encrypted with a master key which is not
+	// configured.
+	ErrUnknownKey = errors.New("encrypted: unknown master key")
+	// ErrCorrupted is returned when the image cannot be decrypted, because it was modified or
+	// truncated in the backend.
+	ErrCorrupted = errors.New("encrypted: image is corrupted")
+	// ErrNotEncrypted is returned when the image is not encrypted and plaintext images are not
+	// allowed.
+	ErrNotEncrypted = errors.New("encrypted: image is not encrypted")
+)
+
+// Storage encrypts the images stored in another storage. It does not implement the
+// storage.Presigner, as the backend only has the encrypted images.
+type Storage struct {
+	storage        storage.Storage
+	keyID          string
+	keys           map[string]cipher.AEAD
+	allowPlaintext bool
+	log            *zap.Logger
+	reg            prometheus.Registerer
+
+	plaintextReads prometheus.Counter
+}
+
+// New creates the storage encrypting the images stored in store.
+func New(store storage.Storage, cfg *Config, opts ...Option) (*Storage, error) {
+	keys := make(map[string]string, len(cfg.Keys))
+	for id, key := range cfg.Keys {
+		keys[id] = key
+	}
+	if cfg.KeyFile != "" {
+		b, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key file: %w", err)
+		}
+		var fileKeys map[string]string
+		if err := yaml.Unmarshal(b, &fileKeys); err != nil {
+			return nil, fmt.Errorf("unable to parse key file: %w", err)
+		}
+		for id, key := range fileKeys {
+			keys[id] = key
+		}
+	}
+
+	s := &Storage{
+		storage:        store,
+		keyID:          cfg.KeyID,
+		keys:           make(map[string]cipher.AEAD, len(keys)),
+		allowPlaintext: cfg.AllowPlaintext,
+		log:            zap.NewNop(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	for id, key := range keys {
+		aead, err := masterKey(id, key)
+		if err != nil {
+			return nil, err
+		}
+		s.keys[id] = aead
+	}
+
+	if err := validate(s); err != nil {
+		return nil, fmt.Errorf("encryption validation failed: %w", err)
+	}
+
+	// The counter is shared by all the encrypted storages.
+	s.plaintextReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "saferplace",
+		Subsystem: "storage",
+		Name:      "plaintext_reads_total",
+		Help:      "Number of images read which were not encrypted.",
+	})
+	if s.reg != nil {
+		if err := s.reg.Register(s.plaintextReads); err != nil {
+			are := prometheus.AlreadyRegisteredError{}
+			if !errors.As(err, &are) {
+				return nil, fmt.Errorf("unable to register encryption metrics: %w", err)
+			}
+			s.plaintextReads = are.ExistingCollector.(prometheus.Counter)
+		}
+	}
+
+	return s, nil
+}
+
+func masterKey(id, key string) (cipher.AEAD, error) {
+	if id == "" || len(id) > maxKeyIDLength {
+		return nil, fmt.Errorf("key ID %q must have between 1 and %d bytes", id, maxKeyIDLength)
+	}
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode key %q: %w", id, err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("key %q must have 32 bytes, has %d", id, len(b))
+	}
+	return newAEAD(b)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Upload the encrypted image.
+func (s *Storage) Upload(ctx context.Context, r io.Reader, size int64, contentType string) (string, error) {
+	// The reference is needed to encrypt the image, so it is generated here rather than by the
+	// backend.
+	reference := uuid.New().String()
+	if err := s.Put(ctx, reference, r, size, contentType); err != nil {
+		return "", err
+	}
+	return reference, nil
+}
+
+// Put the encrypted image. The image is encrypted while it is read, so the size can be unknown.
+func (s *Storage) Put(ctx context.Context, reference string, r io.Reader, size int64, contentType string) error {
+	e, err := s.encrypt(reference, r)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 {
+		size = int64(len(e.buf)) + encryptedSize(size)
+	}
+	return s.storage.Put(ctx, reference, e, size, contentType)
+}
+
+// Get the decrypted image.
+func (s *Storage) Get(ctx context.Context, reference string) (io.ReadSeekCloser, *storage.Object, error) {
+	r, obj, err := s.storage.Get(ctx, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d, err := s.decrypt(reference, r, obj)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	if d == nil {
+		if err := s.plaintext(reference); err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+		return r, obj, nil
+	}
+
+	decrypted := *obj
+	decrypted.Size = d.size
+	return d, &decrypted, nil
+}
+
+// Stat describes the decrypted image, reading its header to find its size. Only the header is
+// requested if the backend is a storage.RangeGetter.
+func (s *Storage) Stat(ctx context.Context, reference string) (*storage.Object, error) {
+	var (
+		r   io.ReadCloser
+		obj *storage.Object
+		err error
+	)
+	if rg, ok := s.storage.(storage.RangeGetter); ok {
+		r, obj, err = rg.GetRange(ctx, reference, 0, int64(maxHeaderSize))
+	} else {
+		r, obj, err = s.storage.Get(ctx, reference)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	h, err := s.header(reference, r)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		if err := s.plaintext(reference); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	size, _, ok := decryptedSize(obj.Size - h.size)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid size", ErrCorrupted)
+	}
+	decrypted := *obj
+	decrypted.Size = size
+	return &decrypted, nil
+}
+
+// plaintext checks whether the image which is not encrypted can be read, logging and counting
+// the read if it can.
+func (s *Storage) plaintext(reference string) error {
+	if !s.allowPlaintext {
+		return fmt.Errorf("%w: %s", ErrNotEncrypted, reference)
+	}
+	s.log.Warn("reading image which is not encrypted", zap.String("reference", reference))
+	s.plaintextReads.Inc()
+	return nil
+}
+
+// Delete the image.
+func (s *Storage) Delete(ctx context.Context, reference string) error {
+	return s.storage.Delete(ctx, reference)
+}
+
+// List the images, with the size of the encrypted images.
+func (s *Storage) List(ctx context.Context, fn func(*storage.Object) error) error {
+	return s.storage.List(ctx, fn)
+}
+
+// encrypt the image read from r with a new data key, wrapped by the active master key.
+func (s *Storage) encrypt(reference string, r io.Reader) (*encrypter, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(magic)+1+len(s.keyID)+wrappedKeySize)
+	header = append(header, magic...)
+	header = append(header, byte(len(s.keyID)))
+	header = append(header, s.keyID...)
+
+	master := s.keys[s.keyID]
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	// The header so far and the reference are authenticated with the data key.
+	aad := append(header[:len(header):len(header)], reference...)
+	header = append(header, nonce...)
+	header = master.Seal(header, nonce, dataKey, aad)
+
+	return &encrypter{
+		r:     r,
+		aead:  aead,
+		buf:   header,
+		plain: make([]byte, chunkSize),
+	}, nil
+}
+
+// header of the encrypted image.
+type header struct {
+	// aead of the data key.
+	aead cipher.AEAD
+	size int64
+}
+
+// header reads the header of the image from r and unwraps its data key, or returns nil if the
+// image is not encrypted.
+func (s *Storage) header(reference string, r io.Reader) (*header, error) {
+	prefix := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, prefix); err != nil || string(prefix[:len(magic)]) != magic {
+		return nil, nil
+	}
+
+	rest := make([]byte, int(prefix[len(magic)])+wrappedKeySize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	keyID := string(rest[:prefix[len(magic)]])
+	wrapped := rest[len(keyID):]
+
+	master, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	aad := append(append(prefix, keyID...), reference...)
+	nonceSize := master.NonceSize()
+	dataKey, err := master.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to unwrap data key", ErrCorrupted)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &header{aead: aead, size: int64(len(prefix) + len(rest))}, nil
+}
+
+// decrypt the image read from r, or return nil if the image is not encrypted.
+func (s *Storage) decrypt(reference string, r io.ReadSeekCloser, obj *storage.Object) (*decrypter, error) {
+	h, err := s.header(reference, r)
+	if err != nil || h == nil {
+		return nil, err
+	}
+
+	size, chunks, ok := decryptedSize(obj.Size - h.size)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid size", ErrCorrupted)
+	}
+
+	return &decrypter{
+		r:      r,
+		aead:   h.aead,
+		offset: h.size,
+		size:   size,
+		chunks: chunks,
+		chunk:  -1,
+		next:   0,
+		buf:    make([]byte, chunkSize+h.aead.Overhead()),
+	}, nil
+}
+
+// encryptedSize of the chunks of the image with the size. The last chunk is never full, so images
+// whose size is a multiple of the chunk size end with an empty chunk.
+func encryptedSize(size int64) int64 {
+	return size + (size/chunkSize+1)*16
+}
+
+// decryptedSize of the chunks with the encrypted size, and their number.
+func decryptedSize(size int64) (int64, int64, bool) {
+	last := size % (chunkSize + 16)
+	if size < 0 || last < 16 {
+		return 0, 0, false
+	}
+	chunks := size/(chunkSize+16) + 1
+	return size - chunks*16, chunks, true
+}
+
+// chunkNonce is the index of the chunk, with the last byte set on the last chunk.
+func chunkNonce(nonce []byte, index int64, last bool) []byte {
+	clear(nonce)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encrypter reads the header followed by the encrypted chunks of the image.
+type encrypter struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	index int64
+	// buf is the encrypted data which was not read yet.
+	buf   []byte
+	plain []byte
+	done  bool
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// seal the next chunk of the image. Only the last chunk is not full, which can be empty.
+func (e *encrypter) seal() error {
+	n, err := io.ReadFull(e.r, e.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+
+	nonce := chunkNonce(make([]byte, e.aead.NonceSize()), e.index, last)
+	e.buf = e.aead.Seal(e.buf[:0], nonce, e.plain[:n], nil)
+	e.index++
+	e.done = last
+	return nil
+}
+
+// decrypter decrypts the chunks of the image as they are read.
+type decrypter struct {
+	r      io.ReadSeekCloser
+	aead   cipher.AEAD
+	offset int64
+	size   int64
+	chunks int64
+	pos    int64
+	// chunk is the index of the decrypted chunk in plain, -1 if there is none.
+	chunk int64
+	plain []byte
+	// next is the index of the chunk r is positioned at.
+	next int64
+	buf  []byte
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	index := d.pos / chunkSize
+	if index != d.chunk {
+		if err := d.open(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain[d.pos-index*chunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// open decrypts the chunk with the index.
+func (d *decrypter) open(index int64) error {
+	if index != d.next {
+		if _, err := d.r.Seek(d.offset+index*int64(len(d.buf)), io.SeekStart); err != nil {
+			return err
+		}
+	}
+	d.chunk, d.next = -1, -1
+
+	n, err := io.ReadFull(d.r, d.buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+
+	nonce := chunkNonce(make([]byte, d.aead.NonceSize()), index, index == d.chunks-1)
+	d.plain, err = d.aead.Open(d.plain[:0], nonce, d.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%w: unable to decrypt chunk %d", ErrCorrupted, index)
+	}
+	d.chunk, d.next = index, index+1
+	return nil
+}
+
+func (d *decrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("encrypted: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("encrypted: negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decrypter) Close() error {
+	return d.r.Close()
+}
+
+var (
+	errMissingStorage = errors.New("missing storage")
+	errMissingKey     = errors.New("missing active master key")
+)
+
+func validate(s *Storage) error {
+	if s.storage == nil {
+		return errMissingStorage
+	}
+	if _, ok := s.keys[s.keyID]; !ok {
+		return errMissingKey
+	}
+	return nil
+}
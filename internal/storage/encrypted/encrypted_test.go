@@ -0,0 +1,324 @@
+// Copyright 2023 SaferPlace
+
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+	"safer.place/internal/storage"
+	"safer.place/internal/storage/filesystem"
+)
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newBackend(t *testing.T) *filesystem.Storage {
+	t.Helper()
+	s, err := filesystem.New(&filesystem.Config{Dir: t.TempDir()},
+		filesystem.Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newStorage(t *testing.T, backend storage.Storage, keyID string, keys map[string]string) *Storage {
+	t.Helper()
+	s, err := New(backend, &Config{Enabled: true, KeyID: keyID, Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func random(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func read(t *testing.T, s storage.Storage, reference string) ([]byte, *storage.Object) {
+	t.Helper()
+	r, obj, err := s.Get(context.Background(), reference)
+	if err != nil {
+		t.Fatalf("Get(%q) = %v", reference, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unable to read %q: %v", reference, err)
+	}
+	return b, obj
+}
+
+func TestRoundTrip(t *testing.T) {
+	backend := newBackend(t)
+	s := newStorage(t, backend, "k1", map[string]string{"k1": newKey(t)})
+	ctx := context.Background()
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		for _, known := range []bool{true, false} {
+			image := random(t, size)
+			declared := int64(-1)
+			if known {
+				declared = int64(size)
+			}
+			reference, err := s.Upload(ctx, bytes.NewReader(image), declared, "image/png")
+			if err != nil {
+				t.Fatalf("Upload(%d) = %v", size, err)
+			}
+
+			got, obj := read(t, s, reference)
+			if !bytes.Equal(got, image) {
+				t.Errorf("size %d: decrypted image differs", size)
+			}
+			if obj.Size != int64(size) || obj.ContentType != "image/png" {
+				t.Errorf("size %d: object = %+v", size, obj)
+			}
+			if stat, err := s.Stat(ctx, reference); err != nil || stat.Size != int64(size) {
+				t.Errorf("size %d: Stat() = %+v, %v", size, stat, err)
+			}
+
+			stored, _ := read(t, backend, reference)
+			if size > 16 && bytes.Contains(stored, image[:16]) {
+				t.Errorf("size %d: backend holds the plaintext", size)
+			}
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	s := newStorage(t, newBackend(t), "k1", map[string]string{"k1": newKey(t)})
+	image := random(t, 2*chunkSize+100)
+	if err := s.Put(context.Background(), "image", bytes.NewReader(image), -1, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := s.Get(context.Background(), "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, offset := range []int64{chunkSize - 10, 10, 2 * chunkSize, int64(len(image)) - 5} {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 20)
+		n, _ := io.ReadFull(r, got)
+		want := image[offset:min(offset+20, int64(len(image)))]
+		if !bytes.Equal(got[:n], want) {
+			t.Errorf("read at %d differs", offset)
+		}
+	}
+	if end, err := r.Seek(0, io.SeekEnd); err != nil || end != int64(len(image)) {
+		t.Errorf("Seek(end) = %d, %v, want %d", end, err, len(image))
+	}
+}
+
+func TestRotation(t *testing.T) {
+	backend := newBackend(t)
+	k1, k2 := newKey(t), newKey(t)
+	old := newStorage(t, backend, "k1", map[string]string{"k1": k1})
+	if err := old.Put(context.Background(), "old", bytes.NewReader([]byte("old image")), -1, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newStorage(t, backend, "k2", map[string]string{"k1": k1, "k2": k2})
+	if err := rotated.Put(context.Background(), "new", bytes.NewReader([]byte("new image")), -1, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := read(t, rotated, "old"); string(got) != "old image" {
+		t.Errorf("old image = %q", got)
+	}
+	if got, _ := read(t, rotated, "new"); string(got) != "new image" {
+		t.Errorf("new image = %q", got)
+	}
+
+	// The old images cannot be read once their key is removed.
+	retired := newStorage(t, backend, "k2", map[string]string{"k2": k2})
+	if _, _, err := retired.Get(context.Background(), "old"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Get() = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := filesystem.New(&filesystem.Config{Dir: dir},
+		filesystem.Tracer(trace.NewNoopTracerProvider().Tracer("test")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newStorage(t, backend, "k1", map[string]string{"k1": newKey(t)})
+	ctx := context.Background()
+
+	for _, reference := range []string{"aa-modified", "aa-truncated", "aa-one", "aa-two"} {
+		if err := s.Put(ctx, reference, bytes.NewReader(random(t, chunkSize+100)), -1, "image/png"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(reference string) string {
+		return filepath.Join(dir, "aa", reference)
+	}
+
+	b, err := os.ReadFile(path("aa-modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err := os.WriteFile(path("aa-modified"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Dropping the last chunk leaves only full chunks.
+	if err := os.Truncate(path("aa-truncated"), int64(len(b)-100-16)); err != nil {
+		t.Fatal(err)
+	}
+	// The object of another image is rejected, even though it was encrypted with the same key.
+	if err := os.Rename(path("aa-one"), path("aa-two")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reference := range []string{"aa-modified", "aa-truncated", "aa-two"} {
+		r, _, err := s.Get(ctx, reference)
+		if err == nil {
+			_, err = io.ReadAll(r)
+			r.Close()
+		}
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: read = %v, want %v", reference, err, ErrCorrupted)
+		}
+	}
+}
+
+func TestUnencrypted(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	if err := backend.Put(ctx, "plain", bytes.NewReader([]byte("plain image")), -1, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{"k1": newKey(t)}
+
+	s := newStorage(t, backend, "k1", keys)
+	if _, _, err := s.Get(ctx, "plain"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Get() = %v, want %v", err, ErrNotEncrypted)
+	}
+	if _, err := s.Stat(ctx, "plain"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Stat() = %v, want %v", err, ErrNotEncrypted)
+	}
+
+	reg := prometheus.NewRegistry()
+	s, err := New(backend, &Config{KeyID: "k1", Keys: keys, AllowPlaintext: true}, Metrics(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := read(t, s, "plain"); string(got) != "plain image" {
+		t.Errorf("image = %q, want the image stored before the encryption", got)
+	}
+	if obj, err := s.Stat(ctx, "plain"); err != nil || obj.Size != int64(len("plain image")) {
+		t.Errorf("Stat() = %v, %v, want the size of the image", obj, err)
+	}
+	if got := testutil.ToFloat64(s.plaintextReads); got != 2 {
+		t.Errorf("plaintext reads = %v, want 2", got)
+	}
+}
+
+// rangeBackend records the ranges read from the storage.
+type rangeBackend struct {
+	*filesystem.Storage
+	gets   int
+	ranges int
+}
+
+func (b *rangeBackend) Get(ctx context.Context, reference string) (io.ReadSeekCloser, *storage.Object, error) {
+	b.gets++
+	return b.Storage.Get(ctx, reference)
+}
+
+func (b *rangeBackend) GetRange(
+	ctx context.Context, reference string, offset, length int64,
+) (io.ReadCloser, *storage.Object, error) {
+	b.ranges++
+	f, obj, err := b.Storage.Get(ctx, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f.(io.ReaderAt), offset, length), f}, obj, nil
+}
+
+func TestStatRange(t *testing.T) {
+	ctx := context.Background()
+	backend := &rangeBackend{Storage: newBackend(t)}
+	s := newStorage(t, backend, "k1", map[string]string{"k1": newKey(t)})
+
+	image := random(t, 3*chunkSize)
+	reference, err := s.Upload(ctx, bytes.NewReader(image), int64(len(image)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := s.Stat(ctx, reference)
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	}
+	if obj.Size != int64(len(image)) {
+		t.Errorf("size = %d, want %d", obj.Size, len(image))
+	}
+	if backend.gets != 0 || backend.ranges != 1 {
+		t.Errorf("gets = %d, ranges = %d, want only the header read", backend.gets, backend.ranges)
+	}
+}
+
+func TestNew(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(keyFile, []byte("file: "+newKey(t)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		cfg Config
+		ok  bool
+	}{
+		"key from config":    {Config{KeyID: "k1", Keys: map[string]string{"k1": newKey(t)}}, true},
+		"key from file":      {Config{KeyID: "file", KeyFile: keyFile}, true},
+		"missing active key": {Config{KeyID: "k2", Keys: map[string]string{"k1": newKey(t)}}, false},
+		"short key": {Config{KeyID: "k1", Keys: map[string]string{
+			"k1": base64.StdEncoding.EncodeToString([]byte("short")),
+		}}, false},
+		"missing key file": {Config{KeyID: "k1", KeyFile: keyFile + ".missing"}, false},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := New(newBackend(t), &tc.cfg)
+			if (err == nil) != tc.ok {
+				t.Errorf("New() = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package encrypted
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Option extends the functionality of the storage.
+type Option func(*Storage)
+
+// Logger logs the reads of the images which are not encrypted.
+func Logger(log *zap.Logger) Option {
+	return func(s *Storage) {
+		s.log = log
+	}
+}
+
+// Metrics provides the registry of the plaintext read metrics.
+func Metrics(reg prometheus.Registerer) Option {
+	return func(s *Storage) {
+		s.reg = reg
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2023 SaferPlace
+
+// Package filesystem stores the images in a local directory, for development and small
+// deployments without an object store.
+//
+// Every image is stored in a directory named after the first characters of its reference, so no
+// single directory grows too large, alongside a metadata file containing its content type:
+//
+//	<dir>/ab/ab12cd34-...        the image
+//	<dir>/ab/ab12cd34-....json   the metadata
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"safer.place/internal/storage"
+)
+
+// Config of the filesystem storage.
+type Config struct {
+	// Dir is the directory containing the images, created if it does not exist.
+	Dir string `yaml:"dir" default:"images"`
+}
+
+// shardLength is the number of characters of the reference used to name the shard directory.
+const shardLength = 2
+
+// metadataExt is appended to the image path to get the path of its metadata.
+const metadataExt = ".json"
+
+// metadata stored alongside the image.
+type metadata struct {
+	ContentType string `json:"content_type"`
+}
+
+// Storage stores the images in the directory.
+type Storage struct {
+	dir    string
+	tracer trace.Tracer
+}
+
+// New creates the storage, creating the directory if needed.
+func New(cfg *Config, opts ...Option) (*Storage, error) {
+	s := &Storage{dir: cfg.Dir}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := validate(s); err != nil {
+		return nil, fmt.Errorf("filesystem validation failed: %w", err)
+	}
+
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("unable to create directory: %w", err)
+	}
+
+	return s, nil
+}
+
+// Upload the image to the directory. Both the image and its metadata are written to temporary
+// files and renamed into place, so a partially written image is never visible. The image is
+// renamed first, so it can be visible before its metadata, in which case its content type is
+// sniffed.
+func (s *Storage) Upload(ctx context.Context, r io.Reader, size int64, contentType string) (string, error) {
+	_, span := s.tracer.Start(ctx, "upload")
+	defer span.End()
+
+	id := uuid.New().String()
+	if err := s.upload(id, r, size, contentType); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", fmt.Errorf("unable to upload image: %w", err)
+	}
+
+	return id, nil
+}
+
+// Put the image in the directory under the reference.
+func (s *Storage) Put(ctx context.Context, reference string, r io.Reader, size int64, contentType string) error {
+	_, span := s.tracer.Start(ctx, "put")
+	defer span.End()
+
+	if !validReference(reference) {
+		return storage.ErrInvalidReference
+	}
+	if err := s.upload(reference, r, size, contentType); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("unable to put image: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) upload(id string, r io.Reader, size int64, contentType string) error {
+	path := s.path(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("unable to create shard directory: %w", err)
+	}
+
+	meta, err := json.Marshal(&metadata{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("unable to encode metadata: %w", err)
+	}
+	_, err = os.Stat(path)
+	overwrite := err == nil
+
+	// The metadata is written after the image, so a failed overwrite leaves the existing image
+	// and its metadata in place.
+	if err := writeFile(path, r, size); err != nil {
+		return err
+	}
+	if err := writeFile(path+metadataExt, bytes.NewReader(meta), int64(len(meta))); err != nil {
+		if !overwrite {
+			_ = os.Remove(path)
+		}
+		return fmt.Errorf("unable to write metadata: %w", err)
+	}
+
+	return nil
+}
+
+var errSizeMismatch = errors.New("size does not match the uploaded image")
+
+// writeFile writes the file atomically using a temporary file in the same directory. The size is
+// checked unless it is negative.
+func writeFile(path string, r io.Reader, size int64) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		return fmt.Errorf("unable to write file: %w", err)
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("%w: got %d bytes, want %d", errSizeMismatch, written, size)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("unable to sync file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to rename file: %w", err)
+	}
+
+	return nil
+}
+
+// Get opens the image.
+func (s *Storage) Get(ctx context.Context, reference string) (io.ReadSeekCloser, *storage.Object, error) {
+	_, span := s.tracer.Start(ctx, "get")
+	defer span.End()
+
+	f, obj, err := s.open(reference)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, err
+	}
+
+	return f, obj, nil
+}
+
+// Stat describes the image.
+func (s *Storage) Stat(ctx context.Context, reference string) (*storage.Object, error) {
+	_, span := s.tracer.Start(ctx, "stat")
+	defer span.End()
+
+	f, obj, err := s.open(reference)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	f.Close()
+
+	return obj, nil
+}
+
+// Delete the image and its metadata. The image is removed first, so the image is no longer visible
+// even when its metadata could not be removed.
+func (s *Storage) Delete(ctx context.Context, reference string) error {
+	_, span := s.tracer.Start(ctx, "delete")
+	defer span.End()
+
+	if !validReference(reference) {
+		return storage.ErrInvalidReference
+	}
+	path := s.path(reference)
+	for _, p := range []string{path, path + metadataExt} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("unable to delete image: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// List the images in the directory, skipping their metadata and the temporary files.
+func (s *Storage) List(ctx context.Context, fn func(*storage.Object) error) error {
+	_, span := s.tracer.Start(ctx, "list")
+	defer span.End()
+
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || !validReference(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted while listing.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(&storage.Object{
+			Reference: d.Name(),
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+		})
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *Storage) open(reference string) (*os.File, *storage.Object, error) {
+	if !validReference(reference) {
+		return nil, nil, storage.ErrInvalidReference
+	}
+	path := s.path(reference)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("unable to open image: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("unable to stat image: %w", err)
+	}
+
+	var meta metadata
+	b, err := os.ReadFile(path + metadataExt)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// The image was renamed into place before its metadata.
+		meta.ContentType, err = sniffContentType(f)
+	case err == nil:
+		err = json.Unmarshal(b, &meta)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("unable to read metadata: %w", err)
+	}
+
+	return f, &storage.Object{
+		Reference:   reference,
+		Size:        info.Size(),
+		ContentType: meta.ContentType,
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+// sniffContentType detects the content type of the image, and rewinds it.
+func sniffContentType(f *os.File) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", fmt.Errorf("unable to sniff content type: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("unable to rewind image: %w", err)
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// validReference prevents the reference from escaping the directory, or pointing at the
+// metadata and temporary files.
+func validReference(reference string) bool {
+	if reference == "" || reference[0] == '.' || strings.HasSuffix(reference, metadataExt) {
+		return false
+	}
+	for _, r := range reference {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// path of the image with the reference.
+func (s *Storage) path(id string) string {
+	shard := id
+	if len(shard) > shardLength {
+		shard = shard[:shardLength]
+	}
+	return filepath.Join(s.dir, shard, id)
+}
+
+var (
+	errMissingDir    = errors.New("missing directory")
+	errMissingTracer = errors.New("missing tracer")
+)
+
+func validate(s *Storage) error {
+	if s.dir == "" {
+		return errMissingDir
+	}
+	if s.tracer == nil {
+		return errMissingTracer
+	}
+	return nil
+}
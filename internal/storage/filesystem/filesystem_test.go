@@ -0,0 +1,200 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	"safer.place/internal/storage"
+)
+
+func newStorage(t *testing.T) (*Storage, string) {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "images")
+	s, err := New(&Config{Dir: dir}, Tracer(trace.NewNoopTracerProvider().Tracer("test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestUpload(t *testing.T) {
+	s, dir := newStorage(t)
+
+	id, err := s.Upload(context.Background(), strings.NewReader("image"), 5, "image/png")
+	if err != nil {
+		t.Fatalf("Upload() = %v", err)
+	}
+
+	path := filepath.Join(dir, id[:2], id)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "image" {
+		t.Errorf("image = %q, want %q", b, "image")
+	}
+
+	var meta metadata
+	b, err = os.ReadFile(path + metadataExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.ContentType != "image/png" {
+		t.Errorf("content type = %q, want image/png", meta.ContentType)
+	}
+}
+
+func TestGet(t *testing.T) {
+	s, _ := newStorage(t)
+	ctx := context.Background()
+
+	id, err := s.Upload(ctx, strings.NewReader("image"), 5, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, obj, err := s.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	defer r.Close()
+	b, _ := io.ReadAll(r)
+	if string(b) != "image" || obj.Size != 5 || obj.ContentType != "image/png" || obj.Reference != id {
+		t.Errorf("Get() = %q, %+v", b, obj)
+	}
+
+	if err := s.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	if _, err := s.Stat(ctx, id); err != storage.ErrNotFound {
+		t.Errorf("Stat() after Delete() = %v, want %v", err, storage.ErrNotFound)
+	}
+	if err := s.Delete(ctx, id); err != nil {
+		t.Errorf("Delete() of a deleted image = %v", err)
+	}
+
+	if _, err := s.Stat(ctx, "00000000-0000-0000-0000-000000000000"); err != storage.ErrNotFound {
+		t.Errorf("Stat() = %v, want %v", err, storage.ErrNotFound)
+	}
+	for _, ref := range []string{"", "../images", id + metadataExt, "a/b", ".upload-1"} {
+		if _, err := s.Stat(ctx, ref); err != storage.ErrInvalidReference {
+			t.Errorf("Stat(%q) = %v, want %v", ref, err, storage.ErrInvalidReference)
+		}
+	}
+}
+
+func TestUploadSizeMismatch(t *testing.T) {
+	s, dir := newStorage(t)
+
+	_, err := s.Upload(context.Background(), strings.NewReader("truncated"), 100, "image/png")
+	if !errors.Is(err, errSizeMismatch) {
+		t.Fatalf("Upload() = %v, want %v", err, errSizeMismatch)
+	}
+
+	// Neither the image, its metadata nor the temporary files are left behind.
+	if err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("unexpected file %s", path)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutOverwriteFailure(t *testing.T) {
+	s, _ := newStorage(t)
+	ctx := context.Background()
+
+	id, err := s.Upload(ctx, strings.NewReader("image"), 5, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, id, strings.NewReader("truncated"), 100, "image/jpeg"); !errors.Is(err, errSizeMismatch) {
+		t.Fatalf("Put() = %v, want %v", err, errSizeMismatch)
+	}
+
+	// The existing image is still readable with its metadata.
+	r, obj, err := s.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	defer r.Close()
+	b, _ := io.ReadAll(r)
+	if string(b) != "image" || obj.ContentType != "image/png" {
+		t.Errorf("Get() = %q, %+v", b, obj)
+	}
+}
+
+func TestGetMissingMetadata(t *testing.T) {
+	s, dir := newStorage(t)
+	ctx := context.Background()
+
+	png := "\x89PNG\r\n\x1a\n"
+	id, err := s.Upload(ctx, strings.NewReader(png), int64(len(png)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The image is renamed into place before its metadata is.
+	if err := os.Remove(filepath.Join(dir, id[:2], id) + metadataExt); err != nil {
+		t.Fatal(err)
+	}
+
+	r, obj, err := s.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	defer r.Close()
+	b, _ := io.ReadAll(r)
+	if string(b) != png || obj.ContentType != "image/png" {
+		t.Errorf("Get() = %q, %+v, want the image with the sniffed content type", b, obj)
+	}
+}
+
+func TestList(t *testing.T) {
+	s, dir := newStorage(t)
+	ctx := context.Background()
+
+	want := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		id, err := s.Upload(ctx, strings.NewReader("image"), 5, "image/png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[id] = true
+	}
+	// Temporary files of uploads in progress are not listed.
+	if err := os.WriteFile(filepath.Join(dir, ".upload-1"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]bool{}
+	if err := s.List(ctx, func(obj *storage.Object) error {
+		if obj.Size != 5 {
+			t.Errorf("%s size = %d, want 5", obj.Reference, obj.Size)
+		}
+		got[obj.Reference] = true
+		return nil
+	}); err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+	for id := range want {
+		if !got[id] {
+			t.Errorf("%s not listed", id)
+		}
+	}
+}
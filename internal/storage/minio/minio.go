@@ -8,12 +8,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
+	"safer.place/internal/storage"
 )
 
 type Config struct {
@@ -71,11 +75,7 @@ func (s *Storage) Upload(ctx context.Context, r io.Reader, size int64, contentTy
 	defer span.End()
 
 	id := uuid.New().String()
-	if _, err := s.client.PutObject(
-		ctx, s.bucket, id, r, size, minio.PutObjectOptions{
-			ContentType: contentType,
-		},
-	); err != nil {
+	if err := s.put(ctx, id, r, size, contentType); err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		return "", fmt.Errorf("unable to upload image: %w", err)
@@ -84,6 +84,164 @@ func (s *Storage) Upload(ctx context.Context, r io.Reader, size int64, contentTy
 	return id, nil
 }
 
+// Put the image in the minio bucket under the reference.
+func (s *Storage) Put(ctx context.Context, reference string, r io.Reader, size int64, contentType string) error {
+	ctx, span := s.tracer.Start(ctx, "put")
+	defer span.End()
+
+	if err := s.put(ctx, reference, r, size, contentType); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("unable to put image: %w", err)
+	}
+
+	return nil
+}
+
+// unknownSizePartSize is the size of the parts buffered by the client when the size of the image is
+// unknown. The client otherwise picks the part size fitting the largest object, allocating over
+// 500 MiB per upload. The images are much smaller, and the objects can still be up to 160 GiB.
+const unknownSizePartSize = 16 << 20
+
+func (s *Storage) put(ctx context.Context, reference string, r io.Reader, size int64, contentType string) error {
+	opts := minio.PutObjectOptions{
+		ContentType: contentType,
+	}
+	if size < 0 {
+		opts.PartSize = unknownSizePartSize
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, reference, r, size, opts)
+	return err
+}
+
+// Get the image from the minio bucket.
+func (s *Storage) Get(ctx context.Context, reference string) (io.ReadSeekCloser, *storage.Object, error) {
+	ctx, span := s.tracer.Start(ctx, "get")
+	defer span.End()
+
+	obj, err := s.client.GetObject(ctx, s.bucket, reference, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s.error(span, err)
+	}
+	// The object is only requested once it is used.
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, s.error(span, err)
+	}
+
+	return obj, toObject(info), nil
+}
+
+// GetRange reads part of the image from the minio bucket, only requesting the range.
+func (s *Storage) GetRange(
+	ctx context.Context, reference string, offset, length int64,
+) (io.ReadCloser, *storage.Object, error) {
+	ctx, span := s.tracer.Start(ctx, "get_range")
+	defer span.End()
+
+	info, err := s.client.StatObject(ctx, s.bucket, reference, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, nil, s.error(span, err)
+	}
+	end := min(offset+length, info.Size)
+	if offset >= end {
+		return io.NopCloser(strings.NewReader("")), toObject(info), nil
+	}
+
+	// The range must be read from the object which was described, even if it is replaced.
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetMatchETag(info.ETag); err != nil {
+		return nil, nil, s.error(span, err)
+	}
+	if err := opts.SetRange(offset, end-1); err != nil {
+		return nil, nil, s.error(span, err)
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, reference, opts)
+	if err != nil {
+		return nil, nil, s.error(span, err)
+	}
+
+	return obj, toObject(info), nil
+}
+
+// Stat describes the image in the minio bucket.
+func (s *Storage) Stat(ctx context.Context, reference string) (*storage.Object, error) {
+	ctx, span := s.tracer.Start(ctx, "stat")
+	defer span.End()
+
+	info, err := s.client.StatObject(ctx, s.bucket, reference, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.error(span, err)
+	}
+
+	return toObject(info), nil
+}
+
+// Delete the image from the minio bucket.
+func (s *Storage) Delete(ctx context.Context, reference string) error {
+	ctx, span := s.tracer.Start(ctx, "delete")
+	defer span.End()
+
+	if err := s.client.RemoveObject(ctx, s.bucket, reference, minio.RemoveObjectOptions{}); err != nil {
+		return s.error(span, err)
+	}
+	return nil
+}
+
+// List the images in the minio bucket.
+func (s *Storage) List(ctx context.Context, fn func(*storage.Object) error) error {
+	ctx, span := s.tracer.Start(ctx, "list")
+	defer span.End()
+
+	// Cancelling the context stops the listing if fn fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if info.Err != nil {
+			return s.error(span, info.Err)
+		}
+		if err := fn(toObject(info)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PresignedURL creates a temporary URL to download the image directly from minio.
+func (s *Storage) PresignedURL(
+	ctx context.Context, reference string, expiry time.Duration,
+) (*url.URL, error) {
+	ctx, span := s.tracer.Start(ctx, "presign")
+	defer span.End()
+
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, reference, expiry, nil)
+	if err != nil {
+		return nil, s.error(span, err)
+	}
+	return u, nil
+}
+
+// error records the error on the span, converting missing objects to storage.ErrNotFound.
+func (s *Storage) error(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return storage.ErrNotFound
+	}
+	return fmt.Errorf("minio: %w", err)
+}
+
+func toObject(info minio.ObjectInfo) *storage.Object {
+	return &storage.Object{
+		Reference:   info.Key,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		ModTime:     info.LastModified,
+	}
+}
+
 var (
 	errMissingClient = errors.New("missing client")
 	errMissingBucket = errors.New("missing bucket")
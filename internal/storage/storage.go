@@ -4,13 +4,68 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
+	"net/url"
+	"time"
 )
 
+var (
+	// ErrNotFound is returned when the image with the reference does not exist.
+	ErrNotFound = errors.New("storage: image not found")
+	// ErrInvalidReference is returned when the reference could not have been returned by Upload.
+	ErrInvalidReference = errors.New("storage: invalid reference")
+)
+
+// OriginalSuffix is appended to the reference of the original image when it is stored next to the
+// image, such as in the quarantine.
+const OriginalSuffix = "_original"
+
+// StagingSuffix is appended to the reference of the image while it is scanned, before it is
+// published under its reference.
+const StagingSuffix = "_staging"
+
+// ResumablePrefix of the references of the resumable uploads and their parts.
+const ResumablePrefix = "tus_"
+
 // Storage allows to upload the image
 type Storage interface {
 	// Upload takes in the reader from which it reads from to get the image and returns the
 	// reference which can uniquely identify the image, or an error if there was a problem uploading
 	// to the bucket.
 	Upload(ctx context.Context, r io.Reader, size int64, contentType string) (string, error)
+	// Put stores the image under the reference, replacing any existing image. It is used to store
+	// the images related to an uploaded image, using the references derived from it.
+	Put(ctx context.Context, reference string, r io.Reader, size int64, contentType string) error
+	// Get returns the image with the reference, which must be closed by the caller.
+	Get(ctx context.Context, reference string) (io.ReadSeekCloser, *Object, error)
+	// Stat describes the image with the reference without reading it.
+	Stat(ctx context.Context, reference string) (*Object, error)
+	// Delete the image with the reference. Deleting an image which does not exist is not an error.
+	Delete(ctx context.Context, reference string) error
+	// List calls fn with every stored image, in no particular order, stopping at the first error.
+	// The content type of the listed images is not set.
+	List(ctx context.Context, fn func(*Object) error) error
+}
+
+// Presigner is implemented by the storage which can create temporary URLs to download the image
+// directly from the backend.
+type Presigner interface {
+	PresignedURL(ctx context.Context, reference string, expiry time.Duration) (*url.URL, error)
+}
+
+// RangeGetter is implemented by the storage which can read part of the image without requesting
+// the rest of it from the backend.
+type RangeGetter interface {
+	// GetRange returns at most length bytes of the image from the offset, which must be closed by
+	// the caller. The object describes the whole image.
+	GetRange(ctx context.Context, reference string, offset, length int64) (io.ReadCloser, *Object, error)
+}
+
+// Object describes the stored image.
+type Object struct {
+	Reference   string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
 }
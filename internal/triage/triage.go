@@ -0,0 +1,321 @@
+// Copyright 2023 SaferPlace
+
+// Package triage evaluates moderator written rules against incoming incidents, so incidents can
+// be resolved, routed and prioritised before a reviewer looks at them.
+//
+// Rules are written in the Common Expression Language (https://github.com/google/cel-spec) and
+// have access to the following:
+//
+//	incident                the incident.v1.Incident being triaged
+//	hour                    hour of the day (0-23) when the incident was reported
+//	distance(coords, lat, lon)
+//	                        distance in meters between the coordinates and the point
+//
+// The enums from the incident package can be referenced directly, for example
+// `incident.location == Location.LOCATION_TRANSPORTATION`.
+package triage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"safer.place/internal/geo"
+	"safer.place/internal/notifier"
+)
+
+// Config of the triage rules engine.
+type Config struct {
+	// File containing rules which is reloaded whenever it changes. Optional.
+	File           string        `yaml:"file"`
+	ReloadInterval time.Duration `yaml:"reload_interval" default:"30s" split_words:"true"`
+	// Timezone used to determine the hour of day of the incident.
+	Timezone string `yaml:"timezone" default:"UTC"`
+
+	// Rules defined directly in the configuration. They are evaluated before the rules
+	// from the file.
+	Rules []Rule `yaml:"rules" ignored:"true"`
+}
+
+// Rule matches incidents using the CEL expression and applies the action to the matched incident.
+type Rule struct {
+	Name       string `yaml:"name"`
+	Expression string `yaml:"expression"`
+	Action     Action `yaml:"action"`
+}
+
+// Action which is applied when the rule matches. Empty fields are ignored.
+type Action struct {
+	// Resolution to set on the incident, for example "ALERTED".
+	Resolution string `yaml:"resolution"`
+	// Notifier used to notify about the incident instead of the default.
+	Notifier string `yaml:"notifier"`
+	// Priority added to the incident.
+	Priority int `yaml:"priority"`
+	// Urgency of the notification about the incident. Urgent notifications skip digests.
+	Urgency notifier.Urgency `yaml:"urgency"`
+}
+
+// Decision is the outcome of triaging a single incident.
+type Decision struct {
+	// Rule which matched the incident, empty if no rule matched.
+	Rule       string
+	Resolution incident.Resolution
+	Notifier   string
+	Priority   int
+	Urgency    notifier.Urgency
+}
+
+// Matched returns true if any rule matched the incident.
+func (d Decision) Matched() bool {
+	return d.Rule != ""
+}
+
+type rule struct {
+	Rule
+
+	resolution incident.Resolution
+	program    cel.Program
+}
+
+// Engine evaluates the rules against incidents.
+type Engine struct {
+	cfg Config
+	env *cel.Env
+	loc *time.Location
+	log *zap.Logger
+
+	static  []*rule
+	rules   atomic.Pointer[[]*rule]
+	modTime time.Time
+}
+
+// New creates the rules engine and loads all the rules. Invalid rules cause an error so that
+// mistakes are caught at startup.
+func New(cfg Config, log *zap.Logger) (*Engine, error) {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load timezone: %w", err)
+	}
+
+	env, err := newEnv()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create rule environment: %w", err)
+	}
+
+	e := &Engine{
+		cfg: cfg,
+		env: env,
+		loc: loc,
+		log: log,
+	}
+
+	e.static, err = e.compile(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	e.rules.Store(&e.static)
+
+	if _, err := e.reload(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Run watches the rules file for changes and reloads the rules when it changes. Invalid rules
+// are logged and the previous rules are kept.
+func (e *Engine) Run(ctx context.Context) error {
+	if e.cfg.File == "" {
+		return nil
+	}
+
+	ticker := time.NewTicker(e.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			reloaded, err := e.reload()
+			if err != nil {
+				e.log.Error("unable to reload triage rules", zap.Error(err))
+				continue
+			}
+			if reloaded {
+				e.log.Info("triage rules reloaded", zap.Int("rules", len(*e.rules.Load())))
+			}
+		}
+	}
+}
+
+// Evaluate the rules in order against the incident. The first matching rule decides. Rules
+// which fail to evaluate are logged and skipped.
+func (e *Engine) Evaluate(ctx context.Context, inc *incident.Incident) Decision {
+	if e == nil {
+		return Decision{}
+	}
+
+	vars := map[string]any{
+		"incident": inc,
+		"hour":     int64(inc.GetTimestamp().AsTime().In(e.loc).Hour()),
+	}
+
+	for _, r := range *e.rules.Load() {
+		out, _, err := r.program.ContextEval(ctx, vars)
+		if err != nil {
+			e.log.Warn("unable to evaluate triage rule",
+				zap.String("rule", r.Name),
+				zap.String("id", inc.Id),
+				zap.Error(err),
+			)
+			continue
+		}
+		if matched, ok := out.Value().(bool); !ok || !matched {
+			continue
+		}
+
+		return Decision{
+			Rule:       r.Name,
+			Resolution: r.resolution,
+			Notifier:   r.Action.Notifier,
+			Priority:   r.Action.Priority,
+			Urgency:    r.Action.Urgency,
+		}
+	}
+
+	return Decision{}
+}
+
+// reload the rules from the file if it has changed since the last load.
+func (e *Engine) reload() (bool, error) {
+	if e.cfg.File == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(e.cfg.File)
+	if err != nil {
+		return false, fmt.Errorf("unable to stat rules file: %w", err)
+	}
+	if info.ModTime().Equal(e.modTime) {
+		return false, nil
+	}
+
+	f, err := os.Open(e.cfg.File)
+	if err != nil {
+		return false, fmt.Errorf("unable to open rules file: %w", err)
+	}
+	defer f.Close()
+
+	var file struct {
+		Rules []Rule `yaml:"rules"`
+	}
+	if err := yaml.NewDecoder(f).Decode(&file); err != nil {
+		return false, fmt.Errorf("unable to decode rules file: %w", err)
+	}
+
+	rules, err := e.compile(file.Rules)
+	if err != nil {
+		return false, err
+	}
+
+	all := append(append([]*rule{}, e.static...), rules...)
+	e.rules.Store(&all)
+	e.modTime = info.ModTime()
+
+	return true, nil
+}
+
+var errNotBool = errors.New("expression must evaluate to a bool")
+
+func (e *Engine) compile(rules []Rule) ([]*rule, error) {
+	compiled := make([]*rule, 0, len(rules))
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		ast, iss := e.env.Compile(r.Expression)
+		if err := iss.Err(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, errNotBool)
+		}
+
+		program, err := e.env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+
+		resolution, err := ParseResolution(r.Action.Resolution)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+
+		compiled = append(compiled, &rule{
+			Rule:       r,
+			resolution: resolution,
+			program:    program,
+		})
+	}
+
+	return compiled, nil
+}
+
+// ParseResolution parses the resolution name, with or without the RESOLUTION_ prefix. An
+// empty string is the unspecified resolution.
+func ParseResolution(s string) (incident.Resolution, error) {
+	if s == "" {
+		return incident.Resolution_RESOLUTION_UNSPECIFIED, nil
+	}
+
+	s = strings.ToUpper(s)
+	if !strings.HasPrefix(s, "RESOLUTION_") {
+		s = "RESOLUTION_" + s
+	}
+
+	v, ok := incident.Resolution_value[s]
+	if !ok {
+		return incident.Resolution_RESOLUTION_UNSPECIFIED, fmt.Errorf("unknown resolution %q", s)
+	}
+
+	return incident.Resolution(v), nil
+}
+
+func newEnv() (*cel.Env, error) {
+	coordinates := cel.ObjectType("incident.v1.Coordinates")
+
+	return cel.NewEnv(
+		cel.Types(&incident.Incident{}),
+		cel.Container("incident.v1"),
+		cel.Variable("incident", cel.ObjectType("incident.v1.Incident")),
+		cel.Variable("hour", cel.IntType),
+		cel.Function("distance",
+			cel.Overload("distance_coordinates_double_double",
+				[]*cel.Type{coordinates, cel.DoubleType, cel.DoubleType},
+				cel.DoubleType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					c, ok := args[0].Value().(*incident.Coordinates)
+					if !ok {
+						return types.NewErr("distance: unexpected coordinates type %T", args[0].Value())
+					}
+					lat, _ := args[1].Value().(float64)
+					lon, _ := args[2].Value().(float64)
+					return types.Double(geo.Distance(c.Lat, c.Lon, lat, lon))
+				}),
+			),
+		),
+	)
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 SaferPlace
+
+package triage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"api.safer.place/incident/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"safer.place/internal/notifier"
+)
+
+func TestEvaluate(t *testing.T) {
+	cfg := Config{
+		Timezone: "UTC",
+		Rules: []Rule{
+			{
+				Name:       "fire in the city centre",
+				Expression: `incident.description.contains("fire") && distance(incident.coordinates, 53.3498, -6.2603) < 1000.0`,
+				Action: Action{
+					Resolution: "alerted",
+					Notifier:   "oncall",
+					Priority:   10,
+					Urgency:    notifier.UrgencyCritical,
+				},
+			},
+			{
+				Name:       "transport at night",
+				Expression: `incident.location == Location.LOCATION_TRANSPORTATION && (hour >= 22 || hour < 6)`,
+				Action:     Action{Priority: 5},
+			},
+		},
+	}
+
+	e, err := New(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	testCases := map[string]struct {
+		inc  *incident.Incident
+		want Decision
+	}{
+		"fire in the centre": {
+			inc: &incident.Incident{
+				Description: "there is a fire",
+				Coordinates: &incident.Coordinates{Lat: 53.3499, Lon: -6.2604},
+				Timestamp:   timestamppb.New(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)),
+			},
+			want: Decision{
+				Rule:       "fire in the city centre",
+				Resolution: incident.Resolution_RESOLUTION_ALERTED,
+				Notifier:   "oncall",
+				Priority:   10,
+				Urgency:    notifier.UrgencyCritical,
+			},
+		},
+		"fire far away": {
+			inc: &incident.Incident{
+				Description: "there is a fire",
+				Coordinates: &incident.Coordinates{Lat: 51.8985, Lon: -8.4756},
+				Timestamp:   timestamppb.New(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)),
+			},
+			want: Decision{},
+		},
+		"transport at night": {
+			inc: &incident.Incident{
+				Location:  incident.Location_LOCATION_TRANSPORTATION,
+				Timestamp: timestamppb.New(time.Date(2023, 1, 1, 23, 0, 0, 0, time.UTC)),
+			},
+			want: Decision{Rule: "transport at night", Priority: 5},
+		},
+		"transport during the day": {
+			inc: &incident.Incident{
+				Location:  incident.Location_LOCATION_TRANSPORTATION,
+				Timestamp: timestamppb.New(time.Date(2023, 1, 1, 13, 0, 0, 0, time.UTC)),
+			},
+			want: Decision{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := e.Evaluate(context.Background(), tc.inc); got != tc.want {
+				t.Errorf("Evaluate() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewInvalidRules(t *testing.T) {
+	testCases := map[string]Rule{
+		"syntax error":       {Expression: `incident.description.contains(`},
+		"not a bool":         {Expression: `incident.description`},
+		"unknown field":      {Expression: `incident.colour == "red"`},
+		"unknown resolution": {Expression: `true`, Action: Action{Resolution: "maybe"}},
+	}
+
+	for name, r := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := New(Config{Timezone: "UTC", Rules: []Rule{r}}, zap.NewNop()); err == nil {
+				t.Errorf("New(%+v) = nil, want error", r)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.yaml")
+	writeRules := func(expr string, modTime time.Time) {
+		t.Helper()
+		rules := "rules:\n  - name: file\n    expression: '" + expr + "'\n    action:\n      priority: 1\n"
+		if err := os.WriteFile(file, []byte(rules), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeRules("false", time.Now().Add(-time.Hour))
+	e, err := New(Config{File: file, Timezone: "UTC"}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	inc := &incident.Incident{Timestamp: timestamppb.Now()}
+	if got := e.Evaluate(context.Background(), inc); got.Matched() {
+		t.Errorf("Evaluate() = %+v before reload, want no match", got)
+	}
+
+	writeRules("true", time.Now())
+	if reloaded, err := e.reload(); err != nil || !reloaded {
+		t.Fatalf("reload() = %v, %v; want true, nil", reloaded, err)
+	}
+
+	if got := e.Evaluate(context.Background(), inc); !got.Matched() {
+		t.Errorf("Evaluate() = %+v after reload, want match", got)
+	}
+}
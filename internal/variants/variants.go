@@ -0,0 +1,179 @@
+// Copyright 2023 SaferPlace
+
+// Package variants generates the smaller variants of the stored images in the background, see
+// imaging.Variants. The variants are JPEG images whatever the format of the image, so every
+// browser can show them. HEIC images cannot be decoded, so they have no variants.
+package variants
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"sync"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"safer.place/internal/imaging"
+	"safer.place/internal/storage"
+)
+
+// Config of the generator.
+type Config struct {
+	// Workers generating the variants, each decoding one image at a time.
+	Workers int
+	// Queue is the number of images waiting for their variants.
+	Queue int
+	// Quality of the JPEG variants, from 1 to 100.
+	Quality int
+}
+
+// Generator generates the variants of the queued images.
+type Generator struct {
+	storage storage.Storage
+	log     *zap.Logger
+	tracer  trace.Tracer
+	quality int
+
+	jobs chan string
+	// ctx is cancelled when the generator is closed, stopping the workers.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// queued are the images waiting for their variants, so an image requested many times before
+	// its variants exist is only queued once.
+	queued map[string]bool
+}
+
+// New starts the workers generating the variants of the images in the storage. The generator must
+// be closed to stop them.
+func New(cfg Config, store storage.Storage, log *zap.Logger, tracer trace.Tracer) *Generator {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Generator{
+		storage: store,
+		log:     log,
+		tracer:  tracer,
+		quality: cfg.Quality,
+		jobs:    make(chan string, cfg.Queue),
+		ctx:     ctx,
+		cancel:  cancel,
+		queued:  make(map[string]bool),
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		g.wg.Add(1)
+		go g.work()
+	}
+
+	return g
+}
+
+// Enqueue the image to have its variants generated, returning false if the queue is full or the
+// generator is closed.
+func (g *Generator) Enqueue(reference string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.ctx.Err() != nil {
+		return false
+	}
+	if g.queued[reference] {
+		return true
+	}
+	select {
+	case g.jobs <- reference:
+		g.queued[reference] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the workers, waiting for the variants being generated. The images still queued are
+// dropped, their variants are generated once they are requested again.
+func (g *Generator) Close() error {
+	g.cancel()
+	g.wg.Wait()
+	return nil
+}
+
+func (g *Generator) work() {
+	defer g.wg.Done()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case reference := <-g.jobs:
+			g.generate(reference)
+		}
+	}
+}
+
+func (g *Generator) generate(reference string) {
+	defer func() {
+		g.mu.Lock()
+		delete(g.queued, reference)
+		g.mu.Unlock()
+	}()
+
+	ctx, span := g.tracer.Start(g.ctx, "variants")
+	defer span.End()
+
+	if err := g.Generate(ctx, reference); err != nil && g.ctx.Err() == nil {
+		g.log.Error("unable to generate image variants", zap.String("reference", reference), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Generate the variants of the image right away. Images which already fit within a variant are
+// stored as the variant too, so every variant of the image exists once it is generated.
+func (g *Generator) Generate(ctx context.Context, reference string) error {
+	r, obj, err := g.storage.Get(ctx, reference)
+	if errors.Is(err, storage.ErrNotFound) {
+		// The image was removed, or never existed when it was queued by a request.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get image: %w", err)
+	}
+	defer r.Close()
+
+	img, err := imaging.Decode(r, obj.ContentType)
+	if errors.Is(err, imaging.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, v := range imaging.Variants {
+		resized, _ := v.Resize(img)
+		var b bytes.Buffer
+		if err := imaging.Encode(&b, flatten(resized), imaging.JPEG, g.quality); err != nil {
+			return err
+		}
+		if err := g.storage.Put(ctx, v.Reference(reference), &b, int64(b.Len()), imaging.JPEG); err != nil {
+			return fmt.Errorf("unable to store %s: %w", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// flatten the image over a white background, as JPEG has no transparency.
+func flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,83 @@
+package variants
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"safer.place/internal/imaging"
+	"safer.place/internal/storage/filesystem"
+)
+
+func TestGenerator(t *testing.T) {
+	ctx := context.Background()
+	tracer := trace.NewNoopTracerProvider().Tracer("test")
+	store, err := filesystem.New(
+		&filesystem.Config{Dir: filepath.Join(t.TempDir(), "images")},
+		filesystem.Tracer(tracer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A transparent PNG, which is larger than the thumbnail but fits within the medium variant.
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	reference, err := store.Upload(ctx, &b, int64(b.Len()), imaging.PNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := New(Config{Workers: 1, Queue: 1, Quality: 90}, store, zap.NewNop(), tracer)
+	defer g.Close()
+	if !g.Enqueue(reference) {
+		t.Fatal("Enqueue() = false, want the image queued")
+	}
+
+	want := map[string]image.Point{"thumbnail": {320, 160}, "medium": {400, 200}}
+	for _, v := range imaging.Variants {
+		var (
+			r   io.ReadSeekCloser
+			err error
+		)
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			if r, _, err = store.Get(ctx, v.Reference(reference)); err == nil || time.Now().After(deadline) {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s not generated: %v", v.Name, err)
+		}
+
+		got, err := jpeg.Decode(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s is not a JPEG: %v", v.Name, err)
+		}
+		if size := got.Bounds().Size(); size != want[v.Name] {
+			t.Errorf("%s = %v, want %v", v.Name, size, want[v.Name])
+		}
+		// The transparent pixels are white.
+		if r, g, b, _ := got.At(got.Bounds().Dx()-1, got.Bounds().Dy()-1).RGBA(); r < 0xf000 || g < 0xf000 || b < 0xf000 {
+			t.Errorf("%s background = %d, %d, %d, want white", v.Name, r, g, b)
+		}
+	}
+
+	g.Close()
+	if g.Enqueue(reference) {
+		t.Error("Enqueue() = true after Close()")
+	}
+}
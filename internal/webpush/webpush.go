@@ -0,0 +1,348 @@
+// Package webpush sends Web Push messages to the push services of the browsers, encrypting the
+// messages (RFC 8291) and identifying the application server with VAPID (RFC 8292).
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Subscription is the push subscription created by the browser.
+type Subscription struct {
+	Endpoint string           `json:"endpoint"`
+	Keys     SubscriptionKeys `json:"keys"`
+}
+
+// SubscriptionKeys are the base64url encoded keys used to encrypt the messages.
+type SubscriptionKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+var (
+	// ErrGone is returned when the subscription expired or was removed by the user, and should
+	// not be used anymore.
+	ErrGone = errors.New("subscription is gone")
+
+	errInvalidKey = errors.New("invalid key")
+)
+
+// Validate the subscription keys.
+func (s *Subscription) Validate() error {
+	if _, err := url.ParseRequestURI(s.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if _, err := s.publicKey(); err != nil {
+		return err
+	}
+	if _, err := s.authSecret(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Subscription) publicKey() (*ecdh.PublicKey, error) {
+	b, err := decode(s.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("%w p256dh: %v", errInvalidKey, err)
+	}
+	key, err := ecdh.P256().NewPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w p256dh: %v", errInvalidKey, err)
+	}
+	return key, nil
+}
+
+func (s *Subscription) authSecret() ([]byte, error) {
+	b, err := decode(s.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("%w auth: %v", errInvalidKey, err)
+	}
+	if len(b) != 16 {
+		return nil, fmt.Errorf("%w auth: must be 16 bytes", errInvalidKey)
+	}
+	return b, nil
+}
+
+// Keys are the VAPID keys of the application server.
+type Keys struct {
+	private *ecdsa.PrivateKey
+	public  []byte
+}
+
+// GenerateKeys generates new VAPID keys.
+func GenerateKeys() (*Keys, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	return newKeys(key)
+}
+
+// ParseKeys parses the base64url encoded VAPID private key.
+func ParseKeys(private string) (*Keys, error) {
+	b, err := decode(strings.TrimSpace(private))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidKey, err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidKey, err)
+	}
+	return newKeys(key)
+}
+
+// LoadKeys reads the VAPID private key from the file.
+func LoadKeys(file string) (*Keys, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+	return ParseKeys(string(b))
+}
+
+func newKeys(key *ecdh.PrivateKey) (*Keys, error) {
+	public := key.PublicKey().Bytes()
+	return &Keys{
+		private: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(public[1:33]),
+				Y:     new(big.Int).SetBytes(public[33:65]),
+			},
+			D: new(big.Int).SetBytes(key.Bytes()),
+		},
+		public: public,
+	}, nil
+}
+
+// PublicKey is the base64url encoded public key, which the browser needs as the
+// applicationServerKey to subscribe.
+func (k *Keys) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(k.public)
+}
+
+// PrivateKey is the base64url encoded private key.
+func (k *Keys) PrivateKey() string {
+	b := make([]byte, 32)
+	return base64.RawURLEncoding.EncodeToString(k.private.D.FillBytes(b))
+}
+
+// Urgency of the message, used by the push service to save the battery of the device.
+type Urgency string
+
+const (
+	UrgencyVeryLow Urgency = "very-low"
+	UrgencyLow     Urgency = "low"
+	UrgencyNormal  Urgency = "normal"
+	UrgencyHigh    Urgency = "high"
+)
+
+// Message sent to the subscription.
+type Message struct {
+	Payload []byte
+	// TTL is how long the push service keeps the message if the device is offline.
+	TTL     time.Duration
+	Urgency Urgency
+	// Topic replaces pending messages with the same topic.
+	Topic string
+}
+
+// Client sends the push messages.
+type Client struct {
+	client  *http.Client
+	keys    *Keys
+	subject string
+}
+
+// NewClient creates the client. The subject is a mailto: or https: URL the push services can
+// use to contact the operator of the application server.
+func NewClient(c *http.Client, keys *Keys, subject string) *Client {
+	return &Client{client: c, keys: keys, subject: subject}
+}
+
+// Send the message to the subscription. ErrGone is returned if the subscription is no longer
+// valid.
+func (c *Client) Send(ctx context.Context, sub *Subscription, msg *Message) error {
+	body, err := encrypt(sub, msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	token, err := c.vapid(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(msg.TTL/time.Second)))
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, c.keys.PublicKey()))
+	if msg.Urgency != "" {
+		req.Header.Set("Urgency", string(msg.Urgency))
+	}
+	if msg.Topic != "" {
+		req.Header.Set("Topic", msg.Topic)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to send push message: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrGone
+	default:
+		return fmt.Errorf("unexpected response %q: %s", string(respBody), resp.Status)
+	}
+}
+
+// vapid creates the signed JWT for the push service of the endpoint.
+func (c *Client) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": c.subject,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to encode claims: %w", err)
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, c.keys.private, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign token: %w", err)
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// recordSize of the single encrypted record.
+const recordSize = 4096
+
+// encrypt the payload for the subscription using the aes128gcm content encoding.
+// https://www.rfc-editor.org/rfc/rfc8291
+func encrypt(sub *Subscription, payload []byte) ([]byte, error) {
+	uaPublic, err := sub.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := sub.authSecret()
+	if err != nil {
+		return nil, err
+	}
+	// Leave room for the padding delimiter and the authentication tag.
+	if len(payload) > recordSize-103 {
+		return nil, fmt.Errorf("payload too large: %d bytes", len(payload))
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	shared, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive shared secret: %w", err)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %w", err)
+	}
+
+	asPublic := asPrivate.PublicKey().Bytes()
+	gcm, nonce, err := contentKeys(shared, authSecret, salt, uaPublic.Bytes(), asPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single record, ending with the last record padding delimiter.
+	plaintext := append(append([]byte{}, payload...), 0x02)
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// contentKeys derives the content encryption key and the nonce.
+func contentKeys(
+	shared, authSecret, salt, uaPublic, asPublic []byte,
+) (cipher.AEAD, []byte, error) {
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, authSecret, keyInfo), ikm); err != nil {
+		return nil, nil, fmt.Errorf("unable to derive key: %w", err)
+	}
+
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, nil, fmt.Errorf("unable to derive content encryption key: %w", err)
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, nil, fmt.Errorf("unable to derive nonce: %w", err)
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create cipher: %w", err)
+	}
+
+	return gcm, nonce, nil
+}
+
+// decode base64url, with or without padding as browsers differ.
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
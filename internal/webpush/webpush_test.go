@@ -0,0 +1,198 @@
+package webpush
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// browser is the user agent side of the subscription.
+type browser struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func newBrowser(t *testing.T) *browser {
+	t.Helper()
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	_, _ = rand.Read(auth)
+
+	return &browser{key: key, auth: auth}
+}
+
+func (b *browser) subscription(endpoint string) *Subscription {
+	return &Subscription{
+		Endpoint: endpoint,
+		Keys: SubscriptionKeys{
+			P256dh: base64.RawURLEncoding.EncodeToString(b.key.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(b.auth),
+		},
+	}
+}
+
+// decrypt the aes128gcm encoded body, as the browser would.
+func (b *browser) decrypt(t *testing.T, body []byte) []byte {
+	t.Helper()
+
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != recordSize {
+		t.Fatalf("record size = %d, want %d", rs, recordSize)
+	}
+	idlen := int(body[20])
+	asPublic := body[21 : 21+idlen]
+
+	pub, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := b.key.ECDH(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gcm, nonce, err := contentKeys(shared, b.auth, salt, b.key.PublicKey().Bytes(), asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, body[21+idlen:], nil)
+	if err != nil {
+		t.Fatalf("unable to decrypt: %v", err)
+	}
+	if plaintext[len(plaintext)-1] != 0x02 {
+		t.Fatalf("missing padding delimiter")
+	}
+
+	return plaintext[:len(plaintext)-1]
+}
+
+// verifyVAPID checks the JWT is signed by the key in the authorization header.
+func verifyVAPID(t *testing.T, r *http.Request, audience string) {
+	t.Helper()
+
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "vapid ")
+	var token, key string
+	for _, part := range strings.Split(auth, ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		switch name {
+		case "t":
+			token = value
+		case "k":
+			key = value
+		}
+	}
+
+	rawKey, _ := base64.RawURLEncoding.DecodeString(key)
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(rawKey[1:33]),
+		Y:     new(big.Int).SetBytes(rawKey[33:65]),
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("invalid token %q", token)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("invalid vapid signature")
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub"`
+		Exp int64  `json:"exp"`
+	}
+	rawClaims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != audience {
+		t.Errorf("aud = %q, want %q", claims.Aud, audience)
+	}
+	if claims.Sub != "mailto:admin@safer.place" {
+		t.Errorf("sub = %q, want the subject", claims.Sub)
+	}
+	if claims.Exp < time.Now().Unix() {
+		t.Errorf("token already expired")
+	}
+}
+
+func TestSend(t *testing.T) {
+	b := newBrowser(t)
+
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Errorf("content encoding = %q", r.Header.Get("Content-Encoding"))
+		}
+		if r.Header.Get("TTL") != "60" || r.Header.Get("Urgency") != "high" {
+			t.Errorf("ttl = %q, urgency = %q", r.Header.Get("TTL"), r.Header.Get("Urgency"))
+		}
+		verifyVAPID(t, r, "http://"+r.Host)
+
+		body, _ := io.ReadAll(r.Body)
+		got = b.decrypt(t, body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	keys, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(srv.Client(), keys, "mailto:admin@safer.place")
+
+	msg := &Message{Payload: []byte(`{"title":"alert"}`), TTL: time.Minute, Urgency: UrgencyHigh}
+	if err := c.Send(context.Background(), b.subscription(srv.URL+"/push/abc"), msg); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	if string(got) != `{"title":"alert"}` {
+		t.Errorf("payload = %q", got)
+	}
+
+	if err := c.Send(context.Background(), b.subscription(srv.URL+"/gone"), msg); err != ErrGone {
+		t.Errorf("Send() = %v, want %v", err, ErrGone)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	keys, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseKeys(keys.PrivateKey() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.PublicKey() != keys.PublicKey() {
+		t.Errorf("public key = %q, want %q", parsed.PublicKey(), keys.PublicKey())
+	}
+
+	if _, err := ParseKeys("not a key"); err == nil {
+		t.Error("expected an error")
+	}
+}
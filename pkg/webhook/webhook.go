@@ -0,0 +1,134 @@
+// Copyright 2023 SaferPlace
+
+// Package webhook contains the payload and signature verification of the webhooks sent by
+// saferplace, so receivers can verify that the webhook was sent by us.
+//
+// Every request is signed with HMAC-SHA256 over the timestamp, a dot, and the body, using the
+// secret shared with the receiver:
+//
+//	X-Saferplace-Timestamp: 1700000000
+//	X-Saferplace-Signature: v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// Receivers should use [Verify] on every request before trusting the body.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Version of the payload and the signature scheme.
+	Version = "v1"
+
+	// TimestampHeader contains the unix timestamp when the request was signed.
+	TimestampHeader = "X-Saferplace-Timestamp"
+	// SignatureHeader contains the signature of the request.
+	SignatureHeader = "X-Saferplace-Signature"
+	// VersionHeader contains the version of the payload.
+	VersionHeader = "X-Saferplace-Version"
+	// EventHeader contains the event which caused the webhook to be sent.
+	EventHeader = "X-Saferplace-Event"
+
+	// DefaultTolerance is the maximum accepted age of the request to protect from replays.
+	DefaultTolerance = 5 * time.Minute
+)
+
+// Payload is the JSON body of the webhook.
+type Payload struct {
+	Version string `json:"version"`
+	// Event which caused the webhook to be sent.
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	// Incident encoded using protojson, it can be decoded with protojson.Unmarshal into the
+	// incident.v1.Incident message.
+	Incident json.RawMessage `json:"incident"`
+	// Title and Body of the notification, rendered from the same templates as the other
+	// notifications.
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	// URL to review the incident.
+	URL string `json:"url,omitempty"`
+}
+
+var (
+	ErrMissingSignature = errors.New("webhook: missing signature")
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrExpired          = errors.New("webhook: timestamp outside of tolerance")
+)
+
+// Sign returns the signature header value of the body signed at the timestamp.
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	return Version + "=" + hex.EncodeToString(mac(secret, timestamp.Unix(), body))
+}
+
+// Verify checks that the request was signed with the secret within the tolerance, and returns
+// the body of the request. The request body is consumed.
+func Verify(r *http.Request, secret []byte, tolerance time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: unable to read body: %w", err)
+	}
+
+	if err := VerifySignature(
+		secret,
+		r.Header.Get(TimestampHeader),
+		r.Header.Get(SignatureHeader),
+		body,
+		tolerance,
+		time.Now(),
+	); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// VerifySignature checks the header values against the body.
+func VerifySignature(
+	secret []byte, timestamp, signature string, body []byte, tolerance time.Duration, now time.Time,
+) error {
+	if timestamp == "" || signature == "" {
+		return ErrMissingSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if diff := now.Sub(time.Unix(unix, 0)).Abs(); diff > tolerance {
+		return ErrExpired
+	}
+
+	hexSig, ok := strings.CutPrefix(signature, Version+"=")
+	if !ok {
+		return ErrInvalidSignature
+	}
+	sig, err := hex.DecodeString(hexSig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal(sig, mac(secret, unix, body)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func mac(secret []byte, timestamp int64, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 SaferPlace
+
+package webhook
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"version":"v1"}`)
+	now := time.Unix(1700000000, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := Sign(secret, now, body)
+
+	testCases := map[string]struct {
+		secret    []byte
+		timestamp string
+		signature string
+		body      []byte
+		now       time.Time
+		want      error
+	}{
+		"valid":             {secret, timestamp, signature, body, now, nil},
+		"within tolerance":  {secret, timestamp, signature, body, now.Add(time.Minute), nil},
+		"missing signature": {secret, timestamp, "", body, now, ErrMissingSignature},
+		"wrong secret":      {[]byte("other"), timestamp, signature, body, now, ErrInvalidSignature},
+		"modified body":     {secret, timestamp, signature, []byte(`{}`), now, ErrInvalidSignature},
+		"other timestamp":   {secret, "1700000001", signature, body, now, ErrInvalidSignature},
+		"unknown version":   {secret, timestamp, "v0" + signature[2:], body, now, ErrInvalidSignature},
+		"expired":           {secret, timestamp, signature, body, now.Add(time.Hour), ErrExpired},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := VerifySignature(tc.secret, tc.timestamp, tc.signature, tc.body, DefaultTolerance, tc.now)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("VerifySignature() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}